@@ -0,0 +1,419 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"github/timtimjnvr/chat/conn"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/orchestrator"
+	"github/timtimjnvr/chat/storage"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// Config of a node, only Port and Name are required
+	Config struct {
+		Address         string
+		Port            string
+		Name            string         // nickname used in all chats, the node hosts a chat with this name
+		DataDir         string         // directory used to save chats and messages across restarts (kept in memory only if empty)
+		TLS             bool           // encrypt the connections with TLS, all the nodes need to enable it
+		ShutdownTimeout time.Duration  // time given to the other nodes to close the connections when leaving (conn.DefaultShutdownTimeout if 0)
+		Transport       conn.Transport // TCP if nil
+	}
+
+	// Node is a chat node embedded in a program : it joins chats, sends messages and
+	// tells what happens in its chats through Events
+	Node struct {
+		myInfos       *crdt.NodeInfos
+		identity      *crdt.Identity
+		security      *conn.TLS
+		transport     conn.Transport
+		storage       orchestrator.Storage
+		persistent    *storage.Persistent
+		previousChats []storage.PreviousChat
+		orchestrator  *orchestrator.Orchestrator
+		nodeHandler   *conn.NodeHandler
+
+		connectionRequests chan conn.ConnectionRequest
+		toExecute          chan *crdt.Operation
+		events             <-chan Event
+
+		lock    *sync.Mutex
+		ctx     context.Context // set by Start
+		stopped chan struct{}
+	}
+
+	// Event tells what changed in the chats of the node
+	Event     = orchestrator.Event
+	EventType = orchestrator.EventType
+)
+
+const (
+	MessageReceived   = orchestrator.MessageReceived
+	MessageEdited     = orchestrator.MessageEdited
+	MessageDeleted    = orchestrator.MessageDeleted
+	MemberJoined      = orchestrator.MemberJoined
+	MemberLeft        = orchestrator.MemberLeft
+	ChatJoined        = orchestrator.ChatJoined
+	ChatLeft          = orchestrator.ChatLeft
+	Error             = orchestrator.Error
+	RoomsListed       = orchestrator.RoomsListed // answers RemoteRooms, Event.Rooms holds the crdt.RoomList
+	ConnectionChanged = orchestrator.ConnectionChanged
+
+	// events kept until they are read, the next ones are dropped
+	EventsBufferSize = 128
+)
+
+var (
+	NotStartedErr     = errors.New("node not started")
+	AlreadyStartedErr = errors.New("node already started")
+	StoppedErr        = errors.New("node stopped")
+	ConnectToSelfErr  = orchestrator.ConnectToSelfErr
+)
+
+// New returns a node with the identity (and chats) saved in config.DataDir, or a new one
+func New(config Config) (*Node, error) {
+	n := &Node{
+		myInfos:            crdt.NewNodeInfos(config.Address, config.Port, config.Name),
+		transport:          config.Transport,
+		storage:            storage.NewStorage(),
+		connectionRequests: make(chan conn.ConnectionRequest),
+		// 2 senders : node handler & local node (operations from the API or stdin)
+		toExecute: make(chan *crdt.Operation, 2),
+		lock:      &sync.Mutex{},
+		stopped:   make(chan struct{}),
+	}
+
+	if n.transport == nil {
+		n.transport = conn.TCPTransport{}
+	}
+
+	keys, err := n.load(config)
+	if err != nil {
+		if n.persistent != nil {
+			n.persistent.Close()
+		}
+
+		return nil, err
+	}
+
+	n.orchestrator = orchestrator.NewOrchestrator(n.storage, n.myInfos, n.identity, keys)
+	n.events = n.orchestrator.Events().Subscribe(EventsBufferSize)
+
+	n.nodeHandler = conn.NewNodeHandler(n.transport, n.storage, n.myInfos, n.identity, n.security)
+	if config.ShutdownTimeout > 0 {
+		n.nodeHandler.SetShutdownTimeout(config.ShutdownTimeout)
+	}
+
+	return n, nil
+}
+
+// load sets the storage, the identity and the certificate of the node, it returns the key pair receiving
+// the keys of encrypted chats
+func (n *Node) load(config Config) (*crdt.KeyPair, error) {
+	var err error
+	if config.DataDir != "" {
+		n.persistent, err = storage.OpenPersistent(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+
+		// keep the same identity across restarts
+		n.identity = n.persistent.GetIdentity()
+		n.previousChats = n.persistent.GetPreviousChats()
+		n.storage = n.persistent
+	}
+
+	if n.identity == nil {
+		n.identity, err = crdt.NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the node id is bound to the key signing its operations
+	n.myInfos.Id = n.identity.Id()
+
+	if config.TLS {
+		// keep the same certificate across restarts so that the other nodes can pin it
+		if config.DataDir != "" {
+			n.security, err = conn.LoadOrCreateTLS(config.DataDir)
+		} else {
+			n.security, err = conn.NewTLS()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		n.myInfos.Fingerprint = n.security.Fingerprint()
+	}
+
+	keys, err := crdt.NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	n.myInfos.PublicKey = keys.PublicKey()
+	return keys, nil
+}
+
+// Infos returns the infos the node shares with the other nodes
+func (n *Node) Infos() crdt.NodeInfos {
+	return *n.myInfos
+}
+
+// Start listens for the other nodes and joins again the chats saved in the data directory. The node leaves its
+// chats once ctx is done : Done is closed once the connections are closed.
+func (n *Node) Start(ctx context.Context) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.ctx != nil {
+		return AlreadyStartedErr
+	}
+
+	ln, err := conn.Listen(n.transport, n.security, n.myInfos)
+	if err != nil {
+		return err
+	}
+
+	n.ctx = ctx
+
+	var (
+		newConnections = make(chan net.Conn)
+		toSend         = make(chan *crdt.Operation)
+		running        = &sync.WaitGroup{}
+	)
+
+	// create connections : tcp connect & listen for incoming connections
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		conn.CreateConnections(ctx, ln, n.transport, n.myInfos, n.identity, n.security, n.connectionRequests, newConnections)
+	}()
+
+	// handle created connections until the orchestrator stops sending operations
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		n.nodeHandler.Start(ctx, newConnections, toSend, n.toExecute)
+	}()
+
+	// maintain chat infos by executing and propagating operations
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		n.orchestrator.HandleChats(ctx, n.toExecute, toSend)
+	}()
+
+	// join again the chats we were in before restarting
+	go n.rejoin(ctx)
+
+	go func() {
+		running.Wait()
+		if n.persistent != nil {
+			n.persistent.Close()
+		}
+
+		close(n.stopped)
+	}()
+
+	return nil
+}
+
+// Done is closed once the node stopped
+func (n *Node) Done() <-chan struct{} {
+	return n.stopped
+}
+
+// Events returns the events of the chats of the node, it is closed once the node left its chats.
+// Events are dropped while EventsBufferSize events are waiting to be read.
+func (n *Node) Events() <-chan Event {
+	return n.events
+}
+
+// Subscribe returns another channel receiving the next events of the chats of the node, see orchestrator.Bus
+func (n *Node) Subscribe(size int) <-chan Event {
+	return n.orchestrator.Events().Subscribe(size)
+}
+
+// Unsubscribe closes a channel returned by Subscribe
+func (n *Node) Unsubscribe(events <-chan Event) {
+	n.orchestrator.Events().Unsubscribe(events)
+}
+
+// Join asks the node listening on addr:port to join its chat named room, see MemberJoined
+func (n *Node) Join(addr, port, room string) error {
+	ctx, err := n.context()
+	if err != nil {
+		return err
+	}
+
+	if n.orchestrator.IsMe(addr, port) {
+		return ConnectToSelfErr
+	}
+
+	select {
+	case n.connectionRequests <- conn.NewConnectionRequest(port, addr, room):
+		return nil
+	case <-ctx.Done():
+		return StoppedErr
+	}
+}
+
+// RemoteRooms asks the node listening on addr:port for the chats that can be joined through it, the answer is
+// published as a RoomsListed event
+func (n *Node) RemoteRooms(addr, port string) error {
+	ctx, err := n.context()
+	if err != nil {
+		return err
+	}
+
+	if n.orchestrator.IsMe(addr, port) {
+		return ConnectToSelfErr
+	}
+
+	select {
+	case n.connectionRequests <- conn.NewRoomsRequest(port, addr):
+		return nil
+	case <-ctx.Done():
+		return StoppedErr
+	}
+}
+
+// Send sends a message in the chat named room
+func (n *Node) Send(room, text string) error {
+	chatID, err := n.storage.GetChatID(room)
+	if err != nil {
+		return err
+	}
+
+	message := crdt.NewMessage(n.myInfos.Id, n.myInfos.Name, text)
+	return n.execute(crdt.NewOperation(crdt.AddMessage, chatID.String(), message))
+}
+
+// Leave leaves the chat named room, the last chat of the node can't be left
+func (n *Node) Leave(room string) error {
+	chatID, err := n.storage.GetChatID(room)
+	if err != nil {
+		return err
+	}
+
+	return n.execute(crdt.NewOperation(crdt.RemoveChat, chatID.String(), n.myInfos))
+}
+
+// HandleStdin creates operations from the commands typed by the user until /quit, the end of stdin or ctx is done
+func (n *Node) HandleStdin(ctx context.Context, stdin io.Reader) error {
+	_, err := n.context()
+	if err != nil {
+		return err
+	}
+
+	n.orchestrator.HandleStdin(ctx, stdin, n.toExecute, n.connectionRequests)
+	return nil
+}
+
+// Command executes a command typed by the user (see README), what it displays is written on output.
+// It returns false once the user quits or the node stopped.
+func (n *Node) Command(line string, output io.Writer) bool {
+	ctx, err := n.context()
+	if err != nil {
+		return false
+	}
+
+	return n.orchestrator.HandleCommand(ctx, line, output, n.toExecute, n.connectionRequests)
+}
+
+// Rooms returns the names of the chats of the node in the order they were joined
+func (n *Node) Rooms() []string {
+	var rooms []string
+	for _, c := range n.storage.GetChats() {
+		rooms = append(rooms, c.Name)
+	}
+
+	return rooms
+}
+
+// CurrentRoom returns the name of the chat the commands apply to
+func (n *Node) CurrentRoom() string {
+	return n.orchestrator.CurrentChat()
+}
+
+// Messages returns the messages of the chat named room in chat order, deleted messages excluded
+func (n *Node) Messages(room string) ([]*crdt.Message, error) {
+	chatID, err := n.storage.GetChatID(room)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := n.storage.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*crdt.Message
+	for _, m := range c.GetMessages() {
+		if !m.Deleted {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages, nil
+}
+
+// Members returns the infos of the other members of the chat named room
+func (n *Node) Members(room string) ([]*crdt.NodeInfos, error) {
+	chatID, err := n.storage.GetChatID(room)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.storage.GetChatNodes(chatID)
+}
+
+func (n *Node) execute(op *crdt.Operation) error {
+	ctx, err := n.context()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case n.toExecute <- op:
+		return nil
+	case <-ctx.Done():
+		return StoppedErr
+	}
+}
+
+// context returns the context given to Start
+func (n *Node) context() (context.Context, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.ctx == nil {
+		return nil, NotStartedErr
+	}
+
+	if n.ctx.Err() != nil {
+		return nil, StoppedErr
+	}
+
+	return n.ctx, nil
+}
+
+// rejoin asks one of the nodes we were connected to in each chat to join it again
+func (n *Node) rejoin(ctx context.Context) {
+	for _, c := range n.previousChats {
+		node := c.Nodes[0]
+		select {
+		case n.connectionRequests <- conn.NewConnectionRequest(node.Port, node.Address, c.Name):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
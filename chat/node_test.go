@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"github/timtimjnvr/chat/conn"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/orchestrator"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNode(t *testing.T) {
+	var (
+		network = conn.NewMemoryNetwork()
+		a       = helperNewNode(t, network, "9001", "alice")
+		b       = helperNewNode(t, network, "9002", "bob")
+
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+
+	defer cancel()
+
+	assert.True(t, errors.Is(a.Join("", "9002", "bob"), NotStartedErr))
+
+	for _, n := range []*Node{a, b} {
+		if !assert.Nil(t, n.Start(ctx)) {
+			return
+		}
+	}
+
+	assert.True(t, errors.Is(a.Start(ctx), AlreadyStartedErr))
+	assert.True(t, errors.Is(a.Join("localhost", "9001", "alice"), ConnectToSelfErr))
+
+	// bob looks for the chats of alice without joining them
+	assert.Nil(t, b.RemoteRooms("", "9001"))
+	assert.Equal(t, &crdt.RoomList{Host: "alice", Rooms: []crdt.Room{{Name: "alice", Members: 1}}}, helperWaitEvent(t, b, RoomsListed).Rooms)
+
+	// bob joins the chat of alice
+	assert.Nil(t, b.Join("", "9001", "alice"))
+
+	joined := helperWaitEvent(t, a, MemberJoined)
+	assert.Equal(t, "alice", joined.Chat)
+	assert.Equal(t, "bob", joined.Node.Name)
+
+	assert.Equal(t, "alice", helperWaitEvent(t, b, ChatJoined).Chat)
+	joined = helperWaitEvent(t, b, MemberJoined)
+	assert.Equal(t, "alice", joined.Chat)
+	assert.Equal(t, "alice", joined.Node.Name)
+
+	// messages are received by every member, the sender included
+	assert.Nil(t, b.Send("alice", "Hi"))
+	for _, n := range []*Node{a, b} {
+		received := helperWaitEvent(t, n, MessageReceived)
+		assert.Equal(t, "alice", received.Chat)
+		assert.Equal(t, "bob", received.Message.Sender)
+		assert.Equal(t, "Hi", received.Message.Content)
+	}
+
+	assert.NotNil(t, b.Send("unknown", "Hi"))
+
+	// the last chat can't be left
+	assert.Nil(t, a.Leave("alice"))
+	assert.True(t, errors.Is(helperWaitEvent(t, a, Error).Err, orchestrator.LastChatErr))
+
+	assert.Nil(t, b.Leave("alice"))
+	assert.Equal(t, "alice", helperWaitEvent(t, b, ChatLeft).Chat)
+	left := helperWaitEvent(t, a, MemberLeft)
+	assert.Equal(t, "alice", left.Chat)
+	assert.Equal(t, "bob", left.Node.Name)
+
+	// the nodes leave once the context is done
+	cancel()
+	for _, n := range []*Node{a, b} {
+		select {
+		case <-time.After(2 * time.Second):
+			assert.Fail(t, "test timeout")
+		case <-n.Done():
+		}
+
+		for range n.Events() {
+		}
+	}
+
+	assert.True(t, errors.Is(a.Send("alice", "Hi"), StoppedErr))
+}
+
+// test helper returning a node listening on port in the network
+func helperNewNode(t *testing.T, network *conn.MemoryNetwork, port, name string) *Node {
+	n, err := New(Config{
+		Port:            port,
+		Name:            name,
+		ShutdownTimeout: time.Second,
+		Transport:       network.Transport(net.JoinHostPort("", port)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+// test helper returning the next event of the node with the type typology
+func helperWaitEvent(t *testing.T, n *Node, typology EventType) Event {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			assert.Fail(t, "test timeout")
+			return Event{Message: &crdt.Message{}, Node: &crdt.NodeInfos{}}
+		case event := <-n.Events():
+			if event.Typology == typology {
+				return event
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github/timtimjnvr/chat/crdt"
@@ -22,6 +23,7 @@ type ConnectionRequest struct {
 	targetedPort    string
 	targetedAddress string
 	chatRoom        string
+	rooms           bool // list the chats of the node instead of joining one
 }
 
 func NewConnectionRequest(port, address, chatRoom string) ConnectionRequest {
@@ -32,40 +34,53 @@ func NewConnectionRequest(port, address, chatRoom string) ConnectionRequest {
 	}
 }
 
-func CreateConnections(wg *sync.WaitGroup, isReady *sync.Cond, myInfos *crdt.NodeInfos, incomingConnectionRequests chan ConnectionRequest, newConnections chan net.Conn, shutdown <-chan struct{}) {
+// NewRoomsRequest returns a request asking the node for the chats that can be joined through it, see ListRemoteChats
+func NewRoomsRequest(port, address string) ConnectionRequest {
+	return ConnectionRequest{
+		targetedPort:    port,
+		targetedAddress: address,
+		rooms:           true,
+	}
+}
+
+// Listen opens the listener accepting the connections of the other nodes
+func Listen(transport Transport, security *TLS, myInfos *crdt.NodeInfos) (net.Listener, error) {
+	return security.listen(transport, net.JoinHostPort(myInfos.Address, myInfos.Port))
+}
+
+// CreateConnections accepts the connections on ln and opens the connections requested to join chats until ctx is done,
+// the listener is then closed
+func CreateConnections(ctx context.Context, ln net.Listener, transport Transport, myInfos *crdt.NodeInfos, identity *crdt.Identity, security *TLS, incomingConnectionRequests <-chan ConnectionRequest, newConnections chan<- net.Conn) {
 	var (
-		c                     net.Conn
-		wgInitNodeConnections = sync.WaitGroup{}
-		wgClosure             = sync.WaitGroup{}
-		err                   error
+		joining    = make(chan struct{})
+		closing    = make(chan struct{})
+		handshakes = &sync.WaitGroup{}
 	)
 
-	wgInitNodeConnections.Add(1)
-	go InitJoinChatProcess(&wgInitNodeConnections, myInfos, incomingConnectionRequests, newConnections, shutdown)
+	go func() {
+		defer close(joining)
+		InitJoinChatProcess(ctx, transport, myInfos, identity, security, incomingConnectionRequests, newConnections)
+	}()
+
+	go func() {
+		defer close(closing)
+		<-ctx.Done()
+		ln.Close()
+	}()
 
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("Recovered from panic:", r)
 		}
 
-		wgInitNodeConnections.Wait()
-		isReady.Signal()
-		wgClosure.Wait()
-		wg.Done()
+		<-joining
+		<-closing
+		handshakes.Wait()
 	}()
 
-	ln, err := net.Listen(transportProtocol, fmt.Sprintf("%s:%s", myInfos.Address, myInfos.Port))
-	if err != nil {
-		log.Fatal("[ERROR]", err)
-	}
-
-	wgClosure.Add(1)
-	go handleClosure(&wgClosure, ln, shutdown)
-	isReady.Signal()
-
 	for {
 		// extracts the first connection on the listener queue
-		c, err = ln.Accept()
+		c, err := ln.Accept()
 		if errors.Is(err, net.ErrClosed) {
 			return
 		} else if err != nil {
@@ -73,21 +88,37 @@ func CreateConnections(wg *sync.WaitGroup, isReady *sync.Cond, myInfos *crdt.Nod
 			return
 		}
 
-		newConnections <- c
+		// a slow peer must not delay the connections accepted after it
+		handshakes.Add(1)
+		go func(c net.Conn) {
+			defer handshakes.Done()
+
+			err := security.handshake(ctx, c)
+			if err != nil {
+				fmt.Println("[ERROR] ", err.Error())
+				c.Close()
+				return
+			}
+
+			select {
+			case newConnections <- c:
+			case <-ctx.Done():
+				c.Close()
+			}
+		}(c)
 	}
 }
 
-func InitJoinChatProcess(wg *sync.WaitGroup, myInfos *crdt.NodeInfos, incomingConnectionRequest <-chan ConnectionRequest, newConnections chan<- net.Conn, shutdown <-chan struct{}) {
+func InitJoinChatProcess(ctx context.Context, transport Transport, myInfos *crdt.NodeInfos, identity *crdt.Identity, security *TLS, incomingConnectionRequest <-chan ConnectionRequest, newConnections chan<- net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("[ERROR] ", r)
 		}
-		wg.Done()
 	}()
 
 	for {
 		select {
-		case <-shutdown:
+		case <-ctx.Done():
 			return
 
 		case connectionRequest := <-incomingConnectionRequest:
@@ -102,41 +133,43 @@ func InitJoinChatProcess(wg *sync.WaitGroup, myInfos *crdt.NodeInfos, incomingCo
 				fmt.Println(err)
 			}
 
-			/* Open conn */
+			/* Open conn : the fingerprint of the node is pinned when it introduces itself */
 			var c net.Conn
-			c, err = openConnection(addr, connectionRequest.targetedPort)
+			c, err = openConnection(transport, security, addr, connectionRequest.targetedPort, "")
 			if err != nil {
 				fmt.Println("[ERROR] ", err)
 				break
 			}
 
-			// init joining process
-			_, err = c.Write(crdt.NewOperation(crdt.JoinChatByName, chatRoom, myInfos).ToBytes())
+			// init joining process, or ask for the chats to join
+			request := crdt.NewOperation(crdt.JoinChatByName, chatRoom, myInfos)
+			if connectionRequest.rooms {
+				request = crdt.NewOperation(crdt.ListRemoteChats, "", myInfos)
+			}
+
+			identity.SignOperation(request)
+			_, err = c.Write(request.ToBytes())
 			if err != nil {
 				fmt.Println("[ERROR] ", err)
 			}
 
-			newConnections <- c
+			select {
+			case newConnections <- c:
+			case <-ctx.Done():
+				c.Close()
+				return
+			}
 		}
 	}
 }
 
-func handleClosure(wg *sync.WaitGroup, ln net.Listener, shutdown <-chan struct{}) {
-	<-shutdown
-	err := ln.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	wg.Done()
-}
-
-func openConnection(ip string, port string) (net.Conn, error) {
+// openConnection connects to the node, the certificate presented must match fingerprint if not empty (TLS only)
+func openConnection(transport Transport, security *TLS, ip string, port string, fingerprint string) (net.Conn, error) {
 	if ip == localhost || ip == localhostDecimalPointed || ip == "" {
 		ip = ""
 	}
 
-	conn, err := net.Dial(transportProtocol, fmt.Sprintf("%s:%s", ip, port))
+	conn, err := security.dial(transport, net.JoinHostPort(ip, port), fingerprint)
 	if err != nil {
 		return nil, err
 	}
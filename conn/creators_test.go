@@ -1,6 +1,8 @@
 package conn
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"github/timtimjnvr/chat/crdt"
 	"github/timtimjnvr/chat/reader"
@@ -19,25 +21,20 @@ func TestListenAndServe(t *testing.T) {
 		ip              = ""
 		port            = "12341"
 		wgTests         = sync.WaitGroup{}
-		wg              = sync.WaitGroup{}
-		shutdown        = make(chan struct{}, 0)
-		lock            = sync.Mutex{}
-		isListening     = sync.NewCond(&lock)
 		newConnections  = make(chan net.Conn)
 		maxTestDuration = 1 * time.Second
 	)
 
+	stop, err := helperCreateConnections(&crdt.NodeInfos{Address: ip, Port: port}, newConnections)
+	if !assert.Nil(t, err) {
+		return
+	}
+
 	defer func() {
-		close(shutdown)
+		stop()
 		wgTests.Wait()
-		wg.Wait()
 	}()
 
-	wg.Add(1)
-	isListening.L.Lock()
-	go CreateConnections(&wg, isListening, &crdt.NodeInfos{Address: ip, Port: port}, make(chan ConnectionRequest), newConnections, shutdown)
-	isListening.Wait()
-
 	for i := 0; i < syscall.SOMAXCONN; i++ {
 		wgTests.Add(1)
 		go helperConnect(&wgTests, t, ip, port)
@@ -66,14 +63,11 @@ func TestListenAndServe(t *testing.T) {
 
 func TestConnect(t *testing.T) {
 	var (
-		listenerInfos = crdt.NewNodeInfos("127.0.0.1", "12343", "Listener")
-		joinerInfos   = crdt.NewNodeInfos("127.0.0.1", "12342", "Joiner")
+		listenerInfos  = crdt.NewNodeInfos("127.0.0.1", "12343", "Listener")
+		joinerIdentity = helperNewIdentity(t)
+		joinerInfos    = helperNewNodeInfos(joinerIdentity, "12342", "Joiner")
 
-		wgListen    = sync.WaitGroup{}
-		wgConnect   = sync.WaitGroup{}
-		shutdown    = make(chan struct{}, 0)
-		lock        = sync.Mutex{}
-		isListening = sync.NewCond(&lock)
+		connecting = make(chan struct{})
 
 		connectionRequests     = make(chan ConnectionRequest)
 		newConnectionsListen   = make(chan net.Conn)
@@ -81,19 +75,22 @@ func TestConnect(t *testing.T) {
 		maxTestDuration        = 1 * time.Second
 	)
 
+	stop, err := helperCreateConnections(&crdt.NodeInfos{Address: "", Port: listenerInfos.Port}, newConnectionsListen)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
-		close(shutdown)
-		wgListen.Wait()
-		wgConnect.Wait()
+		stop()
+		cancel()
+		<-connecting
 	}()
 
-	wgListen.Add(1)
-	isListening.L.Lock()
-	go CreateConnections(&wgListen, isListening, &crdt.NodeInfos{Address: "", Port: listenerInfos.Port}, make(chan ConnectionRequest), newConnectionsListen, shutdown)
-	isListening.Wait()
-
-	wgConnect.Add(1)
-	go InitJoinChatProcess(&wgConnect, joinerInfos, connectionRequests, newConnectionsInitConn, shutdown)
+	go func() {
+		defer close(connecting)
+		InitJoinChatProcess(ctx, TCPTransport{}, joinerInfos, joinerIdentity, nil, connectionRequests, newConnectionsInitConn)
+	}()
 
 	connRequest := NewConnectionRequest(listenerInfos.Port, listenerInfos.Address, listenerInfos.Name)
 
@@ -116,7 +113,7 @@ func TestConnect(t *testing.T) {
 
 		case c := <-newConnectionsListen:
 			message := make([]byte, reader.MaxMessageSize)
-			expectedMessage := crdt.NewOperation(crdt.JoinChatByName, "Listener", joinerInfos).ToBytes()
+			expectedMessage := helperSign(joinerIdentity, crdt.NewOperation(crdt.JoinChatByName, "Listener", joinerInfos)).ToBytes()
 
 			err := c.SetDeadline(time.Now().Add(maxTestDuration))
 			if err != nil {
@@ -144,7 +141,6 @@ func TestReadConn(t *testing.T) {
 	var (
 		maxTestDuration = 1 * time.Second
 		messages        = make(chan []byte)
-		shutdown        = make(chan struct{}, 0)
 		testData        = []string{
 			"first message\n",
 			"second message\n",
@@ -165,16 +161,11 @@ func TestReadConn(t *testing.T) {
 		}
 	}
 
-	c, err := newConn(connReader)
-	if err != nil {
-		assert.Fail(t, "failed to create connection reader : ", err.Error())
-		return
-	}
-
-	go reader.Read(c, messages, reader.Separator, shutdown)
+	ctx, shutdown := context.WithCancel(context.Background())
+	go reader.Read(ctx, connReader, messages, bufio.ScanLines)
 
 	defer func() {
-		close(shutdown)
+		shutdown()
 	}()
 
 	var (
@@ -200,18 +191,13 @@ func TestReadConn(t *testing.T) {
 
 // test helper used to retrieve two linked TCP net.Conn
 func helperGetConnections(port string) (net.Conn, net.Conn, error) {
-	var (
-		wgListen       = sync.WaitGroup{}
-		shutdown       = make(chan struct{}, 0)
-		lock           = sync.Mutex{}
-		isListening    = sync.NewCond(&lock)
-		newConnections = make(chan net.Conn)
-	)
+	newConnections := make(chan net.Conn)
+	stop, err := helperCreateConnections(&crdt.NodeInfos{Address: "", Port: port}, newConnections)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	wgListen.Add(1)
-	isListening.L.Lock()
-	go CreateConnections(&wgListen, isListening, &crdt.NodeInfos{Address: "", Port: port}, make(chan ConnectionRequest), newConnections, shutdown)
-	isListening.Wait()
+	defer stop()
 
 	conn1, err := net.Dial(transportProtocol, fmt.Sprintf(":%s", port))
 	if err != nil {
@@ -220,12 +206,32 @@ func helperGetConnections(port string) (net.Conn, net.Conn, error) {
 
 	conn2 := <-newConnections
 
-	close(shutdown)
-	wgListen.Wait()
-
 	return conn1, conn2, nil
 }
 
+// test helper accepting the TCP connections of the node until stop is called
+func helperCreateConnections(infos *crdt.NodeInfos, newConnections chan net.Conn) (func(), error) {
+	ln, err := Listen(TCPTransport{}, nil, infos)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		stopped     = make(chan struct{})
+	)
+
+	go func() {
+		defer close(stopped)
+		CreateConnections(ctx, ln, TCPTransport{}, infos, nil, nil, make(chan ConnectionRequest), newConnections)
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}, nil
+}
+
 func helperConnect(wg *sync.WaitGroup, t *testing.T, ip, port string) {
 	var c net.Conn
 
@@ -234,7 +240,7 @@ func helperConnect(wg *sync.WaitGroup, t *testing.T, ip, port string) {
 		c.Close()
 	}()
 
-	c, err := net.Dial(transportProtocol, fmt.Sprintf("%s:%s", ip, port))
+	c, err := net.Dial(transportProtocol, net.JoinHostPort(ip, port))
 	if err != nil {
 		assert.Fail(t, "failed to connect to listener : ", err.Error())
 		return
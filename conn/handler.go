@@ -1,115 +1,258 @@
 package conn
 
 import (
+	"context"
 	"fmt"
+	"github.com/google/uuid"
 	"github/timtimjnvr/chat/crdt"
 	"github/timtimjnvr/chat/reader"
 	"log"
 	"net"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
+const (
+	helloTimeout = 5 * time.Second
+
+	// DefaultShutdownTimeout bounds the time given to the other nodes to close the connections when leaving
+	DefaultShutdownTimeout = 5 * time.Second
+
+	// DefaultHeartbeat is the interval between two pings sent on a connection
+	DefaultHeartbeat = 5 * time.Second
+
+	// a node is dead when nothing is received from it during missedHeartbeats intervals
+	missedHeartbeats = 3
+
+	// operations kept for a node while the connection with it is opened
+	maxPendingOperations = 100
+)
+
+var (
+	pingFrame = crdt.NewOperation(crdt.Ping, "", nil).ToBytes()
+	pongFrame = crdt.NewOperation(crdt.Pong, "", nil).ToBytes()
+)
+
 type (
-	// slot identifies a TCP connection in one node referential (it get its values between 0 and 255).
-	// Any slot between 1 and 255 identifies an active TCP connection in the node handler.
-	slot uint8
+	// slot identifies a TCP connection in the node handler, it is never exposed outside of it.
+	// Any slot above 0 identifies an active TCP connection in the node handler.
+	slot int
+
+	// frame is an operation received on the TCP connection identified by slot
+	frame struct {
+		slot  slot
+		bytes []byte
+	}
 
 	node struct {
 		slot slot
-		conn *conn
+		conn net.Conn
 
 		Input  chan []byte
-		Output chan<- []byte
+		Output chan<- frame
+
+		heartbeat time.Duration // interval between two pings, 0 disables the heartbeats
+		dead      chan<- slot   // receives the slot when the heartbeats are missed
+
+		quit     chan struct{} // closed to stop the node
+		draining chan struct{} // closed once no more operations are sent to the node
 
 		Wg *sync.WaitGroup
 	}
 
+	// NodeHandler maintains the TCP connections with the other nodes. Each node introduces itself
+	// with a Hello (or JoinChatByName, ListRemoteChats) operation when a connection is opened : the rest of the program
+	// only knows nodes by id and the node handler routes operations to the connection in use for each node.
 	NodeHandler struct {
+		myInfos     *crdt.NodeInfos
+		transport   Transport
+		identity    *crdt.Identity // signs every operation sent
+		security    *TLS           // nil for plain connections
 		nodeStorage NodeStorage
+		backoff     Backoff
+		heartbeat   time.Duration
+		shutdown    time.Duration // see DefaultShutdownTimeout
 		nodes       map[slot]*node
+		ids         map[slot]uuid.UUID // node using each connection, once it introduced itself
+		slots       map[uuid.UUID]slot // connection in use for each node
 
-		Wg *sync.WaitGroup
+		// nodes the connection dropped with, closing the channel stops the reconnection
+		reconnecting map[uuid.UUID]chan struct{}
+
+		// operations waiting for the connection with each node to be opened
+		pending map[uuid.UUID][][]byte
 	}
 
 	NodeStorage interface {
-		GetNodeBySlot(slot uint8) (*crdt.NodeInfos, error)
+		GetNode(nodeID uuid.UUID) (*crdt.NodeInfos, error)
 	}
 )
 
-func newNode(conn net.Conn, slot slot, output chan<- []byte) (*node, error) {
-	c, err := newConn(conn)
-	if err != nil {
-		return nil, err
-	}
-
+func newNode(conn net.Conn, slot slot, output chan<- frame) *node {
 	return &node{
-		slot:   slot,
-		conn:   c,
-		Input:  make(chan []byte),
-		Output: output,
-		Wg:     &sync.WaitGroup{},
-	}, nil
+		slot:     slot,
+		conn:     conn,
+		Input:    make(chan []byte, maxPendingOperations),
+		Output:   output,
+		quit:     make(chan struct{}),
+		draining: make(chan struct{}),
+		Wg:       &sync.WaitGroup{},
+	}
 }
 
 func (n *node) start(done chan<- slot) {
 	var (
 		outputConnection = make(chan []byte)
-		stopReading      = make(chan struct{})
-		isClosing        = atomic.Bool{}
+		ctx, stopReading = context.WithCancel(context.Background())
+		input            = n.Input
+		draining         = n.draining
+		heartbeat        <-chan time.Time
+		lastReceived     = time.Now()
 	)
 	defer func() {
-		isClosing.Store(true)
-		close(stopReading)
+		stopReading()
 		n.Wg.Done()
 	}()
 
-	go reader.Read(n.conn, outputConnection, reader.Separator, stopReading)
+	if n.heartbeat > 0 {
+		ticker := time.NewTicker(n.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	go reader.Read(ctx, n.conn, outputConnection, crdt.ScanFrames)
 
 	for {
 		select {
-		case message, more := <-n.Input:
-			if !more {
-				return
-			}
+		case <-n.quit:
+			return
 
-			// Hide own slot to remote client
-			message = resetSlot(message)
+		case message := <-input:
 			_, err := n.conn.Write(message)
 			if err != nil {
 				fmt.Printf("Write: %s\n", err)
 				// TCP connection need to be re established
-				done <- n.slot
+				n.report(done)
+				return
+			}
+
+		case <-draining:
+			// the last operations are written, the node closes the connection once it received them (see KillNode)
+			if !n.flush() {
+				return
+			}
+
+			input, draining, heartbeat = nil, nil, nil
+
+		case <-heartbeat:
+			// half-open connection : the node is gone without closing it
+			if time.Since(lastReceived) > missedHeartbeats*n.heartbeat {
+				n.report(n.dead)
+				return
+			}
+
+			_, err := n.conn.Write(pingFrame)
+			if err != nil {
+				fmt.Printf("Write: %s\n", err)
+				n.report(done)
 				return
 			}
 
 		case message, more := <-outputConnection:
 			if !more {
+				// the node closed the connection after our last operations
+				if input == nil {
+					return
+				}
+
 				// TCP connection closed and need to be re established
-				if !isClosing.Load() {
-					done <- n.slot
+				n.report(done)
+				return
+			}
+
+			// we are leaving : what the node still sends is dropped
+			if input == nil {
+				continue
+			}
+
+			lastReceived = time.Now()
+
+			// heartbeats are answered here, they are not operations for the node handler
+			switch crdt.FrameTypology(message) {
+			case crdt.Ping:
+				_, err := n.conn.Write(pongFrame)
+				if err != nil {
+					fmt.Printf("Write: %s\n", err)
+					n.report(done)
 					return
 				}
+
+				continue
+
+			case crdt.Pong:
+				continue
 			}
 
-			// Set node slot for chat NodeHandler
-			n.setSlot(message)
-			n.Output <- message
+			// Tell the node handler which connection the operation comes from
+			select {
+			case n.Output <- frame{slot: n.slot, bytes: message}:
+			case <-n.quit:
+				return
+			}
 		}
 	}
 }
 
-func (n *node) setSlot(message []byte) []byte {
-	message[0] = uint8(n.slot)
-	return message
+// send queues the operation bytes to be written on the connection, they are dropped if the node stopped
+func (n *node) send(message []byte) {
+	select {
+	case n.Input <- message:
+	case <-n.quit:
+	}
+}
+
+// flush writes the operations queued, it returns false if the connection is broken
+func (n *node) flush() bool {
+	for {
+		select {
+		case message := <-n.Input:
+			_, err := n.conn.Write(message)
+			if err != nil {
+				return false
+			}
+
+		default:
+			return true
+		}
+	}
+}
+
+// report sends the slot to the node handler and waits to be stopped, the operations sent in the meantime are dropped
+func (n *node) report(to chan<- slot) {
+	for {
+		select {
+		case to <- n.slot:
+			to = nil
+
+		case <-n.Input:
+
+		case <-n.quit:
+			return
+		}
+	}
 }
 
 func (n *node) stop() {
-	close(n.Input)
+	close(n.quit)
 	n.Wg.Wait()
 }
 
+// drain tells the node that no more operations will be sent to it : it stops once the operations queued
+// are written and the connection is closed by the other node (or by the node handler after the shutdown timeout)
+func (n *node) drain() {
+	close(n.draining)
+}
+
 func (d *NodeHandler) getNextSlot() slot {
 	length := len(d.nodes)
 	for s, n := range d.nodes {
@@ -121,192 +264,512 @@ func (d *NodeHandler) getNextSlot() slot {
 	return slot(length + 1)
 }
 
-func NewNodeHandler(nodeStorage NodeStorage) *NodeHandler {
+func NewNodeHandler(transport Transport, nodeStorage NodeStorage, myInfos *crdt.NodeInfos, identity *crdt.Identity, security *TLS) *NodeHandler {
 	return &NodeHandler{
-		nodeStorage: nodeStorage,
-		nodes:       make(map[slot]*node),
-		Wg:          &sync.WaitGroup{},
+		myInfos:      myInfos,
+		transport:    transport,
+		identity:     identity,
+		security:     security,
+		nodeStorage:  nodeStorage,
+		backoff:      DefaultBackoff,
+		heartbeat:    DefaultHeartbeat,
+		shutdown:     DefaultShutdownTimeout,
+		nodes:        make(map[slot]*node),
+		ids:          make(map[slot]uuid.UUID),
+		slots:        make(map[uuid.UUID]slot),
+		reconnecting: make(map[uuid.UUID]chan struct{}),
+		pending:      make(map[uuid.UUID][][]byte),
+	}
+}
+
+// SetShutdownTimeout changes the time given to the other nodes to close the connections when leaving
+func (d *NodeHandler) SetShutdownTimeout(timeout time.Duration) {
+	d.shutdown = timeout
+}
+
+// startNode introduces the local node on the connection and starts handling it in slot
+func (d *NodeHandler) startNode(c net.Conn, s slot, output chan<- frame, done chan<- slot, dead chan<- slot) error {
+	// the first write also completes the TLS handshake : don't let a peer block the node handler
+	hello := crdt.NewOperation(crdt.Hello, "", d.myInfos)
+	d.identity.SignOperation(hello)
+
+	err := c.SetWriteDeadline(time.Now().Add(helloTimeout))
+	if err == nil {
+		_, err = c.Write(hello.ToBytes())
+	}
+
+	if err == nil {
+		err = c.SetWriteDeadline(time.Time{})
+	}
+
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	n := newNode(c, s, output)
+	n.heartbeat = d.heartbeat
+	n.dead = dead
+	n.Wg.Add(1)
+	go n.start(done)
+	d.nodes[s] = n
+	return nil
+}
+
+// identify records the node using the connection, the last connection opened with a node is the one used to reach it.
+// The operations waiting for the node are sent on the connection.
+func (d *NodeHandler) identify(s slot, nodeID uuid.UUID) {
+	d.ids[s] = nodeID
+	d.slots[nodeID] = s
+
+	// the node opened a new connection with us
+	if cancel, ok := d.reconnecting[nodeID]; ok {
+		close(cancel)
+		delete(d.reconnecting, nodeID)
+	}
+
+	for _, message := range d.pending[nodeID] {
+		select {
+		case d.nodes[s].Input <- message:
+		default:
+			// the node is overwhelmed : the operation is lost
+		}
 	}
+
+	delete(d.pending, nodeID)
 }
 
-func (d *NodeHandler) Start(newConnections <-chan net.Conn, toSend <-chan *crdt.Operation, toExecute chan<- *crdt.Operation) {
+// queue keeps the operation until the node is connected, the connection is opened unless we are already reconnecting
+// to the node. The operations for nodes we don't know are dropped.
+func (d *NodeHandler) queue(operation *crdt.Operation, wg *sync.WaitGroup, reconnections chan<- reconnection, reports chan<- *crdt.Operation) {
+	nodeID := operation.Node
+	if _, err := d.nodeStorage.GetNode(nodeID); err != nil {
+		return
+	}
+
+	if len(d.pending[nodeID]) < maxPendingOperations {
+		d.pending[nodeID] = append(d.pending[nodeID], operation.ToBytes())
+	}
+
+	if _, reconnecting := d.reconnecting[nodeID]; reconnecting {
+		return
+	}
+
+	cancel := make(chan struct{})
+	d.reconnecting[nodeID] = cancel
+	wg.Add(1)
+	go d.reconnect(wg, reconnection{nodeID: nodeID, cancel: cancel}, ConnectBackoff, reconnections, reports)
+}
+
+// release stops routing operations to the connection, it is closed by the remote node (see Disconnect).
+// The operations the node sent before receiving the Disconnect operation are still executed.
+func (d *NodeHandler) release(s slot) {
+	if id, ok := d.ids[s]; ok && d.slots[id] == s {
+		delete(d.slots, id)
+	}
+}
+
+// forget removes the connection from the routing of operations
+func (d *NodeHandler) forget(s slot) {
+	d.release(s)
+	delete(d.ids, s)
+	d.nodes[s] = nil
+}
+
+// newStatusReport returns the operation telling the orchestrator what happened to the connection with the node
+func newStatusReport(nodeID uuid.UUID, status string) *crdt.Operation {
+	report := crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: status})
+	report.Node = nodeID
+	return report
+}
+
+// newFailureReport returns the operation telling the orchestrator that the operations for the node are dropped
+func newFailureReport(nodeID uuid.UUID) *crdt.Operation {
+	report := crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: unreachableStatus, Failed: true})
+	report.Node = nodeID
+	return report
+}
+
+// Start routes the operations of toSend to the connections and the operations received to toExecute until toSend
+// is closed. The operations received are dropped once ctx is done : the orchestrator is leaving.
+// Start returns once the connections are closed, see shutdown.
+func (d *NodeHandler) Start(ctx context.Context, newConnections <-chan net.Conn, toSend <-chan *crdt.Operation, toExecute chan<- *crdt.Operation) {
 	var (
-		nodeAccess                 = &sync.Mutex{}
-		done                       = make(chan slot)
-		outputNodes                = make(chan []byte)
-		stopTCPConnectionsHandling = make(chan struct{}, 0)
-		TCPHandling                = &sync.WaitGroup{}
+		nodeAccess    = &sync.Mutex{}
+		done          = make(chan slot)
+		dead          = make(chan slot)
+		outputNodes   = make(chan frame)
+		routed        = make(chan struct{}) // closed once every operation to send has been routed
+		reconnections = make(chan reconnection)
+		reports       = make(chan *crdt.Operation) // connection attempts of the reconnections, see reconnect
+		supervisors   = &sync.WaitGroup{}
 	)
 
-	defer func() {
-		TCPHandling.Done()
-		close(toExecute)
-		// Hugly but needed
-		// this is the last go routine to exit
-		// when this exits all leaving TCP connections will be closed
-		// we want them to be closed cleanly by the remote nodes
-		// wen the KillNode operation is received
-		<-time.Tick(5 * time.Second)
-		d.Wg.Done()
-	}()
-
-	d.Wg.Add(1)
 	go func() {
-		defer d.Wg.Done()
+		defer close(routed)
 
-		for {
-			select {
-			case operation, more := <-toSend:
-				// Received shutdown
-				if !more {
-					close(stopTCPConnectionsHandling)
-					TCPHandling.Wait()
-					return
-				}
+		for operation := range toSend {
+			d.identity.SignOperation(operation)
 
-				// Set slot
-				s := slot(operation.Slot)
+			var (
+				message = operation.ToBytes()
+				targets []*node
+			)
 
-				nodeAccess.Lock()
-				// Broadcast
-				if s == 0 {
-					for _, n := range d.nodes {
-						if n != nil {
-							n.Input <- operation.ToBytes()
-							// TODO find a way to wait node
-						}
-					}
-				} else {
-					if n, exist := d.nodes[s]; exist && n != nil {
-						n.Input <- operation.ToBytes()
-						// TODO find a way to wait node
+			nodeAccess.Lock()
+			// Broadcast
+			if operation.Node == uuid.Nil {
+				for _, n := range d.nodes {
+					if n != nil {
+						targets = append(targets, n)
 					}
 				}
+			} else if s, known := d.slots[operation.Node]; known && d.nodes[s] != nil {
+				targets = append(targets, d.nodes[s])
 
-				nodeAccess.Unlock()
+				if operation.Typology == crdt.Disconnect {
+					d.release(s)
+				}
+			} else if isDialable(operation) {
+				d.queue(operation, supervisors, reconnections, reports)
+			}
+			nodeAccess.Unlock()
+
+			// the lock is released : nodes waiting for the node handler to read their operations are not blocked
+			for _, n := range targets {
+				n.send(message)
 			}
 		}
 	}()
 
-	TCPHandling.Add(1)
+	execute := func(operation *crdt.Operation) {
+		select {
+		case toExecute <- operation:
+		case <-ctx.Done():
+		}
+	}
+
 	for {
 		select {
-		case <-stopTCPConnectionsHandling:
+		case <-routed:
+			nodeAccess.Lock()
+			for id, cancel := range d.reconnecting {
+				close(cancel)
+				delete(d.reconnecting, id)
+			}
+			nodeAccess.Unlock()
+			supervisors.Wait()
 
+			d.leave(nodeAccess, newConnections, outputNodes, done, dead)
 			return
 
 		case c := <-newConnections:
 			fmt.Println("[DEBUG] node Handler", "New connection")
-			s := d.getNextSlot()
-
-			n, err := newNode(c, d.getNextSlot(), outputNodes)
+			nodeAccess.Lock()
+			err := d.startNode(c, d.getNextSlot(), outputNodes, done, dead)
+			nodeAccess.Unlock()
 			if err != nil {
 				log.Println("[ERROR] ", err)
-				continue
 			}
 
-			n.Wg.Add(1)
-			go n.start(done)
+			// TCP connection closed unexpectedly
+		case s := <-done:
 			nodeAccess.Lock()
-			d.nodes[s] = n
+			if n := d.nodes[s]; n != nil {
+				n.stop()
+				n.conn.Close()
+			}
+
+			nodeID, identified := d.ids[s]
+			routed := identified && d.slots[nodeID] == s
+			d.forget(s)
+			_, reconnecting := d.reconnecting[nodeID]
+
+			// reconnect unless the node opened a new connection with us in the meantime or we released it
+			if routed && !reconnecting {
+				cancel := make(chan struct{})
+				d.reconnecting[nodeID] = cancel
+				supervisors.Add(1)
+				go d.reconnect(supervisors, reconnection{nodeID: nodeID, dropped: true, cancel: cancel}, d.backoff, reconnections, reports)
+			}
 			nodeAccess.Unlock()
 
-			// TCP connection closed unexpectedly
-		case s := <-done:
+			// heartbeats missed : the node is dead
+		case s := <-dead:
+			nodeAccess.Lock()
+			if n := d.nodes[s]; n != nil {
+				n.stop()
+				n.conn.Close()
+			}
 
-			nodeInfos, err := d.nodeStorage.GetNodeBySlot(uint8(s))
-			if err != nil {
-				log.Println("[ERROR] ", err)
+			nodeID, identified := d.ids[s]
+			routed := identified && d.slots[nodeID] == s
+			d.forget(s)
+			nodeAccess.Unlock()
+
+			if !routed {
 				continue
 			}
 
-			c, err := openConnection(nodeInfos.Address, nodeInfos.Port)
-			if err != nil {
-				log.Println("[ERROR] ", err)
+			execute(newStatusReport(nodeID, stoppedAnsweringStatus))
+
+			killNode := crdt.NewOperation(crdt.KillNode, "", nil)
+			killNode.Node = nodeID
+			execute(killNode)
+
+		case report := <-reports:
+			execute(report)
+
+		case r := <-reconnections:
+			nodeAccess.Lock()
+			if d.reconnecting[r.nodeID] == r.cancel {
+				delete(d.reconnecting, r.nodeID)
+			}
+
+			_, connected := d.slots[r.nodeID]
+			if connected {
+				// the node opened a new connection with us in the meantime
+				if r.conn != nil {
+					r.conn.Close()
+				}
+
+				nodeAccess.Unlock()
+				continue
+			}
+
+			if r.conn == nil {
+				delete(d.pending, r.nodeID)
+				nodeAccess.Unlock()
+
+				// nothing to report : the node is not in our chats anymore
+				if r.left {
+					continue
+				}
+
+				// a single dial failed : the node is only considered dead once its connection can't be opened again
+				if !r.dropped {
+					execute(newFailureReport(r.nodeID))
+					continue
+				}
+
+				// the node is considered dead
+				execute(newStatusReport(r.nodeID, unreachableStatus))
+
+				killNode := crdt.NewOperation(crdt.KillNode, "", nil)
+				killNode.Node = r.nodeID
+				execute(killNode)
 				continue
 			}
 
-			resetNode, err := newNode(c, s, outputNodes)
+			s := d.getNextSlot()
+			err := d.startNode(r.conn, s, outputNodes, done, dead)
+			if err == nil {
+				d.identify(s, r.nodeID)
+			}
+			nodeAccess.Unlock()
 			if err != nil {
 				log.Println("[ERROR] ", err)
 				continue
 			}
 
-			nodeAccess.Lock()
-			d.nodes[s] = resetNode
-			nodeAccess.Unlock()
+			// exchange the messages sent while disconnected
+			syncOperation := crdt.NewOperation(crdt.SyncNode, "", nil)
+			syncOperation.Node = r.nodeID
+			execute(syncOperation)
 
-		case operationBytes := <-outputNodes:
+		case f := <-outputNodes:
 
-			operation, err := crdt.DecodeOperation(operationBytes)
+			operation, err := crdt.DecodeOperation(f.bytes)
 			if err != nil {
 				log.Println("[ERROR] ", err)
 				continue
 			}
 
-			// Open TCP connection
-			if operation.Typology == crdt.AddNode {
-				newNodeInfos, ok := operation.Data.(*crdt.NodeInfos)
+			// unsigned operations are only emitted by the node handler itself (see SyncNode and KillNode)
+			if len(operation.Signature) == 0 || operation.Typology == crdt.SyncNode {
+				log.Println("[ERROR] unsigned operation received")
+				continue
+			}
+
+			// The first operation received on a connection tells which node uses it
+			if operation.Typology == crdt.Hello || operation.Typology == crdt.JoinChatByName || operation.Typology == crdt.ListRemoteChats {
+				infos, ok := operation.Data.(*crdt.NodeInfos)
 				if !ok {
 					log.Println("[ERROR] can't parse op data to NodeInfos")
 					continue
 				}
 
-				// establish connection and set slot
-				var c net.Conn
+				nodeAccess.Lock()
+				n := d.nodes[f.slot]
+				if n == nil {
+					nodeAccess.Unlock()
+					continue
+				}
 
-				c, err = openConnection(newNodeInfos.Address, newNodeInfos.Port)
-				if err != nil {
-					log.Println("[ERROR] ", err)
-					break
+				// the node proves it owns the identity it announces
+				err = operation.VerifyAuthor(infos.Id)
+				if err == nil {
+					err = d.security.verify(n.conn, infos)
 				}
 
-				s := d.getNextSlot()
-				n, err := newNode(c, d.getNextSlot(), outputNodes)
 				if err != nil {
+					// closing the connection ends the node, its remaining operations are dropped as unidentified
 					log.Println("[ERROR] ", err)
+					n.conn.Close()
+					nodeAccess.Unlock()
 					continue
 				}
 
-				n.Wg.Add(1)
-				go n.start(done)
-				nodeAccess.Lock()
-				d.nodes[s] = n
+				// the Hello following a JoinChatByName or ListRemoteChats must not route a released connection again
+				if id, identified := d.ids[f.slot]; !identified || id != infos.Id {
+					d.identify(f.slot, infos.Id)
+				}
 				nodeAccess.Unlock()
 
-				operation.Slot = uint8(s)
+				if operation.Typology == crdt.Hello {
+					continue
+				}
 			}
 
-			// Close TCP connection
-			if operation.Typology == crdt.KillNode {
+			nodeAccess.Lock()
+			nodeID, identified := d.ids[f.slot]
+			nodeAccess.Unlock()
+			if !identified {
+				log.Println("[ERROR] operation received from an unknown node")
+				continue
+			}
+
+			operation.Node = nodeID
+
+			// Open TCP connection
+			if operation.Typology == crdt.AddNode {
+				newNodeInfos, ok := operation.Data.(*crdt.NodeInfos)
+				if !ok {
+					log.Println("[ERROR] can't parse op data to NodeInfos")
+					continue
+				}
+
 				nodeAccess.Lock()
+				_, connected := d.slots[newNodeInfos.Id]
+				nodeAccess.Unlock()
 
-				// Kill all TCP connections
-				if operation.Slot == 0 {
-					for s, n := range d.nodes {
-						if n != nil {
-							fmt.Println("closing connection")
-							n.stop()
-							d.nodes[s] = nil
-						}
+				// establish connection if not already done
+				if !connected && newNodeInfos.Id != d.myInfos.Id {
+					var c net.Conn
+
+					c, err = openConnection(d.transport, d.security, newNodeInfos.Address, newNodeInfos.Port, newNodeInfos.Fingerprint)
+					if err != nil {
+						log.Println("[ERROR] ", err)
+						break
+					}
+
+					nodeAccess.Lock()
+					s := d.getNextSlot()
+					err = d.startNode(c, s, outputNodes, done, dead)
+					if err == nil {
+						d.identify(s, newNodeInfos.Id)
 					}
-				} else {
-					// Kill specific TCP connection
-					if n, exists := d.nodes[slot(operation.Slot)]; exists && n != nil {
-						n.stop()
-						d.nodes[slot(operation.Slot)] = nil
+					nodeAccess.Unlock()
+					if err != nil {
+						log.Println("[ERROR] ", err)
+						break
 					}
 				}
+			}
 
+			// Close TCP connection
+			if operation.Typology == crdt.KillNode || operation.Typology == crdt.Disconnect {
+				nodeAccess.Lock()
+				if n, exists := d.nodes[f.slot]; exists && n != nil {
+					n.stop()
+					n.conn.Close()
+				}
+				d.forget(f.slot)
 				nodeAccess.Unlock()
 			}
 
-			toExecute <- operation
+			// the node still knows us, the connection was not needed anymore
+			if operation.Typology == crdt.Disconnect {
+				continue
+			}
+
+			execute(operation)
 		}
 	}
 }
 
-func resetSlot(message []byte) []byte {
-	message[0] = 0
-	return message
+// leave waits for the other nodes to close the connections once they received the last operations sent (KillNode),
+// the connections still opened after the shutdown timeout are closed
+func (d *NodeHandler) leave(nodeAccess *sync.Mutex, newConnections <-chan net.Conn, outputNodes <-chan frame, done, dead <-chan slot) {
+	var (
+		nodes   = make(map[slot]*node)
+		waiting []*node
+		drained = make(chan struct{})
+		timeout = time.NewTimer(d.shutdown)
+	)
+
+	defer timeout.Stop()
+
+	nodeAccess.Lock()
+	for s, n := range d.nodes {
+		if n != nil {
+			n.drain()
+			nodes[s] = n
+			waiting = append(waiting, n)
+		}
+
+		d.forget(s)
+	}
+	nodeAccess.Unlock()
+
+	go func() {
+		for _, n := range waiting {
+			n.Wg.Wait()
+		}
+
+		close(drained)
+	}()
+
+	// nodes reporting a broken connection wait to be stopped
+	stop := func(s slot) {
+		if n, ok := nodes[s]; ok {
+			close(n.quit)
+			delete(nodes, s)
+		}
+	}
+
+	for {
+		select {
+		case <-drained:
+			return
+
+		case <-timeout.C:
+			for s, n := range nodes {
+				stop(s)
+				n.conn.Close()
+			}
+
+		case c := <-newConnections:
+			c.Close()
+
+		case s := <-done:
+			stop(s)
+
+		case s := <-dead:
+			stop(s)
+
+		case <-outputNodes:
+		}
+	}
+}
+
+// isDialable reports whether a connection is worth opening to send the operation, operations
+// telling a node we leave are dropped if it is not connected
+func isDialable(operation *crdt.Operation) bool {
+	switch operation.Typology {
+	case crdt.KillNode, crdt.RemoveNode, crdt.Prune, crdt.Disconnect:
+		return false
+	default:
+		return true
+	}
 }
@@ -1,19 +1,20 @@
 package conn
 
 import (
-	"bytes"
+	"context"
 	"github/timtimjnvr/chat/crdt"
-	"github/timtimjnvr/chat/reader"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNode_StartAndStop(t *testing.T) {
 	var (
-		output          = make(chan []byte, maxMessageSize)
+		output          = make(chan frame, maxMessageSize)
 		done            = make(chan slot, 2)
 		maxTestDuration = 1 * time.Second
 	)
@@ -23,28 +24,22 @@ func TestNode_StartAndStop(t *testing.T) {
 		assert.Fail(t, "failed to create a conn")
 	}
 
-	reader, err := newNode(connReader, 1, output)
-	if err != nil {
-		assert.Fail(t, "failed to create node")
-	}
+	reader := newNode(connReader, 1, output)
 
 	reader.Wg.Add(1)
 	go reader.start(done)
 
-	sender, err := newNode(connSender, 1, output)
-	if err != nil {
-		assert.Fail(t, "failed to create node")
-	}
+	sender := newNode(connSender, 1, output)
 
 	sender.Wg.Add(1)
 	go sender.start(done)
 
 	var (
-		message         = []byte{2, 1, 2, 3, 4, 5} // slot set to node slot sender
-		expectedMessage = []byte{1, 1, 2, 3, 4, 5} // slot set to node slot receiver
+		operation       = crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "I love Unit Testing"})
+		expectedMessage = frame{slot: 1, bytes: operation.ToBytes()} // received on the reader slot
 	)
 
-	sender.Input <- message
+	sender.Input <- operation.ToBytes()
 
 	timeout := time.Tick(maxTestDuration)
 	select {
@@ -58,7 +53,7 @@ func TestNode_StartAndStop(t *testing.T) {
 	sender.stop()
 	defer func() {
 		sender.Wg.Wait()
-		reader.Wg.Wait()
+		reader.stop()
 	}()
 
 	timeout = time.NewTicker(1 * time.Second).C
@@ -82,52 +77,326 @@ func TestNodeHandler_Send(t *testing.T) {
 	}
 
 	var (
-		output = make(chan []byte, maxMessageSize)
-		done   = make(chan slot, 1)
+		output       = make(chan frame, maxMessageSize)
+		done         = make(chan slot, 1)
+		myIdentity   = helperNewIdentity(t)
+		peerIdentity = helperNewIdentity(t)
+		myInfos      = helperNewNodeInfos(myIdentity, "12346", "me")
+		peerInfos    = helperNewNodeInfos(peerIdentity, "12347", "peer")
+		nodeReader   = newNode(conn2, 1, output)
 	)
 
-	nodeReader, err := newNode(conn2, 0, output)
-	if err != nil {
-		assert.Fail(t, "failed to create node")
-	}
-
 	nodeReader.Wg.Add(1)
 	go nodeReader.start(done)
 	defer nodeReader.stop()
 
 	var (
 		maxTestDuration = 1 * time.Second
-		shutdown        = make(chan struct{}, 0)
-		nh              = NewNodeHandler(nil)
+		nh              = NewNodeHandler(TCPTransport{}, helperNodeStorage{}, myInfos, myIdentity, nil)
 		newConnections  = make(chan net.Conn)
 		toSend          = make(chan *crdt.Operation)
 		toExecute       = make(chan *crdt.Operation)
 	)
 
-	nh.Wg.Add(1)
-	go nh.Start(newConnections, toSend, toExecute)
-	defer func() {
-		close(shutdown)
-		nh.Wg.Wait()
-	}()
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer wait()
 
 	newConnections <- conn1
+
+	// the node handler introduces the local node first
+	timeout := time.Tick(maxTestDuration)
+	select {
+	case <-timeout:
+		assert.Fail(t, "test timeout")
+		return
+	case m := <-output:
+		hello, err := crdt.DecodeOperation(m.bytes)
+		assert.Nil(t, err)
+		assert.Equal(t, crdt.Hello, hello.Typology)
+		assert.Equal(t, myInfos.Id, hello.Data.(*crdt.NodeInfos).Id)
+		assert.Nil(t, hello.VerifyAuthor(myInfos.Id))
+	}
+
+	// operations received from the peer are tagged with its id once it introduced itself
+	nodeReader.Input <- helperSign(peerIdentity, crdt.NewOperation(crdt.Hello, "", peerInfos)).ToBytes()
+	nodeReader.Input <- helperSign(peerIdentity, crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"})).ToBytes()
+
+	select {
+	case <-timeout:
+		assert.Fail(t, "test timeout")
+		return
+	case op := <-toExecute:
+		assert.Equal(t, crdt.AddMessage, op.Typology)
+		assert.Equal(t, peerInfos.Id, op.Node)
+		assert.Nil(t, op.VerifyAuthor(op.Node))
+	}
+
+	// operations are routed by node id, operations for unknown nodes are dropped
+	unknownOperation := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Lost"})
+	unknownOperation.Node = uuid.New()
+
 	messageOperation := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "I love Unit Testing"})
-	messageOperation.Slot = 1
+	messageOperation.Node = peerInfos.Id
+	expectedBytes := helperSign(myIdentity, messageOperation.Copy()).ToBytes() // the node handler signs what it sends
 
-	expectedMessageOperation := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "I love Unit Testing"})
-	expectedMessageOperation.Slot = 0
-	expectedBytesOperationWithSeparator := expectedMessageOperation.ToBytes()
-	expectedBytes := bytes.TrimSuffix(expectedBytesOperationWithSeparator, reader.Separator)
+	toSend <- unknownOperation
 	toSend <- messageOperation
 	close(toSend)
 
-	timeout := time.Tick(maxTestDuration)
 	select {
 	case <-timeout:
 		assert.Fail(t, "test timeout")
 		return
 	case m := <-output:
-		assert.Equal(t, m, expectedBytes, "did not received expected operation bytes")
+		assert.Equal(t, expectedBytes, m.bytes, "did not received expected operation bytes")
+	}
+}
+
+func TestNodeHandler_RejectsForgedHello(t *testing.T) {
+	conn1, conn2, err := helperGetConnections("12366")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var (
+		output     = make(chan frame, maxMessageSize)
+		done       = make(chan slot, 1)
+		myIdentity = helperNewIdentity(t)
+		myInfos    = helperNewNodeInfos(myIdentity, "12366", "me")
+		nodeReader = newNode(conn2, 1, output)
+	)
+
+	nodeReader.Wg.Add(1)
+	go nodeReader.start(done)
+
+	var (
+		nh             = NewNodeHandler(TCPTransport{}, helperNodeStorage{}, myInfos, myIdentity, nil)
+		newConnections = make(chan net.Conn)
+		toSend         = make(chan *crdt.Operation)
+		toExecute      = make(chan *crdt.Operation)
+	)
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	newConnections <- conn1
+
+	// the peer introduces itself as another node : it can't sign with its key
+	impersonated := helperNewNodeInfos(helperNewIdentity(t), "12367", "victim")
+	nodeReader.Input <- helperSign(helperNewIdentity(t), crdt.NewOperation(crdt.Hello, "", impersonated)).ToBytes()
+	nodeReader.Input <- crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"}).ToBytes()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case op := <-toExecute:
+		assert.Fail(t, "operation of an impersonating node executed", crdt.GetOperationName(op.Typology))
+	}
+
+	// the connection is closed by the node handler
+	select {
+	case <-time.After(time.Second):
+		assert.Fail(t, "test timeout")
+	case <-done:
+	}
+
+	nodeReader.stop()
+}
+
+func TestNode_LargeOperation(t *testing.T) {
+	var (
+		output          = make(chan frame, maxMessageSize)
+		done            = make(chan slot, 2)
+		maxTestDuration = 5 * time.Second
+	)
+
+	connReader, connSender, err := helperGetConnections("12350")
+	if err != nil {
+		assert.Fail(t, "failed to create a conn")
+		return
+	}
+
+	reader := newNode(connReader, 1, output)
+
+	reader.Wg.Add(1)
+	go reader.start(done)
+	defer reader.stop()
+
+	sender := newNode(connSender, 1, make(chan frame))
+
+	sender.Wg.Add(1)
+	go sender.start(done)
+	defer sender.stop()
+
+	// messages bigger than a read and containing separators
+	expectedOperations := []*crdt.Operation{
+		crdt.NewOperation(crdt.AddMessage, "test-chat", crdt.NewMessage(uuid.New(), "James", strings.Repeat("a\n", 1<<19))),
+		crdt.NewOperation(crdt.AddMessage, "test-chat", crdt.NewMessage(uuid.New(), "James", "small one\n")),
+	}
+
+	for _, op := range expectedOperations {
+		sender.Input <- op.ToBytes()
+	}
+
+	timeout := time.Tick(maxTestDuration)
+	for _, expected := range expectedOperations {
+		select {
+		case <-timeout:
+			assert.Fail(t, "test timeout")
+			return
+
+		case received := <-output:
+			op, err := crdt.DecodeOperation(received.bytes)
+			assert.Nil(t, err)
+
+			assert.Equal(t, slot(1), received.slot)
+			assert.Equal(t, expected, op, "operations sent and received are not equal")
+		}
+	}
+}
+
+// test helper running the node handler until toSend is closed, wait returns once it stopped
+func helperStartNodeHandler(nh *NodeHandler, newConnections <-chan net.Conn, toSend <-chan *crdt.Operation, toExecute chan<- *crdt.Operation) (wait func()) {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		nh.Start(context.Background(), newConnections, toSend, toExecute)
+	}()
+
+	return func() {
+		<-stopped
+	}
+}
+
+func helperNewIdentity(t *testing.T) *crdt.Identity {
+	identity, err := crdt.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return identity
+}
+
+// test helper returning the infos of a node listening on port with the id bound to identity
+func helperNewNodeInfos(identity *crdt.Identity, port, name string) *crdt.NodeInfos {
+	infos := crdt.NewNodeInfos("127.0.0.1", port, name)
+	infos.Id = identity.Id()
+	return infos
+}
+
+func helperSign(identity *crdt.Identity, op *crdt.Operation) *crdt.Operation {
+	identity.SignOperation(op)
+	return op
+}
+
+func TestNode_Heartbeat(t *testing.T) {
+	var (
+		output = make(chan frame, maxMessageSize)
+		done   = make(chan slot, 3)
+		dead   = make(chan slot, 3)
+	)
+
+	connA, connB, err := helperGetConnections("12370")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	nodes := []*node{newNode(connA, 1, output), newNode(connB, 2, output)}
+	for _, n := range nodes {
+		n.heartbeat = 20 * time.Millisecond
+		n.dead = dead
+		n.Wg.Add(1)
+		go n.start(done)
+	}
+
+	// both nodes answer : heartbeats are not forwarded to the node handler
+	select {
+	case <-time.After(300 * time.Millisecond):
+	case s := <-dead:
+		assert.Fail(t, "heartbeats missed", "slot %d", s)
+	case f := <-output:
+		assert.Fail(t, "heartbeat forwarded", crdt.GetOperationName(crdt.FrameTypology(f.bytes)))
+	}
+
+	for _, n := range nodes {
+		n.stop()
+	}
+
+	// a peer stops answering without closing the connection
+	conn, silentConn, err := helperGetConnections("12372")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer silentConn.Close()
+
+	n := newNode(conn, 3, output)
+	n.heartbeat = 20 * time.Millisecond
+	n.dead = dead
+	n.Wg.Add(1)
+	go n.start(done)
+	defer n.stop()
+
+	select {
+	case <-time.After(time.Second):
+		assert.Fail(t, "test timeout")
+	case s := <-dead:
+		assert.Equal(t, slot(3), s)
+	}
+}
+
+func TestNodeHandler_MissedHeartbeats(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12367", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12371", "peer")
+		nh                       = NewNodeHandler(TCPTransport{}, helperNodeStorage{peerInfos.Id: peerInfos}, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	nh.heartbeat = 20 * time.Millisecond
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	ln, err := net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	c, err := net.Dial(transportProtocol, ln.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	newConnections <- c
+	peerConn, err := helperAcceptPeer(ln, peerIdentity, peerInfos)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer peerConn.Close()
+
+	assert.Equal(t, crdt.AddMessage, helperWaitOperation(t, toExecute, crdt.AddMessage).Typology)
+
+	// the peer never answers the pings : it is killed without reconnecting
+	killNode := helperWaitOperation(t, toExecute, crdt.KillNode)
+	if assert.NotNil(t, killNode) {
+		assert.Equal(t, peerInfos.Id, killNode.Node)
+	}
+
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case op := <-toExecute:
+		assert.Fail(t, "unexpected operation", crdt.GetOperationName(op.Typology))
 	}
 }
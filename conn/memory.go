@@ -0,0 +1,445 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryNetwork links the nodes of a single process with in-memory connections (net.Pipe) so that whole
+	// clusters can be simulated in tests. Faults are injected in the connections : lost writes, latency and
+	// partitions between nodes. Nodes are identified by the address they listen on.
+	MemoryNetwork struct {
+		lock       *sync.Mutex
+		listeners  map[string]*memoryListener
+		conns      map[*memoryConn]bool
+		partitions map[[2]string]bool
+		faults     Faults
+	}
+
+	// Faults are injected in every write on the connections of a MemoryNetwork
+	Faults struct {
+		Drop  float64       // probability that a write is lost, TLS connections break on a lost write
+		Delay time.Duration // latency added to each write
+	}
+
+	// MemoryTransport is the transport of the node listening on address in a MemoryNetwork
+	MemoryTransport struct {
+		network *MemoryNetwork
+		address string
+	}
+
+	memoryAddr string
+
+	memoryListener struct {
+		network *MemoryNetwork
+		address string
+		conns   chan net.Conn
+		closed  chan struct{}
+		once    *sync.Once
+	}
+
+	// memoryConn is one end of a net.Pipe. A write on a pipe waits for the other end to read it :
+	// writes are queued as in the socket buffer of the kernel and written on the pipe by flush.
+	memoryConn struct {
+		net.Conn
+		network       *MemoryNetwork
+		local, remote string
+		writes        chan memoryWrite
+		closed        chan struct{}
+		once          *sync.Once
+		lock          *sync.Mutex
+		writeDeadline time.Time
+	}
+
+	memoryWrite struct {
+		bytes []byte
+		at    time.Time
+	}
+)
+
+const (
+	memoryNetwork = "memory"
+
+	// writes queued on a connection before the writer blocks
+	memoryBufferSize = 64
+
+	// time given to the writes queued on a closed connection to be read by the other end
+	memoryLinger = time.Second
+
+	// connections waiting to be accepted before the dialer blocks
+	memoryBacklog = 128
+)
+
+var (
+	ConnectionRefusedErr = errors.New("connection refused")
+	AddressInUseErr      = errors.New("address already in use")
+	PartitionedErr       = errors.New("network partitioned")
+)
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		lock:       &sync.Mutex{},
+		listeners:  make(map[string]*memoryListener),
+		conns:      make(map[*memoryConn]bool),
+		partitions: make(map[[2]string]bool),
+	}
+}
+
+// Transport returns the transport of the node listening on address, the connections it opens come from address
+func (m *MemoryNetwork) Transport(address string) *MemoryTransport {
+	return &MemoryTransport{
+		network: m,
+		address: memoryAddress(address),
+	}
+}
+
+// SetFaults changes the faults injected in the writes of every connection
+func (m *MemoryNetwork) SetFaults(faults Faults) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.faults = faults
+}
+
+// Partition closes the connections between the nodes listening on a and b, they can't open new ones until Heal
+func (m *MemoryNetwork) Partition(a, b string) {
+	key := partitionKey(a, b)
+
+	m.lock.Lock()
+	m.partitions[key] = true
+
+	var broken []*memoryConn
+	for c := range m.conns {
+		if partitionKey(c.local, c.remote) == key {
+			broken = append(broken, c)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, c := range broken {
+		c.Close()
+	}
+}
+
+// Heal lets the nodes listening on a and b connect again
+func (m *MemoryNetwork) Heal(a, b string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.partitions, partitionKey(a, b))
+}
+
+// state returns the faults injected in a write from local to remote
+func (m *MemoryNetwork) state(local, remote string) (Faults, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.faults, m.partitions[partitionKey(local, remote)]
+}
+
+func (m *MemoryNetwork) newConn(pipe net.Conn, local, remote string) *memoryConn {
+	c := &memoryConn{
+		Conn:    pipe,
+		network: m,
+		local:   local,
+		remote:  remote,
+		writes:  make(chan memoryWrite, memoryBufferSize),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+		lock:    &sync.Mutex{},
+	}
+
+	m.conns[c] = true
+	go c.flush()
+	return c
+}
+
+func (t *MemoryTransport) Dial(address string) (net.Conn, error) {
+	address = memoryAddress(address)
+
+	m := t.network
+	m.lock.Lock()
+	ln, listening := m.listeners[address]
+	if !listening {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", address, ConnectionRefusedErr)
+	}
+
+	if m.partitions[partitionKey(t.address, address)] {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", address, PartitionedErr)
+	}
+
+	client, server := net.Pipe()
+	var (
+		clientConn = m.newConn(client, t.address, address)
+		serverConn = m.newConn(server, address, t.address)
+	)
+	m.lock.Unlock()
+
+	select {
+	case ln.conns <- serverConn:
+		return clientConn, nil
+
+	case <-ln.closed:
+		clientConn.Close()
+		serverConn.Close()
+		return nil, fmt.Errorf("dial %s: %w", address, ConnectionRefusedErr)
+	}
+}
+
+func (t *MemoryTransport) Listen(address string) (net.Listener, error) {
+	address = memoryAddress(address)
+
+	m := t.network
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.listeners[address]; exists {
+		return nil, fmt.Errorf("listen %s: %w", address, AddressInUseErr)
+	}
+
+	ln := &memoryListener{
+		network: m,
+		address: address,
+		conns:   make(chan net.Conn, memoryBacklog),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+	}
+
+	m.listeners[address] = ln
+	return ln, nil
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		err = nil
+
+		l.network.lock.Lock()
+		delete(l.network.listeners, l.address)
+		l.network.lock.Unlock()
+
+		close(l.closed)
+
+		// connections never accepted are refused
+		for {
+			select {
+			case c := <-l.conns:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.address)
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.Conn.Read(b)
+	if err != nil && c.isClosed() {
+		// Close interrupts the pending read with a deadline
+		return n, net.ErrClosed
+	}
+
+	return n, err
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	c.lock.Lock()
+	deadline := c.writeDeadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c.writes <- memoryWrite{bytes: append([]byte(nil), b...), at: time.Now()}:
+		return len(b), nil
+
+	case <-c.closed:
+		return 0, net.ErrClosed
+
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// flush writes the queued writes on the pipe until the connection is closed or broken
+func (c *memoryConn) flush() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case w := <-c.writes:
+			if !c.send(w) {
+				// the other end is gone : the connection is broken
+				c.Close()
+				return
+			}
+
+		case <-c.closed:
+			// like TCP, what was written before closing the connection is still delivered
+			for {
+				select {
+				case w := <-c.writes:
+					if !c.send(w) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes w on the pipe once the latency elapsed, it returns false if the pipe is broken
+func (c *memoryConn) send(w memoryWrite) bool {
+	faults, partitioned := c.network.state(c.local, c.remote)
+	if partitioned {
+		return false
+	}
+
+	time.Sleep(time.Until(w.at.Add(faults.Delay)))
+
+	if faults.Drop > 0 && rand.Float64() < faults.Drop {
+		return true
+	}
+
+	_, err := c.Conn.Write(w.bytes)
+	return err == nil
+}
+
+func (c *memoryConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		err = nil
+
+		c.network.lock.Lock()
+		delete(c.network.conns, c)
+		c.network.lock.Unlock()
+
+		close(c.closed)
+		_ = c.Conn.SetReadDeadline(time.Now())
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(memoryLinger))
+	})
+
+	return err
+}
+
+func (c *memoryConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return memoryAddr(c.local)
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return memoryAddr(c.remote)
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+func (a memoryAddr) Network() string {
+	return memoryNetwork
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// memoryAddress returns the address in the form used by the listeners, local hosts are all the same host
+func memoryAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if host == localhost || host == localhostDecimalPointed {
+		host = ""
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+func partitionKey(a, b string) [2]string {
+	a, b = memoryAddress(a), memoryAddress(b)
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]string{a, b}
+}
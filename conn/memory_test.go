@@ -0,0 +1,417 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"github/timtimjnvr/chat/crdt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryNetwork_Connect(t *testing.T) {
+	var (
+		network   = NewMemoryNetwork()
+		server    = network.Transport("127.0.0.1:9001")
+		client    = network.Transport("127.0.0.1:9002")
+		serverMsg = []byte("hello from server")
+		clientMsg = []byte("hello from client")
+	)
+
+	_, err := client.Dial("127.0.0.1:9001")
+	assert.True(t, errors.Is(err, ConnectionRefusedErr))
+
+	ln, err := server.Listen("127.0.0.1:9001")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	_, err = client.Listen("localhost:9001")
+	assert.True(t, errors.Is(err, AddressInUseErr))
+
+	// local hosts are the same host
+	clientConn, err := client.Dial(":9001")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	serverConn, err := ln.Accept()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, ":9002", serverConn.RemoteAddr().String())
+	assert.Equal(t, ":9001", clientConn.RemoteAddr().String())
+
+	// both ends write before reading : writes don't wait for the other end like on a bare net.Pipe
+	for _, c := range []net.Conn{serverConn, clientConn} {
+		err = c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		assert.Nil(t, err)
+	}
+
+	_, err = serverConn.Write(serverMsg)
+	assert.Nil(t, err)
+	_, err = clientConn.Write(clientMsg)
+	assert.Nil(t, err)
+
+	assert.Equal(t, clientMsg, helperRead(t, serverConn, len(clientMsg)))
+	assert.Equal(t, serverMsg, helperRead(t, clientConn, len(serverMsg)))
+
+	// what is written before closing is still delivered
+	_, err = clientConn.Write(clientMsg)
+	assert.Nil(t, err)
+	assert.Nil(t, clientConn.Close())
+
+	assert.Equal(t, clientMsg, helperRead(t, serverConn, len(clientMsg)))
+	_, err = serverConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	serverConn.Close()
+
+	// closing interrupts the pending reads
+	clientConn, err = client.Dial(":9001")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	read := make(chan error)
+	go func() {
+		_, err := clientConn.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	clientConn.Close()
+	select {
+	case <-time.After(time.Second):
+		assert.Fail(t, "test timeout")
+	case err = <-read:
+		assert.True(t, errors.Is(err, net.ErrClosed))
+	}
+
+	// connections waiting to be accepted are closed with the listener
+	clientConn, err = client.Dial(":9001")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer clientConn.Close()
+
+	assert.Nil(t, ln.Close())
+	_, err = ln.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	_, err = client.Dial(":9001")
+	assert.True(t, errors.Is(err, ConnectionRefusedErr))
+}
+
+func TestMemoryNetwork_Faults(t *testing.T) {
+	network := NewMemoryNetwork()
+	serverConn, clientConn, err := helperGetMemoryConnections(network, ":9001", ":9002")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// lost writes
+	network.SetFaults(Faults{Drop: 1})
+	_, err = clientConn.Write([]byte("lost"))
+	assert.Nil(t, err)
+
+	err = serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	assert.Nil(t, err)
+	_, err = serverConn.Read(make([]byte, 4))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	err = serverConn.SetReadDeadline(time.Time{})
+	assert.Nil(t, err)
+
+	// latency
+	const delay = 100 * time.Millisecond
+	network.SetFaults(Faults{Delay: delay})
+
+	sent := time.Now()
+	_, err = clientConn.Write([]byte("late"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []byte("late"), helperRead(t, serverConn, 4))
+	assert.GreaterOrEqual(t, time.Since(sent), delay)
+}
+
+func TestMemoryNetwork_Partition(t *testing.T) {
+	var (
+		network = NewMemoryNetwork()
+		other   = network.Transport(":9003")
+	)
+
+	serverConn, clientConn, err := helperGetMemoryConnections(network, ":9001", ":9002")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer serverConn.Close()
+
+	ln, err := network.Transport(":9001").Listen(":9001")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	// the connections between the nodes are closed
+	network.Partition(":9001", "127.0.0.1:9002")
+
+	_, err = serverConn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = clientConn.Write([]byte("lost"))
+	assert.True(t, errors.Is(err, net.ErrClosed))
+
+	_, err = network.Transport(":9002").Dial(":9001")
+	assert.True(t, errors.Is(err, PartitionedErr))
+
+	// other nodes are not concerned
+	c, err := other.Dial(":9001")
+	if assert.Nil(t, err) {
+		c.Close()
+	}
+
+	network.Heal(":9002", ":9001")
+	c, err = network.Transport(":9002").Dial(":9001")
+	if assert.Nil(t, err) {
+		c.Close()
+	}
+}
+
+func TestNodeHandler_MemoryNetwork(t *testing.T) {
+	var (
+		network = NewMemoryNetwork()
+		storage = helperNodeStorage{}
+		a       = helperStartMemoryNode(t, network, storage, "9001", "a")
+		b       = helperStartMemoryNode(t, network, storage, "9002", "b")
+	)
+
+	defer a.stop()
+	defer b.stop()
+
+	// a joins a chat through b over a TLS connection
+	a.connectionRequests <- NewConnectionRequest(b.infos.Port, b.infos.Address, "room")
+	join := helperWaitOperation(t, b.toExecute, crdt.JoinChatByName)
+	assert.Equal(t, a.infos.Id, join.Node)
+
+	helperExchangeMessage(t, b, a)
+
+	// the nodes reconnect once the partition is healed
+	network.Partition(net.JoinHostPort(a.infos.Address, a.infos.Port), net.JoinHostPort(b.infos.Address, b.infos.Port))
+	time.Sleep(50 * time.Millisecond)
+	network.Heal(net.JoinHostPort(a.infos.Address, a.infos.Port), net.JoinHostPort(b.infos.Address, b.infos.Port))
+
+	// the first node to reconnect asks to exchange the messages sent in the meantime, once its attempts are reported
+	timeout := time.After(2 * time.Second)
+	for synced := false; !synced; {
+		var op *crdt.Operation
+		select {
+		case <-timeout:
+			assert.Fail(t, "test timeout")
+			return
+		case op = <-a.toExecute:
+		case op = <-b.toExecute:
+		}
+
+		if op.Typology != crdt.ConnectionStatus {
+			assert.Equal(t, crdt.SyncNode, op.Typology)
+			synced = true
+		}
+	}
+
+	helperExchangeMessage(t, a, b)
+}
+
+func TestNodeHandler_Shutdown(t *testing.T) {
+	var (
+		network = NewMemoryNetwork()
+		storage = helperNodeStorage{}
+		a       = helperStartMemoryNode(t, network, storage, "9001", "a")
+		b       = helperStartMemoryNode(t, network, storage, "9002", "b")
+	)
+
+	defer b.stop()
+
+	a.connectionRequests <- NewConnectionRequest(b.infos.Port, b.infos.Address, "room")
+	helperWaitOperation(t, b.toExecute, crdt.JoinChatByName)
+	helperExchangeMessage(t, b, a)
+
+	// the last operations are delivered and the peer closes the connection on KillNode
+	// without waiting for the shutdown timeout
+	message := crdt.NewOperation(crdt.AddMessage, "room", &crdt.Message{Content: "Bye"})
+	message.Node = b.infos.Id
+	a.toSend <- message
+	a.toSend <- crdt.NewOperation(crdt.KillNode, "", nil)
+
+	stopping := time.Now()
+	a.stop()
+	assert.Less(t, time.Since(stopping), DefaultShutdownTimeout)
+
+	received := helperWaitOperation(t, b.toExecute, crdt.AddMessage)
+	assert.Equal(t, a.infos.Id, received.Node)
+	helperWaitOperation(t, b.toExecute, crdt.KillNode)
+}
+
+func TestNodeHandler_RoomsRequest(t *testing.T) {
+	var (
+		network = NewMemoryNetwork()
+		storage = helperNodeStorage{}
+		a       = helperStartMemoryNode(t, network, storage, "9001", "a")
+		b       = helperStartMemoryNode(t, network, storage, "9002", "b")
+	)
+
+	defer a.stop()
+	defer b.stop()
+
+	// the node asking for the rooms is identified by its request
+	a.connectionRequests <- NewRoomsRequest(b.infos.Port, b.infos.Address)
+	request := helperWaitOperation(t, b.toExecute, crdt.ListRemoteChats)
+	assert.Equal(t, a.infos.Id, request.Node)
+
+	rooms := crdt.NewOperation(crdt.RemoteChats, "", &crdt.RoomList{Host: "b", Rooms: []crdt.Room{{Name: "room", Members: 1}}})
+	rooms.Node = a.infos.Id
+	b.toSend <- rooms
+
+	disconnect := crdt.NewOperation(crdt.Disconnect, "", nil)
+	disconnect.Node = a.infos.Id
+	b.toSend <- disconnect
+
+	received := helperWaitOperation(t, a.toExecute, crdt.RemoteChats)
+	assert.Equal(t, b.infos.Id, received.Node)
+	assert.Equal(t, rooms.Data, received.Data)
+
+	// the connection is closed without reconnecting
+	select {
+	case op := <-a.toExecute:
+		assert.Fail(t, "unexpected operation", crdt.GetOperationName(op.Typology))
+	case op := <-b.toExecute:
+		assert.Fail(t, "unexpected operation", crdt.GetOperationName(op.Typology))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+type helperMemoryNode struct {
+	infos              *crdt.NodeInfos
+	connectionRequests chan ConnectionRequest
+	toSend             chan *crdt.Operation
+	toExecute          chan *crdt.Operation
+	stop               func()
+}
+
+// test helper starting the connections and the node handler of a node listening on port in the network,
+// the node is added to storage
+func helperStartMemoryNode(t *testing.T, network *MemoryNetwork, storage helperNodeStorage, port, name string) *helperMemoryNode {
+	var (
+		identity  = helperNewIdentity(t)
+		infos     = helperNewNodeInfos(identity, port, name)
+		security  = helperNewTLS(t)
+		transport = network.Transport(net.JoinHostPort(infos.Address, port))
+		listening = make(chan struct{})
+		handling  = make(chan struct{})
+
+		ctx, cancel = context.WithCancel(context.Background())
+
+		newConnections = make(chan net.Conn)
+		n              = &helperMemoryNode{
+			infos:              infos,
+			connectionRequests: make(chan ConnectionRequest),
+			toSend:             make(chan *crdt.Operation),
+			toExecute:          make(chan *crdt.Operation, 10),
+		}
+	)
+
+	infos.Fingerprint = security.Fingerprint()
+	storage[infos.Id] = infos
+
+	nh := NewNodeHandler(transport, storage, infos, identity, security)
+	nh.backoff = Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond, MaxAttempts: 100}
+
+	ln, err := Listen(transport, security, infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer close(listening)
+		CreateConnections(ctx, ln, transport, infos, identity, security, n.connectionRequests, newConnections)
+	}()
+
+	go func() {
+		defer close(handling)
+		nh.Start(ctx, newConnections, n.toSend, n.toExecute)
+	}()
+
+	n.stop = func() {
+		cancel()
+		close(n.toSend)
+		<-listening
+		<-handling
+	}
+
+	return n
+}
+
+// test helper sending a message from a node to another one and checking it is received
+func helperExchangeMessage(t *testing.T, from, to *helperMemoryNode) {
+	message := crdt.NewOperation(crdt.AddMessage, "room", &crdt.Message{Content: "Hi"})
+	message.Node = to.infos.Id
+	from.toSend <- message
+
+	received := helperWaitOperation(t, to.toExecute, crdt.AddMessage)
+	assert.Equal(t, from.infos.Id, received.Node)
+	assert.Nil(t, received.VerifyAuthor(from.infos.Id))
+}
+
+// test helper returning two linked in-memory connections between the nodes listening on serverAddress and clientAddress
+func helperGetMemoryConnections(network *MemoryNetwork, serverAddress, clientAddress string) (net.Conn, net.Conn, error) {
+	ln, err := network.Transport(serverAddress).Listen(serverAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer ln.Close()
+
+	clientConn, err := network.Transport(clientAddress).Dial(serverAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverConn, err := ln.Accept()
+	if err != nil {
+		clientConn.Close()
+		return nil, nil, err
+	}
+
+	return serverConn, clientConn, nil
+}
+
+// test helper reading size bytes on c
+func helperRead(t *testing.T, c net.Conn, size int) []byte {
+	err := c.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.SetReadDeadline(time.Time{})
+
+	bytes := make([]byte, size)
+	_, err = io.ReadFull(c, bytes)
+	assert.Nil(t, err)
+	return bytes
+}
@@ -0,0 +1,108 @@
+package conn
+
+import (
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Backoff is the policy used to open again the connection with a node after it dropped.
+	// The delay before each attempt doubles from Initial up to Max and is randomized by ± Jitter (fraction of the delay)
+	// so that the nodes of a chat don't all reconnect at the same time.
+	Backoff struct {
+		Initial     time.Duration
+		Max         time.Duration
+		Jitter      float64
+		MaxAttempts int // the node is unreachable once all the attempts failed
+	}
+
+	// reconnection is the result of the reconnection to a node, conn is nil if the node is unreachable or left
+	reconnection struct {
+		nodeID  uuid.UUID
+		conn    net.Conn
+		left    bool // the node is not in the storage anymore
+		dropped bool // the node was connected : the connection dropped, otherwise it is opened to send operations
+		cancel  chan struct{}
+	}
+)
+
+var (
+	DefaultBackoff = Backoff{
+		Initial:     500 * time.Millisecond,
+		Max:         30 * time.Second,
+		Jitter:      0.2,
+		MaxAttempts: 10,
+	}
+
+	// ConnectBackoff is the policy used to open a connection with a node we have operations for
+	ConnectBackoff = Backoff{MaxAttempts: 1}
+)
+
+// Status of the connection with a node reported to the orchestrator, see crdt.ConnectionStatus
+const (
+	stoppedAnsweringStatus = "stopped answering"
+	unreachableStatus      = "unreachable"
+	connectingStatus       = "connecting (attempt %d/%d)"
+)
+
+// delay returns the time to wait before the attempt (starting at 1)
+func (b Backoff) delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+
+	if delay > b.Max {
+		delay = b.Max
+	}
+
+	jitter := (rand.Float64()*2 - 1) * b.Jitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
+
+// reconnect opens the connection with the node of r until it succeeds, the attempts of the backoff are exhausted,
+// the node left or r.cancel is closed. Each attempt is reported to reports and r is sent to reconnections with the
+// result unless r.cancel is closed.
+func (d *NodeHandler) reconnect(wg *sync.WaitGroup, r reconnection, backoff Backoff, reconnections chan<- reconnection, reports chan<- *crdt.Operation) {
+	defer wg.Done()
+
+	for attempt := 1; attempt <= backoff.MaxAttempts && r.conn == nil && !r.left; attempt++ {
+		select {
+		case <-r.cancel:
+			return
+		case <-time.After(backoff.delay(attempt)):
+		}
+
+		// the node may have left in the meantime
+		nodeInfos, err := d.nodeStorage.GetNode(r.nodeID)
+		if err != nil {
+			r.left = true
+			continue
+		}
+
+		select {
+		case reports <- newStatusReport(r.nodeID, fmt.Sprintf(connectingStatus, attempt, backoff.MaxAttempts)):
+		case <-r.cancel:
+			return
+		}
+
+		c, err := openConnection(d.transport, d.security, nodeInfos.Address, nodeInfos.Port, nodeInfos.Fingerprint)
+		if err == nil {
+			r.conn = c
+		}
+	}
+
+	select {
+	case reconnections <- r:
+	case <-r.cancel:
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package conn
+
+import (
+	"bufio"
+	"errors"
+	"github/timtimjnvr/chat/crdt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type helperNodeStorage map[uuid.UUID]*crdt.NodeInfos
+
+func (s helperNodeStorage) GetNode(nodeID uuid.UUID) (*crdt.NodeInfos, error) {
+	infos, ok := s[nodeID]
+	if !ok {
+		return nil, errors.New("unknown node")
+	}
+
+	return infos, nil
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Jitter: 0.2, MaxAttempts: 10}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: 100 * time.Millisecond},
+		{attempt: 2, expected: 200 * time.Millisecond},
+		{attempt: 4, expected: 800 * time.Millisecond},
+		{attempt: 5, expected: time.Second},
+		{attempt: 100, expected: time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			delay := backoff.delay(tt.attempt)
+			assert.GreaterOrEqual(t, delay, tt.expected*8/10)
+			assert.LessOrEqual(t, delay, tt.expected*12/10)
+		}
+	}
+}
+
+func TestNodeHandler_Reconnect(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12367", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12368", "peer")
+		nh                       = NewNodeHandler(TCPTransport{}, helperNodeStorage{peerInfos.Id: peerInfos}, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	nh.backoff = Backoff{Initial: 20 * time.Millisecond, Max: 50 * time.Millisecond, Jitter: 0.2, MaxAttempts: 100}
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	ln, err := net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	c, err := net.Dial(transportProtocol, ln.Addr().String())
+	if !assert.Nil(t, err) {
+		ln.Close()
+		return
+	}
+
+	newConnections <- c
+	peerConn, err := helperAcceptPeer(ln, peerIdentity, peerInfos)
+	if !assert.Nil(t, err) {
+		ln.Close()
+		return
+	}
+
+	// the connection is identified once the operations of the peer are received
+	assert.Equal(t, crdt.AddMessage, helperWaitOperation(t, toExecute, crdt.AddMessage).Typology)
+
+	// the peer goes down for a few attempts
+	ln.Close()
+	peerConn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	ln, err = net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	peerConn, err = helperAcceptPeer(ln, peerIdentity, peerInfos)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer peerConn.Close()
+
+	syncNode := helperWaitOperation(t, toExecute, crdt.SyncNode)
+	if assert.NotNil(t, syncNode) {
+		assert.Equal(t, peerInfos.Id, syncNode.Node)
+	}
+}
+
+func TestNodeHandler_Unreachable(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12367", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12369", "peer")
+		nh                       = NewNodeHandler(TCPTransport{}, helperNodeStorage{peerInfos.Id: peerInfos}, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	nh.backoff = Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond, MaxAttempts: 3}
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	ln, err := net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	c, err := net.Dial(transportProtocol, ln.Addr().String())
+	if !assert.Nil(t, err) {
+		ln.Close()
+		return
+	}
+
+	newConnections <- c
+	peerConn, err := helperAcceptPeer(ln, peerIdentity, peerInfos)
+	if !assert.Nil(t, err) {
+		ln.Close()
+		return
+	}
+
+	assert.Equal(t, crdt.AddMessage, helperWaitOperation(t, toExecute, crdt.AddMessage).Typology)
+
+	// the peer never comes back : it is killed once the attempts are exhausted
+	ln.Close()
+	peerConn.Close()
+
+	var statuses []string
+	for len(statuses) < 4 {
+		report := helperWaitOperation(t, toExecute, crdt.ConnectionStatus)
+		status, ok := report.Data.(*crdt.NodeStatus)
+		if !assert.True(t, ok) {
+			return
+		}
+
+		assert.Equal(t, peerInfos.Id, report.Node)
+		assert.Empty(t, report.Signature)
+		statuses = append(statuses, status.Status)
+	}
+
+	assert.Equal(t, []string{"connecting (attempt 1/3)", "connecting (attempt 2/3)", "connecting (attempt 3/3)", "unreachable"}, statuses)
+
+	killNode := helperWaitOperation(t, toExecute, crdt.KillNode)
+	if assert.NotNil(t, killNode) {
+		assert.Equal(t, peerInfos.Id, killNode.Node)
+		assert.Empty(t, killNode.Signature)
+	}
+}
+
+// test helper accepting the connection of the node handler on behalf of the peer : the peer reads the Hello
+// of the node handler then introduces itself and sends a message
+func helperAcceptPeer(ln net.Listener, identity *crdt.Identity, infos *crdt.NodeInfos) (net.Conn, error) {
+	c, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.SetDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(c)
+	scanner.Split(crdt.ScanFrames)
+	if !scanner.Scan() {
+		c.Close()
+		return nil, errors.New("no hello received")
+	}
+
+	hello, err := crdt.DecodeOperation(scanner.Bytes())
+	if err != nil || hello.Typology != crdt.Hello {
+		c.Close()
+		return nil, errors.New("invalid hello received")
+	}
+
+	for _, op := range []*crdt.Operation{
+		crdt.NewOperation(crdt.Hello, "", infos),
+		crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"}),
+	} {
+		_, err = c.Write(helperSign(identity, op).ToBytes())
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, c.SetDeadline(time.Time{})
+}
+
+// test helper returning the first operation of the typology executed, other operations are skipped
+func helperWaitOperation(t *testing.T, toExecute <-chan *crdt.Operation, typology crdt.OperationType) *crdt.Operation {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			assert.Fail(t, "test timeout", crdt.GetOperationName(typology))
+			return &crdt.Operation{}
+		case op := <-toExecute:
+			if op.Typology == typology {
+				return op
+			}
+		}
+	}
+}
+
+func TestNodeHandler_ConnectOnDemand(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12367", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12373", "peer")
+		nh                       = NewNodeHandler(TCPTransport{}, helperNodeStorage{peerInfos.Id: peerInfos}, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	nh.backoff = Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond, MaxAttempts: 10}
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	ln, err := net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	// operations for a node we are not connected to open a connection with it
+	message := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"})
+	message.Node = peerInfos.Id
+	toSend <- message
+
+	c, err := ln.Accept()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Split(crdt.ScanFrames)
+	for _, typology := range []crdt.OperationType{crdt.Hello, crdt.AddMessage} {
+		if !assert.True(t, scanner.Scan()) {
+			return
+		}
+
+		op, err := crdt.DecodeOperation(scanner.Bytes())
+		if assert.Nil(t, err) {
+			assert.Equal(t, typology, op.Typology)
+			assert.Nil(t, op.VerifyAuthor(myInfos.Id))
+		}
+	}
+
+	syncNode := helperWaitOperation(t, toExecute, crdt.SyncNode)
+	assert.Equal(t, peerInfos.Id, syncNode.Node)
+
+	// the connection is released : the node handler does not reconnect once the peer closed it
+	disconnect := crdt.NewOperation(crdt.Disconnect, "", nil)
+	disconnect.Node = peerInfos.Id
+	toSend <- disconnect
+
+	if assert.True(t, scanner.Scan()) {
+		assert.Equal(t, crdt.Disconnect, crdt.FrameTypology(scanner.Bytes()))
+	}
+
+	c.Close()
+
+	err = ln.(*net.TCPListener).SetDeadline(time.Now().Add(300 * time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = ln.Accept()
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "unexpected reconnection")
+}
+
+func TestNodeHandler_ConnectOnDemandFailure(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12369", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12376", "peer")
+		nh                       = NewNodeHandler(TCPTransport{}, helperNodeStorage{peerInfos.Id: peerInfos}, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	// nothing listens on the port of the peer : the operation is dropped
+	message := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"})
+	message.Node = peerInfos.Id
+	toSend <- message
+
+	var report *crdt.Operation
+	for failed := false; !failed; {
+		report = helperWaitOperation(t, toExecute, crdt.ConnectionStatus)
+		status, ok := report.Data.(*crdt.NodeStatus)
+		failed = !ok || status.Failed
+	}
+
+	assert.Equal(t, peerInfos.Id, report.Node)
+
+	// the peer was never connected : it is not killed for a single failed dial
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case <-timeout:
+			return
+		case op := <-toExecute:
+			assert.NotEqual(t, crdt.KillNode, op.Typology)
+		}
+	}
+}
+
+func TestNodeHandler_ConnectAfterLeaving(t *testing.T) {
+	var (
+		myIdentity, peerIdentity = helperNewIdentity(t), helperNewIdentity(t)
+		myInfos                  = helperNewNodeInfos(myIdentity, "12368", "me")
+		peerInfos                = helperNewNodeInfos(peerIdentity, "12374", "peer")
+		storage                  = &helperLeavingStorage{infos: peerInfos, leftAt: 2}
+		nh                       = NewNodeHandler(TCPTransport{}, storage, myInfos, myIdentity, nil)
+		newConnections           = make(chan net.Conn)
+		toSend                   = make(chan *crdt.Operation)
+		toExecute                = make(chan *crdt.Operation, 10)
+	)
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	// the node leaves before the connection is opened
+	message := crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"})
+	message.Node = peerInfos.Id
+	toSend <- message
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case op := <-toExecute:
+		assert.Fail(t, "unexpected operation", crdt.GetOperationName(op.Typology))
+	default:
+	}
+
+	ln, err := net.Listen(transportProtocol, net.JoinHostPort(peerInfos.Address, peerInfos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer ln.Close()
+
+	// the node is known again : the connection is opened
+	toSend <- message
+
+	err = ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	c, err := ln.Accept()
+	if assert.Nil(t, err, "no connection opened") {
+		c.Close()
+	}
+}
+
+// test helper : a storage knowing a single node, except for its lookup number leftAt
+type helperLeavingStorage struct {
+	lock    sync.Mutex
+	infos   *crdt.NodeInfos
+	lookups int
+	leftAt  int
+}
+
+func (s *helperLeavingStorage) GetNode(nodeID uuid.UUID) (*crdt.NodeInfos, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lookups++
+	if nodeID != s.infos.Id || s.lookups == s.leftAt {
+		return nil, errors.New("unknown node")
+	}
+
+	return s.infos, nil
+}
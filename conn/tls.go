@@ -0,0 +1,353 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// TLS encrypts the connections with the other nodes. Nodes use self-signed certificates :
+	// the fingerprint of the certificate travels in crdt.NodeInfos and the first fingerprint seen
+	// for a node id is pinned (trust on first use). A nil *TLS means plain connections.
+	TLS struct {
+		certificate tls.Certificate
+		fingerprint string
+
+		pinsLock *sync.Mutex
+		pins     map[uuid.UUID]string // node id -> pinned fingerprint
+		pinsFile string               // pins are kept in memory only if empty
+	}
+)
+
+const (
+	certificateFileName = "node.crt"
+	keyFileName         = "node.key"
+	pinsFileName        = "known_nodes"
+
+	certificateValidity = 10 * 365 * 24 * time.Hour
+	handshakeTimeout    = 5 * time.Second
+)
+
+var (
+	NotTLSConnErr          = errors.New("not a TLS connection")
+	NoPeerCertificateErr   = errors.New("no certificate presented by the peer")
+	FingerprintMismatchErr = errors.New("certificate fingerprint does not match the node infos")
+	PinMismatchErr         = errors.New("certificate differs from the one pinned for this node")
+)
+
+// NewTLS generates a self-signed certificate kept in memory only
+func NewTLS() (*TLS, error) {
+	certPEM, keyPEM, err := generateCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return newTLS(certPEM, keyPEM, "")
+}
+
+// LoadOrCreateTLS loads the certificate and the pinned fingerprints saved in dir.
+// A self-signed certificate is generated and saved on first use.
+func LoadOrCreateTLS(dir string) (*TLS, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		certFile = filepath.Join(dir, certificateFileName)
+		keyFile  = filepath.Join(dir, keyFileName)
+	)
+
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		certPEM, keyPEM, err = generateCertificate()
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(keyFile, keyPEM, 0o600)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(certFile, certPEM, 0o600)
+		if err != nil {
+			return nil, err
+		}
+	} else if certErr != nil {
+		return nil, certErr
+	} else if keyErr != nil {
+		return nil, keyErr
+	}
+
+	t, err := newTLS(certPEM, keyPEM, filepath.Join(dir, pinsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.loadPins()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newTLS(certPEM, keyPEM []byte, pinsFile string) (*TLS, error) {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLS{
+		certificate: certificate,
+		fingerprint: Fingerprint(certificate.Certificate[0]),
+		pinsLock:    &sync.Mutex{},
+		pins:        make(map[uuid.UUID]string),
+		pinsFile:    pinsFile,
+	}, nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 of a DER encoded certificate
+func Fingerprint(certificate []byte) string {
+	sum := sha256.Sum256(certificate)
+	return hex.EncodeToString(sum[:])
+}
+
+// Fingerprint returns the fingerprint of the node certificate, empty for plain TCP connections
+func (t *TLS) Fingerprint() string {
+	if t == nil {
+		return ""
+	}
+
+	return t.fingerprint
+}
+
+// listen accepts the connections of the transport, the TLS handshake is completed by handshake
+func (t *TLS) listen(transport Transport, address string) (net.Listener, error) {
+	ln, err := transport.Listen(address)
+	if err != nil || t == nil {
+		return ln, err
+	}
+
+	return tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{t.certificate},
+		// certificates are self-signed : they are checked against the node infos in verify
+		ClientAuth: tls.RequireAnyClientCert,
+		MinVersion: tls.VersionTLS13,
+	}), nil
+}
+
+// dial opens a connection with the transport, expectedFingerprint is checked during the handshake if not empty
+func (t *TLS) dial(transport Transport, address string, expectedFingerprint string) (net.Conn, error) {
+	conn, err := transport.Dial(address)
+	if err != nil || t == nil {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		Certificates: []tls.Certificate{t.certificate},
+		// certificates are self-signed : they are checked against the node infos in verify
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if expectedFingerprint == "" {
+				return nil
+			}
+
+			if len(state.PeerCertificates) == 0 {
+				return NoPeerCertificateErr
+			}
+
+			if Fingerprint(state.PeerCertificates[0].Raw) != expectedFingerprint {
+				return FingerprintMismatchErr
+			}
+
+			return nil
+		},
+	})
+
+	err = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+
+	if err == nil {
+		err = tlsConn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// handshake completes the TLS handshake of an accepted connection : the node dialing waits for it
+// and the node handler would otherwise do it on its first write. The handshake is aborted once ctx is done.
+func (t *TLS) handshake(ctx context.Context, conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if t == nil || !ok {
+		return nil
+	}
+
+	err := tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+// verify checks that the peer of conn presented the certificate announced in its node infos
+// and pins the fingerprint for the node id the first time it is seen
+func (t *TLS) verify(conn net.Conn, infos *crdt.NodeInfos) error {
+	if t == nil {
+		return nil
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return NotTLSConnErr
+	}
+
+	// the node infos were read from the connection : the handshake is done
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return NoPeerCertificateErr
+	}
+
+	fingerprint := Fingerprint(certificates[0].Raw)
+	if fingerprint != infos.Fingerprint {
+		return FingerprintMismatchErr
+	}
+
+	t.pinsLock.Lock()
+	defer t.pinsLock.Unlock()
+
+	pinned, ok := t.pins[infos.Id]
+	if ok {
+		if pinned != fingerprint {
+			return PinMismatchErr
+		}
+
+		return nil
+	}
+
+	t.pins[infos.Id] = fingerprint
+	return t.savePin(infos.Id, fingerprint)
+}
+
+func (t *TLS) loadPins() error {
+	f, err := os.Open(t.pinsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		id, err := uuid.Parse(fields[0])
+		if err != nil {
+			continue
+		}
+
+		t.pins[id] = fields[1]
+	}
+
+	return scanner.Err()
+}
+
+// savePin expects the caller to hold pinsLock
+func (t *TLS) savePin(id uuid.UUID, fingerprint string) error {
+	if t.pinsFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(t.pinsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s %s\n", id, fingerprint)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// generateCertificate returns a PEM encoded self-signed certificate and its private key
+func generateCertificate() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "chat node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,283 @@
+package conn
+
+import (
+	"context"
+	"github/timtimjnvr/chat/crdt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLS_Connect(t *testing.T) {
+	server, client := helperNewTLS(t), helperNewTLS(t)
+
+	serverConn, clientConn, err := helperGetTLSConnections("12360", server, client, server.Fingerprint())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	_, err = clientConn.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	message := make([]byte, 5)
+	_, err = serverConn.Read(message)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(message))
+
+	var (
+		clientInfos = &crdt.NodeInfos{Id: crdt.NewNodeInfos("", "", "client").Id, Fingerprint: client.Fingerprint()}
+		serverInfos = &crdt.NodeInfos{Id: crdt.NewNodeInfos("", "", "server").Id, Fingerprint: server.Fingerprint()}
+	)
+
+	assert.Nil(t, server.verify(serverConn, clientInfos))
+	assert.Nil(t, client.verify(clientConn, serverInfos))
+
+	// infos announcing a certificate the peer did not present
+	assert.ErrorIs(t, server.verify(serverConn, &crdt.NodeInfos{Id: clientInfos.Id, Fingerprint: server.Fingerprint()}), FingerprintMismatchErr)
+}
+
+func TestTLS_DialPinnedFingerprint(t *testing.T) {
+	server, client := helperNewTLS(t), helperNewTLS(t)
+
+	// the node listening on the port is not the expected one
+	_, _, err := helperGetTLSConnections("12361", server, client, client.Fingerprint())
+	assert.ErrorIs(t, err, FingerprintMismatchErr)
+}
+
+func TestTLS_PinMismatch(t *testing.T) {
+	var (
+		server   = helperNewTLS(t)
+		id       = crdt.NewNodeInfos("", "", "client").Id
+		previous = helperNewTLS(t)
+		other    = helperNewTLS(t)
+	)
+
+	for i, client := range []*TLS{previous, other} {
+		serverConn, clientConn, err := helperGetTLSConnections("12362", server, client, "")
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		_, err = clientConn.Write([]byte("x"))
+		assert.Nil(t, err)
+		_, err = serverConn.Read(make([]byte, 1))
+		assert.Nil(t, err)
+
+		// the same node id comes back with another certificate
+		err = server.verify(serverConn, &crdt.NodeInfos{Id: id, Fingerprint: client.Fingerprint()})
+		if i == 0 {
+			assert.Nil(t, err)
+		} else {
+			assert.ErrorIs(t, err, PinMismatchErr)
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+func TestCreateConnections_SlowHandshake(t *testing.T) {
+	var (
+		server, client = helperNewTLS(t), helperNewTLS(t)
+		infos          = &crdt.NodeInfos{Port: "12375"}
+		newConnections = make(chan net.Conn)
+		stopped        = make(chan struct{})
+	)
+
+	ln, err := Listen(TCPTransport{}, server, infos)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(stopped)
+		CreateConnections(ctx, ln, TCPTransport{}, infos, nil, server, make(chan ConnectionRequest), newConnections)
+	}()
+
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// a peer connects but never starts the handshake
+	silent, err := net.Dial(transportProtocol, net.JoinHostPort("", infos.Port))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer silent.Close()
+
+	c, err := client.dial(TCPTransport{}, net.JoinHostPort("", infos.Port), server.Fingerprint())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer c.Close()
+
+	select {
+	case <-time.After(handshakeTimeout / 2):
+		assert.Fail(t, "the silent peer delayed the other connections")
+	case accepted := <-newConnections:
+		accepted.Close()
+	}
+}
+
+func TestLoadOrCreateTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	created, err := LoadOrCreateTLS(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	client := helperNewTLS(t)
+	serverConn, clientConn, err := helperGetTLSConnections("12363", created, client, created.Fingerprint())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = clientConn.Write([]byte("x"))
+	assert.Nil(t, err)
+	_, err = serverConn.Read(make([]byte, 1))
+	assert.Nil(t, err)
+
+	clientInfos := &crdt.NodeInfos{Id: crdt.NewNodeInfos("", "", "client").Id, Fingerprint: client.Fingerprint()}
+	assert.Nil(t, created.verify(serverConn, clientInfos))
+	serverConn.Close()
+	clientConn.Close()
+
+	// same certificate and pins after a restart
+	loaded, err := LoadOrCreateTLS(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, created.Fingerprint(), loaded.Fingerprint())
+	assert.Equal(t, map[string]string{clientInfos.Id.String(): client.Fingerprint()}, helperPins(loaded))
+}
+
+func TestNodeHandler_TLSRejectsForgedHello(t *testing.T) {
+	var (
+		server, client = helperNewTLS(t), helperNewTLS(t)
+		myIdentity     = helperNewIdentity(t)
+		peerIdentity   = helperNewIdentity(t)
+		myInfos        = helperNewNodeInfos(myIdentity, "12364", "me")
+		peerInfos      = helperNewNodeInfos(peerIdentity, "12365", "peer")
+	)
+
+	serverConn, clientConn, err := helperGetTLSConnections("12364", server, client, server.Fingerprint())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var (
+		output     = make(chan frame, maxMessageSize)
+		done       = make(chan slot, 1)
+		nodeReader = newNode(clientConn, 1, output)
+	)
+
+	nodeReader.Wg.Add(1)
+	go nodeReader.start(done)
+
+	var (
+		nh             = NewNodeHandler(TCPTransport{}, helperNodeStorage{}, myInfos, myIdentity, server)
+		newConnections = make(chan net.Conn)
+		toSend         = make(chan *crdt.Operation)
+		toExecute      = make(chan *crdt.Operation)
+	)
+
+	wait := helperStartNodeHandler(nh, newConnections, toSend, toExecute)
+	defer func() {
+		close(toSend)
+		wait()
+	}()
+
+	newConnections <- serverConn
+
+	// the peer announces a certificate it does not own
+	peerInfos.Fingerprint = server.Fingerprint()
+	nodeReader.Input <- helperSign(peerIdentity, crdt.NewOperation(crdt.Hello, "", peerInfos)).ToBytes()
+	nodeReader.Input <- helperSign(peerIdentity, crdt.NewOperation(crdt.AddMessage, "test-chat", &crdt.Message{Content: "Hi"})).ToBytes()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case op := <-toExecute:
+		assert.Fail(t, "operation of an unverified node executed", crdt.GetOperationName(op.Typology))
+	}
+
+	// the connection is closed by the node handler
+	select {
+	case <-time.After(time.Second):
+		assert.Fail(t, "test timeout")
+	case <-done:
+	}
+
+	nodeReader.stop()
+}
+
+func helperNewTLS(t *testing.T) *TLS {
+	security, err := NewTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return security
+}
+
+func helperPins(security *TLS) map[string]string {
+	security.pinsLock.Lock()
+	defer security.pinsLock.Unlock()
+
+	pins := make(map[string]string)
+	for id, fingerprint := range security.pins {
+		pins[id.String()] = fingerprint
+	}
+
+	return pins
+}
+
+// test helper used to retrieve two linked TLS net.Conn, the client expects the server to present fingerprint
+func helperGetTLSConnections(port string, server, client *TLS, fingerprint string) (net.Conn, net.Conn, error) {
+	ln, err := server.listen(TCPTransport{}, net.JoinHostPort("", port))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		err = server.handshake(context.Background(), c)
+		if err != nil {
+			c.Close()
+			close(accepted)
+			return
+		}
+
+		accepted <- c
+	}()
+
+	clientConn, err := client.dial(TCPTransport{}, net.JoinHostPort("", port), fingerprint)
+	serverConn := <-accepted
+	if err != nil {
+		if serverConn != nil {
+			serverConn.Close()
+		}
+
+		return nil, nil, err
+	}
+
+	return serverConn, clientConn, nil
+}
@@ -0,0 +1,28 @@
+package conn
+
+import (
+	"net"
+	"time"
+)
+
+type (
+	// Transport opens the connections between the nodes, addresses are "host:port" strings.
+	// TLS is added on top of the transport when enabled (see TLS).
+	Transport interface {
+		Dial(address string) (net.Conn, error)
+		Listen(address string) (net.Listener, error)
+	}
+
+	// TCPTransport connects the nodes over TCP
+	TCPTransport struct{}
+)
+
+const dialTimeout = 5 * time.Second
+
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.DialTimeout(transportProtocol, address, dialTimeout)
+}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(transportProtocol, address)
+}
@@ -1,33 +1,85 @@
 package crdt
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"time"
+	"sort"
 )
 
 type (
 	Chat struct {
-		Id         uuid.UUID `json:"id"`
-		Name       string    `json:"name"`
-		nodesSlots []uint8
-		messages   []*Message // ordered by date : 0 being the oldest message, 1 coming after 0 etc ...
+		Id        uuid.UUID `json:"id"`
+		Name      string    `json:"name"`
+		Encrypted bool      `json:"encrypted,omitempty"` // messages content is sealed with the chat key between nodes
+		Gossip    bool      `json:"gossip,omitempty"`    // operations are relayed between neighbors instead of sent to every member
+		Direct    bool      `json:"direct,omitempty"`    // private chat between two nodes (see NewDirectChat), never joined nor relayed
+
+		nodes    []uuid.UUID       // ids of the chat members
+		messages []*Message        // ordered by Message.Before : 0 being the oldest message, 1 coming after 0 etc ...
+		clock    uint64            // highest Lamport timestamp seen in the chat
+		keys     map[uint32][]byte // keys of an encrypted chat by epoch, never saved nor sent in clear
+		epoch    uint32            // epoch of the key used to seal messages, 0 if no key yet
+
+		// edits and deletions received before their message by message id, applied once it is saved (see SaveMessage)
+		pending map[uuid.UUID][]*Message
 	}
 )
 
-var NotFoundErr = errors.New("not found")
+var (
+	NotFoundErr         = errors.New("not found")
+	NotMessageSenderErr = errors.New("only the sender of a message can modify it")
+	MessageDeletedErr   = errors.New("message deleted")
+	OutdatedEditErr     = errors.New("a more recent edit is already saved")
+	NoChatKeyErr        = errors.New("no key to seal or open the messages of the encrypted chat")
+	NotSealedErr        = errors.New("message not sealed in an encrypted chat")
+	MessagePendingErr   = errors.New("message not received yet : the modification is applied once it is")
+)
 
 const maxNumberOfMessages, maxNumberOfNodes = 100, 100
 
+// DirectChatPrefix starts the name of the direct chats, followed by the name of the other node
+const DirectChatPrefix = "@"
+
 func NewChat(name string) *Chat {
 	return &Chat{
-		Id:         uuid.New(),
-		Name:       name,
-		nodesSlots: make([]uint8, 0, maxNumberOfNodes),
-		messages:   make([]*Message, 0, maxNumberOfMessages),
+		Id:       uuid.New(),
+		Name:     name,
+		nodes:    make([]uuid.UUID, 0, maxNumberOfNodes),
+		messages: make([]*Message, 0, maxNumberOfMessages),
+	}
+}
+
+// NewEncryptedChat returns a chat with a first key, its messages are sealed between nodes
+func NewEncryptedChat(name string) (*Chat, error) {
+	c := NewChat(name)
+	c.Encrypted = true
+
+	_, _, err := c.RotateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewDirectChat returns the chat holding the direct messages exchanged by the local node and peer
+func NewDirectChat(myID uuid.UUID, peer *NodeInfos) *Chat {
+	c := NewChat(DirectChatPrefix + peer.Name)
+	c.Id = DirectChatID(myID, peer.Id)
+	c.Direct = true
+	return c
+}
+
+// DirectChatID returns the id of the direct chat between two nodes, the same on both nodes
+func DirectChatID(a, b uuid.UUID) uuid.UUID {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
 	}
+
+	return uuid.NewSHA1(a, b[:])
 }
 
 func (c *Chat) GetID() uuid.UUID {
@@ -38,109 +90,335 @@ func (c *Chat) GetName() string {
 	return c.Name
 }
 
-func (c *Chat) SaveNode(nodeSlot uint8) {
-
-	// check if present
-	for _, s := range c.nodesSlots {
-		if s == nodeSlot {
+// SaveNode adds the node to the members of the chat, the local node is never a member
+func (c *Chat) SaveNode(nodeID uuid.UUID) {
+	for _, id := range c.nodes {
+		if id == nodeID {
 			return
 		}
 	}
 
-	// append if not found
-	c.nodesSlots = append(c.nodesSlots, nodeSlot)
+	c.nodes = append(c.nodes, nodeID)
 }
 
-func (c *Chat) RemoveNode(slot uint8) error {
-	// get index
-	var (
-		index int
-		found bool
-		s     uint8
-	)
+func (c *Chat) RemoveNode(nodeID uuid.UUID) error {
+	for index, id := range c.nodes {
+		if id == nodeID {
+			c.nodes = append(c.nodes[:index:index], c.nodes[index+1:]...)
+			return nil
+		}
+	}
 
-	for index, s = range c.nodesSlots {
-		if s == slot {
-			found = true
-			break
+	return NotFoundErr
+}
+
+// SaveMessage inserts the message in the chat according to the messages order (see Message.Before).
+// A message without Lamport timestamp is a message we send : it is stamped after the last known message.
+// The modifications of the message received before it are applied if they come from its sender.
+func (c *Chat) SaveMessage(message *Message) {
+	if c.ContainsMessage(message) {
+		return
+	}
+
+	if message.Clock == 0 {
+		message.Clock = c.clock + 1
+	}
+
+	if message.Clock > c.clock {
+		c.clock = message.Clock
+	}
+
+	index := sort.Search(len(c.messages), func(i int) bool {
+		return message.Before(c.messages[i])
+	})
+
+	c.messages = append(c.messages, nil)
+	copy(c.messages[index+1:], c.messages[index:])
+	c.messages[index] = message
+
+	modifications := c.pending[message.Id]
+	delete(c.pending, message.Id)
+	for _, m := range modifications {
+		if m.Deleted {
+			_ = c.DeleteMessage(m)
+		} else {
+			_ = c.UpdateMessage(m)
 		}
 	}
+}
 
-	if !found {
+// keep saves a modification received before its message, see SaveMessage
+func (c *Chat) keep(modification *Message) error {
+	if _, ok := c.pending[modification.Id]; !ok && len(c.pending) >= maxNumberOfMessages {
 		return NotFoundErr
 	}
 
-	if index == 0 && len(c.nodesSlots) == 1 {
-		c.nodesSlots = make([]uint8, 0, 0)
-		return nil
+	if c.pending == nil {
+		c.pending = make(map[uuid.UUID][]*Message)
 	}
 
-	if index == 0 && len(c.nodesSlots) > 1 {
-		c.nodesSlots = c.nodesSlots[index+1:]
-		return nil
+	copied := *modification
+	c.pending[modification.Id] = append(c.pending[modification.Id], &copied)
+	return MessagePendingErr
+}
+
+// UpdateMessage replaces the content of a message with the content of edit (last-writer-wins on Message.Edit).
+// An edit without Lamport timestamp is an edit we make : it is stamped after the last known operation.
+// On success, edit is completed with the saved message so that it can be propagated.
+// An edit received before the message is kept until the message is saved and MessagePendingErr is returned.
+func (c *Chat) UpdateMessage(edit *Message) error {
+	message, err := c.getMessage(edit.Id)
+	if errors.Is(err, NotFoundErr) {
+		if edit.Clock == 0 || edit.Edit == 0 {
+			return err
+		}
+
+		if edit.Edit > c.clock {
+			c.clock = edit.Edit
+		}
+
+		return c.keep(edit)
+	}
+
+	if message.NodeId != edit.NodeId {
+		return NotMessageSenderErr
+	}
+
+	if message.Deleted {
+		return MessageDeletedErr
+	}
+
+	if edit.Edit == 0 {
+		edit.Edit = c.clock + 1
 	}
 
-	if index == len(c.nodesSlots)-1 {
-		c.nodesSlots = c.nodesSlots[:len(c.nodesSlots)-1]
-		return nil
+	if edit.Edit > c.clock {
+		c.clock = edit.Edit
 	}
-	var (
-		newNodesSlots = make([]uint8, len(c.nodesSlots)-1)
-		j             int
-	)
-	for i := 0; i <= len(c.nodesSlots)-1; i++ {
-		if i == index {
-			continue
+
+	// concurrent edits of the same sender are ordered by content to converge
+	if edit.Edit < message.Edit || (edit.Edit == message.Edit && edit.Content <= message.Content) {
+		return OutdatedEditErr
+	}
+
+	message.Content = edit.Content
+	message.Edit = edit.Edit
+	message.Key = edit.Key
+	message.Signature = edit.Signature
+	*edit = *message
+
+	return nil
+}
+
+// DeleteMessage replaces the message identified by deletion.Id with a tombstone.
+// On success, deletion is completed with the saved tombstone so that it can be propagated.
+// A deletion received before the message is kept until the message is saved and MessagePendingErr is returned.
+func (c *Chat) DeleteMessage(deletion *Message) error {
+	message, err := c.getMessage(deletion.Id)
+	if errors.Is(err, NotFoundErr) {
+		if deletion.Clock == 0 {
+			return err
 		}
 
-		newNodesSlots[j] = c.nodesSlots[i]
-		j++
+		deletion.Deleted = true
+		return c.keep(deletion)
 	}
 
-	c.nodesSlots = newNodesSlots
+	if message.NodeId != deletion.NodeId {
+		return NotMessageSenderErr
+	}
+
+	if message.Deleted {
+		return MessageDeletedErr
+	}
+
+	message.Content = ""
+	message.Edit = 0
+	message.Deleted = true
+	message.Key = deletion.Key
+	message.Signature = deletion.Signature
+	*deletion = *message
+
 	return nil
 }
 
-func (c *Chat) SaveMessage(message *Message) {
-	if len(c.messages) == 0 {
-		c.messages = append(c.messages, message)
-		return
+// GetMessage returns a copy of the message identified by id
+func (c *Chat) GetMessage(id uuid.UUID) (*Message, error) {
+	message, err := c.getMessage(id)
+	if err != nil {
+		return nil, err
 	}
 
-	messageToSaveDate, _ := time.Parse(time.RFC3339, message.Date)
-	if !c.ContainsMessage(message) {
-		var (
-			i              int
-			messageDate, _ = time.Parse(time.RFC3339, c.messages[i].Date)
-		)
+	copied := *message
+	return &copied, nil
+}
 
-		for messageDate, _ = time.Parse(time.RFC3339, c.messages[i].Date); messageToSaveDate.After(messageDate) && i < len(c.messages); i++ {
-		}
+// GetClock returns the Lamport timestamp of the last operation known in the chat
+func (c *Chat) GetClock() uint64 {
+	return c.clock
+}
 
-		beginning := c.messages[:i]
-		end := c.messages[i:]
-		newMessages := make([]*Message, len(c.messages)+1)
+// GetMessages returns copies of the chat messages (tombstones included) in chat order
+func (c *Chat) GetMessages() []*Message {
+	messages := make([]*Message, 0, len(c.messages))
+	for _, m := range c.messages {
+		copied := *m
+		messages = append(messages, &copied)
+	}
 
-		j := 0
-		if len(beginning) > 0 {
-			var m *Message
-			for j, m = range beginning {
-				newMessages[j] = m
-			}
+	return messages
+}
 
-			j += 1
-		}
+// Copy returns a deep copy of the chat, safe to read while the chat is modified
+func (c *Chat) Copy() *Chat {
+	copied := &Chat{
+		Id:        c.Id,
+		Name:      c.Name,
+		Encrypted: c.Encrypted,
+		Gossip:    c.Gossip,
+		Direct:    c.Direct,
+		nodes:     c.GetNodes(),
+		messages:  c.GetMessages(),
+		clock:     c.clock,
+		epoch:     c.epoch,
+	}
 
-		newMessages[j] = message
+	if c.keys != nil {
+		copied.keys = make(map[uint32][]byte, len(c.keys))
+		for epoch, key := range c.keys {
+			copied.keys[epoch] = key
+		}
+	}
 
-		if len(end) > 0 {
-			for k, m := range end {
-				newMessages[k+j+1] = m
+	if c.pending != nil {
+		copied.pending = make(map[uuid.UUID][]*Message, len(c.pending))
+		for id, modifications := range c.pending {
+			for _, m := range modifications {
+				modification := *m
+				copied.pending[id] = append(copied.pending[id], &modification)
 			}
 		}
+	}
+
+	return copied
+}
+
+// Infos returns a copy of the chat without its messages nor its keys, cheap whatever the size of the history
+func (c *Chat) Infos() *Chat {
+	return &Chat{
+		Id:        c.Id,
+		Name:      c.Name,
+		Encrypted: c.Encrypted,
+		Gossip:    c.Gossip,
+		Direct:    c.Direct,
+		nodes:     c.GetNodes(),
+	}
+}
+
+// RotateKey generates a new key for the chat, used to seal messages from now on
+func (c *Chat) RotateKey() (uint32, []byte, error) {
+	key, err := newChatKey()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.SetKey(c.epoch+1, key)
+	return c.epoch, key, nil
+}
+
+// SetKey saves the key of the epoch, the key of the highest epoch is used to seal messages.
+// Concurrent rotations of the same epoch converge to the greatest key.
+func (c *Chat) SetKey(epoch uint32, key []byte) {
+	if c.keys == nil {
+		c.keys = make(map[uint32][]byte)
+	}
+
+	if previous, ok := c.keys[epoch]; ok && bytes.Compare(previous, key) >= 0 {
+		return
+	}
+
+	c.keys[epoch] = key
+	if epoch > c.epoch {
+		c.epoch = epoch
+	}
+}
+
+// GetKey returns the key used to seal messages and its epoch
+func (c *Chat) GetKey() (uint32, []byte, error) {
+	if c.epoch == 0 {
+		return 0, nil, NoChatKeyErr
+	}
+
+	return c.epoch, c.keys[c.epoch], nil
+}
+
+// SealMessage returns a copy of the message with its content sealed with the chat key,
+// the message is returned unchanged if the chat is not encrypted
+func (c *Chat) SealMessage(message *Message) (*Message, error) {
+	if !c.Encrypted || message.Content == "" {
+		return message, nil
+	}
+
+	epoch, key, err := c.GetKey()
+	if err != nil {
+		return nil, err
+	}
 
-		c.messages = newMessages
+	sealed, err := seal(key, []byte(message.Content), c.additionalData(message))
+	if err != nil {
+		return nil, err
 	}
+
+	copied := *message
+	copied.Content = base64.StdEncoding.EncodeToString(sealed)
+	copied.Epoch = epoch
+	return &copied, nil
+}
+
+// OpenMessage returns a copy of the message sealed by SealMessage with its content in clear
+func (c *Chat) OpenMessage(message *Message) (*Message, error) {
+	if !c.Encrypted || message.Content == "" {
+		return message, nil
+	}
+
+	if message.Epoch == 0 {
+		return nil, NotSealedErr
+	}
+
+	key, ok := c.keys[message.Epoch]
+	if !ok {
+		return nil, NoChatKeyErr
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(message.Content)
+	if err != nil {
+		return nil, DecryptionErr
+	}
+
+	content, err := open(key, sealed, c.additionalData(message))
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *message
+	copied.Content = string(content)
+	copied.Epoch = 0
+	return &copied, nil
+}
+
+// additionalData binds a sealed content to its chat and message
+func (c *Chat) additionalData(message *Message) []byte {
+	return append(c.Id[:len(c.Id):len(c.Id)], message.Id[:]...)
+}
+
+func (c *Chat) getMessage(id uuid.UUID) (*Message, error) {
+	for _, m := range c.messages {
+		if m.Id == id {
+			return m, nil
+		}
+	}
+
+	return nil, NotFoundErr
 }
 
 func (c *Chat) ToBytes() []byte {
@@ -148,24 +426,22 @@ func (c *Chat) ToBytes() []byte {
 	return bytesChat
 }
 
-// GetSlots returns all the slots identifying active TCP connections between nodes.
-func (c *Chat) GetSlots() []uint8 {
-	length := 0
-	if len(c.nodesSlots) > 0 {
-		length = len(c.nodesSlots) - 1
-	}
+// GetNodes returns the ids of the chat members
+func (c *Chat) GetNodes() []uuid.UUID {
+	nodes := make([]uuid.UUID, len(c.nodes))
+	copy(nodes, c.nodes)
+	return nodes
+}
 
-	slots := make([]uint8, 0, length)
-	for _, s := range c.nodesSlots {
-		// My own slot
-		if s == 0 {
-			continue
+// ContainsNode returns true if the node is a member of the chat
+func (c *Chat) ContainsNode(nodeID uuid.UUID) bool {
+	for _, id := range c.nodes {
+		if id == nodeID {
+			return true
 		}
-
-		slots = append(slots, s)
 	}
 
-	return slots
+	return false
 }
 
 func (c *Chat) ContainsMessage(message *Message) bool {
@@ -177,6 +453,14 @@ func (c *Chat) ContainsMessage(message *Message) bool {
 	return false
 }
 
-func (c *Chat) Display() {
-	fmt.Printf("- %s : %d users, %d messages\n", c.Name, len(c.nodesSlots)+1, len(c.messages))
+// CountMessages returns the number of messages of the chat, tombstones excluded
+func (c *Chat) CountMessages() int {
+	var numberOfMessages int
+	for _, m := range c.messages {
+		if !m.Deleted {
+			numberOfMessages++
+		}
+	}
+
+	return numberOfMessages
 }
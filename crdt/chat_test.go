@@ -1,20 +1,22 @@
 package crdt
 
 import (
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"reflect"
 	"testing"
-	"time"
+	"testing/quick"
 )
 
 func TestContainsMessage(t *testing.T) {
 	var (
 		chatMessages = []*Message{
-			NewMessage("James", "Hello Bob!"),
-			NewMessage("Bob", "Hello James!"),
-			NewMessage("Peter", "Hello James!"),
+			NewMessage(uuid.New(), "James", "Hello Bob!"),
+			NewMessage(uuid.New(), "Bob", "Hello James!"),
+			NewMessage(uuid.New(), "Peter", "Hello James!"),
 		}
 
 		chat = Chat{
@@ -26,75 +28,154 @@ func TestContainsMessage(t *testing.T) {
 	assert.True(t, chat.ContainsMessage(chatMessages[1]))
 	assert.True(t, chat.ContainsMessage(chatMessages[2]))
 
-	var otherMessage = NewMessage("Anonymous", "Hello Guys!")
+	var otherMessage = NewMessage(uuid.New(), "Anonymous", "Hello Guys!")
 	assert.False(t, chat.ContainsMessage(otherMessage))
 }
 
 func TestChat_SaveMessage(t *testing.T) {
-	// inserting message with random dates and verifying they are in right order
+	// inserting message with random timestamps and verifying they are in right order
 	chat := NewChat("name")
 	for i := 0; i < 10; i++ {
-		m := NewMessage("sender", fmt.Sprintf("%d", i))
-		m.Date = randomTimestamp().Format(time.RFC3339)
+		m := NewMessage(uuid.New(), "sender", fmt.Sprintf("%d", i))
+		m.Clock = uint64(rand.Intn(5) + 1)
 		chat.SaveMessage(m)
 	}
 
-	var (
-		currentDate     time.Time
-		previousDate, _ = time.Parse(time.RFC3339, chat.messages[0].Date)
-	)
 	for i := 1; i < len(chat.messages); i++ {
-		currentDate, _ = time.Parse(time.RFC3339, chat.messages[i].Date)
-		assert.True(t, currentDate.After(previousDate))
+		assert.True(t, chat.messages[i-1].Before(chat.messages[i]))
 	}
+
+	// messages we send are stamped after the last known message
+	m := NewMessage(uuid.New(), "sender", "last")
+	chat.SaveMessage(m)
+	assert.Equal(t, m, chat.messages[len(chat.messages)-1])
+	assert.Equal(t, chat.messages[len(chat.messages)-2].Clock+1, m.Clock)
+}
+
+func TestMessage_Before(t *testing.T) {
+	var (
+		first  = &Message{Id: uuid.New(), NodeId: uuid.MustParse("00000000-0000-0000-0000-000000000001"), Clock: 1}
+		second = &Message{Id: uuid.New(), NodeId: uuid.MustParse("00000000-0000-0000-0000-000000000002"), Clock: 1}
+		third  = &Message{Id: uuid.New(), NodeId: first.NodeId, Clock: 2}
+	)
+
+	assert.True(t, first.Before(second), "same timestamp : ordered by node id")
+	assert.True(t, second.Before(third), "ordered by timestamp")
+	assert.True(t, first.Before(third), "ordered by timestamp")
+	assert.False(t, third.Before(first))
+	assert.False(t, first.Before(first))
 }
 
-func randomTimestamp() time.Time {
-	randomTime := rand.Int63n(time.Now().Unix()-94608000) + 94608000
+// TestChat_SaveMessage_Convergence simulates nodes sending messages concurrently in a chat,
+// every replica receives the messages in a different order and must end with the same history.
+func TestChat_SaveMessage_Convergence(t *testing.T) {
+	const numberOfNodes, numberOfReplicas, messagesPerNode = 4, 5, 20
+
+	property := func(seed int64) bool {
+		var (
+			r        = rand.New(rand.NewSource(seed))
+			nodes    = make([]*Chat, numberOfNodes)
+			nodeIDs  = make([]uuid.UUID, numberOfNodes)
+			messages []*Message
+		)
+
+		for i := range nodes {
+			nodes[i] = NewChat("chat")
+			nodeIDs[i] = uuid.New()
+		}
+
+		// each node sends messages and sometimes receives messages already sent
+		// so that timestamps are concurrent as well as causally related
+		for i := 0; i < numberOfNodes*messagesPerNode; i++ {
+			n := r.Intn(numberOfNodes)
+			if len(messages) > 0 && r.Intn(2) == 0 {
+				received := *messages[r.Intn(len(messages))]
+				nodes[n].SaveMessage(&received)
+			}
+
+			m := NewMessage(nodeIDs[n], "sender", fmt.Sprintf("%d", i))
+			// same second for every message
+			m.Date = "2023-01-01T00:00:00Z"
+			nodes[n].SaveMessage(m)
+			messages = append(messages, m)
+		}
 
-	randomNow := time.Unix(randomTime, 0)
+		var histories [numberOfReplicas][]uuid.UUID
+		for i := range histories {
+			var (
+				replica  = NewChat("chat")
+				shuffled = make([]*Message, len(messages))
+			)
 
-	return randomNow
+			for j, k := range r.Perm(len(messages)) {
+				copied := *messages[k]
+				shuffled[j] = &copied
+			}
+
+			for _, m := range shuffled {
+				replica.SaveMessage(m)
+				// duplicated delivery
+				if r.Intn(4) == 0 {
+					duplicate := *m
+					replica.SaveMessage(&duplicate)
+				}
+			}
+
+			for _, m := range replica.messages {
+				histories[i] = append(histories[i], m.Id)
+			}
+		}
+
+		for i := 1; i < numberOfReplicas; i++ {
+			if !reflect.DeepEqual(histories[0], histories[i]) {
+				return false
+			}
+		}
+
+		return len(histories[0]) == len(messages)
+	}
+
+	assert.Nil(t, quick.Check(property, nil))
 }
 
-func TestChat_RemoveNodeBySlot(t *testing.T) {
+func TestChat_RemoveNode(t *testing.T) {
 	var (
-		idToDelete = uuid.New()
-		tests      = []struct {
+		ids   = []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+		tests = []struct {
 			name                  string
-			slot                  uint8
+			node                  uuid.UUID
 			chat                  *Chat
 			expectedNumberOfNodes int
 		}{
 			{
 				name: "delete first node",
-				slot: 1,
+				node: ids[0],
 				chat: &Chat{
-					nodesSlots: []uint8{1, 2, 3},
+					nodes: []uuid.UUID{ids[0], ids[1], ids[2]},
 				},
 				expectedNumberOfNodes: 2,
 			},
 			{
 				name: "delete middle one",
-				slot: 2,
+				node: ids[1],
 				chat: &Chat{
-					nodesSlots: []uint8{1, 2, 3},
+					nodes: []uuid.UUID{ids[0], ids[1], ids[2]},
 				},
 				expectedNumberOfNodes: 2,
 			},
 			{
 				name: "delete middle one (4 elements)",
-				slot: 2,
+				node: ids[1],
 				chat: &Chat{
-					nodesSlots: []uint8{1, 2, 3, 4},
+					nodes: []uuid.UUID{ids[0], ids[1], ids[2], ids[3]},
 				},
 				expectedNumberOfNodes: 3,
 			},
 			{
 				name: "delete last",
-				slot: 3,
+				node: ids[2],
 				chat: &Chat{
-					nodesSlots: []uint8{1, 2, 3},
+					nodes: []uuid.UUID{ids[0], ids[1], ids[2]},
 				},
 				expectedNumberOfNodes: 2,
 			},
@@ -103,9 +184,283 @@ func TestChat_RemoveNodeBySlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.chat.RemoveNode(tt.slot)
-			assert.NotContains(t, idToDelete, tt.chat.nodesSlots)
-			assert.Equal(t, tt.expectedNumberOfNodes, len(tt.chat.nodesSlots))
+			nodes := tt.chat.GetNodes()
+			assert.Nil(t, tt.chat.RemoveNode(tt.node))
+			assert.NotContains(t, tt.chat.nodes, tt.node)
+			assert.Equal(t, tt.expectedNumberOfNodes, len(tt.chat.nodes))
+
+			// the removal doesn't modify the slices returned before
+			assert.Contains(t, nodes, tt.node)
 		})
 	}
+
+	assert.True(t, errors.Is(NewChat("name").RemoveNode(ids[0]), NotFoundErr))
+}
+
+func TestChat_UpdateMessage(t *testing.T) {
+	var (
+		chat    = NewChat("name")
+		author  = uuid.New()
+		message = NewMessage(author, "James", "Hello Bob!")
+	)
+
+	chat.SaveMessage(message)
+
+	// edit made locally : stamped and completed
+	edit := &Message{Id: message.Id, NodeId: author, Content: "Hello Bobby!"}
+	assert.Nil(t, chat.UpdateMessage(edit))
+	assert.Equal(t, "Hello Bobby!", chat.messages[0].Content)
+	assert.Equal(t, message.Clock+1, edit.Edit)
+	assert.Equal(t, message.Clock, edit.Clock)
+	assert.Equal(t, "James", edit.Sender)
+
+	// same edit received again
+	duplicate := *edit
+	assert.True(t, errors.Is(chat.UpdateMessage(&duplicate), OutdatedEditErr))
+
+	// older edit received after a newer one
+	older := &Message{Id: message.Id, NodeId: author, Content: "Hello you!", Clock: message.Clock, Edit: edit.Edit - 1}
+	assert.True(t, errors.Is(chat.UpdateMessage(older), OutdatedEditErr))
+	assert.Equal(t, "Hello Bobby!", chat.messages[0].Content)
+
+	// only the sender can edit
+	forged := &Message{Id: message.Id, NodeId: uuid.New(), Content: "Bob is dumb"}
+	assert.True(t, errors.Is(chat.UpdateMessage(forged), NotMessageSenderErr))
+	assert.Equal(t, "Hello Bobby!", chat.messages[0].Content)
+
+	// unknown message
+	unknown := &Message{Id: uuid.New(), NodeId: author, Content: "?"}
+	assert.True(t, errors.Is(chat.UpdateMessage(unknown), NotFoundErr))
+}
+
+func TestChat_DeleteMessage(t *testing.T) {
+	var (
+		chat    = NewChat("name")
+		author  = uuid.New()
+		message = NewMessage(author, "James", "Hello Bob!")
+	)
+
+	chat.SaveMessage(message)
+
+	// only the sender can delete
+	forged := &Message{Id: message.Id, NodeId: uuid.New()}
+	assert.True(t, errors.Is(chat.DeleteMessage(forged), NotMessageSenderErr))
+	assert.False(t, chat.messages[0].Deleted)
+
+	deletion := &Message{Id: message.Id, NodeId: author}
+	assert.Nil(t, chat.DeleteMessage(deletion))
+	assert.True(t, chat.messages[0].Deleted)
+	assert.Empty(t, chat.messages[0].Content)
+	assert.Equal(t, message.Clock, deletion.Clock)
+
+	// tombstones can't be edited nor deleted again
+	edit := &Message{Id: message.Id, NodeId: author, Content: "Hello again"}
+	assert.True(t, errors.Is(chat.UpdateMessage(edit), MessageDeletedErr))
+	assert.True(t, errors.Is(chat.DeleteMessage(&Message{Id: message.Id, NodeId: author}), MessageDeletedErr))
+}
+
+// TestChat_ModificationsConvergence delivers a message, its edits and its deletion in every order
+// and checks that all replicas end with the same state.
+func TestChat_ModificationsConvergence(t *testing.T) {
+	var (
+		origin  = NewChat("name")
+		author  = uuid.New()
+		message = NewMessage(author, "James", "v0")
+		edits   []*Message
+	)
+
+	origin.SaveMessage(message)
+	added := *message
+
+	for i := 1; i <= 3; i++ {
+		edit := &Message{Id: message.Id, NodeId: author, Content: fmt.Sprintf("v%d", i)}
+		assert.Nil(t, origin.UpdateMessage(edit))
+		copied := *edit
+		edits = append(edits, &copied)
+	}
+
+	type delivery struct {
+		typology OperationType
+		message  Message
+	}
+
+	var (
+		withoutDeletion = []delivery{{AddMessage, added}, {UpdateMessage, *edits[0]}, {UpdateMessage, *edits[1]}, {UpdateMessage, *edits[2]}}
+		deletion        = &Message{Id: message.Id, NodeId: author}
+	)
+
+	assert.Nil(t, origin.DeleteMessage(deletion))
+	withDeletion := append(append([]delivery(nil), withoutDeletion...), delivery{DeleteMessage, *deletion})
+
+	apply := func(c *Chat, d delivery) {
+		m := d.message
+		switch d.typology {
+		case AddMessage:
+			c.SaveMessage(&m)
+		case UpdateMessage:
+			_ = c.UpdateMessage(&m)
+		case DeleteMessage:
+			_ = c.DeleteMessage(&m)
+		}
+	}
+
+	for _, deliveries := range [][]delivery{withoutDeletion, withDeletion} {
+		expected := NewChat("name")
+		for _, d := range deliveries {
+			apply(expected, d)
+		}
+
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 50; i++ {
+			replica := NewChat("name")
+			for _, k := range r.Perm(len(deliveries)) {
+				apply(replica, deliveries[k])
+			}
+
+			assert.Equal(t, 1, len(replica.messages))
+			assert.Equal(t, *expected.messages[0], *replica.messages[0])
+		}
+	}
+}
+
+func TestChat_PendingModifications(t *testing.T) {
+	var (
+		chat    = NewChat("name")
+		author  = uuid.New()
+		message = NewMessage(author, "James", "Hello Bob!")
+		other   = NewMessage(author, "James", "Bye Bob!")
+	)
+
+	message.Clock, other.Clock = 1, 2
+
+	// a member deletes the message of another one before it arrived
+	forged := &Message{Id: message.Id, NodeId: uuid.New(), Clock: message.Clock, Deleted: true}
+	assert.True(t, errors.Is(chat.DeleteMessage(forged), MessagePendingErr))
+
+	// the sender edits it before it arrived
+	edit := &Message{Id: message.Id, NodeId: author, Sender: "James", Content: "Hello Bobby!", Clock: message.Clock, Edit: 3}
+	assert.True(t, errors.Is(chat.UpdateMessage(edit), MessagePendingErr))
+	assert.Empty(t, chat.messages)
+
+	// the edit of the sender is applied once the message arrives, the forged deletion is dropped
+	chat.SaveMessage(message)
+	saved, err := chat.GetMessage(message.Id)
+	assert.Nil(t, err)
+	assert.False(t, saved.Deleted)
+	assert.Equal(t, "Hello Bobby!", saved.Content)
+	assert.Equal(t, uint64(3), saved.Edit)
+	assert.Empty(t, chat.pending)
+
+	// the deletion of the sender is applied once the message arrives
+	deletion := &Message{Id: other.Id, NodeId: author, Clock: other.Clock, Deleted: true}
+	assert.True(t, errors.Is(chat.DeleteMessage(deletion), MessagePendingErr))
+	chat.SaveMessage(other)
+	saved, err = chat.GetMessage(other.Id)
+	assert.Nil(t, err)
+	assert.True(t, saved.Deleted)
+	assert.Empty(t, saved.Content)
+}
+
+func TestChat_SealOpenMessage(t *testing.T) {
+	chat, err := NewEncryptedChat("secret")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var (
+		message = NewMessage(uuid.New(), "James", "Hello my Dear friend")
+		replica = chat.Copy()
+	)
+
+	sealed, err := chat.SealMessage(message)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, uint32(1), sealed.Epoch)
+	assert.NotContains(t, sealed.Content, "friend")
+	assert.Equal(t, "Hello my Dear friend", message.Content, "message sealed in place")
+
+	opened, err := replica.OpenMessage(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, message, opened)
+
+	// content sealed for another message
+	other := *sealed
+	other.Id = uuid.New()
+	_, err = replica.OpenMessage(&other)
+	assert.ErrorIs(t, err, DecryptionErr)
+
+	// plain content in an encrypted chat
+	_, err = replica.OpenMessage(message)
+	assert.ErrorIs(t, err, NotSealedErr)
+
+	// messages sealed with the previous key can still be opened after a rotation
+	_, _, err = chat.RotateKey()
+	assert.Nil(t, err)
+	rotated, err := chat.SealMessage(message)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), rotated.Epoch)
+
+	_, err = replica.OpenMessage(rotated)
+	assert.ErrorIs(t, err, NoChatKeyErr)
+
+	_, err = chat.OpenMessage(sealed)
+	assert.Nil(t, err)
+
+	// tombstones have no content to seal
+	tombstone := &Message{Id: message.Id, Deleted: true}
+	sealed, err = chat.SealMessage(tombstone)
+	assert.Nil(t, err)
+	assert.Equal(t, tombstone, sealed)
+
+	// messages of chats that are not encrypted are sent in clear
+	plain := NewChat("plain")
+	sealed, err = plain.SealMessage(message)
+	assert.Nil(t, err)
+	assert.Equal(t, message, sealed)
+}
+
+func TestChat_SetKey(t *testing.T) {
+	var (
+		chat      = NewChat("secret")
+		first, _  = newChatKey()
+		second, _ = newChatKey()
+		greatest  = first
+		smallest  = second
+	)
+
+	_, _, err := chat.GetKey()
+	assert.ErrorIs(t, err, NoChatKeyErr)
+
+	if string(second) > string(first) {
+		greatest, smallest = second, first
+	}
+
+	// concurrent rotations of the same epoch converge whatever the reception order
+	chat.SetKey(2, smallest)
+	chat.SetKey(2, greatest)
+	chat.SetKey(2, smallest)
+	chat.SetKey(1, smallest)
+
+	epoch, key, err := chat.GetKey()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), epoch)
+	assert.Equal(t, greatest, key)
+}
+
+func TestDirectChatID(t *testing.T) {
+	var (
+		alice, bob, carol = uuid.New(), uuid.New(), uuid.New()
+		chat              = NewDirectChat(alice, &NodeInfos{Id: bob, Name: "bob"})
+	)
+
+	// both nodes compute the same id, different for each pair of nodes
+	assert.Equal(t, DirectChatID(alice, bob), DirectChatID(bob, alice))
+	assert.NotEqual(t, DirectChatID(alice, bob), DirectChatID(alice, carol))
+
+	assert.Equal(t, DirectChatID(bob, alice), chat.Id)
+	assert.Equal(t, "@bob", chat.Name)
+	assert.True(t, chat.Direct)
+	assert.True(t, chat.Copy().Direct)
 }
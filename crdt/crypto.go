@@ -0,0 +1,160 @@
+package crdt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// KeyPair is the X25519 key pair a node uses to receive the keys of encrypted chats,
+	// its public key is shared in NodeInfos.PublicKey
+	KeyPair struct {
+		private *ecdh.PrivateKey
+	}
+
+	// ChatKey is a key of an encrypted chat sealed for one member of the chat
+	ChatKey struct {
+		Epoch     uint32 `json:"epoch"`     // version of the key, incremented on each rotation
+		Ephemeral []byte `json:"ephemeral"` // public key of the X25519 key pair generated to seal the key
+		Sealed    []byte `json:"sealed"`    // chat key encrypted with AES-GCM
+	}
+)
+
+const chatKeySize = 32
+
+var (
+	InvalidPublicKeyErr = errors.New("invalid public key")
+	DecryptionErr       = errors.New("message authentication failed")
+)
+
+func NewKeyPair() (*KeyPair, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{private: private}, nil
+}
+
+func (k *KeyPair) PublicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// NewChatKey seals the key of a chat for the owner of publicKey
+func NewChatKey(epoch uint32, key []byte, publicKey []byte) (*ChatKey, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, InvalidPublicKeyErr
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	chatKey := &ChatKey{
+		Epoch:     epoch,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	}
+
+	chatKey.Sealed, err = seal(chatKey.wrappingKey(shared, publicKey), key, chatKey.additionalData())
+	if err != nil {
+		return nil, err
+	}
+
+	return chatKey, nil
+}
+
+// OpenChatKey returns the chat key sealed for the key pair
+func (k *KeyPair) OpenChatKey(chatKey *ChatKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(chatKey.Ephemeral)
+	if err != nil {
+		return nil, InvalidPublicKeyErr
+	}
+
+	shared, err := k.private.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(chatKey.wrappingKey(shared, k.PublicKey()), chatKey.Sealed, chatKey.additionalData())
+}
+
+func (k *ChatKey) ToBytes() []byte {
+	bytesKey, _ := json.Marshal(k)
+	return bytesKey
+}
+
+// wrappingKey derives the AES key sealing the chat key from the X25519 shared secret
+func (k *ChatKey) wrappingKey(shared []byte, recipient []byte) []byte {
+	hash := sha256.New()
+	hash.Write(shared)
+	hash.Write(k.Ephemeral)
+	hash.Write(recipient)
+	return hash.Sum(nil)
+}
+
+func (k *ChatKey) additionalData() []byte {
+	return binary.BigEndian.AppendUint32(nil, k.Epoch)
+}
+
+func newChatKey() ([]byte, error) {
+	key := make([]byte, chatKeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// seal encrypts plaintext with AES-GCM, the random nonce is prepended to the ciphertext
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, DecryptionErr
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, DecryptionErr
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,36 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatKey_SealOpen(t *testing.T) {
+	var (
+		recipient, _ = NewKeyPair()
+		other, _     = NewKeyPair()
+		key, _       = newChatKey()
+	)
+
+	chatKey, err := NewChatKey(7, key, recipient.PublicKey())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	opened, err := recipient.OpenChatKey(chatKey)
+	assert.Nil(t, err)
+	assert.Equal(t, key, opened)
+
+	// only the recipient can open the key
+	_, err = other.OpenChatKey(chatKey)
+	assert.ErrorIs(t, err, DecryptionErr)
+
+	// the epoch is authenticated
+	chatKey.Epoch = 8
+	_, err = recipient.OpenChatKey(chatKey)
+	assert.ErrorIs(t, err, DecryptionErr)
+
+	_, err = NewChatKey(7, key, []byte("not a key"))
+	assert.ErrorIs(t, err, InvalidPublicKeyErr)
+}
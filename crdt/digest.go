@@ -0,0 +1,89 @@
+package crdt
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Digest summarizes the messages of a chat known by a node.
+	// Exchanged between two nodes, it lets each one send only the messages the other one is missing.
+	Digest struct {
+		Versions map[uuid.UUID]uint64 `json:"versions"` // message id -> message version
+		Reply    bool                 `json:"reply"`    // digest sent in response to another digest
+
+		// Members of a gossip chat known by the node, the other node sends it the missing ones
+		Members []uuid.UUID `json:"members,omitempty"`
+	}
+)
+
+const deletedVersion = math.MaxUint64
+
+// Digest returns the summary of all the messages of the chat
+func (c *Chat) Digest() *Digest {
+	d := &Digest{
+		Versions: make(map[uuid.UUID]uint64, len(c.messages)),
+	}
+
+	for _, m := range c.messages {
+		d.Versions[m.Id] = m.version()
+	}
+
+	return d
+}
+
+// Missing returns copies of the messages the owner of the digest does not have
+// or has in an older version (older edit or not deleted yet), in chat order.
+func (c *Chat) Missing(d *Digest) []*Message {
+	var missing []*Message
+	for _, m := range c.messages {
+		version, known := d.Versions[m.Id]
+		if known && version >= m.version() {
+			continue
+		}
+
+		copied := *m
+		missing = append(missing, &copied)
+	}
+
+	return missing
+}
+
+// GetOperationType returns the operation that brings the message of the owner of the digest up to date : a message it
+// never received is sent whole since edits and deletions are only applied to the messages a node has.
+func (d *Digest) GetOperationType(m *Message) OperationType {
+	if _, known := d.Versions[m.Id]; !known {
+		return AddMessage
+	}
+
+	return m.GetOperationType()
+}
+
+func (d *Digest) ToBytes() []byte {
+	bytesDigest, _ := json.Marshal(d)
+	return bytesDigest
+}
+
+// version increases each time the message is modified : 0 for the original message,
+// the Lamport timestamp of the last edit, and the highest version once deleted.
+func (m *Message) version() uint64 {
+	if m.Deleted {
+		return deletedVersion
+	}
+
+	return m.Edit
+}
+
+// GetOperationType returns the operation that recreates the current state of the message on a node which has it.
+func (m *Message) GetOperationType() OperationType {
+	switch {
+	case m.Deleted:
+		return DeleteMessage
+	case m.Edit > 0:
+		return UpdateMessage
+	default:
+		return AddMessage
+	}
+}
@@ -0,0 +1,73 @@
+package crdt
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodeDigest(t *testing.T) {
+	var (
+		chat = NewChat("name")
+		op   = NewOperation(SyncChat, chat.Id.String(), nil)
+	)
+
+	for i := 0; i < 3; i++ {
+		chat.SaveMessage(NewMessage(uuid.New(), "James", fmt.Sprintf("%d", i)))
+	}
+
+	digest := chat.Digest()
+	digest.Reply = true
+	digest.Members = []uuid.UUID{uuid.New(), uuid.New()}
+	op.Data = digest
+
+	decodedOp, err := DecodeOperation(op.ToBytes())
+	assert.Nil(t, err)
+	assert.True(t, reflect.DeepEqual(decodedOp, op), "failed to encode/decode digest")
+}
+
+func TestChat_Missing(t *testing.T) {
+	var (
+		author   = uuid.New()
+		local    = NewChat("name")
+		remote   = NewChat("name")
+		shared   = NewMessage(author, "James", "shared")
+		edited   = NewMessage(author, "James", "edited")
+		deleted  = NewMessage(author, "James", "deleted")
+		onlyHere = NewMessage(author, "James", "only here")
+	)
+
+	for _, m := range []*Message{shared, edited, deleted} {
+		local.SaveMessage(m)
+		copied := *m
+		remote.SaveMessage(&copied)
+	}
+
+	assert.Nil(t, local.UpdateMessage(&Message{Id: edited.Id, NodeId: author, Content: "edited twice"}))
+	assert.Nil(t, local.DeleteMessage(&Message{Id: deleted.Id, NodeId: author}))
+	local.SaveMessage(onlyHere)
+
+	missing := local.Missing(remote.Digest())
+	assert.Equal(t, 3, len(missing))
+	assert.Equal(t, edited.Id, missing[0].Id)
+	assert.Equal(t, UpdateMessage, missing[0].GetOperationType())
+	assert.Equal(t, deleted.Id, missing[1].Id)
+	assert.Equal(t, DeleteMessage, missing[1].GetOperationType())
+	assert.Equal(t, onlyHere.Id, missing[2].Id)
+	assert.Equal(t, AddMessage, missing[2].GetOperationType())
+
+	// the remote node has nothing we don't have
+	assert.Empty(t, remote.Missing(local.Digest()))
+
+	// an empty digest (new node) misses everything
+	empty := NewChat("name").Digest()
+	assert.Equal(t, len(local.messages), len(local.Missing(empty)))
+
+	// messages the node never received are sent whole
+	assert.Equal(t, UpdateMessage, remote.Digest().GetOperationType(missing[0]))
+	assert.Equal(t, AddMessage, empty.GetOperationType(missing[0]))
+	assert.Equal(t, AddMessage, empty.GetOperationType(missing[1]))
+}
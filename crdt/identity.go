@@ -0,0 +1,158 @@
+package crdt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Identity is the Ed25519 key pair of a node. The id of the node is derived from its public key (see NodeID)
+	// so that anyone can check that an operation signed with a key comes from the node it claims to come from.
+	Identity struct {
+		private ed25519.PrivateKey
+	}
+)
+
+// identityNamespace is the UUID namespace of the node ids derived from public keys
+var identityNamespace = uuid.MustParse("3f0c9a55-52a7-4e47-9b0b-6c1c7a3d2e11")
+
+var (
+	UnsignedErr     = errors.New("not signed")
+	BadSignatureErr = errors.New("invalid signature")
+	NotAuthorErr    = errors.New("signed by another node than the claimed author")
+)
+
+func NewIdentity() (*Identity, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{private: private}, nil
+}
+
+// NewIdentityFromSeed restores the identity saved with Seed
+func NewIdentityFromSeed(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid identity seed")
+	}
+
+	return &Identity{private: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// NodeID returns the id of the node owning the public key
+func NodeID(publicKey []byte) uuid.UUID {
+	return uuid.NewSHA1(identityNamespace, publicKey)
+}
+
+func (i *Identity) Seed() []byte {
+	return i.private.Seed()
+}
+
+func (i *Identity) PublicKey() []byte {
+	return i.private.Public().(ed25519.PublicKey)
+}
+
+// Id returns the id of the node, see NodeID
+func (i *Identity) Id() uuid.UUID {
+	return NodeID(i.PublicKey())
+}
+
+// SignOperation signs the operation as sent by the node, see Operation.VerifyAuthor
+func (i *Identity) SignOperation(op *Operation) {
+	var dataBytes []byte
+	if op.Data != nil {
+		dataBytes = op.Data.ToBytes()
+	}
+
+	op.Author = i.PublicKey()
+	op.Signature = ed25519.Sign(i.private, signedOperation(op.Typology, op.TargetedChat, dataBytes))
+	op.signed = nil
+}
+
+// SignMessage signs the message as written by the node. The message is relayed by the other nodes
+// so its signature is kept with it, see Message.Verify.
+func (i *Identity) SignMessage(message *Message) {
+	message.Key = i.PublicKey()
+	message.Signature = ed25519.Sign(i.private, message.signedBytes())
+}
+
+// VerifyAuthor checks that the operation has been signed by the node nodeID
+func (op *Operation) VerifyAuthor(nodeID uuid.UUID) error {
+	if len(op.Signature) == 0 {
+		return UnsignedErr
+	}
+
+	signed := op.signed
+	if signed == nil {
+		var dataBytes []byte
+		if op.Data != nil {
+			dataBytes = op.Data.ToBytes()
+		}
+
+		signed = signedOperation(op.Typology, op.TargetedChat, dataBytes)
+	}
+
+	if len(op.Author) != ed25519.PublicKeySize || !ed25519.Verify(op.Author, signed, op.Signature) {
+		return BadSignatureErr
+	}
+
+	if NodeID(op.Author) != nodeID {
+		return NotAuthorErr
+	}
+
+	return nil
+}
+
+// Verify checks that the message has been signed by the node Message.NodeId
+func (m *Message) Verify() error {
+	if len(m.Signature) == 0 {
+		return UnsignedErr
+	}
+
+	if len(m.Key) != ed25519.PublicKeySize || !ed25519.Verify(m.Key, m.signedBytes(), m.Signature) {
+		return BadSignatureErr
+	}
+
+	if NodeID(m.Key) != m.NodeId {
+		return NotAuthorErr
+	}
+
+	return nil
+}
+
+// signedOperation returns the bytes of the operation covered by its signature
+func signedOperation(typology OperationType, targetedChat string, dataBytes []byte) []byte {
+	signed := make([]byte, 0, 6+len(targetedChat)+len(dataBytes))
+	signed = append(signed, FrameVersion, byte(typology))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(len(targetedChat)))
+	signed = append(signed, targetedChat...)
+	return append(signed, dataBytes...)
+}
+
+// signedBytes returns the fields of the message covered by its signature, the epoch of the chat key
+// is not included since messages are sealed again by each node relaying them
+func (m *Message) signedBytes() []byte {
+	signed := make([]byte, 0, 64+len(m.Sender)+len(m.Content)+len(m.Date))
+	signed = append(signed, m.Id[:]...)
+	signed = append(signed, m.NodeId[:]...)
+	signed = binary.BigEndian.AppendUint64(signed, m.Clock)
+	signed = binary.BigEndian.AppendUint64(signed, m.Edit)
+
+	var deleted byte
+	if m.Deleted {
+		deleted = 1
+	}
+
+	signed = append(signed, deleted)
+	for _, field := range []string{m.Sender, m.Content, m.Date} {
+		signed = binary.BigEndian.AppendUint32(signed, uint32(len(field)))
+		signed = append(signed, field...)
+	}
+
+	return signed
+}
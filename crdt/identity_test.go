@@ -0,0 +1,79 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentity_SignOperation(t *testing.T) {
+	var (
+		identity, _ = NewIdentity()
+		other, _    = NewIdentity()
+		infos       = NewNodeInfos("127.0.0.1", "8080", "James")
+	)
+
+	infos.Id = identity.Id()
+	op := NewOperation(Hello, "", infos)
+	identity.SignOperation(op)
+
+	// the signature goes through the frame
+	decoded, err := DecodeOperation(op.ToBytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, op.Author, decoded.Author)
+	assert.Equal(t, op.Signature, decoded.Signature)
+	assert.Nil(t, decoded.VerifyAuthor(identity.Id()))
+	assert.ErrorIs(t, decoded.VerifyAuthor(other.Id()), NotAuthorErr)
+
+	// modified after being signed
+	op.TargetedChat = "room"
+	decoded, err = DecodeOperation(op.ToBytes())
+	if assert.Nil(t, err) {
+		assert.ErrorIs(t, decoded.VerifyAuthor(identity.Id()), BadSignatureErr)
+	}
+
+	decoded, err = DecodeOperation(NewOperation(Hello, "", infos).ToBytes())
+	if assert.Nil(t, err) {
+		assert.ErrorIs(t, decoded.VerifyAuthor(identity.Id()), UnsignedErr)
+	}
+
+	// the identity is restored from its seed
+	restored, err := NewIdentityFromSeed(identity.Seed())
+	assert.Nil(t, err)
+	assert.Equal(t, identity.Id(), restored.Id())
+}
+
+func TestIdentity_SignMessage(t *testing.T) {
+	var (
+		identity, _ = NewIdentity()
+		other, _    = NewIdentity()
+		message     = NewMessage(identity.Id(), "James", "hello\n")
+	)
+
+	message.Clock = 3
+	identity.SignMessage(message)
+	assert.Nil(t, message.Verify())
+
+	// the signature goes through the frame, the epoch of a sealed content is not signed
+	decoded, err := DecodeOperation(NewOperation(AddMessage, "room", message).ToBytes())
+	if assert.Nil(t, err) {
+		decodedMessage := decoded.Data.(*Message)
+		decodedMessage.Epoch = 2
+		assert.Nil(t, decodedMessage.Verify())
+	}
+
+	tampered := *message
+	tampered.Content = "bye\n"
+	assert.ErrorIs(t, tampered.Verify(), BadSignatureErr)
+
+	// signed by a node in the name of another
+	impersonated := *message
+	other.SignMessage(&impersonated)
+	assert.ErrorIs(t, impersonated.Verify(), NotAuthorErr)
+
+	unsigned := NewMessage(identity.Id(), "James", "hello\n")
+	assert.ErrorIs(t, unsigned.Verify(), UnsignedErr)
+}
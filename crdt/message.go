@@ -1,6 +1,7 @@
 package crdt
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/google/uuid"
 	"time"
@@ -9,22 +10,47 @@ import (
 type (
 	Message struct {
 		Id      uuid.UUID `json:"id"`
+		NodeId  uuid.UUID `json:"node_id"` // id of the node who sent the message
 		Sender  string    `json:"sender"`
 		Content string    `json:"content"`
-		Date    string    `json:"date"`
+		Date    string    `json:"date"`              // sending date, only used for display
+		Clock   uint64    `json:"clock"`             // Lamport timestamp, 0 until the message is saved in a chat for the first time
+		Edit    uint64    `json:"edit,omitempty"`    // Lamport timestamp of the last edit, 0 if never edited
+		Deleted bool      `json:"deleted,omitempty"` // tombstone : the message has been deleted by its sender
+		Epoch   uint32    `json:"epoch,omitempty"`   // epoch of the chat key sealing Content, 0 if Content is in clear
+
+		// Ed25519 public key of the sender and signature of the message in clear, see Identity.SignMessage
+		Key       []byte `json:"key,omitempty"`
+		Signature []byte `json:"signature,omitempty"`
 	}
 )
 
-func NewMessage(sender, content string) *Message {
+func NewMessage(nodeID uuid.UUID, sender, content string) *Message {
 	id, _ := uuid.NewUUID()
 	return &Message{
 		Id:      id,
+		NodeId:  nodeID,
 		Sender:  sender,
 		Content: content,
 		Date:    time.Now().Format(time.RFC3339),
 	}
 }
 
+// Before reports whether m is ordered before other in a chat.
+// Messages are ordered by Lamport timestamp, then by sender node id and message id to break ties,
+// which gives the same total order on every node whatever the reception order.
+func (m *Message) Before(other *Message) bool {
+	if m.Clock != other.Clock {
+		return m.Clock < other.Clock
+	}
+
+	if m.NodeId != other.NodeId {
+		return bytes.Compare(m.NodeId[:], other.NodeId[:]) < 0
+	}
+
+	return bytes.Compare(m.Id[:], other.Id[:]) < 0
+}
+
 func (m *Message) ToBytes() []byte {
 	bytesMessage, _ := json.Marshal(m)
 	return bytesMessage
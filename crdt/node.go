@@ -2,17 +2,27 @@ package crdt
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/google/uuid"
 )
 
 type (
 	NodeInfos struct {
-		Slot    uint8
 		Id      uuid.UUID `json:"id"`
 		Port    string    `json:"port"`
 		Address string    `json:"address"`
 		Name    string    `json:"name"`
+
+		// Fingerprint of the node TLS certificate, empty if the node uses plain TCP connections
+		Fingerprint string `json:"fingerprint,omitempty"`
+
+		// PublicKey used to send the node the keys of encrypted chats (see KeyPair)
+		PublicKey []byte `json:"public_key,omitempty"`
+	}
+
+	// NodeStatus tells what happened to the connection with a node, see ConnectionStatus
+	NodeStatus struct {
+		Status string `json:"status"`
+		Failed bool   `json:"failed,omitempty"` // the connection could not be opened : the operations for the node are dropped
 	}
 )
 
@@ -20,7 +30,6 @@ func NewNodeInfos(addr string, port, name string) *NodeInfos {
 	id, _ := uuid.NewUUID()
 
 	return &NodeInfos{
-		Slot:    0,
 		Id:      id,
 		Port:    port,
 		Address: addr,
@@ -40,6 +49,8 @@ func (i *NodeInfos) ToBytes() []byte {
 	bytesMessage, _ := json.Marshal(i)
 	return bytesMessage
 }
-func (i *NodeInfos) Display() {
-	fmt.Printf("- %s (Address: %s, Port: %s, Slot: %d)\n", i.Name, i.Address, i.Port, i.Slot)
+
+func (s *NodeStatus) ToBytes() []byte {
+	bytesStatus, _ := json.Marshal(s)
+	return bytesStatus
 }
@@ -21,7 +21,6 @@ func TestEncodeDecodeNode(t *testing.T) {
 		}{
 			{
 				message: &NodeInfos{
-					Slot:    1,
 					Id:      id,
 					Port:    "8080",
 					Address: "localhost",
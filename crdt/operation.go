@@ -1,16 +1,25 @@
 package crdt
 
 import (
+	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/json"
-	"github/timtimjnvr/chat/reader"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
 type (
 	Operation struct {
-		Slot         uint8 // Slot of the node who forwarded the operation
+		Node         uuid.UUID // node who forwarded the operation or to send it to (not sent), uuid.Nil for the local node or all the connected nodes
 		Typology     OperationType
 		TargetedChat string // uuid or chat name
 		Data         Data
+		Author       []byte // Ed25519 public key of the node who signed the operation, see Identity.SignOperation
+		Signature    []byte
+
+		signed []byte // bytes covered by the signature when the operation has been decoded
 	}
 
 	OperationType uint8
@@ -20,6 +29,25 @@ type (
 	}
 )
 
+const (
+	// FrameVersion is the version of the binary frame format produced by Operation.ToBytes, it changes with the layout :
+	// 1 carried the connection slot after the version, 2 replaced it with the flags and 3 added the signature block
+	FrameVersion byte = 3
+
+	// FrameHeaderSize is the fixed size of a frame header (everything before TargetedChat)
+	FrameHeaderSize = 16
+
+	// MaxFrameSize bounds the size of a frame a node accepts to decode
+	MaxFrameSize = 16 << 20
+
+	frameMagic byte = 0xC4
+
+	// flagSigned marks frames followed by the Ed25519 public key of their author and their signature
+	flagSigned byte = 1 << 0
+
+	signatureBlockSize = ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
 const (
 	CreateChat OperationType = iota
 	JoinChatByName
@@ -35,36 +63,78 @@ const (
 	ListUsers
 	ListChats
 	Quit
+	UpdateMessage
+	DeleteMessage
+	SyncChat
+	SyncNode
+	Hello
+	SetChatKey
+	Ping
+	Pong
+	Neighbor
+	ForceNeighbor
+	Prune
+	Disconnect
+	Help
+	DirectMessage
+	ListRemoteChats
+	RemoteChats
+	ConnectionStatus // emitted by the node handler only, never sent
+)
+
+var (
+	ShortFrameErr         = errors.New("short frame")
+	BadMagicErr           = errors.New("bad frame magic")
+	UnsupportedVersionErr = errors.New("unsupported frame version")
+	FrameTooLargeErr      = errors.New("frame too large")
+	ChecksumErr           = errors.New("frame checksum mismatch")
+	UnknownFlagsErr       = errors.New("unknown frame flags")
 )
 
 var operationNames = map[OperationType]string{
-	CreateChat:     "create chat",
-	JoinChatByName: "join chat by name",
-	SaveNode:       "save node",
-	KillNode:       "kill node",
-	AddNode:        "add node",
-	RemoveNode:     "remove node",
-	AddChat:        "add chat",
-	RemoveChat:     "leave chat",
-	SwitchChat:     "switch chat",
-	AddMessage:     "add message",
-	ListChatUsers:  "list chat users",
-	ListUsers:      "list users",
-	ListChats:      "list chats",
-	Quit:           "quit",
+	CreateChat:       "create chat",
+	JoinChatByName:   "join chat by name",
+	SaveNode:         "save node",
+	KillNode:         "kill node",
+	AddNode:          "add node",
+	RemoveNode:       "remove node",
+	AddChat:          "add chat",
+	RemoveChat:       "leave chat",
+	SwitchChat:       "switch chat",
+	AddMessage:       "add message",
+	ListChatUsers:    "list chat users",
+	ListUsers:        "list users",
+	ListChats:        "list chats",
+	Quit:             "quit",
+	UpdateMessage:    "update message",
+	DeleteMessage:    "delete message",
+	SyncChat:         "sync chat",
+	SyncNode:         "sync node",
+	Hello:            "hello",
+	SetChatKey:       "set chat key",
+	Ping:             "ping",
+	Pong:             "pong",
+	Neighbor:         "neighbor",
+	ForceNeighbor:    "force neighbor",
+	Prune:            "prune",
+	Disconnect:       "disconnect",
+	Help:             "help",
+	DirectMessage:    "direct message",
+	ListRemoteChats:  "list remote chats",
+	RemoteChats:      "remote chats",
+	ConnectionStatus: "connection status",
 }
 
 func NewOperation(typology OperationType, targetedChat string, data Data) *Operation {
 	return &Operation{
-		Slot:         0,
 		Typology:     typology,
 		TargetedChat: targetedChat,
 		Data:         data,
 	}
 }
 
-// Slot :
-// identifies the TCP connection slot
+// Flags :
+// bit 0 is set when the frame is signed, other bits are reserved and always 0
 //
 // TargetedChat :
 // uuid of the chat, name in case of JoinChatByName operation
@@ -74,47 +144,155 @@ func NewOperation(typology OperationType, targetedChat string, data Data) *Opera
 //
 // Data :
 // bytes that can be deserialized into a Chat or NodeInfo according to operation typology
-// *------*-------------------*--------------*----------*---------*------*
-// | Slot | lenTargetedChat   | TargetedChat | Typology | lenData | Data |
-// *------*-------*------------*--------------*----------*---------*----*
-//							 lenTargetedChat				  	  lenData
-//	 1 byte	 	1 byte	  	 	bytes		  1 byte	 1 byte	   bytes
-
+//
+// Author, Signature :
+// only present in signed frames, Ed25519 public key of the node who signed the operation and its signature
+//
+// Checksum :
+// crc32 (IEEE) of everything following the header
+// *-------*---------*-------*----------*-----------------*---------*----------*--------------*------*----------*-----------*
+// | Magic | Version | Flags | Typology | lenTargetedChat | lenData | Checksum | TargetedChat | Data |  Author  | Signature |
+// *-------*---------*-------*----------*-----------------*---------*----------*--------------*------*----------*-----------*
+//
+//	1 byte   1 byte   1 byte   1 byte      4 bytes        4 bytes    4 bytes   lenTargetedChat  lenData  32 bytes    64 bytes
+//
+// lengths and checksum are big endian unsigned integers.
 func (op *Operation) ToBytes() []byte {
-	var bytes []byte
-	bytes = append(bytes, op.Slot)
-	bytes = append(bytes, uint8(len(op.TargetedChat)))
-	bytes = append(bytes, []byte(op.TargetedChat)...)
-	bytes = append(bytes, uint8(op.Typology))
-
 	var dataBytes []byte
 	if op.Data != nil {
 		dataBytes = op.Data.ToBytes()
 	}
 
-	bytes = append(bytes, uint8(len(dataBytes)))
+	var (
+		bytes = make([]byte, FrameHeaderSize, FrameHeaderSize+len(op.TargetedChat)+len(dataBytes)+signatureBlockSize)
+	)
+
+	bytes[0] = frameMagic
+	bytes[1] = FrameVersion
+	bytes[3] = uint8(op.Typology)
+	binary.BigEndian.PutUint32(bytes[4:8], uint32(len(op.TargetedChat)))
+	binary.BigEndian.PutUint32(bytes[8:12], uint32(len(dataBytes)))
+
+	bytes = append(bytes, []byte(op.TargetedChat)...)
 	bytes = append(bytes, dataBytes...)
-	bytes = append(bytes, reader.Separator...)
+
+	if len(op.Signature) != 0 {
+		bytes[2] |= flagSigned
+		bytes = append(bytes, op.Author...)
+		bytes = append(bytes, op.Signature...)
+	}
+
+	binary.BigEndian.PutUint32(bytes[12:16], crc32.ChecksumIEEE(bytes[FrameHeaderSize:]))
 
 	return bytes
 }
 
+// FrameSize returns the total size of the frame starting at the beginning of bytes.
+// It only needs the header to be available and returns ShortFrameErr otherwise.
+func FrameSize(bytes []byte) (int, error) {
+	if len(bytes) < FrameHeaderSize {
+		return 0, ShortFrameErr
+	}
+
+	if bytes[0] != frameMagic {
+		return 0, BadMagicErr
+	}
+
+	if bytes[1] != FrameVersion {
+		return 0, errors.Wrapf(UnsupportedVersionErr, "version %d, expected %d", bytes[1], FrameVersion)
+	}
+
+	if bytes[2]&^flagSigned != 0 {
+		return 0, errors.Wrapf(UnknownFlagsErr, "flags %#x", bytes[2])
+	}
+
+	var (
+		lenTargetedChat = uint64(binary.BigEndian.Uint32(bytes[4:8]))
+		lenData         = uint64(binary.BigEndian.Uint32(bytes[8:12]))
+		size            = FrameHeaderSize + lenTargetedChat + lenData
+	)
+
+	if bytes[2]&flagSigned != 0 {
+		size += signatureBlockSize
+	}
+
+	if size > MaxFrameSize {
+		return 0, errors.Wrapf(FrameTooLargeErr, "%d bytes", size)
+	}
+
+	return int(size), nil
+}
+
+// FrameTypology returns the typology of the operation in the frame without decoding it,
+// bytes must hold at least the frame header
+func FrameTypology(bytes []byte) OperationType {
+	return OperationType(bytes[3])
+}
+
+// ScanFrames is a bufio.SplitFunc returning each complete operation frame found in data.
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	size, err := FrameSize(data)
+	if errors.Is(err, ShortFrameErr) || (err == nil && len(data) < size) {
+		if atEOF && len(data) > 0 {
+			return 0, nil, ShortFrameErr
+		}
+
+		// request more data
+		return 0, nil, nil
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, data[:size], nil
+}
+
 func DecodeOperation(bytes []byte) (*Operation, error) {
-	slot := bytes[0]
-	offset, targetedChat := getField(1, bytes)
-	typology := OperationType(bytes[offset])
-	_, dataBytes := getField(offset+1, bytes)
+	size, err := FrameSize(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) != size {
+		return nil, errors.Wrapf(ShortFrameErr, "expected %d bytes, got %d", size, len(bytes))
+	}
+
+	var (
+		typology        = OperationType(bytes[3])
+		lenTargetedChat = int(binary.BigEndian.Uint32(bytes[4:8]))
+		lenData         = int(binary.BigEndian.Uint32(bytes[8:12]))
+		checksum        = binary.BigEndian.Uint32(bytes[12:16])
+		payload         = bytes[FrameHeaderSize:]
+		targetedChat    = payload[:lenTargetedChat]
+		dataBytes       = payload[lenTargetedChat : lenTargetedChat+lenData]
+	)
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ChecksumErr
+	}
 
 	op := &Operation{
-		Slot:         slot,
 		Typology:     typology,
 		TargetedChat: string(targetedChat),
 		Data:         nil,
 	}
 
+	if bytes[2]&flagSigned != 0 {
+		block := payload[lenTargetedChat+lenData:]
+		op.Author = append([]byte(nil), block[:ed25519.PublicKeySize]...)
+		op.Signature = append([]byte(nil), block[ed25519.PublicKeySize:]...)
+		op.signed = signedOperation(typology, op.TargetedChat, dataBytes)
+	}
+
+	// operation without data
+	if len(dataBytes) == 0 {
+		return op, nil
+	}
+
 	// decode data into concrete type when needed
 	switch typology {
-	case AddNode, SaveNode, RemoveChat, JoinChatByName:
+	case AddNode, SaveNode, RemoveNode, KillNode, RemoveChat, JoinChatByName, Hello, Neighbor, ForceNeighbor, ListRemoteChats:
 		var result NodeInfos
 		err := decodeData(dataBytes, &result)
 		if err != nil {
@@ -123,7 +301,7 @@ func DecodeOperation(bytes []byte) (*Operation, error) {
 
 		op.Data = &result
 
-	case AddMessage:
+	case AddMessage, UpdateMessage, DeleteMessage, DirectMessage:
 		var result Message
 		err := decodeData(dataBytes, &result)
 		if err != nil {
@@ -132,13 +310,40 @@ func DecodeOperation(bytes []byte) (*Operation, error) {
 
 		op.Data = &result
 
-	case AddChat:
+	case SyncChat:
+		var result Digest
+		err := decodeData(dataBytes, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		op.Data = &result
+
+	case AddChat, CreateChat:
 		var result Chat
 		err := decodeData(dataBytes, &result)
 		if err != nil {
 			return nil, err
 		}
 
+		op.Data = &result
+
+	case RemoteChats:
+		var result RoomList
+		err := decodeData(dataBytes, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		op.Data = &result
+
+	case SetChatKey:
+		var result ChatKey
+		err := decodeData(dataBytes, &result)
+		if err != nil {
+			return nil, err
+		}
+
 		op.Data = &result
 	}
 
@@ -154,24 +359,18 @@ func decodeData(bytes []byte, result any) error {
 	return nil
 }
 
-func getField(offset int, source []byte) (int, []byte) {
-	if len(source) <= offset-1 {
-		return 0, []byte{}
-	} else {
-		lenField := int(source[offset])
-		return offset + lenField + 1, source[offset+1 : offset+lenField+1]
-	}
-}
-
 func GetOperationName(typology OperationType) string {
 	return operationNames[typology]
 }
 
 func (o *Operation) Copy() *Operation {
 	newOp := &Operation{}
-	newOp.Slot = o.Slot
+	newOp.Node = o.Node
 	newOp.Typology = o.Typology
 	newOp.TargetedChat = o.TargetedChat
 	newOp.Data = o.Data
+	newOp.Author = o.Author
+	newOp.Signature = o.Signature
+	newOp.signed = o.signed
 	return newOp
 }
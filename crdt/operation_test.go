@@ -1,10 +1,14 @@
 package crdt
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -23,7 +27,6 @@ func TestEncodeDecodeOperation(t *testing.T) {
 		}{
 			{
 				&Operation{
-					Slot:         0,
 					Typology:     AddChat,
 					TargetedChat: "my-awesome-chat",
 					Data: &Chat{
@@ -35,11 +38,9 @@ func TestEncodeDecodeOperation(t *testing.T) {
 			},
 			{
 				&Operation{
-					Slot:         0,
 					Typology:     AddNode,
 					TargetedChat: uuidString,
 					Data: &NodeInfos{
-						Slot:    0,
 						Port:    "8080",
 						Address: "localhost",
 						Name:    "James",
@@ -49,11 +50,9 @@ func TestEncodeDecodeOperation(t *testing.T) {
 			},
 			{
 				&Operation{
-					Slot:         2,
 					Typology:     JoinChatByName,
 					TargetedChat: "my-awesome-Chat",
 					Data: &NodeInfos{
-						Slot:    0,
 						Port:    "8080",
 						Address: "localhost",
 						Name:    "James",
@@ -63,7 +62,6 @@ func TestEncodeDecodeOperation(t *testing.T) {
 			},
 			{
 				&Operation{
-					Slot:         3,
 					Typology:     AddMessage,
 					TargetedChat: uuidString,
 					Data: &Message{
@@ -75,6 +73,142 @@ func TestEncodeDecodeOperation(t *testing.T) {
 				},
 				nil,
 			},
+			{
+				&Operation{
+					Typology:     UpdateMessage,
+					TargetedChat: uuidString,
+					Data: &Message{
+						Id:      idString,
+						Sender:  "James",
+						Date:    time.Now().Format(time.RFC3339),
+						Content: "Hello my Dearest friend",
+						Clock:   2,
+						Edit:    5,
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     AddChat,
+					TargetedChat: "my-secret-chat",
+					Data: &Chat{
+						Id:        id,
+						Name:      "secret",
+						Encrypted: true,
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     SaveNode,
+					TargetedChat: uuidString,
+					Data: &NodeInfos{
+						Port:        "8080",
+						Address:     "localhost",
+						Name:        "James",
+						Fingerprint: "0c4a",
+						PublicKey:   []byte{1, 2, 3},
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     SetChatKey,
+					TargetedChat: uuidString,
+					Data: &ChatKey{
+						Epoch:     3,
+						Ephemeral: []byte{4, 5, 6},
+						Sealed:    []byte{7, 8, 9},
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     AddMessage,
+					TargetedChat: uuidString,
+					Data: &Message{
+						Id:      idString,
+						Sender:  "James",
+						Date:    time.Now().Format(time.RFC3339),
+						Content: "c2VhbGVk",
+						Clock:   2,
+						Epoch:   3,
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     DeleteMessage,
+					TargetedChat: uuidString,
+					Data: &Message{
+						Id:      idString,
+						Sender:  "James",
+						Date:    time.Now().Format(time.RFC3339),
+						Clock:   2,
+						Deleted: true,
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology: Ping,
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     AddChat,
+					TargetedChat: "my-large-chat",
+					Data: &Chat{
+						Id:     id,
+						Name:   "large",
+						Gossip: true,
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology:     ForceNeighbor,
+					TargetedChat: uuidString,
+					Data: &NodeInfos{
+						Port:    "8080",
+						Address: "localhost",
+						Name:    "James",
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology: ListRemoteChats,
+					Data: &NodeInfos{
+						Port:    "8080",
+						Address: "localhost",
+						Name:    "James",
+					},
+				},
+				nil,
+			},
+			{
+				&Operation{
+					Typology: RemoteChats,
+					Data: &RoomList{
+						Host: "James",
+						Rooms: []Room{
+							{Name: "james", Members: 1},
+							{Name: "large", Members: 12, Gossip: true},
+						},
+					},
+				},
+				nil,
+			},
 		}
 	)
 
@@ -86,33 +220,112 @@ func TestEncodeDecodeOperation(t *testing.T) {
 		}
 
 		assert.True(t, reflect.DeepEqual(decodedOp, test.op), fmt.Sprintf("test %d failed to encode/decode struct", i))
+		assert.Equal(t, test.op.Typology, FrameTypology(bytes))
 	}
 }
 
-func TestGetField(t *testing.T) {
-	var testData = []struct {
-		bytes          []byte
-		offset         int
-		expectedField  []byte
-		expectedOffset int
-	}{
-		{
-			bytes:          []byte{0, 0, 0, 4, 1, 1, 1, 1, 0},
-			offset:         3,
-			expectedField:  []byte{1, 1, 1, 1},
-			expectedOffset: 8,
-		},
-		{
-			bytes:          []byte{0, 0, 0, 4, 1, 1, 1, 1, 2, 1, 1, 0},
-			offset:         8,
-			expectedField:  []byte{1, 1},
-			expectedOffset: 11,
-		},
+func TestEncodeDecodeOperation_LargeMessage(t *testing.T) {
+	for _, size := range []int{255, 256, 64 << 10, 1 << 20} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			var (
+				message = NewMessage(uuid.New(), "James", strings.Repeat("a", size))
+				op      = NewOperation(AddMessage, uuid.New().String(), message)
+			)
+
+			decodedOp, err := DecodeOperation(op.ToBytes())
+			assert.Nil(t, err)
+			assert.True(t, reflect.DeepEqual(decodedOp, op), "failed to encode/decode large message")
+		})
 	}
+}
+
+func TestDecodeOperation_Errors(t *testing.T) {
+	var (
+		op    = NewOperation(AddMessage, uuid.New().String(), NewMessage(uuid.New(), "James", "Hello my Dear friend"))
+		valid = op.ToBytes()
+
+		corrupted = func(offset int) []byte {
+			bytes := append([]byte(nil), valid...)
+			bytes[offset] ^= 0xFF
+			return bytes
+		}
+
+		tooLarge = func() []byte {
+			bytes := append([]byte(nil), valid...)
+			binary.BigEndian.PutUint32(bytes[8:12], MaxFrameSize)
+			return bytes
+		}
+
+		tests = []struct {
+			name        string
+			bytes       []byte
+			expectedErr error
+		}{
+			{name: "empty", bytes: []byte{}, expectedErr: ShortFrameErr},
+			{name: "truncated header", bytes: valid[:FrameHeaderSize-1], expectedErr: ShortFrameErr},
+			{name: "truncated payload", bytes: valid[:len(valid)-1], expectedErr: ShortFrameErr},
+			{name: "trailing bytes", bytes: append(append([]byte(nil), valid...), 0), expectedErr: ShortFrameErr},
+			{name: "bad magic", bytes: corrupted(0), expectedErr: BadMagicErr},
+			{name: "unsupported version", bytes: corrupted(1), expectedErr: UnsupportedVersionErr},
+			{name: "unknown flags", bytes: corrupted(2), expectedErr: UnknownFlagsErr},
+			{name: "too large", bytes: tooLarge(), expectedErr: FrameTooLargeErr},
+			{name: "corrupted payload", bytes: corrupted(len(valid) - 2), expectedErr: ChecksumErr},
+		}
+	)
 
-	for i, d := range testData {
-		offset, field := getField(d.offset, d.bytes)
-		assert.Equal(t, d.expectedField, field, fmt.Sprintf("test %d failed on field", i))
-		assert.Equal(t, d.expectedOffset, offset, fmt.Sprintf("test %d failed on offset", i))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decodedOp, err := DecodeOperation(tt.bytes)
+			assert.Nil(t, decodedOp)
+			assert.True(t, errors.Is(err, tt.expectedErr), fmt.Sprintf("unexpected error %v", err))
+		})
 	}
 }
+
+func TestDecodeOperation_OldVersion(t *testing.T) {
+	var (
+		op    = NewOperation(AddMessage, uuid.New().String(), NewMessage(uuid.New(), "James", "Hello my Dear friend"))
+		frame = op.ToBytes()
+	)
+
+	// version 1 frame : the byte following the version is the connection slot of the node
+	frame[1] = 1
+	frame[2] = 4
+
+	decodedOp, err := DecodeOperation(frame)
+	assert.Nil(t, decodedOp)
+	assert.ErrorIs(t, err, UnsupportedVersionErr)
+	assert.EqualError(t, err, fmt.Sprintf("version 1, expected %d: unsupported frame version", FrameVersion))
+}
+
+func TestScanFrames(t *testing.T) {
+	var (
+		first  = NewOperation(CreateChat, "first", nil).ToBytes()
+		second = NewOperation(AddMessage, uuid.New().String(), NewMessage(uuid.New(), "James", "line 1\nline 2\n")).ToBytes()
+		data   = append(append([]byte(nil), first...), second...)
+	)
+
+	advance, token, err := ScanFrames(data, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(first), advance)
+	assert.Equal(t, first, token)
+
+	advance, token, err = ScanFrames(data[advance:], false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(second), advance)
+	assert.Equal(t, second, token)
+
+	// partial frame : more data requested
+	advance, token, err = ScanFrames(second[:len(second)-1], false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, advance)
+	assert.Nil(t, token)
+
+	// partial frame at EOF
+	_, _, err = ScanFrames(second[:len(second)-1], true)
+	assert.True(t, errors.Is(err, ShortFrameErr))
+
+	// garbage
+	_, _, err = ScanFrames(bytes.Repeat([]byte{'\n'}, FrameHeaderSize), false)
+	assert.True(t, errors.Is(err, BadMagicErr))
+}
@@ -0,0 +1,45 @@
+package crdt
+
+import (
+	"encoding/json"
+)
+
+type (
+	// Room describes a chat a node hosts to the nodes that did not join it yet
+	Room struct {
+		Name      string `json:"name"`
+		Members   int    `json:"members"` // the node hosting the chat included
+		Encrypted bool   `json:"encrypted,omitempty"`
+		Gossip    bool   `json:"gossip,omitempty"`
+	}
+
+	// RoomList answers a ListRemoteChats operation with the chats that can be joined through the node
+	RoomList struct {
+		Host  string `json:"host"` // name of the node
+		Rooms []Room `json:"rooms"`
+	}
+)
+
+// NewRoomList returns the chats that can be joined through the node named host, direct chats excluded
+func NewRoomList(host string, chats []*Chat) *RoomList {
+	list := &RoomList{Host: host, Rooms: []Room{}}
+	for _, c := range chats {
+		if c.Direct {
+			continue
+		}
+
+		list.Rooms = append(list.Rooms, Room{
+			Name:      c.Name,
+			Members:   len(c.GetNodes()) + 1,
+			Encrypted: c.Encrypted,
+			Gossip:    c.Gossip,
+		})
+	}
+
+	return list
+}
+
+func (l *RoomList) ToBytes() []byte {
+	bytesList, _ := json.Marshal(l)
+	return bytesList
+}
@@ -0,0 +1,31 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRoomList(t *testing.T) {
+	var (
+		peer   = &NodeInfos{Id: uuid.New(), Name: "peer"}
+		room   = NewChat("room")
+		large  = NewChat("large")
+		direct = NewDirectChat(uuid.New(), peer)
+	)
+
+	large.Gossip = true
+	room.SaveNode(peer.Id)
+	direct.SaveNode(peer.Id)
+
+	list := NewRoomList("me", []*Chat{room, large, direct})
+	assert.Equal(t, "me", list.Host)
+	assert.Equal(t, []Room{
+		{Name: "room", Members: 2},
+		{Name: "large", Members: 1, Gossip: true},
+	}, list.Rooms)
+
+	// nothing to join
+	assert.Equal(t, []Room{}, NewRoomList("me", []*Chat{direct}).Rooms)
+}
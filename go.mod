@@ -1,13 +1,12 @@
 module github/timtimjnvr/chat
 
-go 1.18
+go 1.20
 
 require github.com/pkg/errors v0.9.1
 
 require (
 	github.com/google/uuid v1.3.0
 	github.com/stretchr/testify v1.8.1
-	golang.org/x/sys v0.4.0
 )
 
 require (
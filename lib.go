@@ -1,56 +1,121 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github/timtimjnvr/chat/conn"
-	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/chat"
 	"github/timtimjnvr/chat/orchestrator"
-	"github/timtimjnvr/chat/storage"
-	"net"
+	"github/timtimjnvr/chat/tui"
+	"io"
+	"log"
 	"os"
-	"sync"
 )
 
-func start(addr string, port string, name string, stdin *os.File, sigc chan os.Signal, debugModePtr bool) {
+func start(config chat.Config, stdin io.Reader, sigc chan os.Signal, debugModePtr, tuiMode bool) {
+	node, err := chat.New(config)
+	if err != nil {
+		log.Fatal("[ERROR] ", err)
+	}
+
 	var (
-		myInfos            = crdt.NewNodeInfos(addr, port, name)
-		shutDown           = make(chan struct{})
-		connectionRequests = make(chan conn.ConnectionRequest)
-		newConnections     = make(chan net.Conn)
-		toSend             = make(chan *crdt.Operation)
-		// 2 senders : node handler & orchestrator (operations from stdin)
-		toExecute = make(chan *crdt.Operation, 2)
-
-		wgListen      = sync.WaitGroup{}
-		wgHandleChats = sync.WaitGroup{}
-		lock          = sync.Mutex{}
-		isReady       = sync.NewCond(&lock)
-		storage       = storage.NewStorage()
-		orch          = orchestrator.NewOrchestrator(storage, myInfos)
-		nodeHandler   = conn.NewNodeHandler(storage)
+		terminal  *tui.Terminal
+		screen    = os.Stdout
+		restore   = func() {}
+		displayed = make(chan struct{})
 	)
 
-	// create connections : tcp connect & listen for incoming connections
-	wgListen.Add(1)
-	isReady.L.Lock()
-	go conn.CreateConnections(&wgListen, isReady, myInfos, connectionRequests, newConnections, shutDown)
-	isReady.Wait()
+	if tuiMode {
+		terminal, err = tui.OpenTerminal(os.Stdin)
+		if err != nil {
+			log.Fatal("[ERROR] ", err)
+		}
+
+		// only the UI draws on the terminal, what the node prints would break it
+		restore = silence()
+		close(displayed)
+	} else {
+		// print what happens in the chats
+		events := node.Subscribe(orchestrator.TerminalBufferSize)
+		go func() {
+			defer close(displayed)
+			orchestrator.Display(os.Stdout, events)
+		}()
+	}
+
+	// the node leaves once the user quits or a signal is received
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	err = node.Start(ctx)
+	if err != nil {
+		restore()
+		if terminal != nil {
+			if restoreErr := terminal.Restore(); restoreErr != nil {
+				log.Println("[ERROR] ", restoreErr)
+			}
+		}
+
+		log.Fatal("[ERROR] ", err)
+	}
+
+	go func() {
+		select {
+		case <-sigc:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	if tuiMode {
+		err = runTUI(ctx, node, terminal, stdin, screen)
+	} else {
+		// create operations from stdin input
+		_ = node.HandleStdin(ctx, stdin)
+	}
 
-	// handle created connections until closure
-	nodeHandler.Wg.Add(1)
-	go nodeHandler.Start(newConnections, toSend, toExecute)
-	defer nodeHandler.Wg.Wait()
+	stop()
 
-	// maintain chat infos by executing and propagating operations
-	wgHandleChats.Add(1)
-	go orch.HandleChats(&wgHandleChats, toExecute, toSend)
+	<-node.Done()
+	<-displayed
+	restore()
+	if err != nil {
+		log.Println("[ERROR] can't restore the terminal: ", err)
+	}
 
-	// create operations from stdin input
-	orch.HandleStdin(stdin, toExecute, connectionRequests, shutDown, sigc)
+	fmt.Fprintln(screen, "[INFO] program shutdown")
+}
+
+// runTUI draws the full-screen UI of node on the terminal until the user quits, it returns the error
+// of the terminal restoration
+func runTUI(ctx context.Context, node *chat.Node, terminal *tui.Terminal, stdin io.Reader, screen io.Writer) error {
+	size, err := terminal.Size()
+	if err != nil {
+		size = tui.Size{Width: 80, Height: 24}
+	}
+
+	ui := tui.New(node, tui.NewScreen(size.Width, size.Height))
+	ui.Run(ctx, stdin, screen, node.Events(), terminal.Resized(ctx))
+	return terminal.Restore()
+}
+
+// silence discards the standard output and the logs, the returned function restores them
+func silence() func() {
+	var (
+		stdout    = os.Stdout
+		logOutput = log.Writer()
+	)
 
-	wgHandleChats.Wait()
-	wgListen.Wait()
-	nodeHandler.Wg.Wait()
-	fmt.Println("[INFO] program shutdown")
+	log.SetOutput(io.Discard)
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err == nil {
+		os.Stdout = devNull
+	}
 
+	return func() {
+		log.SetOutput(logOutput)
+		if err == nil {
+			os.Stdout = stdout
+			_ = devNull.Close()
+		}
+	}
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"github/timtimjnvr/chat/chat"
+	"github/timtimjnvr/chat/conn"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +15,10 @@ func main() {
 		myAddrPtr    = flag.String("a", "", "address used to accept connections")
 		myNamePtr    = flag.String("u", "tim", "nickname used in all chat")
 		debugModePtr = flag.Bool("d", false, "Enable debub mode")
+		dataDirPtr   = flag.String("data", "", "directory used to save chats and messages across restarts (kept in memory only if empty)")
+		tlsPtr       = flag.Bool("tls", false, "encrypt the connections with TLS, all the nodes need to enable it")
+		shutdownPtr  = flag.Duration("shutdown-timeout", conn.DefaultShutdownTimeout, "time given to the other nodes to close the connections when leaving")
+		tuiPtr       = flag.Bool("tui", false, "full-screen terminal interface instead of the line by line one")
 
 		sigc = make(chan os.Signal, 1)
 	)
@@ -26,5 +32,14 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	start(*myAddrPtr, *myPortPtr, *myNamePtr, os.Stdin, sigc, *debugModePtr)
+	config := chat.Config{
+		Address:         *myAddrPtr,
+		Port:            *myPortPtr,
+		Name:            *myNamePtr,
+		DataDir:         *dataDirPtr,
+		TLS:             *tlsPtr,
+		ShutdownTimeout: *shutdownPtr,
+	}
+
+	start(config, os.Stdin, sigc, *debugModePtr, *tuiPtr)
 }
@@ -0,0 +1,160 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/storage"
+
+	"github.com/google/uuid"
+)
+
+// Direct messages are sent to one node only. They are saved on both nodes in a chat created on the first message,
+// its id is computed from the ids of the two nodes (see crdt.DirectChatID) and its only member is the other node.
+
+var (
+	UnknownUserErr   = errors.New("no user with this name")
+	AmbiguousUserErr = errors.New("several users with this name, use the id of the node")
+	NotRecipientErr  = errors.New("direct message sent by or to another node")
+	DirectChatErr    = errors.New("direct chats can't be joined")
+)
+
+// directMessage saves a direct message, the ones typed by the user are sent to the other node only.
+// op.TargetedChat is the id of the node receiving the message.
+func (o *Orchestrator) directMessage(op *crdt.Operation, toSend chan<- *crdt.Operation) error {
+	recipientID, err := uuid.Parse(op.TargetedChat)
+	if err != nil {
+		return err
+	}
+
+	message, ok := op.Data.(*crdt.Message)
+	if !ok {
+		return fmt.Errorf("%w to Message", InvalidDataErr)
+	}
+
+	peerID := recipientID
+	if op.Node != uuid.Nil {
+		if recipientID != o.myInfos.Id || message.NodeId != op.Node {
+			return NotRecipientErr
+		}
+
+		peerID = op.Node
+	}
+
+	peer, err := o.storage.GetNode(peerID)
+	if err != nil {
+		return err
+	}
+
+	chatID, err := o.directChat(peer)
+	if err != nil {
+		return err
+	}
+
+	message, err = o.checkMessage(op, message, chatID)
+	if err != nil {
+		return err
+	}
+
+	// already received
+	err = o.storage.AddMessageToChat(message, chatID)
+	if err != nil {
+		return nil
+	}
+
+	o.emit(MessageReceived, chatID, message, nil)
+
+	// never relayed : only the node the message is for receives it
+	if op.Node == uuid.Nil {
+		sendOperation := crdt.NewOperation(crdt.DirectMessage, peerID.String(), message)
+		sendOperation.Node = peerID
+		toSend <- sendOperation
+	}
+
+	return nil
+}
+
+// directChat returns the id of the direct chat with the node, created if needed
+func (o *Orchestrator) directChat(peer *crdt.NodeInfos) (uuid.UUID, error) {
+	chatID := crdt.DirectChatID(o.myInfos.Id, peer.Id)
+	if chat, err := o.storage.GetChatInfos(chatID); err == nil {
+		// the node is back after leaving
+		if !chat.ContainsNode(peer.Id) {
+			err = o.storage.AddNodeToChat(peer, chatID)
+		}
+
+		return chatID, err
+	}
+
+	chat := crdt.NewDirectChat(o.myInfos.Id, peer)
+	err := o.storage.AddChat(chat)
+
+	// another chat has the name of the node
+	if errors.Is(err, storage.AlreadyInListWithNameErr) {
+		chat.Name = fmt.Sprintf("%s#%s", chat.Name, peer.Id.String()[:8])
+		err = o.storage.AddChat(chat)
+	}
+
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	err = o.storage.AddNodeToChat(peer, chatID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	o.emit(ChatJoined, chatID, nil, nil)
+	return chatID, nil
+}
+
+// directPeer returns the node the chat is with if the chat is a direct chat, uuid.Nil once the node left
+func (o *Orchestrator) directPeer(chatID uuid.UUID) (uuid.UUID, bool) {
+	chat, err := o.storage.GetChatInfos(chatID)
+	if err != nil || !chat.Direct {
+		return uuid.Nil, false
+	}
+
+	for _, id := range chat.GetNodes() {
+		if crdt.DirectChatID(o.myInfos.Id, id) == chatID {
+			return id, true
+		}
+	}
+
+	return uuid.Nil, true
+}
+
+// fromPeer reports whether the operation is not about a direct chat or comes from the other node of the chat,
+// the id of a direct chat is known by every node
+func (o *Orchestrator) fromPeer(op *crdt.Operation) bool {
+	chatID, err := uuid.Parse(op.TargetedChat)
+	if err != nil {
+		return true
+	}
+
+	peerID, direct := o.directPeer(chatID)
+	return !direct || op.Node == peerID
+}
+
+// findUser returns the node named name, or whose id is name, among the nodes of the chats
+func (o *Orchestrator) findUser(name string) (*crdt.NodeInfos, error) {
+	var found []*crdt.NodeInfos
+	for _, node := range o.storage.GetNodes() {
+		if node.Id.String() == name {
+			return node, nil
+		}
+
+		if node.Name == name {
+			found = append(found, node)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, UnknownUserErr
+	case 1:
+		return found[0], nil
+	default:
+		return nil, AmbiguousUserErr
+	}
+}
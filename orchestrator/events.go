@@ -0,0 +1,158 @@
+package orchestrator
+
+import (
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// EventType tells what changed in the chats of the local node
+	EventType uint8
+
+	// Event is published on the bus of the orchestrator once an operation changed a chat, see Events
+	Event struct {
+		Typology EventType
+		Chat     string          // name of the chat, empty for errors not related to a chat
+		Message  *crdt.Message   // MessageReceived, MessageEdited and MessageDeleted : the message in clear, ours included
+		Node     *crdt.NodeInfos // MemberJoined and MemberLeft : the member, ConnectionChanged : the remote node
+		Rooms    *crdt.RoomList  // RoomsListed : the chats that can be joined through a remote node
+		Status   string          // ConnectionChanged : what happened to the connection, e.g. "unreachable"
+		Err      error           // Error
+	}
+
+	// Bus passes the events published to every subscriber
+	Bus struct {
+		lock        *sync.RWMutex
+		subscribers map[<-chan Event]chan Event
+		closed      bool
+	}
+)
+
+const (
+	MessageReceived EventType = iota
+	MessageEdited
+	MessageDeleted
+	MemberJoined
+	MemberLeft
+	ChatJoined        // the local node created or joined the chat
+	ChatLeft          // the local node left the chat
+	Error             // an operation or a command failed
+	RoomsListed       // a remote node answered /rooms
+	ConnectionChanged // the connection with a node dropped, is being opened again or the node is unreachable
+)
+
+func NewBus() *Bus {
+	return &Bus{
+		lock:        &sync.RWMutex{},
+		subscribers: make(map[<-chan Event]chan Event),
+	}
+}
+
+// Subscribe returns a channel receiving the next events published. Up to size events are kept until they are read,
+// the next ones are dropped : the publisher never waits for a subscriber. The channel is closed by Unsubscribe or Close.
+func (b *Bus) Subscribe(size int) <-chan Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	events := make(chan Event, size)
+	if b.closed {
+		close(events)
+		return events
+	}
+
+	b.subscribers[events] = events
+	return events
+}
+
+// Unsubscribe stops publishing events on a channel returned by Subscribe and closes it
+func (b *Bus) Unsubscribe(events <-chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if subscriber, exists := b.subscribers[events]; exists {
+		close(subscriber)
+		delete(b.subscribers, events)
+	}
+}
+
+// Publish passes the event to the subscribers, the events published once the bus is closed are dropped
+func (b *Bus) Publish(event Event) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of the subscribers : no more events will be published
+func (b *Bus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	for events, subscriber := range b.subscribers {
+		close(subscriber)
+		delete(b.subscribers, events)
+	}
+}
+
+// Events returns the bus on which the events of the chats are published, it is closed once HandleChats returns
+func (o *Orchestrator) Events() *Bus {
+	return o.events
+}
+
+// emit publishes an event about the chat
+func (o *Orchestrator) emit(typology EventType, chatID uuid.UUID, message *crdt.Message, node *crdt.NodeInfos) {
+	chatName, err := o.storage.GetChatName(chatID)
+	if err != nil {
+		return
+	}
+
+	event := Event{Typology: typology, Chat: chatName}
+	if message != nil {
+		copied := *message
+		event.Message = &copied
+	}
+
+	if node != nil {
+		copied := *node
+		event.Node = &copied
+	}
+
+	o.events.Publish(event)
+}
+
+// fail publishes the error of an operation
+func (o *Orchestrator) fail(op *crdt.Operation, err error) {
+	o.events.Publish(Event{
+		Typology: Error,
+		Err:      fmt.Errorf("[%s] %w", crdt.GetOperationName(op.Typology), err),
+	})
+}
+
+// addMember adds the node to the chat, MemberJoined is emitted if it was not a member yet
+func (o *Orchestrator) addMember(node *crdt.NodeInfos, chatID uuid.UUID) error {
+	joined := !o.isMember(chatID, node.Id)
+
+	err := o.storage.AddNodeToChat(node, chatID)
+	if err != nil {
+		return err
+	}
+
+	if joined {
+		o.emit(MemberJoined, chatID, nil, node)
+	}
+
+	return nil
+}
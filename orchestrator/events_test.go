@@ -0,0 +1,41 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	var (
+		bus    = NewBus()
+		first  = bus.Subscribe(1)
+		second = bus.Subscribe(2)
+	)
+
+	// every subscriber receives the events, the ones it can't keep are dropped
+	bus.Publish(Event{Typology: ChatJoined, Chat: "a"})
+	bus.Publish(Event{Typology: ChatJoined, Chat: "b"})
+
+	assert.Equal(t, "a", (<-first).Chat)
+	assert.Equal(t, 0, len(first))
+	assert.Equal(t, "a", (<-second).Chat)
+	assert.Equal(t, "b", (<-second).Chat)
+
+	bus.Unsubscribe(first)
+	_, more := <-first
+	assert.False(t, more)
+
+	bus.Publish(Event{Typology: ChatLeft, Chat: "a"})
+	assert.Equal(t, ChatLeft, (<-second).Typology)
+
+	bus.Close()
+	_, more = <-second
+	assert.False(t, more)
+
+	// nothing is published once closed
+	bus.Publish(Event{Typology: ChatLeft, Chat: "b"})
+	_, more = <-bus.Subscribe(1)
+	assert.False(t, more)
+	bus.Unsubscribe(second)
+}
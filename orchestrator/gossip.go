@@ -0,0 +1,243 @@
+package orchestrator
+
+import (
+	"github/timtimjnvr/chat/crdt"
+	"math/rand"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultViewSize is the number of neighbors of a node in each gossip chat
+	DefaultViewSize = 5
+
+	// members sent to a new neighbor, in number of views
+	membersSampleSize = 2
+)
+
+type (
+	// view is the partial view of a gossip chat (HyParView-like) : the operations of the chat are only relayed
+	// to the active view, the other members we know are the candidates to replace a neighbor that left.
+	// Active views are symmetric : a node is our neighbor if we are its neighbor.
+	// Nodes don't know every member of the chat, they exchange some of them each time they become neighbors.
+	view struct {
+		active   []uuid.UUID        // neighbors, at most viewSize
+		pending  []uuid.UUID        // nodes asked to become neighbors, waiting for their answer
+		rejected map[uuid.UUID]bool // nodes that refused to become neighbors, reset once the view is empty
+	}
+)
+
+func contains(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remove(ids []uuid.UUID, id uuid.UUID) []uuid.UUID {
+	for index, i := range ids {
+		if i == id {
+			return append(ids[:index:index], ids[index+1:]...)
+		}
+	}
+
+	return ids
+}
+
+// isGossip reports whether the operations of the chat are relayed between neighbors
+func (o *Orchestrator) isGossip(chatID uuid.UUID) bool {
+	chat, err := o.storage.GetChatInfos(chatID)
+	return err == nil && chat.Gossip
+}
+
+func (o *Orchestrator) getView(chatID uuid.UUID) *view {
+	v, ok := o.views[chatID]
+	if !ok {
+		v = &view{rejected: make(map[uuid.UUID]bool)}
+		o.views[chatID] = v
+	}
+
+	return v
+}
+
+// relayTargets returns the nodes the operations of the chat are sent to : every member in a fully meshed chat,
+// the neighbors in a gossip chat and the other node in a direct chat
+func (o *Orchestrator) relayTargets(chatID uuid.UUID) ([]uuid.UUID, error) {
+	if peerID, direct := o.directPeer(chatID); direct {
+		if peerID == uuid.Nil {
+			return nil, nil
+		}
+
+		return []uuid.UUID{peerID}, nil
+	}
+
+	if !o.isGossip(chatID) {
+		return o.storage.GetNodeIDs(chatID)
+	}
+
+	return append([]uuid.UUID(nil), o.getView(chatID).active...), nil
+}
+
+// sendMissingMembers sends the node a random sample of the members of the chat it does not know,
+// the members spread each time two nodes become neighbors
+func (o *Orchestrator) sendMissingMembers(chatID uuid.UUID, nodeID uuid.UUID, known []uuid.UUID, toSend chan<- *crdt.Operation) {
+	nodeIDs, err := o.storage.GetNodeIDs(chatID)
+	if err != nil {
+		return
+	}
+
+	rand.Shuffle(len(nodeIDs), func(i, j int) {
+		nodeIDs[i], nodeIDs[j] = nodeIDs[j], nodeIDs[i]
+	})
+
+	sent := 0
+	for _, id := range nodeIDs {
+		if sent >= membersSampleSize*o.viewSize {
+			return
+		}
+
+		if id == nodeID || contains(known, id) {
+			continue
+		}
+
+		infos, err := o.storage.GetNode(id)
+		if err != nil {
+			continue
+		}
+
+		saveNode := crdt.NewOperation(crdt.SaveNode, chatID.String(), infos)
+		saveNode.Node = nodeID
+		toSend <- saveNode
+		sent++
+	}
+}
+
+// addNeighbor adds the node to the active view of the chat, a random neighbor is pruned if the view is full
+func (o *Orchestrator) addNeighbor(chatID uuid.UUID, nodeID uuid.UUID, toSend chan<- *crdt.Operation) {
+	v := o.getView(chatID)
+	v.pending = remove(v.pending, nodeID)
+	delete(v.rejected, nodeID)
+	if contains(v.active, nodeID) {
+		return
+	}
+
+	if len(v.active) >= o.viewSize {
+		evicted := v.active[rand.Intn(len(v.active))]
+		v.active = remove(v.active, evicted)
+
+		prune := crdt.NewOperation(crdt.Prune, chatID.String(), nil)
+		prune.Node = evicted
+		toSend <- prune
+		o.release(evicted, toSend)
+	}
+
+	v.active = append(v.active, nodeID)
+}
+
+// removeNeighbor forgets the node in the view of the chat after it left
+func (o *Orchestrator) removeNeighbor(chatID uuid.UUID, nodeID uuid.UUID) {
+	v := o.getView(chatID)
+	v.active = remove(v.active, nodeID)
+	v.pending = remove(v.pending, nodeID)
+	delete(v.rejected, nodeID)
+}
+
+// fillView asks random members of the chat to become neighbors until the view is full or viewSize nodes refused.
+// The first request is forced when we have at most one neighbor left : the node accepts it even if its own view is
+// full. Two nodes only neighbors of each other would otherwise be cut from the rest of the chat.
+func (o *Orchestrator) fillView(chatID uuid.UUID, toSend chan<- *crdt.Operation) {
+	if !o.isGossip(chatID) {
+		return
+	}
+
+	v := o.getView(chatID)
+	if len(v.active) <= 1 && len(v.pending) == 0 {
+		v.rejected = make(map[uuid.UUID]bool)
+	}
+
+	// most nodes are full : our view is completed by the requests of other nodes
+	if len(v.active)+len(v.pending) >= o.viewSize || len(v.rejected) >= o.viewSize {
+		return
+	}
+
+	nodeIDs, err := o.storage.GetNodeIDs(chatID)
+	if err != nil {
+		return
+	}
+
+	rand.Shuffle(len(nodeIDs), func(i, j int) {
+		nodeIDs[i], nodeIDs[j] = nodeIDs[j], nodeIDs[i]
+	})
+
+	for _, id := range nodeIDs {
+		if len(v.active)+len(v.pending) >= o.viewSize {
+			return
+		}
+
+		if contains(v.active, id) || contains(v.pending, id) || v.rejected[id] {
+			continue
+		}
+
+		typology := crdt.Neighbor
+		if len(v.active) <= 1 && len(v.pending) == 0 {
+			typology = crdt.ForceNeighbor
+		}
+
+		request := crdt.NewOperation(typology, chatID.String(), o.myInfos)
+		request.Node = id
+		toSend <- request
+		v.pending = append(v.pending, id)
+	}
+}
+
+// answerNeighbor handles a request to become neighbors, or the answer of a node we sent a request to
+func (o *Orchestrator) answerNeighbor(op *crdt.Operation, chatID uuid.UUID, toSend chan<- *crdt.Operation) {
+	v := o.getView(chatID)
+	switch {
+	// the node accepted our request : we may have missed operations while looking for neighbors
+	case contains(v.pending, op.Node):
+		o.addNeighbor(chatID, op.Node, toSend)
+
+		err := o.sendDigest(chatID, op.Node, false, toSend)
+		if err != nil {
+			o.fail(op, err)
+		}
+
+	case contains(v.active, op.Node):
+
+	case op.Typology == crdt.ForceNeighbor || len(v.active)+len(v.pending) < o.viewSize:
+		o.addNeighbor(chatID, op.Node, toSend)
+
+		accept := crdt.NewOperation(crdt.Neighbor, chatID.String(), o.myInfos)
+		accept.Node = op.Node
+		toSend <- accept
+
+	default:
+		reject := crdt.NewOperation(crdt.Prune, chatID.String(), nil)
+		reject.Node = op.Node
+		toSend <- reject
+		o.release(op.Node, toSend)
+	}
+}
+
+// release closes the connection with the node once no chat needs it : the node is neither a member
+// of a fully meshed chat nor one of our neighbors
+func (o *Orchestrator) release(nodeID uuid.UUID, toSend chan<- *crdt.Operation) {
+	for _, chatID := range o.storage.GetChatIDsByNode(nodeID) {
+		if !o.isGossip(chatID) {
+			return
+		}
+
+		v := o.getView(chatID)
+		if contains(v.active, nodeID) || contains(v.pending, nodeID) {
+			return
+		}
+	}
+
+	disconnect := crdt.NewOperation(crdt.Disconnect, "", nil)
+	disconnect.Node = nodeID
+	toSend <- disconnect
+}
@@ -0,0 +1,15 @@
+//go:build simulation
+
+package orchestrator
+
+import "testing"
+
+// simulations of large gossip chats, too slow for the default tests : run them with go test -tags simulation
+
+func TestGossip_PropagationSimulation(t *testing.T) {
+	helperGossipPropagation(t, 100, 10)
+}
+
+func TestGossip_NodesFailureSimulation(t *testing.T) {
+	helperGossipNodesFailure(t, 100, 15, 10)
+}
@@ -0,0 +1,372 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/storage"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// bounds each wait of the simulation, the signatures checked by the nodes are slow under the race detector
+	gossipTestDuration = 20 * time.Second
+
+	// nodes of the simulated networks, larger than the views so that operations are relayed (see the simulation tag)
+	gossipTestSize = 20
+
+	// the queues of the nodes are checked too : the network is idle sooner than a test cluster
+	gossipIdleDuration = 50 * time.Millisecond
+)
+
+// testNetwork links orchestrators as if any node could open a connection with any other node.
+// The operations a node receives are executed in the order they are sent.
+type testNetwork struct {
+	nodes        []*Orchestrator
+	storages     []*storage.Storage
+	identities   []*crdt.Identity
+	index        map[uuid.UUID]int
+	inboxes      []chan *crdt.Operation
+	toExecute    []chan *crdt.Operation
+	down         []atomic.Bool // stopped nodes : the operations sent to them are lost
+	lastActivity atomic.Int64
+	queued       atomic.Int64 // operations delivered and not read by their node yet
+	relayed      atomic.Int64 // add message operations exchanged between the nodes
+
+	wgHandleChats *sync.WaitGroup
+	wgRoute       *sync.WaitGroup
+	wgQueue       *sync.WaitGroup
+}
+
+func newTestNetwork(t *testing.T, size int) *testNetwork {
+	n := &testNetwork{
+		nodes:         make([]*Orchestrator, size),
+		storages:      make([]*storage.Storage, size),
+		identities:    make([]*crdt.Identity, size),
+		index:         make(map[uuid.UUID]int, size),
+		inboxes:       make([]chan *crdt.Operation, size),
+		toExecute:     make([]chan *crdt.Operation, size),
+		down:          make([]atomic.Bool, size),
+		wgHandleChats: &sync.WaitGroup{},
+		wgRoute:       &sync.WaitGroup{},
+		wgQueue:       &sync.WaitGroup{},
+	}
+
+	for i := range n.nodes {
+		infos, identity, keys := helperNewNode(t, fmt.Sprintf("%d", 9000+i), fmt.Sprintf("node-%d", i))
+		n.storages[i] = storage.NewStorage()
+		n.identities[i] = identity
+		n.index[infos.Id] = i
+		n.nodes[i] = NewOrchestrator(n.storages[i], infos, identity, keys)
+		n.inboxes[i] = make(chan *crdt.Operation)
+		n.toExecute[i] = make(chan *crdt.Operation, 100)
+	}
+
+	n.lastActivity.Store(time.Now().UnixNano())
+	for i := range n.nodes {
+		toSend := make(chan *crdt.Operation)
+
+		n.wgHandleChats.Add(1)
+		go func(o *Orchestrator, toExecute chan *crdt.Operation, toSend chan<- *crdt.Operation) {
+			defer n.wgHandleChats.Done()
+			o.HandleChats(context.Background(), toExecute, toSend)
+		}(n.nodes[i], n.toExecute[i], toSend)
+
+		n.wgRoute.Add(1)
+		go n.route(i, toSend)
+
+		n.wgQueue.Add(1)
+		go n.queue(n.inboxes[i], n.toExecute[i])
+	}
+
+	return n
+}
+
+// queue delivers the operations received by a node without ever blocking their senders
+func (n *testNetwork) queue(inbox <-chan *crdt.Operation, toExecute chan<- *crdt.Operation) {
+	defer n.wgQueue.Done()
+
+	var waiting []*crdt.Operation
+	for {
+		var (
+			next  chan<- *crdt.Operation
+			first *crdt.Operation
+		)
+
+		if len(waiting) > 0 {
+			next, first = toExecute, waiting[0]
+		}
+
+		select {
+		case op, more := <-inbox:
+			if !more {
+				return
+			}
+
+			waiting = append(waiting, op)
+
+		case next <- first:
+			waiting = waiting[1:]
+			n.queued.Add(-1)
+		}
+	}
+}
+
+// deliver sends the operation to the node
+func (n *testNetwork) deliver(node int, op *crdt.Operation) {
+	n.lastActivity.Store(time.Now().UnixNano())
+	n.queued.Add(1)
+	n.inboxes[node] <- op
+}
+
+func (n *testNetwork) route(from int, toSend <-chan *crdt.Operation) {
+	defer n.wgRoute.Done()
+
+	for op := range toSend {
+		n.lastActivity.Store(time.Now().UnixNano())
+
+		// connections are handled by the node handler
+		if op.Node == uuid.Nil || op.Typology == crdt.Disconnect || n.down[from].Load() {
+			continue
+		}
+
+		to := n.index[op.Node]
+		if n.down[to].Load() {
+			// the node handler can't reach the node : it is reported dead
+			killNode := crdt.NewOperation(crdt.KillNode, "", nil)
+			killNode.Node = op.Node
+			n.deliver(from, killNode)
+			continue
+		}
+
+		n.identities[from].SignOperation(op)
+		received, err := crdt.DecodeOperation(op.ToBytes())
+		if err != nil {
+			continue
+		}
+
+		received.Node = n.identities[from].Id()
+		if received.Typology == crdt.AddMessage {
+			n.relayed.Add(1)
+		}
+
+		n.deliver(to, received)
+	}
+}
+
+// join makes the node join the chat through the entry point node and waits for the node to be in the chat
+func (n *testNetwork) join(t *testing.T, node, entryPoint int, chatName string) {
+	op := crdt.NewOperation(crdt.JoinChatByName, chatName, n.nodes[node].myInfos)
+	n.deliver(entryPoint, helperReceived(n.identities[node], op))
+
+	timeout := time.Now().Add(maxTestDuration)
+	for {
+		if _, err := n.storages[node].GetChatID(chatName); err == nil {
+			return
+		}
+
+		if time.Now().After(timeout) {
+			t.Fatalf("node %d failed to join %s", node, chatName)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// send writes a message in the chat from the node
+func (n *testNetwork) send(node int, chatID uuid.UUID, content string) {
+	infos := n.nodes[node].myInfos
+	n.deliver(node, crdt.NewOperation(crdt.AddMessage, chatID.String(), crdt.NewMessage(infos.Id, infos.Name, content)))
+}
+
+// wait waits for the nodes to stop exchanging operations and to execute the ones they received
+func (n *testNetwork) wait(t *testing.T) {
+	timeout := time.Now().Add(gossipTestDuration)
+	for time.Since(time.Unix(0, n.lastActivity.Load())) < gossipIdleDuration || !n.idle() {
+		if time.Now().After(timeout) {
+			assert.Fail(t, "test timeout")
+			return
+		}
+
+		time.Sleep(gossipIdleDuration / 10)
+	}
+}
+
+// idle reports whether every operation delivered has been read by its node
+func (n *testNetwork) idle() bool {
+	if n.queued.Load() > 0 {
+		return false
+	}
+
+	for _, toExecute := range n.toExecute {
+		if len(toExecute) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *testNetwork) stop(t *testing.T) {
+	n.wait(t)
+
+	for i := range n.nodes {
+		n.deliver(i, crdt.NewOperation(crdt.Quit, "", nil))
+	}
+
+	n.wgHandleChats.Wait()
+	n.wgRoute.Wait()
+
+	for i := range n.nodes {
+		close(n.inboxes[i])
+	}
+
+	n.wgQueue.Wait()
+}
+
+// helperGossipChat creates the gossip chat on the first node and makes the other nodes join it through random members
+func helperGossipChat(t *testing.T, n *testNetwork, chatName string) uuid.UUID {
+	chat := crdt.NewChat(chatName)
+	chat.Gossip = true
+	err := n.storages[0].AddChat(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(n.nodes); i++ {
+		n.join(t, i, rand.Intn(i), chatName)
+	}
+
+	n.wait(t)
+	return chat.Id
+}
+
+func TestGossip_Propagation(t *testing.T) {
+	helperGossipPropagation(t, gossipTestSize, 10)
+}
+
+func TestGossip_NodesFailure(t *testing.T) {
+	helperGossipNodesFailure(t, gossipTestSize, gossipTestSize/6, 10)
+}
+
+// test helper sending messages in a gossip chat of size nodes and checking they reached every node through the views
+func helperGossipPropagation(t *testing.T, size, messages int) {
+	var (
+		network = newTestNetwork(t, size)
+		chatID  = helperGossipChat(t, network, "room")
+	)
+
+	for i := 0; i < messages; i++ {
+		network.send(rand.Intn(size), chatID, fmt.Sprintf("message %d\n", i))
+	}
+
+	network.stop(t)
+
+	for i, s := range network.storages {
+		digest, err := s.GetDigest(chatID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, messages, len(digest.Versions), fmt.Sprintf("node %d missed messages", i))
+		}
+	}
+
+	// each node relays a message to its neighbors only, instead of all the members
+	assert.LessOrEqual(t, network.relayed.Load(), int64(messages*size*DefaultViewSize))
+
+	for i, o := range network.nodes {
+		active := o.views[chatID].active
+		assert.NotEmpty(t, active, fmt.Sprintf("node %d has no neighbor", i))
+		assert.LessOrEqual(t, len(active), DefaultViewSize)
+
+		for _, id := range active {
+			assert.Contains(t, network.nodes[network.index[id]].views[chatID].active, o.myInfos.Id, "active views are not symmetric")
+		}
+	}
+}
+
+// test helper stopping failures nodes of a gossip chat of size nodes and checking the messages sent afterwards
+// reach the nodes alive
+func helperGossipNodesFailure(t *testing.T, size, failures, messages int) {
+	var (
+		network = newTestNetwork(t, size)
+		chatID  = helperGossipChat(t, network, "room")
+		alive   []int
+	)
+
+	// the heartbeats report the nodes that stopped to the other nodes
+	for _, i := range rand.Perm(size)[:failures] {
+		network.down[i].Store(true)
+	}
+
+	for i := range network.nodes {
+		if network.down[i].Load() {
+			continue
+		}
+
+		alive = append(alive, i)
+		for j := range network.nodes {
+			if network.down[j].Load() {
+				killNode := crdt.NewOperation(crdt.KillNode, "", nil)
+				killNode.Node = network.nodes[j].myInfos.Id
+				network.deliver(i, killNode)
+			}
+		}
+	}
+
+	network.wait(t)
+
+	for i := 0; i < messages; i++ {
+		network.send(alive[rand.Intn(len(alive))], chatID, fmt.Sprintf("message %d\n", i))
+	}
+
+	network.stop(t)
+
+	for _, i := range alive {
+		digest, err := network.storages[i].GetDigest(chatID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, messages, len(digest.Versions), fmt.Sprintf("node %d missed messages", i))
+		}
+
+		active := network.nodes[i].views[chatID].active
+		assert.NotEmpty(t, active, fmt.Sprintf("node %d has no neighbor", i))
+		for _, id := range active {
+			assert.False(t, network.down[network.index[id]].Load(), "dead neighbor")
+		}
+	}
+}
+
+func TestFillView_ForcesWithOneNeighbor(t *testing.T) {
+	var (
+		s                 = storage.NewStorage()
+		infos, id, keys   = helperNewNode(t, "9000", "alice")
+		o                 = NewOrchestrator(s, infos, id, keys)
+		chat              = crdt.NewChat("room")
+		neighbor, members = uuid.New(), []uuid.UUID{uuid.New(), uuid.New()}
+		toSend            = make(chan *crdt.Operation, 10)
+	)
+
+	chat.Gossip = true
+	assert.Nil(t, s.AddChat(chat))
+	for i, nodeID := range append([]uuid.UUID{neighbor}, members...) {
+		assert.Nil(t, s.AddNodeToChat(&crdt.NodeInfos{Id: nodeID, Name: fmt.Sprintf("node-%d", i)}, chat.Id))
+	}
+
+	// the node only has a neighbor who may only have the node : the first request can't be refused
+	o.getView(chat.Id).active = []uuid.UUID{neighbor}
+	o.fillView(chat.Id, toSend)
+	close(toSend)
+
+	var typologies []crdt.OperationType
+	for op := range toSend {
+		assert.Contains(t, members, op.Node)
+		typologies = append(typologies, op.Typology)
+	}
+
+	assert.Equal(t, []crdt.OperationType{crdt.ForceNeighbor, crdt.Neighbor}, typologies)
+}
@@ -1,13 +1,17 @@
 package orchestrator
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github/timtimjnvr/chat/conn"
 	"github/timtimjnvr/chat/crdt"
 	"github/timtimjnvr/chat/parsestdin"
 	"github/timtimjnvr/chat/reader"
 	"github/timtimjnvr/chat/storage"
-	"log"
+	"io"
 	"os"
 	"sync"
 
@@ -19,8 +23,50 @@ type (
 		*sync.RWMutex
 		debugMode    bool
 		myInfos      *crdt.NodeInfos
+		identity     *crdt.Identity // signs the messages we send
+		keys         *crdt.KeyPair  // receives the keys of encrypted chats
 		currenChatID uuid.UUID
-		storage      *storage.Storage
+		storage      Storage
+		events       *Bus                // see Events
+		viewSize     int                 // neighbors of the local node in each gossip chat
+		views        map[uuid.UUID]*view // partial views of the gossip chats, only used by HandleChats
+	}
+
+	// Storage holds the chats and nodes infos, implemented in memory by *storage.Storage
+	// and on disk by *storage.Persistent
+	Storage interface {
+		GetNumberOfChats() int
+		GetChatID(chatName string) (uuid.UUID, error)
+		GetChatName(id uuid.UUID) (string, error)
+		GetChat(chatID uuid.UUID) (*crdt.Chat, error)
+		GetChatInfos(chatID uuid.UUID) (*crdt.Chat, error)
+		GetNewCurrentChatID() (uuid.UUID, error)
+		GetChatIDsByNode(nodeID uuid.UUID) []uuid.UUID
+		AddNewChat(chatName string) (uuid.UUID, error)
+		AddChat(chat *crdt.Chat) error
+		RemoveChat(chatID uuid.UUID)
+
+		AddNodeToChat(node *crdt.NodeInfos, chatID uuid.UUID) error
+		RemoveNodeFromChat(nodeID uuid.UUID, chatID uuid.UUID) error
+		RemoveNodeFromStorage(nodeID uuid.UUID)
+		GetNode(nodeID uuid.UUID) (*crdt.NodeInfos, error)
+		GetNodeIDs(chatID uuid.UUID) ([]uuid.UUID, error)
+		IsNodeInOtherChats(nodeID uuid.UUID, excludeChatForSearch uuid.UUID) bool
+
+		AddMessageToChat(message *crdt.Message, chatID uuid.UUID) error
+		UpdateMessageInChat(message *crdt.Message, chatID uuid.UUID) error
+		DeleteMessageFromChat(message *crdt.Message, chatID uuid.UUID) error
+		GetDigest(chatID uuid.UUID) (*crdt.Digest, error)
+		GetMissingMessages(chatID uuid.UUID, digest *crdt.Digest) ([]*crdt.Message, error)
+
+		SetChatKey(chatID uuid.UUID, epoch uint32, key []byte) error
+		RotateChatKey(chatID uuid.UUID) (uint32, []byte, error)
+		SealMessage(message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error)
+		OpenMessage(message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error)
+
+		GetChats() []*crdt.Chat
+		GetNodes() []*crdt.NodeInfos
+		GetChatNodes(chatID uuid.UUID) ([]*crdt.NodeInfos, error)
 	}
 )
 
@@ -30,340 +76,981 @@ func (o *Orchestrator) updateCurrentChat(currenChatID uuid.UUID) {
 	o.currenChatID = currenChatID
 }
 
+var (
+	InvalidDataErr   = errors.New("can't parse op data")
+	LastChatErr      = errors.New("you can't leave your last chat")
+	ConnectToSelfErr = errors.New("you are trying to connect to yourself")
+	UnreachableErr   = errors.New("can't connect to the node, the operations sent to it are dropped")
+)
+
 const (
-	MaxMessagesStdin       = 100
-	logErrFormat           = "[ERROR] %s\n"
-	logFormat              = "[INFO] %s\n"
-	logOpperationErrFormat = "[ERROR] [%s] %s\n"
-	typeCommand            = "type a Command :"
+	MaxMessagesStdin = 100
+	logErrFormat     = "[ERROR] %s\n"
+	logFormat        = "[INFO] %s\n"
+	typeCommand      = "type a Command :"
 )
 
-func NewOrchestrator(storage *storage.Storage, myInfos *crdt.NodeInfos) *Orchestrator {
+// NewOrchestrator returns an orchestrator for the local node, identity is the identity matching myInfos.Id
+// and keys the key pair matching myInfos.PublicKey
+func NewOrchestrator(storage Storage, myInfos *crdt.NodeInfos, identity *crdt.Identity, keys *crdt.KeyPair) *Orchestrator {
 	var (
-		s     = storage
-		id, _ = s.AddNewChat(myInfos.Name)
-		o     = &Orchestrator{
-			RWMutex: &sync.RWMutex{},
-			myInfos: myInfos,
-			storage: s,
+		s       = storage
+		id, err = s.AddNewChat(myInfos.Name)
+		o       = &Orchestrator{
+			RWMutex:  &sync.RWMutex{},
+			myInfos:  myInfos,
+			identity: identity,
+			keys:     keys,
+			storage:  s,
+			events:   NewBus(),
+			viewSize: DefaultViewSize,
+			views:    make(map[uuid.UUID]*view),
 		}
 	)
 
+	// chat restored from a previous run
+	if err != nil {
+		id, _ = s.GetChatID(myInfos.Name)
+	}
+
 	o.updateCurrentChat(id)
 
 	return o
 }
 
 // HandleChats maintains chat infos consistency by executing and propagating operations received
-// from stdin or TCP connections through the channel toExecute
-func (o *Orchestrator) HandleChats(wg *sync.WaitGroup, toExecute chan *crdt.Operation, toSend chan<- *crdt.Operation) {
-	defer func() {
-		close(toSend)
-		wg.Done()
-	}()
+// from stdin or TCP connections through the channel toExecute until the Quit operation or ctx is done.
+// The operations already received when ctx is done are executed before leaving.
+func (o *Orchestrator) HandleChats(ctx context.Context, toExecute chan *crdt.Operation, toSend chan<- *crdt.Operation) {
+	defer close(toSend)
+	defer o.events.Close()
 
 	for {
+		var (
+			op   *crdt.Operation
+			more = true
+		)
+
 		select {
-		case op, more := <-toExecute:
-			if !more {
+		case <-ctx.Done():
+			select {
+			case op, more = <-toExecute:
+			default:
+				op = crdt.NewOperation(crdt.Quit, "", nil)
+			}
 
-				return
+		case op, more = <-toExecute:
+		}
+
+		if !more {
+			return
+		}
+
+		// operations of other nodes must be signed by the node they come from
+		if op.Node != uuid.Nil && !isNodeReport(op) {
+			err := op.VerifyAuthor(op.Node)
+			if err != nil {
+				o.fail(op, err)
+				continue
 			}
 
-			switch op.Typology {
-			case crdt.JoinChatByName:
-				chatID, err := o.storage.GetChatID(op.TargetedChat)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
-				}
+			if !o.fromPeer(op) {
+				o.fail(op, NotRecipientErr)
+				continue
+			}
+		}
 
-				newNodeInfos, ok := op.Data.(*crdt.NodeInfos)
-				if !ok {
-					log.Println("[ERROR] can't parse op data to NodeInfos")
-					continue
-				}
+		switch op.Typology {
+		case crdt.JoinChatByName:
+			chatID, err := o.storage.GetChatID(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
 
-				newNodeSlot := op.Slot
-
-				// create chat
-				createChatOperation := crdt.NewOperation(crdt.AddChat, op.TargetedChat, &crdt.Chat{Id: chatID, Name: op.TargetedChat})
-				createChatOperation.Slot = newNodeSlot
-				toSend <- createChatOperation
-
-				// add me
-				addMeOperation := crdt.NewOperation(crdt.SaveNode, chatID.String(), o.myInfos)
-				addMeOperation.Slot = newNodeSlot
-				toSend <- addMeOperation
-
-				// add other nodes
-				slots, _ := o.storage.GetSlots(chatID)
-				for _, s := range slots {
-					nodeInfo, err := o.storage.GetNodeBySlot(s)
-					if err != nil {
-						fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-						continue
-					}
-
-					addNodeOperation := crdt.NewOperation(crdt.AddNode, chatID.String(), nodeInfo)
-					addNodeOperation.Slot = newNodeSlot
-					toSend <- addNodeOperation
-				}
+			newNodeInfos, ok := op.Data.(*crdt.NodeInfos)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to NodeInfos", InvalidDataErr))
+				continue
+			}
 
-				// add new node
-				newNodeInfos.Slot = op.Slot
-				err = o.storage.AddNodeToChat(newNodeInfos, chatID)
+			newNodeID := op.Node
 
-				fmt.Printf(logFormat, fmt.Sprintf("%s joined chat", newNodeInfos.Name))
+			chat, err := o.storage.GetChat(chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
 
-			case crdt.CreateChat:
-				id, err := o.storage.AddNewChat(op.TargetedChat)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
-				}
+			if chat.Direct {
+				o.fail(op, DirectChatErr)
+				continue
+			}
 
-				// don't care about error since we just added the given chat
-				_ = o.storage.AddNodeToChat(o.myInfos, id)
+			// create chat
+			createChatOperation := crdt.NewOperation(crdt.AddChat, op.TargetedChat, &crdt.Chat{Id: chatID, Name: op.TargetedChat, Encrypted: chat.Encrypted, Gossip: chat.Gossip})
+			createChatOperation.Node = newNodeID
+			toSend <- createChatOperation
+
+			// add me
+			addMeOperation := crdt.NewOperation(crdt.SaveNode, chatID.String(), o.myInfos)
+			addMeOperation.Node = newNodeID
+			toSend <- addMeOperation
+
+			// add other nodes : in a gossip chat the new node only learns some of them with the chat history
+			// (see SyncChat) and connects to a few of them (see fillView)
+			nodeIDs, _ := o.storage.GetNodeIDs(chatID)
+			if chat.Gossip {
+				nodeIDs = nil
+			}
 
-			case crdt.AddChat:
-				newChatInfos, ok := op.Data.(*crdt.Chat)
-				if !ok {
-					fmt.Println("[ERROR] can't parse op data to Chat")
+			for _, id := range nodeIDs {
+				// the node may be joining again
+				if id == newNodeID {
 					continue
 				}
 
-				err := o.storage.AddChat(newChatInfos)
+				nodeInfo, err := o.storage.GetNode(id)
 				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
+					o.fail(op, err)
 					continue
 				}
 
-				o.updateCurrentChat(newChatInfos.Id)
-				fmt.Printf(logFormat, fmt.Sprintf("you joined a new chat : %s", newChatInfos.Name))
+				addNodeOperation := crdt.NewOperation(crdt.AddNode, chatID.String(), nodeInfo)
+				addNodeOperation.Node = newNodeID
+				toSend <- addNodeOperation
+			}
 
-			case crdt.AddNode, crdt.SaveNode:
-				chatID, err := uuid.Parse(op.TargetedChat)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
-				}
+			// add new node
+			err = o.addMember(newNodeInfos, chatID)
+			if err != nil {
+				o.fail(op, err)
+			}
 
-				newNodeInfos, ok := op.Data.(*crdt.NodeInfos)
-				if !ok {
-					log.Println("[ERROR] can't parse op data to NodeInfos")
-					continue
-				}
+			// we are the first neighbor of the new node
+			if chat.Gossip {
+				o.addNeighbor(chatID, newNodeID, toSend)
+			}
 
-				newNodeInfos.Slot = op.Slot
-				err = o.storage.AddNodeToChat(newNodeInfos, chatID)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
-				}
-				// in case of node we just added we need to ask the remote node to save us
-				if op.Typology == crdt.AddNode {
-					addMe := crdt.NewOperation(crdt.SaveNode, chatID.String(), o.myInfos)
-					addMe.Slot = op.Slot
-					toSend <- addMe
+			// share the key before the chat history : the node needs it to read the messages
+			if chat.Encrypted {
+				epoch, key, err := chat.GetKey()
+				if err == nil {
+					err = o.sendChatKey(chatID, newNodeID, epoch, key, toSend)
 				}
 
-			case crdt.AddMessage:
-				chatID, err := uuid.Parse(op.TargetedChat)
 				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
+					o.fail(op, err)
 				}
+			}
 
-				newMessage, ok := op.Data.(*crdt.Message)
-				if !ok {
-					log.Println("[ERROR] can't parse op data to Message")
-					break
+		case crdt.CreateChat:
+			var (
+				chatID uuid.UUID
+				err    error
+			)
+
+			if infos, ok := op.Data.(*crdt.Chat); ok && infos.Encrypted {
+				var chat *crdt.Chat
+				chat, err = crdt.NewEncryptedChat(op.TargetedChat)
+				if err == nil {
+					chatID = chat.Id
+					err = o.storage.AddChat(chat)
 				}
+			} else if ok && infos.Gossip {
+				chat := crdt.NewChat(op.TargetedChat)
+				chat.Gossip = true
+				chatID = chat.Id
+				err = o.storage.AddChat(chat)
+			} else {
+				chatID, err = o.storage.AddNewChat(op.TargetedChat)
+			}
 
-				err = o.storage.AddMessageToChat(newMessage, chatID)
-				if err != nil {
-					continue
-				}
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
 
-				// No error so we effectively got a new message
-				fmt.Printf("%s (%s): %s", newMessage.Sender, newMessage.Date, newMessage.Content)
+			o.emit(ChatJoined, chatID, nil, nil)
 
-				slots, err := o.storage.GetSlots(chatID)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
-				}
-				for _, s := range slots {
-					// Send message to all slots except the sender
-					if op.Slot != s {
-						copied := op.Copy()
-						copied.Slot = s
-						toSend <- copied
-					}
-				}
+		case crdt.AddChat:
+			newChatInfos, ok := op.Data.(*crdt.Chat)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to Chat", InvalidDataErr))
+				continue
+			}
 
-			case crdt.RemoveNode:
-				chatID, err := uuid.Parse(op.TargetedChat)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
+			err := o.storage.AddChat(newChatInfos)
+			// already known chat : we are joining it again after a restart
+			if err != nil && !errors.Is(err, storage.AlreadyInListWithIDErr) {
+				o.fail(op, err)
+				continue
+			}
+
+			o.updateCurrentChat(newChatInfos.Id)
+			o.emit(ChatJoined, newChatInfos.Id, nil, nil)
+
+			// the entry point node is our first neighbor
+			if newChatInfos.Gossip {
+				o.addNeighbor(newChatInfos.Id, op.Node, toSend)
+			}
+
+			// ask the entry point node for the chat history
+			err = o.sendDigest(newChatInfos.Id, op.Node, false, toSend)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+		case crdt.AddNode, crdt.SaveNode:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			newNodeInfos, ok := op.Data.(*crdt.NodeInfos)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to NodeInfos", InvalidDataErr))
+				continue
+			}
+
+			// the local node is not a member of its own chats
+			if newNodeInfos.Id == o.myInfos.Id {
+				continue
+			}
+
+			err = o.addMember(newNodeInfos, chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+			// in case of node we just added we need to ask the remote node to save us
+			if op.Typology == crdt.AddNode {
+				addMe := crdt.NewOperation(crdt.SaveNode, chatID.String(), o.myInfos)
+				addMe.Node = newNodeInfos.Id
+				toSend <- addMe
+			}
+
+			// a new candidate to become our neighbor
+			o.fillView(chatID, toSend)
+
+		case crdt.Neighbor, crdt.ForceNeighbor:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			infos, ok := op.Data.(*crdt.NodeInfos)
+			if !ok || infos.Id != op.Node {
+				o.fail(op, fmt.Errorf("%w to the NodeInfos of the node", InvalidDataErr))
+				continue
+			}
+
+			// we are not (anymore) in the gossip chat
+			if !o.isGossip(chatID) {
+				leaveOperation := crdt.NewOperation(crdt.RemoveNode, chatID.String(), nil)
+				leaveOperation.Node = op.Node
+				toSend <- leaveOperation
+				continue
+			}
+
+			err = o.addMember(infos, chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			o.answerNeighbor(op, chatID, toSend)
+
+		case crdt.Prune:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			if !o.isGossip(chatID) {
+				continue
+			}
+
+			// the node refused our request or replaced us with another neighbor
+			v := o.getView(chatID)
+			if contains(v.pending, op.Node) {
+				v.rejected[op.Node] = true
+			}
+
+			v.active = remove(v.active, op.Node)
+			v.pending = remove(v.pending, op.Node)
+			o.fillView(chatID, toSend)
+			o.release(op.Node, toSend)
+
+		case crdt.AddMessage:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			newMessage, ok := op.Data.(*crdt.Message)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to Message", InvalidDataErr))
+				break
+			}
+
+			newMessage, err = o.checkMessage(op, newMessage, chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			err = o.storage.AddMessageToChat(newMessage, chatID)
+			if err != nil {
+				continue
+			}
+
+			// No error so we effectively got a new message, a message deleted before it reached us has nothing to show
+			if !newMessage.Deleted {
+				o.emit(MessageReceived, chatID, newMessage, nil)
+			}
+
+			err = o.propagate(op, chatID, toSend)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+		case crdt.DirectMessage:
+			err := o.directMessage(op, toSend)
+			if err != nil {
+				o.fail(op, err)
+			}
+
+		case crdt.ListRemoteChats:
+			// the node joins none of our chats : the connection is closed once it has the list
+			rooms := crdt.NewOperation(crdt.RemoteChats, "", crdt.NewRoomList(o.myInfos.Name, o.storage.GetChats()))
+			rooms.Node = op.Node
+			toSend <- rooms
+			o.release(op.Node, toSend)
+
+		case crdt.RemoteChats:
+			rooms, ok := op.Data.(*crdt.RoomList)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to RoomList", InvalidDataErr))
+				continue
+			}
+
+			o.events.Publish(Event{Typology: RoomsListed, Rooms: rooms})
+			o.release(op.Node, toSend)
+
+		case crdt.UpdateMessage, crdt.DeleteMessage:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			message, ok := op.Data.(*crdt.Message)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to Message", InvalidDataErr))
+				break
+			}
+
+			message, err = o.checkMessage(op, message, chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			if op.Typology == crdt.UpdateMessage {
+				err = o.storage.UpdateMessageInChat(message, chatID)
+			} else {
+				err = o.storage.DeleteMessageFromChat(message, chatID)
+			}
+
+			if err != nil {
+				// Only report errors for our own modifications, others are duplicates
+				if op.Node == uuid.Nil {
+					o.fail(op, err)
 				}
+				continue
+			}
 
-				err = o.storage.RemoveNodeFromChat(op.Slot, chatID)
+			if message.Deleted {
+				o.emit(MessageDeleted, chatID, message, nil)
+			} else {
+				o.emit(MessageEdited, chatID, message, nil)
+			}
+
+			err = o.propagate(op, chatID, toSend)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+		case crdt.SyncChat:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			digest, ok := op.Data.(*crdt.Digest)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to Digest", InvalidDataErr))
+				continue
+			}
+
+			// send the messages the remote node is missing
+			missing, err := o.storage.GetMissingMessages(chatID, digest)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			for _, m := range missing {
+				sealed, err := o.storage.SealMessage(m, chatID)
 				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
+					o.fail(op, err)
+					break
 				}
 
-			case crdt.KillNode:
-				o.storage.RemoveNodeSlotFromStorage(op.Slot)
+				messageOperation := crdt.NewOperation(digest.GetOperationType(m), chatID.String(), sealed)
+				messageOperation.Node = op.Node
+				toSend <- messageOperation
+			}
 
-			case crdt.RemoveChat:
-				// Only one chat in storage
-				if o.storage.GetNumberOfChats() <= 1 {
-					fmt.Printf("[ERROR] You can't leave the current c\n")
-					continue
-				}
+			if o.isGossip(chatID) {
+				o.sendMissingMembers(chatID, op.Node, digest.Members, toSend)
+			}
 
-				chatID, err := uuid.Parse(op.TargetedChat)
+			// ask for the messages we are missing
+			if !digest.Reply {
+				err = o.sendDigest(chatID, op.Node, true, toSend)
 				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
+					o.fail(op, err)
 				}
+			}
 
-				chatNodeSlots, err := o.storage.GetSlots(chatID)
+		case crdt.SyncNode:
+			// connection re-established : synchronize every chat shared with the node
+			for _, chatID := range o.storage.GetChatIDsByNode(op.Node) {
+				err := o.sendDigest(chatID, op.Node, false, toSend)
 				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
+					o.fail(op, err)
 				}
+			}
 
-				// Killing needed connections and removing node from chat
-				for _, s := range chatNodeSlots {
-					if o.storage.IsSlotUsedByOtherChats(s, chatID) {
-						leaveOperation := crdt.NewOperation(crdt.RemoveNode, chatID.String(), nil)
-						leaveOperation.Slot = s
-						toSend <- leaveOperation
-					} else {
-						removeNode := crdt.NewOperation(crdt.KillNode, "", nil)
-						removeNode.Slot = s
-						toSend <- removeNode
-					}
-				}
+		case crdt.RemoveNode:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
 
-				chatName, err := o.storage.GetChatName(chatID)
-				if err != nil {
-					fmt.Printf(logOpperationErrFormat, crdt.GetOperationName(op.Typology), err)
-					continue
+			node, _ := o.storage.GetNode(op.Node)
+			err = o.storage.RemoveNodeFromChat(op.Node, chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			if node != nil {
+				o.emit(MemberLeft, chatID, nil, node)
+			}
+
+			o.rotateChatKey(chatID, toSend)
+			o.removeNeighbor(chatID, op.Node)
+			o.fillView(chatID, toSend)
+
+		case crdt.KillNode:
+			chatIDs := o.storage.GetChatIDsByNode(op.Node)
+			node, _ := o.storage.GetNode(op.Node)
+			o.storage.RemoveNodeFromStorage(op.Node)
+
+			for _, chatID := range chatIDs {
+				if node != nil {
+					o.emit(MemberLeft, chatID, nil, node)
 				}
 
-				//Removing chat from storage
-				o.storage.RemoveChat(chatID)
-				fmt.Printf(logFormat, fmt.Sprintf("Leaving %s", chatName))
+				o.rotateChatKey(chatID, toSend)
+				o.removeNeighbor(chatID, op.Node)
+				o.fillView(chatID, toSend)
+			}
+
+		case crdt.ConnectionStatus:
+			// only the node handler reports the status of its connections
+			if !isNodeReport(op) {
+				continue
+			}
 
-				// Getting new current chat
-				newID, _ := o.storage.GetNewCurrentChatID()
-				o.updateCurrentChat(newID)
-				newCurrentName, _ := o.storage.GetChatName(newID)
-				fmt.Printf("Switched to chat %s\n", newCurrentName)
+			status, ok := op.Data.(*crdt.NodeStatus)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to NodeStatus", InvalidDataErr))
+				continue
+			}
 
-			case crdt.Quit:
-				// Node handler need to close all TCP connections (node slot 0)
-				toSend <- crdt.NewOperation(crdt.KillNode, "", nil)
-				return
+			node, err := o.storage.GetNode(op.Node)
+			if err != nil {
+				continue
+			}
+
+			if status.Failed {
+				o.fail(op, fmt.Errorf("%w : %s", UnreachableErr, node.Name))
+				continue
+			}
+
+			o.events.Publish(Event{Typology: ConnectionChanged, Node: node, Status: status.Status})
+
+		case crdt.SetChatKey:
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			chatKey, ok := op.Data.(*crdt.ChatKey)
+			if !ok {
+				o.fail(op, fmt.Errorf("%w to ChatKey", InvalidDataErr))
+				continue
+			}
+
+			err = o.saveChatKey(op.Node, chatID, chatKey)
+			if err != nil {
+				o.fail(op, err)
+			}
+
+		case crdt.RemoveChat:
+			// Only one chat in storage
+			if o.storage.GetNumberOfChats() <= 1 {
+				o.fail(op, LastChatErr)
+				continue
+			}
+
+			chatID, err := uuid.Parse(op.TargetedChat)
+			if err != nil {
+				o.fail(op, err)
+				continue
 			}
+
+			chatNodeIDs, err := o.storage.GetNodeIDs(chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			// Killing needed connections and removing node from chat
+			for _, id := range chatNodeIDs {
+				if o.storage.IsNodeInOtherChats(id, chatID) {
+					leaveOperation := crdt.NewOperation(crdt.RemoveNode, chatID.String(), nil)
+					leaveOperation.Node = id
+					toSend <- leaveOperation
+				} else {
+					removeNode := crdt.NewOperation(crdt.KillNode, "", nil)
+					removeNode.Node = id
+					toSend <- removeNode
+				}
+			}
+
+			chatName, err := o.storage.GetChatName(chatID)
+			if err != nil {
+				o.fail(op, err)
+				continue
+			}
+
+			//Removing chat from storage
+			o.storage.RemoveChat(chatID)
+			delete(o.views, chatID)
+
+			// Getting new current chat
+			newID, _ := o.storage.GetNewCurrentChatID()
+			o.updateCurrentChat(newID)
+
+			// the chat is not in storage anymore
+			o.events.Publish(Event{Typology: ChatLeft, Chat: chatName})
+
+		case crdt.Quit:
+			// Node handler need to close all TCP connections (uuid.Nil node)
+			toSend <- crdt.NewOperation(crdt.KillNode, "", nil)
+			return
+		}
+	}
+}
+
+// sendDigest sends the summary of the chat messages (and members of a gossip chat) to the node
+func (o *Orchestrator) sendDigest(chatID uuid.UUID, nodeID uuid.UUID, reply bool, toSend chan<- *crdt.Operation) error {
+	digest, err := o.storage.GetDigest(chatID)
+	if err != nil {
+		return err
+	}
+
+	digest.Reply = reply
+	if o.isGossip(chatID) {
+		digest.Members, err = o.storage.GetNodeIDs(chatID)
+		if err != nil {
+			return err
+		}
+	}
+
+	syncOperation := crdt.NewOperation(crdt.SyncChat, chatID.String(), digest)
+	syncOperation.Node = nodeID
+	toSend <- syncOperation
+
+	return nil
+}
+
+// propagate sends the operation to all the nodes of the chat (its neighbors in a gossip chat) except the one who forwarded it
+func (o *Orchestrator) propagate(op *crdt.Operation, chatID uuid.UUID, toSend chan<- *crdt.Operation) error {
+	nodeIDs, err := o.relayTargets(chatID)
+	if err != nil {
+		return err
+	}
+
+	data := op.Data
+	if message, ok := data.(*crdt.Message); ok {
+		data, err = o.storage.SealMessage(message, chatID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range nodeIDs {
+		if op.Node != id {
+			copied := op.Copy()
+			copied.Node = id
+			copied.Data = data
+			toSend <- copied
+		}
+	}
+
+	return nil
+}
+
+// checkMessage returns the message received from another node in clear once its signature is verified,
+// local messages are signed (see signMessage). op.Data is replaced with the returned message.
+func (o *Orchestrator) checkMessage(op *crdt.Operation, message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error) {
+	var err error
+	if op.Node == uuid.Nil {
+		message, err = o.signMessage(op.Typology, message, chatID)
+	} else {
+		message, err = o.storage.OpenMessage(message, chatID)
+		if err == nil {
+			err = message.Verify()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	op.Data = message
+	return message, nil
+}
+
+// signMessage stamps a message we send with the chat clock before signing it so that the signature
+// covers the message as saved. Edits and deletions are built from the saved message.
+func (o *Orchestrator) signMessage(typology crdt.OperationType, message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error) {
+	chat, err := o.storage.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := *message
+	switch typology {
+	case crdt.AddMessage, crdt.DirectMessage:
+		signed.Clock = chat.GetClock() + 1
+
+	case crdt.UpdateMessage, crdt.DeleteMessage:
+		saved, err := chat.GetMessage(message.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		// the chat refuses the modification if we are not the sender
+		signed = *saved
+		signed.NodeId = message.NodeId
+		if typology == crdt.UpdateMessage {
+			signed.Content = message.Content
+			signed.Edit = chat.GetClock() + 1
+		} else {
+			signed.Content = ""
+			signed.Edit = 0
+			signed.Deleted = true
 		}
 	}
+
+	o.identity.SignMessage(&signed)
+	return &signed, nil
+}
+
+// sendChatKey seals the key of the chat for the node and sends it
+func (o *Orchestrator) sendChatKey(chatID uuid.UUID, nodeID uuid.UUID, epoch uint32, key []byte, toSend chan<- *crdt.Operation) error {
+	infos, err := o.storage.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	chatKey, err := crdt.NewChatKey(epoch, key, infos.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	keyOperation := crdt.NewOperation(crdt.SetChatKey, chatID.String(), chatKey)
+	keyOperation.Node = nodeID
+	toSend <- keyOperation
+	return nil
+}
+
+func (o *Orchestrator) isMember(chatID uuid.UUID, nodeID uuid.UUID) bool {
+	nodeIDs, err := o.storage.GetNodeIDs(chatID)
+	return err == nil && contains(nodeIDs, nodeID)
+}
+
+// saveChatKey saves a key of an encrypted chat sent by one of its members
+func (o *Orchestrator) saveChatKey(nodeID uuid.UUID, chatID uuid.UUID, chatKey *crdt.ChatKey) error {
+	if !o.isMember(chatID, nodeID) {
+		return errors.New("chat key sent by a node outside of the chat")
+	}
+
+	key, err := o.keys.OpenChatKey(chatKey)
+	if err != nil {
+		return err
+	}
+
+	return o.storage.SetChatKey(chatID, chatKey.Epoch, key)
 }
 
-func (o *Orchestrator) HandleStdin(osStdin *os.File, toExecute chan *crdt.Operation, outgoingConnectionRequests chan<- conn.ConnectionRequest, shutdown chan struct{}, sigC chan os.Signal) {
+// rotateChatKey replaces the key of an encrypted chat after a member left so that it can't read the next messages.
+// Only the remaining member with the smallest id generates the new key and sends it to the others.
+func (o *Orchestrator) rotateChatKey(chatID uuid.UUID, toSend chan<- *crdt.Operation) {
+	chat, err := o.storage.GetChat(chatID)
+	if err != nil || !chat.Encrypted {
+		return
+	}
+
+	nodeIDs := chat.GetNodes()
+	for _, id := range nodeIDs {
+		if bytes.Compare(id[:], o.myInfos.Id[:]) < 0 {
+			return
+		}
+	}
+
+	epoch, key, err := o.storage.RotateChatKey(chatID)
+	if err != nil {
+		o.events.Publish(Event{Typology: Error, Chat: chat.Name, Err: err})
+		return
+	}
+
+	for _, id := range nodeIDs {
+		err = o.sendChatKey(chatID, id, epoch, key, toSend)
+		if err != nil {
+			o.events.Publish(Event{Typology: Error, Chat: chat.Name, Err: err})
+		}
+	}
+}
+
+// HandleStdin creates operations from the commands typed by the user until /quit, the end of stdin or ctx is done
+func (o *Orchestrator) HandleStdin(ctx context.Context, stdin io.Reader, toExecute chan<- *crdt.Operation, outgoingConnectionRequests chan<- conn.ConnectionRequest) {
 	var (
-		wgReadStdin = sync.WaitGroup{}
-		stdinChann  = make(chan []byte, MaxMessagesStdin)
-		stopReading = make(chan struct{}, 0)
+		stdinChann           = make(chan []byte, MaxMessagesStdin)
+		reading, stopReading = context.WithCancel(ctx)
 	)
 
-	defer func() {
-
-		close(stopReading)
-		wgReadStdin.Wait()
-	}()
+	defer stopReading()
 
-	go reader.Read(osStdin, stdinChann, reader.Separator, stopReading)
+	go reader.Read(reading, stdin, stdinChann, bufio.ScanLines)
 
 	for {
 		fmt.Printf(logFormat, typeCommand)
 
 		select {
-		case <-sigC:
-			quit(toExecute, shutdown)
+		case <-ctx.Done():
 			return
 
-		case line := <-stdinChann:
-			cmd, err := parsestdin.NewCommand(string(line))
-			if err != nil {
-				fmt.Printf(logErrFormat, err)
+		case line, more := <-stdinChann:
+			// stdin exhausted (EOF)
+			if !more {
+				return
+			}
+
+			// empty lines only print the prompt again
+			if len(bytes.TrimSpace(line)) == 0 {
 				continue
 			}
 
-			args := cmd.GetArgs()
-			switch cmd.GetTypology() {
-			case crdt.JoinChatByName:
-				if args[parsestdin.PortArg] == o.myInfos.Port && sameAddress(o.myInfos.Address, args[parsestdin.AddrArg]) {
-					fmt.Printf(logErrFormat, "You are trying to connect to yourself")
-					continue
-				}
+			if !o.HandleCommand(ctx, string(line), os.Stdout, toExecute, outgoingConnectionRequests) {
+				return
+			}
+		}
+	}
+}
 
-				outgoingConnectionRequests <- conn.NewConnectionRequest(args[parsestdin.PortArg], args[parsestdin.AddrArg], args[parsestdin.ChatRoomArg])
+// HandleCommand creates the operations of a command typed by the user, what the command displays is written on output.
+// It returns false once the user quits.
+func (o *Orchestrator) HandleCommand(ctx context.Context, line string, output io.Writer, toExecute chan<- *crdt.Operation, outgoingConnectionRequests chan<- conn.ConnectionRequest) bool {
+	execute := func(op *crdt.Operation) {
+		select {
+		case toExecute <- op:
+		case <-ctx.Done():
+		}
+	}
 
-			default:
-				switch cmd.GetTypology() {
-				case crdt.CreateChat:
-					toExecute <- crdt.NewOperation(crdt.CreateChat, args[parsestdin.ChatRoomArg], nil)
+	cmd, err := parsestdin.NewCommand(line)
+	if err != nil {
+		fmt.Fprintf(output, logErrFormat, err)
+		return true
+	}
 
-				case crdt.SwitchChat:
-					chatName := args[parsestdin.ChatRoomArg]
-					id, err := o.storage.GetChatID(chatName)
-					if err != nil {
-						fmt.Printf(logErrFormat, err)
-					}
+	var (
+		args          = cmd.GetArgs()
+		currentChatID = o.getCurrentChatID()
+	)
 
-					o.updateCurrentChat(id)
+	switch cmd.GetTypology() {
+	case crdt.JoinChatByName:
+		if o.IsMe(args[parsestdin.AddrArg], args[parsestdin.PortArg]) {
+			fmt.Fprintf(output, logErrFormat, ConnectToSelfErr)
+			return true
+		}
 
-					fmt.Printf(logFormat, fmt.Sprintf("Switched to chat %s", chatName))
+		select {
+		case outgoingConnectionRequests <- conn.NewConnectionRequest(args[parsestdin.PortArg], args[parsestdin.AddrArg], args[parsestdin.ChatRoomArg]):
+		case <-ctx.Done():
+		}
 
-				case crdt.AddMessage:
-					/* Add the messageBytes to discussion & sync with other nodes */
-					toExecute <- crdt.NewOperation(crdt.AddMessage,
-						o.currenChatID.String(),
-						crdt.NewMessage(o.myInfos.Name, args[parsestdin.MessageArg]))
+	case crdt.CreateChat:
+		var chat crdt.Data
+		if args[parsestdin.EncryptedArg] != "" {
+			chat = &crdt.Chat{Name: args[parsestdin.ChatRoomArg], Encrypted: true}
+		} else if args[parsestdin.GossipArg] != "" {
+			chat = &crdt.Chat{Name: args[parsestdin.ChatRoomArg], Gossip: true}
+		}
 
-				case crdt.ListChats:
-					o.storage.DisplayChats()
+		execute(crdt.NewOperation(crdt.CreateChat, args[parsestdin.ChatRoomArg], chat))
 
-				case crdt.ListUsers:
-					o.storage.DisplayNodes()
+	case crdt.SwitchChat:
+		chatName := args[parsestdin.ChatRoomArg]
+		id, err := o.storage.GetChatID(chatName)
+		if err != nil {
+			fmt.Fprintf(output, logErrFormat, err)
+			return true
+		}
 
-				case crdt.ListChatUsers:
-					err = o.storage.DisplayChatUsers(o.currenChatID)
-					if err != nil {
-						fmt.Printf(logErrFormat, err)
-					}
+		o.updateCurrentChat(id)
 
-				case crdt.RemoveChat:
-					toExecute <- crdt.NewOperation(crdt.RemoveChat, o.currenChatID.String(), o.myInfos)
+		fmt.Fprintf(output, logFormat, fmt.Sprintf("Switched to chat %s", chatName))
 
-				case crdt.Quit:
-					quit(toExecute, shutdown)
-					return
-				}
-			}
+	case crdt.AddMessage:
+		message := crdt.NewMessage(o.myInfos.Id, o.myInfos.Name, args[parsestdin.MessageArg])
+
+		// the messages of a direct chat only go to the other node
+		if peerID, direct := o.directPeer(currentChatID); direct && peerID != uuid.Nil {
+			execute(crdt.NewOperation(crdt.DirectMessage, peerID.String(), message))
+			return true
+		}
+
+		/* Add the messageBytes to discussion & sync with other nodes */
+		execute(crdt.NewOperation(crdt.AddMessage, currentChatID.String(), message))
+
+	case crdt.DirectMessage:
+		node, err := o.findUser(args[parsestdin.UserArg])
+		if err != nil {
+			fmt.Fprintf(output, logErrFormat, err)
+			return true
+		}
+
+		execute(crdt.NewOperation(crdt.DirectMessage, node.Id.String(),
+			crdt.NewMessage(o.myInfos.Id, o.myInfos.Name, args[parsestdin.MessageArg])))
+
+	case crdt.UpdateMessage, crdt.DeleteMessage:
+		messageID, err := uuid.Parse(args[parsestdin.MessageIdArg])
+		if err != nil {
+			fmt.Fprintf(output, logErrFormat, err)
+			return true
+		}
+
+		message := &crdt.Message{
+			Id:      messageID,
+			NodeId:  o.myInfos.Id,
+			Sender:  o.myInfos.Name,
+			Content: args[parsestdin.MessageArg],
+		}
+
+		execute(crdt.NewOperation(cmd.GetTypology(), currentChatID.String(), message))
+
+	case crdt.ListRemoteChats:
+		if o.IsMe(args[parsestdin.AddrArg], args[parsestdin.PortArg]) {
+			fmt.Fprintf(output, logErrFormat, ConnectToSelfErr)
+			return true
+		}
+
+		// the rooms are displayed once the node answers, see RoomsListed
+		select {
+		case outgoingConnectionRequests <- conn.NewRoomsRequest(args[parsestdin.PortArg], args[parsestdin.AddrArg]):
+		case <-ctx.Done():
+		}
+
+	case crdt.ListChats:
+		displayChats(output, o.storage.GetChats())
+
+	case crdt.ListUsers:
+		displayNodes(output, o.storage.GetNodes())
+
+	case crdt.ListChatUsers:
+		chatName, err := o.storage.GetChatName(currentChatID)
+		if err != nil {
+			fmt.Fprintf(output, logErrFormat, err)
+			return true
+		}
+
+		nodes, err := o.storage.GetChatNodes(currentChatID)
+		if err != nil {
+			fmt.Fprintf(output, logErrFormat, err)
+			return true
 		}
+
+		displayChatUsers(output, chatName, nodes)
+
+	case crdt.Help:
+		fmt.Fprint(output, parsestdin.Help())
+
+	case crdt.RemoveChat:
+		execute(crdt.NewOperation(crdt.RemoveChat, currentChatID.String(), o.myInfos))
+
+	case crdt.Quit:
+		return false
 	}
+
+	return true
+}
+
+// CurrentChat returns the name of the chat the commands apply to
+func (o *Orchestrator) CurrentChat() string {
+	chatName, _ := o.storage.GetChatName(o.getCurrentChatID())
+	return chatName
+}
+
+func (o *Orchestrator) getCurrentChatID() uuid.UUID {
+	o.RLock()
+	defer o.RUnlock()
+	return o.currenChatID
+}
+
+// isNodeReport reports whether the operation has been emitted by the node handler about the connection with op.Node,
+// the node handler drops the unsigned operations received from other nodes
+func isNodeReport(op *crdt.Operation) bool {
+	switch op.Typology {
+	case crdt.SyncNode, crdt.KillNode, crdt.ConnectionStatus:
+		return len(op.Signature) == 0
+	}
+
+	return false
 }
 
-func quit(toExecute chan *crdt.Operation, shutdown chan struct{}) {
-	toExecute <- crdt.NewOperation(crdt.Quit, "", nil)
-	close(shutdown)
+// IsMe reports whether addr:port is the address the local node listens on
+func (o *Orchestrator) IsMe(addr, port string) bool {
+	return port == o.myInfos.Port && sameAddress(o.myInfos.Address, addr)
 }
 
 func sameAddress(addr1, addr2 string) bool {
@@ -0,0 +1,666 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	idleDuration    = 200 * time.Millisecond
+	maxTestDuration = 5 * time.Second
+)
+
+// testCluster links two orchestrators as if they were connected by a TCP connection
+type testCluster struct {
+	nodes        [2]*Orchestrator
+	storages     [2]*storage.Storage
+	toExecute    [2]chan *crdt.Operation
+	toSend       [2]chan *crdt.Operation
+	lastActivity atomic.Int64
+
+	wireLock *sync.Mutex
+	wire     []*crdt.Operation // operations exchanged between the nodes, as received
+	lost     []*crdt.Operation // operations sent to nodes outside of the cluster
+
+	wgHandleChats *sync.WaitGroup
+	wgRoute       *sync.WaitGroup
+}
+
+func newTestCluster(storages [2]*storage.Storage, infos [2]*crdt.NodeInfos, identities [2]*crdt.Identity, keys [2]*crdt.KeyPair) *testCluster {
+	c := &testCluster{
+		storages:      storages,
+		wireLock:      &sync.Mutex{},
+		wgHandleChats: &sync.WaitGroup{},
+		wgRoute:       &sync.WaitGroup{},
+	}
+
+	for i := range c.nodes {
+		c.nodes[i] = NewOrchestrator(storages[i], infos[i], identities[i], keys[i])
+		c.toExecute[i] = make(chan *crdt.Operation, 1000)
+		c.toSend[i] = make(chan *crdt.Operation)
+	}
+
+	c.lastActivity.Store(time.Now().UnixNano())
+	for i := range c.nodes {
+		c.wgHandleChats.Add(1)
+		go func(o *Orchestrator, toExecute chan *crdt.Operation, toSend chan<- *crdt.Operation) {
+			defer c.wgHandleChats.Done()
+			o.HandleChats(context.Background(), toExecute, toSend)
+		}(c.nodes[i], c.toExecute[i], c.toSend[i])
+
+		c.wgRoute.Add(1)
+		go c.route(c.toSend[i], c.toExecute[1-i], identities[i], infos[1-i].Id)
+	}
+
+	return c
+}
+
+// route delivers the operations broadcast or sent to the node to through the wire format, as the node handler would
+func (c *testCluster) route(toSend <-chan *crdt.Operation, toExecute chan<- *crdt.Operation, from *crdt.Identity, to uuid.UUID) {
+	defer c.wgRoute.Done()
+
+	for op := range toSend {
+		c.lastActivity.Store(time.Now().UnixNano())
+		if op.Node != uuid.Nil && op.Node != to {
+			c.wireLock.Lock()
+			c.lost = append(c.lost, op.Copy())
+			c.wireLock.Unlock()
+			continue
+		}
+
+		from.SignOperation(op)
+		received, err := crdt.DecodeOperation(op.ToBytes())
+		if err != nil {
+			continue
+		}
+
+		received.Node = from.Id()
+
+		c.wireLock.Lock()
+		c.wire = append(c.wire, received.Copy())
+		c.wireLock.Unlock()
+
+		toExecute <- received
+	}
+}
+
+// stop waits for the cluster to be idle and stops both orchestrators
+func (c *testCluster) stop(t *testing.T) {
+	timeout := time.Now().Add(maxTestDuration)
+	for time.Since(time.Unix(0, c.lastActivity.Load())) < idleDuration {
+		if time.Now().After(timeout) {
+			assert.Fail(t, "test timeout")
+			break
+		}
+
+		time.Sleep(idleDuration / 10)
+	}
+
+	for i := range c.nodes {
+		c.toExecute[i] <- crdt.NewOperation(crdt.Quit, "", nil)
+	}
+
+	c.wgHandleChats.Wait()
+	c.wgRoute.Wait()
+}
+
+// helperNewNodes returns the infos, identities and key pairs of alice and bob
+func helperNewNodes(t *testing.T) ([2]*crdt.NodeInfos, [2]*crdt.Identity, [2]*crdt.KeyPair) {
+	var (
+		infos      [2]*crdt.NodeInfos
+		identities [2]*crdt.Identity
+		keys       [2]*crdt.KeyPair
+	)
+
+	for i, name := range []string{"alice", "bob"} {
+		infos[i], identities[i], keys[i] = helperNewNode(t, fmt.Sprintf("%d", 8080+i), name)
+	}
+
+	return infos, identities, keys
+}
+
+func helperNewNode(t *testing.T, port, name string) (*crdt.NodeInfos, *crdt.Identity, *crdt.KeyPair) {
+	identity, err := crdt.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := crdt.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := crdt.NewNodeInfos("", port, name)
+	infos.Id = identity.Id()
+	infos.PublicKey = keys.PublicKey()
+	return infos, identity, keys
+}
+
+// helperReceived returns the operation as received from the node owning identity
+func helperReceived(identity *crdt.Identity, op *crdt.Operation) *crdt.Operation {
+	identity.SignOperation(op)
+	op.Node = identity.Id()
+	return op
+}
+
+// helperSaveMessage saves a message written on the node owning identity, as HandleChats does for a local operation
+func helperSaveMessage(t *testing.T, s *storage.Storage, identity *crdt.Identity, typology crdt.OperationType, message *crdt.Message, chatID uuid.UUID) *crdt.Message {
+	o := &Orchestrator{identity: identity, storage: s}
+	signed, err := o.signMessage(typology, message, chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch typology {
+	case crdt.AddMessage:
+		err = s.AddMessageToChat(signed, chatID)
+	case crdt.UpdateMessage:
+		err = s.UpdateMessageInChat(signed, chatID)
+	case crdt.DeleteMessage:
+		err = s.DeleteMessageFromChat(signed, chatID)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestHandleChats_JoinSyncsHistory(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+	)
+
+	chatID, err := storages[0].AddNewChat("room")
+	assert.Nil(t, err)
+
+	for _, content := range []string{"first\n", "second\n", "third\n"} {
+		helperSaveMessage(t, storages[0], identities[0], crdt.AddMessage, crdt.NewMessage(infos[0].Id, infos[0].Name, content), chatID)
+	}
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	// bob joins the room through alice
+	cluster.toExecute[0] <- helperReceived(identities[1], crdt.NewOperation(crdt.JoinChatByName, "room", infos[1]))
+
+	cluster.stop(t)
+
+	expected, err := storages[0].GetDigest(chatID)
+	assert.Nil(t, err)
+	got, err := storages[1].GetDigest(chatID)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, len(got.Versions))
+	assert.Equal(t, expected, got)
+}
+
+func TestHandleChats_SyncNodeHealsPartition(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		chat                    = crdt.NewChat("room")
+		shared                  [2]*crdt.Message
+	)
+
+	// both nodes are in the room
+	for i, s := range storages {
+		replica := crdt.NewChat(chat.Name)
+		replica.Id = chat.Id
+		assert.Nil(t, s.AddChat(replica))
+
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+	}
+
+	for i := range shared {
+		shared[i] = helperSaveMessage(t, storages[i], identities[i], crdt.AddMessage, crdt.NewMessage(infos[i].Id, infos[i].Name, "before partition\n"), chat.Id)
+		copied := *shared[i]
+		assert.Nil(t, storages[1-i].AddMessageToChat(&copied, chat.Id))
+	}
+
+	// messages sent while the connection was down
+	for i, s := range storages {
+		for j := 0; j <= i+1; j++ {
+			helperSaveMessage(t, s, identities[i], crdt.AddMessage, crdt.NewMessage(infos[i].Id, infos[i].Name, "during partition\n"), chat.Id)
+		}
+	}
+
+	helperSaveMessage(t, storages[0], identities[0], crdt.UpdateMessage, &crdt.Message{Id: shared[0].Id, NodeId: infos[0].Id, Content: "edited\n"}, chat.Id)
+	helperSaveMessage(t, storages[1], identities[1], crdt.DeleteMessage, &crdt.Message{Id: shared[1].Id, NodeId: infos[1].Id}, chat.Id)
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	// connection re-established by the node handler of alice
+	syncNode := crdt.NewOperation(crdt.SyncNode, "", nil)
+	syncNode.Node = infos[1].Id
+	cluster.toExecute[0] <- syncNode
+
+	cluster.stop(t)
+
+	var digests [2]*crdt.Digest
+	for i, s := range storages {
+		d, err := s.GetDigest(chat.Id)
+		assert.Nil(t, err)
+		digests[i] = d
+	}
+
+	assert.Equal(t, 2+2+3, len(digests[0].Versions))
+	assert.Equal(t, digests[0], digests[1])
+	assert.NotEqual(t, uint64(0), digests[1].Versions[shared[0].Id], "edit not synchronized")
+
+	missing, err := storages[0].GetMissingMessages(chat.Id, &crdt.Digest{Versions: map[uuid.UUID]uint64{}})
+	assert.Nil(t, err)
+	for _, m := range missing {
+		if m.Id == shared[1].Id {
+			assert.True(t, m.Deleted, "deletion not synchronized")
+		}
+	}
+}
+
+func TestHandleChats_EncryptedJoin(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		contents                = []string{"first\n", "second\n", "third\n"}
+	)
+
+	chat, err := crdt.NewEncryptedChat("room")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, storages[0].AddChat(chat))
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	for _, content := range contents {
+		// messages are saved before bob joins : sent through the history synchronization
+		cluster.toExecute[0] <- crdt.NewOperation(crdt.AddMessage, chat.Id.String(), crdt.NewMessage(infos[0].Id, infos[0].Name, content))
+	}
+
+	// bob joins the room through alice
+	cluster.toExecute[0] <- helperReceived(identities[1], crdt.NewOperation(crdt.JoinChatByName, "room", infos[1]))
+
+	cluster.stop(t)
+
+	var chats [2]*crdt.Chat
+	for i, s := range storages {
+		chats[i], err = s.GetChat(chat.Id)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	assert.True(t, chats[1].Encrypted)
+	_, aliceKey, _ := chats[0].GetKey()
+	_, bobKey, err := chats[1].GetKey()
+	assert.Nil(t, err)
+	assert.Equal(t, aliceKey, bobKey)
+
+	// bob reads the history in clear
+	messages := chats[1].GetMessages()
+	if assert.Equal(t, len(contents), len(messages)) {
+		for i, m := range messages {
+			assert.Equal(t, contents[i], m.Content)
+		}
+	}
+
+	// but the content never crossed the wire in clear
+	for _, op := range cluster.wire {
+		if m, ok := op.Data.(*crdt.Message); ok {
+			assert.NotEqual(t, uint32(0), m.Epoch)
+			for _, content := range contents {
+				assert.NotContains(t, m.Content, content[:len(content)-1])
+			}
+		}
+
+		assert.NotContains(t, string(op.ToBytes()), "first")
+	}
+}
+
+func TestHandleChats_EncryptedRotation(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+	)
+
+	carol, carolIdentity, _ := helperNewNode(t, "8082", "carol")
+
+	chat, err := crdt.NewEncryptedChat("room")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// alice, bob and carol are in the room
+	for i, s := range storages {
+		assert.Nil(t, s.AddChat(chat))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+		assert.Nil(t, s.AddNodeToChat(carol, chat.Id))
+	}
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	// carol leaves the room
+	for i := range storages {
+		cluster.toExecute[i] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.RemoveNode, chat.Id.String(), nil))
+	}
+
+	cluster.stop(t)
+
+	_, previousKey, _ := chat.GetKey()
+	var epochs [2]uint32
+	var chatKeys [2][]byte
+	for i, s := range storages {
+		c, err := s.GetChat(chat.Id)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		epochs[i], chatKeys[i], err = c.GetKey()
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, [2]uint32{2, 2}, epochs)
+	assert.Equal(t, chatKeys[0], chatKeys[1])
+	assert.NotEqual(t, previousKey, chatKeys[0])
+
+	// a single node generated the new key
+	var keyOperations int
+	for _, op := range cluster.wire {
+		if op.Typology == crdt.SetChatKey {
+			keyOperations++
+		}
+	}
+
+	assert.Equal(t, 1, keyOperations)
+}
+
+func TestHandleChats_RejectsForgedOperations(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		chat                    = crdt.NewChat("room")
+	)
+
+	carol, carolIdentity, _ := helperNewNode(t, "8082", "carol")
+
+	// alice, bob and carol are in the room
+	for i, s := range storages {
+		replica := crdt.NewChat(chat.Name)
+		replica.Id = chat.Id
+		assert.Nil(t, s.AddChat(replica))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+		assert.Nil(t, s.AddNodeToChat(carol, chat.Id))
+	}
+
+	signed := helperSaveMessage(t, storages[1], identities[1], crdt.AddMessage, crdt.NewMessage(infos[1].Id, infos[1].Name, "hello\n"), chat.Id)
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	// bob removes carol from the chat
+	forgedLeave := helperReceived(identities[1], crdt.NewOperation(crdt.RemoveNode, chat.Id.String(), nil))
+	forgedLeave.Node = carol.Id
+	cluster.toExecute[0] <- forgedLeave
+
+	// unsigned operation
+	unsigned := crdt.NewOperation(crdt.AddMessage, chat.Id.String(), crdt.NewMessage(carol.Id, carol.Name, "unsigned\n"))
+	unsigned.Node = carol.Id
+	cluster.toExecute[0] <- unsigned
+
+	// carol writes a message in the name of bob
+	impersonated := crdt.NewMessage(infos[1].Id, infos[1].Name, "impersonated\n")
+	impersonated.Clock = 10
+	carolIdentity.SignMessage(impersonated)
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.AddMessage, chat.Id.String(), impersonated))
+
+	// carol relays a message of bob she modified
+	tampered := *signed
+	tampered.Content = "tampered\n"
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.AddMessage, chat.Id.String(), &tampered))
+
+	// carol deletes the message of bob before it reached alice
+	tombstone := &crdt.Message{Id: signed.Id, NodeId: carol.Id, Sender: carol.Name, Clock: signed.Clock, Deleted: true}
+	carolIdentity.SignMessage(tombstone)
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.DeleteMessage, chat.Id.String(), tombstone))
+
+	// the genuine message relayed by carol is accepted
+	relayed := *signed
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.AddMessage, chat.Id.String(), &relayed))
+
+	cluster.stop(t)
+
+	nodeIDs, err := storages[0].GetNodeIDs(chat.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, nodeIDs, carol.Id)
+
+	saved, err := storages[0].GetChat(chat.Id)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	messages := saved.GetMessages()
+	if assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, "hello\n", messages[0].Content)
+		assert.Nil(t, messages[0].Verify())
+	}
+}
+
+func TestHandleChats_DirectMessage(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		chat                    = crdt.NewChat("room")
+		directID                = crdt.DirectChatID(infos[0].Id, infos[1].Id)
+		output                  = &bytes.Buffer{}
+	)
+
+	carol, carolIdentity, _ := helperNewNode(t, "8082", "carol")
+
+	// alice, bob and carol are in the room
+	for i, s := range storages {
+		replica := crdt.NewChat(chat.Name)
+		replica.Id = chat.Id
+		assert.Nil(t, s.AddChat(replica))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+		assert.Nil(t, s.AddNodeToChat(carol, chat.Id))
+	}
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+
+	assert.True(t, cluster.nodes[0].HandleCommand(context.Background(), "/dm dave hi", output, cluster.toExecute[0], nil))
+	assert.Equal(t, "[ERROR] "+UnknownUserErr.Error()+"\n", output.String())
+
+	// alice whispers to bob, bob answers in the direct chat
+	assert.True(t, cluster.nodes[0].HandleCommand(context.Background(), "/dm bob psst", output, cluster.toExecute[0], nil))
+	assert.Eventually(t, func() bool {
+		_, err := storages[1].GetChatID("@alice")
+		return err == nil
+	}, maxTestDuration, time.Millisecond)
+
+	assert.True(t, cluster.nodes[1].HandleCommand(context.Background(), "/switch @alice", output, cluster.toExecute[1], nil))
+	assert.True(t, cluster.nodes[1].HandleCommand(context.Background(), "hi alice", output, cluster.toExecute[1], nil))
+
+	// carol can't read nor write in the direct chat : she knows its id but is not the other node
+	intruder := crdt.NewMessage(carol.Id, carol.Name, "intruder\n")
+	intruder.Clock = 10
+	carolIdentity.SignMessage(intruder)
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.AddMessage, directID.String(), intruder))
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.SyncChat, directID.String(), &crdt.Digest{Versions: map[uuid.UUID]uint64{}}))
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.JoinChatByName, "@bob", carol))
+
+	cluster.stop(t)
+
+	for i, s := range storages {
+		saved, err := s.GetChat(directID)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		assert.True(t, saved.Direct)
+		assert.Equal(t, "@"+infos[1-i].Name, saved.Name)
+		assert.Equal(t, []uuid.UUID{infos[1-i].Id}, saved.GetNodes())
+
+		var contents []string
+		for _, m := range saved.GetMessages() {
+			contents = append(contents, m.Content)
+		}
+
+		assert.Equal(t, []string{"psst\n", "hi alice\n"}, contents)
+	}
+
+	// nothing is sent to carol, the messages went once on the wire as direct messages
+	for _, op := range cluster.lost {
+		assert.NotEqual(t, directID.String(), op.TargetedChat)
+		assert.NotEqual(t, crdt.DirectMessage, op.Typology)
+	}
+
+	direct := 0
+	for _, op := range cluster.wire {
+		if op.Typology == crdt.DirectMessage {
+			direct++
+		}
+
+		assert.NotEqual(t, crdt.AddMessage, op.Typology)
+	}
+
+	assert.Equal(t, 2, direct)
+}
+
+func TestHandleChats_ListRemoteChats(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		chat                    = crdt.NewChat("room")
+	)
+
+	carol, carolIdentity, _ := helperNewNode(t, "8082", "carol")
+
+	// alice and bob are in the room and have a direct chat
+	for i, s := range storages {
+		replica := crdt.NewChat(chat.Name)
+		replica.Id = chat.Id
+		assert.Nil(t, s.AddChat(replica))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+
+		direct := crdt.NewDirectChat(infos[i].Id, infos[1-i])
+		assert.Nil(t, s.AddChat(direct))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], direct.Id))
+	}
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+	events := cluster.nodes[1].Events().Subscribe(10)
+
+	// bob asks alice for her rooms, they share a chat : the connection is kept
+	cluster.toExecute[0] <- helperReceived(identities[1], crdt.NewOperation(crdt.ListRemoteChats, "", infos[1]))
+
+	// carol asks alice for her rooms and answers bob
+	cluster.toExecute[0] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.ListRemoteChats, "", carol))
+	cluster.toExecute[1] <- helperReceived(carolIdentity, crdt.NewOperation(crdt.RemoteChats, "", &crdt.RoomList{Host: "carol", Rooms: []crdt.Room{}}))
+
+	cluster.stop(t)
+
+	expected := &crdt.RoomList{Host: "alice", Rooms: []crdt.Room{{Name: "room", Members: 2}, {Name: "alice", Members: 1}}}
+	listed := make(map[string]*crdt.RoomList)
+	for e := range events {
+		if e.Typology == RoomsListed {
+			listed[e.Rooms.Host] = e.Rooms
+		}
+	}
+
+	assert.Equal(t, map[string]*crdt.RoomList{"alice": expected, "carol": {Host: "carol", Rooms: []crdt.Room{}}}, listed)
+
+	for _, op := range cluster.wire {
+		assert.NotEqual(t, crdt.Disconnect, op.Typology)
+	}
+
+	// carol gets the same list and the connections with her are released, she joined nothing
+	var toCarol []crdt.OperationType
+	for _, op := range cluster.lost {
+		assert.Equal(t, carol.Id, op.Node)
+		toCarol = append(toCarol, op.Typology)
+
+		if op.Typology == crdt.RemoteChats {
+			assert.Equal(t, expected, op.Data)
+		}
+	}
+
+	assert.ElementsMatch(t, []crdt.OperationType{crdt.RemoteChats, crdt.Disconnect, crdt.Disconnect}, toCarol)
+	for _, s := range storages {
+		_, err := s.GetNode(carol.Id)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestHandleChats_ConnectionStatus(t *testing.T) {
+	var (
+		infos, identities, keys = helperNewNodes(t)
+		storages                = [2]*storage.Storage{storage.NewStorage(), storage.NewStorage()}
+		chat                    = crdt.NewChat("room")
+	)
+
+	for i, s := range storages {
+		replica := crdt.NewChat(chat.Name)
+		replica.Id = chat.Id
+		assert.Nil(t, s.AddChat(replica))
+		assert.Nil(t, s.AddNodeToChat(infos[1-i], chat.Id))
+	}
+
+	cluster := newTestCluster(storages, infos, identities, keys)
+	events := cluster.nodes[0].Events().Subscribe(10)
+
+	// the node handler of alice reports bob, the status of an unknown node is dropped
+	report := crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: "unreachable"})
+	report.Node = infos[1].Id
+	cluster.toExecute[0] <- report
+
+	unknown := crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: "unreachable"})
+	unknown.Node = uuid.New()
+	cluster.toExecute[0] <- unknown
+
+	// bob can't report the status of his own connection
+	cluster.toExecute[0] <- helperReceived(identities[1], crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: "stopped answering"}))
+
+	// the operations for bob are dropped
+	failure := crdt.NewOperation(crdt.ConnectionStatus, "", &crdt.NodeStatus{Status: "unreachable", Failed: true})
+	failure.Node = infos[1].Id
+	cluster.toExecute[0] <- failure
+
+	cluster.stop(t)
+
+	var (
+		changes []Event
+		errs    []error
+	)
+
+	for e := range events {
+		switch e.Typology {
+		case ConnectionChanged:
+			changes = append(changes, e)
+		case Error:
+			errs = append(errs, e.Err)
+		}
+	}
+
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "bob", changes[0].Node.Name)
+		assert.Equal(t, "unreachable", changes[0].Status)
+	}
+
+	if assert.Len(t, errs, 1) {
+		assert.ErrorIs(t, errs[0], UnreachableErr)
+	}
+
+	// bob is still a member of the room
+	nodeIDs, err := storages[0].GetNodeIDs(chat.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, nodeIDs, infos[1].Id)
+}
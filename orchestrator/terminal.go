@@ -0,0 +1,107 @@
+package orchestrator
+
+import (
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"io"
+	"strings"
+)
+
+const (
+	// events kept for the terminal until they are printed
+	TerminalBufferSize = 1024
+
+	messageFormat = "[%s] %s (%s): %s\n"
+	nodeFormat    = "- %s (Address: %s, Port: %s)\n"
+)
+
+// Display prints the events on w until the channel is closed, the terminal is one of the subscribers of the bus
+func Display(w io.Writer, events <-chan Event) {
+	for event := range events {
+		switch event.Typology {
+		case MessageReceived:
+			displayMessage(w, event.Message)
+
+		case MessageEdited:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("%s edited message %s", event.Message.Sender, event.Message.Id))
+			displayMessage(w, event.Message)
+
+		case MessageDeleted:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("%s deleted message %s", event.Message.Sender, event.Message.Id))
+
+		case MemberJoined:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("%s joined chat %s", event.Node.Name, event.Chat))
+
+		case MemberLeft:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("%s leaved chat %s", event.Node.Name, event.Chat))
+
+		case ChatJoined:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("you joined a new chat : %s", event.Chat))
+
+		case ChatLeft:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("Leaving %s", event.Chat))
+
+		case Error:
+			fmt.Fprintf(w, logErrFormat, event.Err)
+
+		case RoomsListed:
+			displayRooms(w, event.Rooms)
+
+		case ConnectionChanged:
+			fmt.Fprintf(w, logFormat, fmt.Sprintf("%s %s", event.Node.Name, event.Status))
+		}
+	}
+}
+
+func displayMessage(w io.Writer, message *crdt.Message) {
+	fmt.Fprintf(w, messageFormat, message.Id, message.Sender, message.Date, strings.TrimSuffix(message.Content, "\n"))
+}
+
+// displayChats prints the list of chats (/list_chats)
+func displayChats(w io.Writer, chats []*crdt.Chat) {
+	fmt.Fprintf(w, "%d chats\n", len(chats))
+
+	for _, c := range chats {
+		fmt.Fprintf(w, "- %s : %d users, %d messages\n", chatLabel(c.Name, c.Encrypted, c.Gossip), len(c.GetNodes())+1, c.CountMessages())
+	}
+}
+
+// displayRooms prints the chats a remote node hosts (/rooms)
+func displayRooms(w io.Writer, rooms *crdt.RoomList) {
+	fmt.Fprintf(w, "%d rooms on %s\n", len(rooms.Rooms), rooms.Host)
+
+	for _, r := range rooms.Rooms {
+		fmt.Fprintf(w, "- %s : %d users\n", chatLabel(r.Name, r.Encrypted, r.Gossip), r.Members)
+	}
+}
+
+// chatLabel returns the name of a chat followed by its kind
+func chatLabel(name string, encrypted, gossip bool) string {
+	if encrypted {
+		name += " (encrypted)"
+	}
+
+	if gossip {
+		name += " (gossip)"
+	}
+
+	return name
+}
+
+// displayNodes prints the list of nodes (/list_users)
+func displayNodes(w io.Writer, nodes []*crdt.NodeInfos) {
+	fmt.Fprintf(w, "%d nodes\n", len(nodes))
+
+	for _, n := range nodes {
+		fmt.Fprintf(w, nodeFormat, n.Name, n.Address, n.Port)
+	}
+}
+
+// displayChatUsers prints the members of a chat (/list)
+func displayChatUsers(w io.Writer, chatName string, nodes []*crdt.NodeInfos) {
+	fmt.Fprintf(w, "chat name : %s\n", chatName)
+
+	for _, n := range nodes {
+		fmt.Fprintf(w, nodeFormat, n.Name, n.Address, n.Port)
+	}
+}
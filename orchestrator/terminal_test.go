@@ -0,0 +1,43 @@
+package orchestrator
+
+import (
+	"bytes"
+	"errors"
+	"github/timtimjnvr/chat/crdt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisplay(t *testing.T) {
+	var (
+		output  = &bytes.Buffer{}
+		events  = make(chan Event, 10)
+		bob     = crdt.NewNodeInfos("", "8081", "bob")
+		message = crdt.NewMessage(uuid.New(), "bob", "Hi\n")
+	)
+
+	events <- Event{Typology: ChatJoined, Chat: "room"}
+	events <- Event{Typology: MemberJoined, Chat: "room", Node: bob}
+	events <- Event{Typology: MessageReceived, Chat: "room", Message: message}
+	events <- Event{Typology: MemberLeft, Chat: "room", Node: bob}
+	events <- Event{Typology: ChatLeft, Chat: "room"}
+	events <- Event{Typology: Error, Err: errors.New("failure")}
+	events <- Event{Typology: RoomsListed, Rooms: &crdt.RoomList{Host: "bob", Rooms: []crdt.Room{{Name: "bob", Members: 2}, {Name: "large", Members: 12, Gossip: true}}}}
+	events <- Event{Typology: ConnectionChanged, Node: bob, Status: "unreachable"}
+	close(events)
+
+	Display(output, events)
+
+	assert.Equal(t, "[INFO] you joined a new chat : room\n"+
+		"[INFO] bob joined chat room\n"+
+		"["+message.Id.String()+"] bob ("+message.Date+"): Hi\n"+
+		"[INFO] bob leaved chat room\n"+
+		"[INFO] Leaving room\n"+
+		"[ERROR] failure\n"+
+		"2 rooms on bob\n"+
+		"- bob : 2 users\n"+
+		"- large (gossip) : 12 users\n"+
+		"[INFO] bob unreachable\n", output.String())
+}
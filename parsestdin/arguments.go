@@ -0,0 +1,131 @@
+package parsestdin
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type (
+	// argument expected by a command
+	argument struct {
+		key  string // key of the value in the args of the Command
+		name string // name displayed in the syntax of the command
+		kind argumentKind
+	}
+
+	argumentKind uint8
+)
+
+const (
+	wordArgument    argumentKind = iota // any word, quotes allow spaces
+	hostArgument                        // IP address or hostname
+	portArgument                        // TCP port
+	messageArgument                     // message id
+	textArgument                        // the rest of the line as typed, quotes included
+
+	minPort, maxPort = 1, 65535
+
+	// max length of a hostname and of its labels (RFC 1123)
+	maxHostnameLength, maxLabelLength = 253, 63
+)
+
+var (
+	remoteAddrArgument = argument{key: AddrArg, name: "<addr>", kind: hostArgument}
+	remotePortArgument = argument{key: PortArg, name: "<port>", kind: portArgument}
+	chatRoomArgument   = argument{key: ChatRoomArg, name: "<chat_name>", kind: wordArgument}
+	messageIdArgument  = argument{key: MessageIdArg, name: "<message_id>", kind: messageArgument}
+	contentArgument    = argument{key: MessageArg, name: "<content>", kind: textArgument}
+
+	// arguments of the commands in the order they are typed, the commands not listed have none
+	commandToArguments = map[string][]argument{
+		newChatCommand:       {chatRoomArgument},
+		newSecretChatCommand: {chatRoomArgument},
+		newGossipChatCommand: {chatRoomArgument},
+		msgCommand:           {contentArgument},
+		joinChatCommand:      {remoteAddrArgument, remotePortArgument, chatRoomArgument},
+		switchCommand:        {chatRoomArgument},
+		editCommand:          {messageIdArgument, contentArgument},
+		deleteCommand:        {messageIdArgument},
+		directMessageCommand: {
+			{key: UserArg, name: "<user>", kind: wordArgument},
+			contentArgument,
+		},
+		listRemoteChatsCommand: {remoteAddrArgument, remotePortArgument},
+	}
+)
+
+// syntax returns the command followed by the names of its arguments
+func syntax(command string) string {
+	words := []string{command}
+	for _, arg := range commandToArguments[command] {
+		words = append(words, arg.name)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// validate returns why value can't be the argument, nil if it can
+func (a argument) validate(value string) error {
+	switch a.kind {
+	case hostArgument:
+		if net.ParseIP(value) == nil && !isHostname(value) {
+			return errors.New("is not an IP address or a hostname")
+		}
+
+	case portArgument:
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("is not a number")
+		}
+
+		if port < minPort || port > maxPort {
+			return errors.Errorf("is not between %d and %d", minPort, maxPort)
+		}
+
+	case messageArgument:
+		if _, err := uuid.Parse(value); err != nil {
+			return errors.New("is not a message id")
+		}
+
+	case textArgument:
+		// anything typed, missing if empty
+
+	default:
+		if value == "" {
+			return errors.New("is empty")
+		}
+
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return errors.New("contains control characters")
+		}
+	}
+
+	return nil
+}
+
+// isHostname reports whether name is made of labels of letters, digits and hyphens separated by dots
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxHostnameLength {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -3,6 +3,7 @@ package parsestdin
 import (
 	"fmt"
 	"github/timtimjnvr/chat/crdt"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -16,43 +17,81 @@ type (
 )
 
 const (
-	newChatCommand       = "/chat"
-	msgCommand           = "/msg"
-	joinChatCommand      = "/join"
-	switchCommand        = "/switch"
-	leaveChatCommand     = "/close"
-	listChatUsersCommand = "/list"
-	listChatsCommand     = "/list_chats"
-	listAllUsersCommand  = "/list_users"
-	quitCommand          = "/quit"
-
-	MessageArg  = "messageArgument"
-	PortArg     = "portArgument"
-	AddrArg     = "addrArgument"
-	ChatRoomArg = "chatRoomArgument"
-
-	switchErrorSyntax  = "Command syntax :" + switchCommand + " <chat_name>"
-	joinErrorSyntax    = "Command syntax : " + joinChatCommand + " <ip> <port>"
-	newChatErrorSyntax = "Command syntax : " + newChatCommand + " <chat_name>"
+	newChatCommand         = "/chat"
+	newSecretChatCommand   = "/secret"
+	newGossipChatCommand   = "/gossip"
+	msgCommand             = "/msg"
+	joinChatCommand        = "/join"
+	switchCommand          = "/switch"
+	leaveChatCommand       = "/close"
+	listChatUsersCommand   = "/list"
+	listChatsCommand       = "/list_chats"
+	listAllUsersCommand    = "/list_users"
+	quitCommand            = "/quit"
+	editCommand            = "/edit"
+	deleteCommand          = "/delete"
+	helpCommand            = "/help"
+	directMessageCommand   = "/dm"
+	listRemoteChatsCommand = "/rooms"
+
+	// a line starting with escapedSlash is a message starting with a slash
+	escapedSlash = "//"
+
+	MessageArg   = "messageArgument"
+	MessageIdArg = "messageIdArgument"
+	PortArg      = "portArgument"
+	AddrArg      = "addrArgument"
+	ChatRoomArg  = "chatRoomArgument"
+	EncryptedArg = "encryptedArgument"
+	GossipArg    = "gossipArgument"
+	UserArg      = "userArgument"
 )
 
 var (
 	commandToOperation = map[string]crdt.OperationType{
-		newChatCommand:       crdt.CreateChat,
-		msgCommand:           crdt.AddMessage,
-		joinChatCommand:      crdt.JoinChatByName,
-		switchCommand:        crdt.SwitchChat,
-		leaveChatCommand:     crdt.RemoveChat,
-		listChatUsersCommand: crdt.ListChatUsers,
-		listAllUsersCommand:  crdt.ListUsers,
-		listChatsCommand:     crdt.ListChats,
-		quitCommand:          crdt.Quit,
+		newChatCommand:         crdt.CreateChat,
+		newSecretChatCommand:   crdt.CreateChat,
+		newGossipChatCommand:   crdt.CreateChat,
+		msgCommand:             crdt.AddMessage,
+		joinChatCommand:        crdt.JoinChatByName,
+		switchCommand:          crdt.SwitchChat,
+		leaveChatCommand:       crdt.RemoveChat,
+		listChatUsersCommand:   crdt.ListChatUsers,
+		listAllUsersCommand:    crdt.ListUsers,
+		listChatsCommand:       crdt.ListChats,
+		quitCommand:            crdt.Quit,
+		editCommand:            crdt.UpdateMessage,
+		deleteCommand:          crdt.DeleteMessage,
+		helpCommand:            crdt.Help,
+		directMessageCommand:   crdt.DirectMessage,
+		listRemoteChatsCommand: crdt.ListRemoteChats,
+	}
+
+	// description of the commands listed by /help
+	commandToHelp = map[string]string{
+		newChatCommand:         "create a new room named chat_name and enter it",
+		newSecretChatCommand:   "create a new end-to-end encrypted room named chat_name",
+		newGossipChatCommand:   "create a new room named chat_name where messages are relayed between neighbors",
+		msgCommand:             "send content in the current room",
+		joinChatCommand:        "join the room named chat_name through the user listening on addr and port",
+		switchCommand:          "change the current room to chat_name",
+		leaveChatCommand:       "exit the current room",
+		listChatUsersCommand:   "display the users in the current room",
+		listAllUsersCommand:    "display all connected users",
+		listChatsCommand:       "display the rooms entered",
+		quitCommand:            "kill the program",
+		editCommand:            "replace the content of one of your messages in the current room",
+		deleteCommand:          "delete one of your messages in the current room",
+		helpCommand:            "display this help",
+		directMessageCommand:   "send content to user only, in the direct chat with user",
+		listRemoteChatsCommand: "display the rooms that can be joined through the user listening on addr and port",
 	}
 
 	/* PACKAGE ERRORS */
 
 	ErrorUnknownCommand = errors.New("unknown Command")
 	ErrorInArguments    = errors.New("problem in arguments")
+	ErrorEmptyMessage   = errors.New("empty message")
 )
 
 func NewCommand(line string) (Command, error) {
@@ -72,11 +111,19 @@ func NewCommand(line string) (Command, error) {
 	}, nil
 }
 
+// parseCommandType returns the operation of the command starting line, lines not starting with a slash
+// (or starting with an escaped one) are messages
 func parseCommandType(line string) (crdt.OperationType, error) {
 	text := fmt.Sprintf(strings.Replace(line, "\n", "", 1))
-	split := strings.Split(text, " ")
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, escapedSlash) {
+		if strings.TrimSpace(text) == "" {
+			return *new(crdt.OperationType), ErrorEmptyMessage
+		}
 
-	commandString := split[0]
+		return crdt.AddMessage, nil
+	}
+
+	commandString := strings.Fields(text)[0]
 	operationTypology, exist := commandToOperation[commandString]
 
 	if !exist {
@@ -86,45 +133,71 @@ func parseCommandType(line string) (crdt.OperationType, error) {
 	return operationTypology, nil
 }
 
+// parseArgs returns the arguments of the command typed on line, checked against the arguments the command expects.
+// Arguments are separated by spaces unless quoted or escaped (see scanner), the content of a message is the rest
+// of the line as typed.
 func parseArgs(line string, command crdt.OperationType) (map[string]string, error) {
 	var (
-		text      = fmt.Sprintf(strings.Replace(line, "\n", "", 1))
-		args      = make(map[string]string)
-		splitArgs = strings.Split(text, " ")
+		text = strings.Replace(line, "\n", "", 1)
+		args = make(map[string]string)
 	)
 
-	switch command {
-	case crdt.CreateChat:
-		// no chat room specified
-		if len(splitArgs) < 2 {
-			return args, errors.Wrap(ErrorInArguments, newChatErrorSyntax)
-		}
+	if command == crdt.AddMessage && (!strings.HasPrefix(text, "/") || strings.HasPrefix(text, escapedSlash)) {
+		args[MessageArg] = fmt.Sprintf("%s\n", strings.TrimPrefix(text, "/"))
+		return args, nil
+	}
 
-		args[ChatRoomArg] = strings.Replace(splitArgs[1], " ", "", 2)
+	var (
+		s          = &scanner{line: text}
+		name, _, _ = s.next()
+		expected   = commandToArguments[name.value]
+	)
 
-	case crdt.SwitchChat:
-		if len(splitArgs) < 2 {
-			return args, errors.Wrap(ErrorInArguments, switchErrorSyntax)
+	for _, arg := range expected {
+		var (
+			value  token
+			exists bool
+			err    error
+		)
+
+		if arg.kind == textArgument {
+			value, exists = s.rest()
+		} else {
+			value, exists, err = s.next()
+			if err != nil {
+				return make(map[string]string), err
+			}
 		}
 
-		args[ChatRoomArg] = strings.Replace(splitArgs[1], " ", "", 2)
+		if !exists {
+			return make(map[string]string), errors.Wrapf(ErrorInArguments, "missing %s, syntax : %s", arg.name, syntax(name.value))
+		}
 
-	case crdt.JoinChatByName:
-		// not enough args
-		if len(splitArgs) <= 3 {
-			return args, errors.Wrap(ErrorInArguments, joinErrorSyntax)
+		if err = arg.validate(value.value); err != nil {
+			return make(map[string]string), errors.Wrapf(ErrorInArguments, "%s %q at column %d %s, syntax : %s", arg.name, value.value, value.column, err, syntax(name.value))
 		}
 
-		args[AddrArg] = strings.Replace(splitArgs[1], " ", "", 2)
-		args[PortArg] = strings.Replace(splitArgs[2], " ", "", 2)
-		args[ChatRoomArg] = strings.Replace(splitArgs[3], " ", "", 2)
+		args[arg.key] = value.value
+	}
+
+	extra, exists, err := s.next()
+	if err != nil {
+		return make(map[string]string), err
+	}
+
+	if exists {
+		return make(map[string]string), errors.Wrapf(ErrorInArguments, "unexpected argument %q at column %d, syntax : %s", extra.value, extra.column, syntax(name.value))
+	}
 
-	case crdt.AddMessage:
-		messageWithoutCommand := strings.Replace(text, fmt.Sprintf("%s ", msgCommand), "", 1)
-		args[MessageArg] = fmt.Sprintf("%s\n", messageWithoutCommand)
+	if _, exists = args[MessageArg]; exists {
+		args[MessageArg] = fmt.Sprintf("%s\n", args[MessageArg])
+	}
 
-	default:
-		// no args
+	switch name.value {
+	case newSecretChatCommand:
+		args[EncryptedArg] = "true"
+	case newGossipChatCommand:
+		args[GossipArg] = "true"
 	}
 
 	return args, nil
@@ -137,3 +210,21 @@ func (c Command) GetTypology() crdt.OperationType {
 func (c Command) GetArgs() map[string]string {
 	return c.args
 }
+
+// Help returns the syntax of every command, one per line
+func Help() string {
+	commands := make([]string, 0, len(commandToOperation))
+	for command := range commandToOperation {
+		commands = append(commands, command)
+	}
+
+	sort.Strings(commands)
+
+	var help strings.Builder
+	for _, command := range commands {
+		help.WriteString(fmt.Sprintf("%-35s : %s\n", syntax(command), commandToHelp[command]))
+	}
+
+	help.WriteString(fmt.Sprintf("any other line is sent in the current room, start it with %s to send a message starting with /\n", escapedSlash))
+	return help.String()
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github/timtimjnvr/chat/crdt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -47,6 +48,21 @@ func TestParseCommandType(t *testing.T) {
 			expectedTypology: crdt.Quit,
 			expectedErr:      nil,
 		},
+		{
+			line:             "/edit ***********!\n",
+			expectedTypology: crdt.UpdateMessage,
+			expectedErr:      nil,
+		},
+		{
+			line:             "/delete ***********!\n",
+			expectedTypology: crdt.DeleteMessage,
+			expectedErr:      nil,
+		},
+		{
+			line:             "/rooms ***********!\n",
+			expectedTypology: crdt.ListRemoteChats,
+			expectedErr:      nil,
+		},
 		{
 			line:             "/quit**********\n",
 			expectedTypology: *new(crdt.OperationType),
@@ -57,6 +73,26 @@ func TestParseCommandType(t *testing.T) {
 			expectedTypology: *new(crdt.OperationType),
 			expectedErr:      ErrorUnknownCommand,
 		},
+		{
+			line:             "/help\n",
+			expectedTypology: crdt.Help,
+			expectedErr:      nil,
+		},
+		{
+			line:             "Hello /quit\n",
+			expectedTypology: crdt.AddMessage,
+			expectedErr:      nil,
+		},
+		{
+			line:             "//unknown\n",
+			expectedTypology: crdt.AddMessage,
+			expectedErr:      nil,
+		},
+		{
+			line:             "  \n",
+			expectedTypology: *new(crdt.OperationType),
+			expectedErr:      ErrorEmptyMessage,
+		},
 	}
 
 	for i, test := range tests {
@@ -83,18 +119,96 @@ func TestGetArgs(t *testing.T) {
 			expectedArgs: map[string]string{ChatRoomArg: "my-awesome-chat"},
 			expectedErr:  nil,
 		},
+		{
+			text:         "/gossip my-large-chat\n",
+			typology:     crdt.CreateChat,
+			expectedArgs: map[string]string{ChatRoomArg: "my-large-chat", GossipArg: "true"},
+			expectedErr:  nil,
+		},
 		{
 			text:         "/msg Hello friend!\n",
 			typology:     crdt.AddMessage,
 			expectedArgs: map[string]string{MessageArg: "Hello friend!\n"},
 			expectedErr:  nil,
 		},
+		{
+			text:         "Hello /msg friend!\n",
+			typology:     crdt.AddMessage,
+			expectedArgs: map[string]string{MessageArg: "Hello /msg friend!\n"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "//msg is a command\n",
+			typology:     crdt.AddMessage,
+			expectedArgs: map[string]string{MessageArg: "/msg is a command\n"},
+			expectedErr:  nil,
+		},
 		{
 			text:         "/join 127.0.0.1 8080 my-awesome-chat\n",
 			typology:     crdt.JoinChatByName,
 			expectedArgs: map[string]string{AddrArg: "127.0.0.1", PortArg: "8080", ChatRoomArg: "my-awesome-chat"},
 			expectedErr:  nil,
 		},
+		{
+			text:         "/join  chat.example.com 8080 \"my awesome chat\"\n",
+			typology:     crdt.JoinChatByName,
+			expectedArgs: map[string]string{AddrArg: "chat.example.com", PortArg: "8080", ChatRoomArg: "my awesome chat"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/join 127.0.0.1 99999 my-awesome-chat\n",
+			typology:     crdt.JoinChatByName,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/join -bad-host- 8080 my-awesome-chat\n",
+			typology:     crdt.JoinChatByName,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/join 127.0.0.1 8080 my awesome chat\n",
+			typology:     crdt.JoinChatByName,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/join 127.0.0.1 8080 'my awesome chat\n",
+			typology:     crdt.JoinChatByName,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorUnterminatedQuote,
+		},
+		{
+			text:         "/chat\n",
+			typology:     crdt.CreateChat,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/secret 'team room'\n",
+			typology:     crdt.CreateChat,
+			expectedArgs: map[string]string{ChatRoomArg: "team room", EncryptedArg: "true"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/msg  it's   \"quoted\"\n",
+			typology:     crdt.AddMessage,
+			expectedArgs: map[string]string{MessageArg: "it's   \"quoted\"\n"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/msg\n",
+			typology:     crdt.AddMessage,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/list extra\n",
+			typology:     crdt.ListChatUsers,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
 		{
 			text:         "/join 127.0.0.1\n",
 			typology:     crdt.JoinChatByName,
@@ -137,6 +251,48 @@ func TestGetArgs(t *testing.T) {
 			expectedArgs: map[string]string{ChatRoomArg: "my-awesome-chat"},
 			expectedErr:  nil,
 		},
+		{
+			text:         "/edit 4b8e153b-834f-4190-b5d3-aba2f35ead56 Hello my friend!\n",
+			typology:     crdt.UpdateMessage,
+			expectedArgs: map[string]string{MessageIdArg: "4b8e153b-834f-4190-b5d3-aba2f35ead56", MessageArg: "Hello my friend!\n"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/edit 4b8e153b-834f-4190-b5d3-aba2f35ead56\n",
+			typology:     crdt.UpdateMessage,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/edit not-an-id Hello my friend!\n",
+			typology:     crdt.UpdateMessage,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/delete 4b8e153b-834f-4190-b5d3-aba2f35ead56\n",
+			typology:     crdt.DeleteMessage,
+			expectedArgs: map[string]string{MessageIdArg: "4b8e153b-834f-4190-b5d3-aba2f35ead56"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/delete\n",
+			typology:     crdt.DeleteMessage,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
+		{
+			text:         "/rooms 127.0.0.1 8080\n",
+			typology:     crdt.ListRemoteChats,
+			expectedArgs: map[string]string{AddrArg: "127.0.0.1", PortArg: "8080"},
+			expectedErr:  nil,
+		},
+		{
+			text:         "/rooms 127.0.0.1 8080 my-awesome-chat\n",
+			typology:     crdt.ListRemoteChats,
+			expectedArgs: make(map[string]string),
+			expectedErr:  ErrorInArguments,
+		},
 	}
 
 	for i, test := range tests {
@@ -145,3 +301,80 @@ func TestGetArgs(t *testing.T) {
 		ass.True(errors.Is(err, test.expectedErr), fmt.Sprintf("test %d failed on error returned", i))
 	}
 }
+
+func TestHelp(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(Help(), "\n"), "\n")
+
+	// every command is listed with its syntax, then the messages
+	assert.Equal(t, len(commandToOperation)+1, len(lines))
+	for command := range commandToOperation {
+		description, exist := commandToHelp[command]
+		assert.True(t, exist, fmt.Sprintf("no help for %s", command))
+		assert.Contains(t, lines, fmt.Sprintf("%-35s : %s", syntax(command), description))
+	}
+
+	assert.Equal(t, "/chat <chat_name>                   : create a new room named chat_name and enter it", lines[0])
+	assert.Contains(t, lines, "/join <addr> <port> <chat_name>     : join the room named chat_name through the user listening on addr and port")
+}
+
+func TestGetArgs_Errors(t *testing.T) {
+	// errors point at the bad argument
+	var tests = []struct {
+		text          string
+		typology      crdt.OperationType
+		expectedError string
+	}{
+		{
+			text:          "/join 127.0.0.1 99999 room\n",
+			typology:      crdt.JoinChatByName,
+			expectedError: `<port> "99999" at column 17 is not between 1 and 65535, syntax : /join <addr> <port> <chat_name>: problem in arguments`,
+		},
+		{
+			text:          "/join 127.0.0.1 http room\n",
+			typology:      crdt.JoinChatByName,
+			expectedError: `<port> "http" at column 17 is not a number, syntax : /join <addr> <port> <chat_name>: problem in arguments`,
+		},
+		{
+			text:          "/join my_host 8080 room\n",
+			typology:      crdt.JoinChatByName,
+			expectedError: `<addr> "my_host" at column 7 is not an IP address or a hostname, syntax : /join <addr> <port> <chat_name>: problem in arguments`,
+		},
+		{
+			text:          "/join 127.0.0.1 8080\n",
+			typology:      crdt.JoinChatByName,
+			expectedError: "missing <chat_name>, syntax : /join <addr> <port> <chat_name>: problem in arguments",
+		},
+		{
+			text:          "/rooms 127.0.0.1\n",
+			typology:      crdt.ListRemoteChats,
+			expectedError: "missing <port>, syntax : /rooms <addr> <port>: problem in arguments",
+		},
+		{
+			text:          "/switch my room\n",
+			typology:      crdt.SwitchChat,
+			expectedError: `unexpected argument "room" at column 12, syntax : /switch <chat_name>: problem in arguments`,
+		},
+		{
+			text:          "/delete 42\n",
+			typology:      crdt.DeleteMessage,
+			expectedError: `<message_id> "42" at column 9 is not a message id, syntax : /delete <message_id>: problem in arguments`,
+		},
+		{
+			text:          "/chat \"\"\n",
+			typology:      crdt.CreateChat,
+			expectedError: `<chat_name> "" at column 7 is empty, syntax : /chat <chat_name>: problem in arguments`,
+		},
+		{
+			text:          "/chat \"room\n",
+			typology:      crdt.CreateChat,
+			expectedError: "column 7: unterminated quote",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := parseArgs(test.text, test.typology)
+		if assert.NotNil(t, err, test.text) {
+			assert.Equal(t, test.expectedError, err.Error())
+		}
+	}
+}
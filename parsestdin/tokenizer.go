@@ -0,0 +1,141 @@
+package parsestdin
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// scanner splits a command line in words like a shell : words are separated by spaces, quotes group words
+	// and a backslash escapes the next character. Single quotes keep everything until the closing quote,
+	// double quotes only interpret \" and \\.
+	scanner struct {
+		line string
+		pos  int // offset of the next byte to read
+	}
+
+	// token is a word of the line and the column (starting at 1) where it starts
+	token struct {
+		value  string
+		column int
+	}
+)
+
+var (
+	ErrorUnterminatedQuote = errors.New("unterminated quote")
+	ErrorTrailingEscape    = errors.New("nothing to escape at the end of the line")
+)
+
+// next returns the next word of the line, false once the line is exhausted
+func (s *scanner) next() (token, bool, error) {
+	s.skipSpaces()
+	if s.pos >= len(s.line) {
+		return token{}, false, nil
+	}
+
+	var (
+		start = s.column()
+		word  strings.Builder
+	)
+
+	for s.pos < len(s.line) {
+		r, size := utf8.DecodeRuneInString(s.line[s.pos:])
+		switch {
+		case unicode.IsSpace(r):
+			return token{word.String(), start}, true, nil
+
+		case r == '\\':
+			if s.pos+size >= len(s.line) {
+				return token{}, false, errors.Wrapf(ErrorTrailingEscape, "column %d", s.column())
+			}
+
+			s.pos += size
+			r, size = utf8.DecodeRuneInString(s.line[s.pos:])
+			word.WriteRune(r)
+
+		case r == '\'' || r == '"':
+			err := s.quoted(r, &word)
+			if err != nil {
+				return token{}, false, err
+			}
+
+			continue
+
+		default:
+			word.WriteRune(r)
+		}
+
+		s.pos += size
+	}
+
+	return token{word.String(), start}, true, nil
+}
+
+// quoted writes the characters between the quote at the current position and the closing one in word
+func (s *scanner) quoted(quote rune, word *strings.Builder) error {
+	opening := s.column()
+	s.pos++
+
+	for s.pos < len(s.line) {
+		r, size := utf8.DecodeRuneInString(s.line[s.pos:])
+		switch {
+		case r == quote:
+			s.pos += size
+			return nil
+
+		case r == '\\' && quote == '"' && s.pos+1 < len(s.line) && (s.line[s.pos+1] == '"' || s.line[s.pos+1] == '\\'):
+			s.pos++
+			r, size = utf8.DecodeRuneInString(s.line[s.pos:])
+		}
+
+		word.WriteRune(r)
+		s.pos += size
+	}
+
+	return errors.Wrapf(ErrorUnterminatedQuote, "column %d", opening)
+}
+
+// rest returns the rest of the line as typed, without the spaces around, false if there is nothing left
+func (s *scanner) rest() (token, bool) {
+	s.skipSpaces()
+
+	var (
+		start = s.column()
+		text  = strings.TrimRightFunc(s.line[s.pos:], unicode.IsSpace)
+	)
+
+	s.pos = len(s.line)
+	return token{text, start}, text != ""
+}
+
+func (s *scanner) skipSpaces() {
+	for s.pos < len(s.line) {
+		r, size := utf8.DecodeRuneInString(s.line[s.pos:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+
+		s.pos += size
+	}
+}
+
+// column returns the column of the next character of the line
+func (s *scanner) column() int {
+	return utf8.RuneCountInString(s.line[:s.pos]) + 1
+}
+
+// Quote returns text as a single word of a command line, quoted only when needed
+func Quote(text string) string {
+	needsQuotes := strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '\'' || r == '\\'
+	}) >= 0
+
+	if text != "" && !needsQuotes {
+		return text
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
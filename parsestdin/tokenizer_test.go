@@ -0,0 +1,91 @@
+package parsestdin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanner(t *testing.T) {
+	ass := assert.New(t)
+
+	var tests = []struct {
+		line           string
+		expectedTokens []token
+		expectedErr    error
+	}{
+		{
+			line:           "  /join  127.0.0.1\t8080 room ",
+			expectedTokens: []token{{"/join", 3}, {"127.0.0.1", 10}, {"8080", 20}, {"room", 25}},
+		},
+		{
+			line:           `/chat "my room" 'it''s' a\ b "say \"hi\" \n"`,
+			expectedTokens: []token{{"/chat", 1}, {"my room", 7}, {"its", 17}, {"a b", 25}, {`say "hi" \n`, 30}},
+		},
+		{
+			line:           `/chat 'caf\é' "" x`,
+			expectedTokens: []token{{"/chat", 1}, {`caf\é`, 7}, {"", 15}, {"x", 18}},
+		},
+		{
+			line:           `/chat "my room`,
+			expectedTokens: []token{{"/chat", 1}},
+			expectedErr:    ErrorUnterminatedQuote,
+		},
+		{
+			line:           `/chat room\`,
+			expectedTokens: []token{{"/chat", 1}},
+			expectedErr:    ErrorTrailingEscape,
+		},
+	}
+
+	for i, test := range tests {
+		var (
+			s      = &scanner{line: test.line}
+			tokens []token
+			err    error
+		)
+
+		for {
+			var (
+				tok    token
+				exists bool
+			)
+
+			tok, exists, err = s.next()
+			if !exists {
+				break
+			}
+
+			tokens = append(tokens, tok)
+		}
+
+		ass.Equal(test.expectedTokens, tokens, fmt.Sprintf("test %d failed on tokens", i))
+		ass.True(errors.Is(err, test.expectedErr), fmt.Sprintf("test %d failed on error returned", i))
+	}
+
+	// the rest of the line is kept as typed
+	s := &scanner{line: `/edit id  it's   "fine" `}
+	_, _, _ = s.next()
+	_, _, _ = s.next()
+	ass.Equal(token{`it's   "fine"`, 11}, func() token { tok, _ := s.rest(); return tok }())
+
+	_, exists := s.rest()
+	ass.False(exists)
+}
+
+func TestQuote(t *testing.T) {
+	for _, word := range []string{"room", "my room", `say "hi"`, `back\slash`, "it's", ""} {
+		s := &scanner{line: "/switch " + Quote(word)}
+		_, _, _ = s.next()
+
+		tok, exists, err := s.next()
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, word, tok.value)
+	}
+
+	assert.Equal(t, "room", Quote("room"))
+	assert.Equal(t, `"my room"`, Quote("my room"))
+}
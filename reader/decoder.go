@@ -0,0 +1,67 @@
+package reader
+
+import (
+	"bufio"
+)
+
+// Decoder reassembles elements out of a stream of bytes received in arbitrary chunks.
+// Bytes that do not form a complete element yet are kept until the next call to Decode.
+type Decoder struct {
+	split   bufio.SplitFunc
+	pending []byte
+}
+
+func NewDecoder(split bufio.SplitFunc) *Decoder {
+	return &Decoder{
+		split: split,
+	}
+}
+
+// Decode appends chunk to the pending bytes and returns every complete element found.
+// Returned elements don't share memory with chunk nor with the decoder internal buffer.
+func (d *Decoder) Decode(chunk []byte) ([][]byte, error) {
+	d.pending = append(d.pending, chunk...)
+	return d.decode(false)
+}
+
+// Flush returns the elements left in the pending bytes once the stream is exhausted.
+// An error is returned if the remaining bytes can't form a complete element.
+func (d *Decoder) Flush() ([][]byte, error) {
+	return d.decode(true)
+}
+
+// Buffered returns the number of bytes waiting for the rest of their element.
+func (d *Decoder) Buffered() int {
+	return len(d.pending)
+}
+
+func (d *Decoder) decode(atEOF bool) ([][]byte, error) {
+	var elements [][]byte
+
+	for len(d.pending) > 0 {
+		advance, element, err := d.split(d.pending, atEOF)
+		if err != nil {
+			return elements, err
+		}
+
+		if advance == 0 && element == nil {
+			// need more data
+			break
+		}
+
+		d.pending = d.pending[advance:]
+		if len(element) == 0 {
+			continue
+		}
+
+		// element is a sub slice of pending : copy it before handing it out
+		elements = append(elements, append([]byte(nil), element...))
+	}
+
+	// release memory of consumed elements
+	if len(d.pending) == 0 {
+		d.pending = nil
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,131 @@
+package reader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoder_Lines(t *testing.T) {
+	var (
+		input    = "first message\nsecond message\r\n\nthird message\n"
+		expected = []string{"first message", "second message", "third message"}
+	)
+
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{name: "coalesced", chunks: []string{input}},
+		{name: "byte at a time", chunks: strings.Split(input, "")},
+		{name: "split in the middle of lines", chunks: []string{"first mes", "sage\nsecond message\r", "\n\nthird", " message\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				decoder  = NewDecoder(bufio.ScanLines)
+				received []string
+			)
+
+			for _, chunk := range tt.chunks {
+				elements, err := decoder.Decode([]byte(chunk))
+				assert.Nil(t, err)
+				for _, e := range elements {
+					received = append(received, string(e))
+				}
+			}
+
+			assert.Equal(t, expected, received)
+			assert.Equal(t, 0, decoder.Buffered())
+		})
+	}
+}
+
+func TestDecoder_LastLineWithoutSeparator(t *testing.T) {
+	decoder := NewDecoder(bufio.ScanLines)
+
+	elements, err := decoder.Decode([]byte("first\nsecond"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("first")}, elements)
+	assert.Equal(t, len("second"), decoder.Buffered())
+
+	elements, err = decoder.Flush()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("second")}, elements)
+}
+
+func TestDecoder_Frames(t *testing.T) {
+	var (
+		chatID     = uuid.New().String()
+		operations = []*crdt.Operation{
+			crdt.NewOperation(crdt.CreateChat, "my-chat", nil),
+			crdt.NewOperation(crdt.AddMessage, chatID, crdt.NewMessage(uuid.New(), "James", "with\nnew lines\n")),
+			crdt.NewOperation(crdt.AddMessage, chatID, crdt.NewMessage(uuid.New(), "James", strings.Repeat("a", 3*MaxMessageSize))),
+		}
+		stream []byte
+	)
+
+	for _, op := range operations {
+		stream = append(stream, op.ToBytes()...)
+	}
+
+	tests := []struct {
+		name      string
+		chunkSize int
+	}{
+		{name: "coalesced", chunkSize: len(stream)},
+		{name: "byte at a time", chunkSize: 1},
+		{name: "header split", chunkSize: crdt.FrameHeaderSize / 2},
+		{name: "read buffer", chunkSize: MaxMessageSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				decoder  = NewDecoder(crdt.ScanFrames)
+				received []*crdt.Operation
+			)
+
+			for offset := 0; offset < len(stream); offset += tt.chunkSize {
+				end := offset + tt.chunkSize
+				if end > len(stream) {
+					end = len(stream)
+				}
+
+				elements, err := decoder.Decode(stream[offset:end])
+				assert.Nil(t, err)
+
+				for _, e := range elements {
+					op, err := crdt.DecodeOperation(e)
+					assert.Nil(t, err)
+					received = append(received, op)
+				}
+			}
+
+			assert.Equal(t, operations, received)
+			assert.Equal(t, 0, decoder.Buffered())
+		})
+	}
+}
+
+func TestDecoder_PartialFrameAtEOF(t *testing.T) {
+	var (
+		decoder = NewDecoder(crdt.ScanFrames)
+		frame   = crdt.NewOperation(crdt.CreateChat, "my-chat", nil).ToBytes()
+	)
+
+	elements, err := decoder.Decode(frame[:len(frame)-1])
+	assert.Nil(t, err)
+	assert.Empty(t, elements)
+
+	elements, err = decoder.Flush()
+	assert.True(t, errors.Is(err, crdt.ShortFrameErr), fmt.Sprintf("unexpected error %v", err))
+	assert.Empty(t, elements)
+}
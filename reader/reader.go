@@ -1,88 +1,85 @@
 package reader
 
 import (
-	"bytes"
-	"golang.org/x/sys/unix"
-	"os"
+	"bufio"
+	"context"
+	"io"
 )
 
-type Reader interface {
-	Fd() uintptr
-	Read(b []byte) (n int, err error)
-	Close() error
-}
-
-var Separator = []byte("\n")
-
+// MaxMessageSize is the number of bytes read from the reader at once.
+// Longer elements are reassembled across reads by Read.
 const MaxMessageSize = 1000
 
-func Read(reader Reader, output chan<- []byte, separator []byte, shutdown chan struct{}) {
-	done := make(chan struct{})
+// Read outputs every element extracted by split from the bytes read on reader until ctx is done,
+// reader is exhausted (io.EOF, read deadline exceeded, closed connection ...) or split returns an error.
+// Partial elements are carried between reads by a Decoder so only complete elements are output.
+//
+// When Read returns, output is closed and so is reader if it implements io.Closer. Closing the reader
+// is what interrupts a pending read on net.Conn and pollable files, other readers leave a goroutine
+// blocked until their Read call returns.
+func Read(ctx context.Context, reader io.Reader, output chan<- []byte, split bufio.SplitFunc) {
+	var (
+		decoder = NewDecoder(split)
+		chunks  = make(chan []byte)
+		readErr = make(chan error, 1)
+		done    = make(chan struct{})
+	)
 
 	defer func() {
-		reader.Close()
 		close(done)
+		if closer, ok := reader.(io.Closer); ok {
+			_ = closer.Close()
+		}
 		close(output)
 	}()
 
-	// writeClose is closed in order to signal to stop reading output
-	var readClose, writeClose, _ = os.Pipe()
+	go func() {
+		for {
+			buffer := make([]byte, MaxMessageSize)
+			n, err := reader.Read(buffer)
+			if n > 0 {
+				select {
+				case chunks <- buffer[:n]:
+				case <-done:
+					return
+				}
+			}
 
-	go func(chan struct{}) {
-		select {
-		case <-shutdown:
-			_ = writeClose.Close()
-		case <-done:
-			return
+			if err != nil {
+				readErr <- err
+				return
+			}
 		}
-	}(done)
+	}()
 
 	for {
-		var (
-			fdSet  = unix.FdSet{}
-			buffer = make([]byte, MaxMessageSize)
-			err    error
-		)
-
-		// clear fdSet
-		fdSet.Zero()
-		fdSet.Set(int(reader.Fd()))
-		fdSet.Set(int(readClose.Fd()))
-
-		// wait and modifies reader descriptors in fdSet with first ready to use reader descriptors (ie for us reader or readClose)
-		someThingToRead, err := unix.Select(int(readClose.Fd()+1), &fdSet, nil, nil, &unix.Timeval{Sec: 5, Usec: 0})
-		// nothing to read
-		if someThingToRead == 0 {
-			continue
-		}
-
-		// Interrupted Syscall sometimes
-		if err != nil {
-			continue
-		}
-
-		// readClose : stop reading output
-		if fdSet.IsSet(int(readClose.Fd())) {
-			return
-		}
-		// default use reader
-		var n int
-		n, err = reader.Read(buffer)
-		if err != nil {
+		select {
+		case <-ctx.Done():
 			return
-		}
-		if n == 0 {
+
+		case <-readErr:
+			// output what is left
+			elements, _ := decoder.Flush()
+			outputElements(ctx, elements, output)
 			return
-		}
 
-		// split content into elements and output them
-		elements := bytes.Split(buffer[:n], separator)
-		for _, element := range elements {
-			if len(element) == 0 {
-				continue
+		case chunk := <-chunks:
+			// split content into elements and output them
+			elements, err := decoder.Decode(chunk)
+			outputElements(ctx, elements, output)
+			if err != nil {
+				return
 			}
+		}
+	}
+}
 
-			output <- element
+func outputElements(ctx context.Context, elements [][]byte, output chan<- []byte) {
+	for _, element := range elements {
+		select {
+		case output <- element:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
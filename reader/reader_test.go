@@ -1,10 +1,15 @@
 package reader
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strings"
-	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -25,9 +30,7 @@ func TestRead(t *testing.T) {
 		n        int
 		err      error
 		w, r     *os.File
-		wgReader = sync.WaitGroup{}
 		messages = make(chan []byte, MaxMessageSize)
-		shutdown = make(chan struct{}, 0)
 	)
 
 	w, err = os.OpenFile("test.txt", os.O_CREATE|os.O_WRONLY, os.ModePerm)
@@ -61,7 +64,8 @@ func TestRead(t *testing.T) {
 		return
 	}
 
-	go Read(r, messages, Separator, shutdown)
+	ctx, shutdown := context.WithCancel(context.Background())
+	go Read(ctx, r, messages, bufio.ScanLines)
 
 	var (
 		timeout = time.Tick(maxTestDuration)
@@ -69,8 +73,7 @@ func TestRead(t *testing.T) {
 	)
 
 	defer func() {
-		close(shutdown)
-		wgReader.Wait()
+		shutdown()
 		err = os.Remove("test.txt")
 		if err != nil {
 			assert.Fail(t, "failed to remove file (Remove) ", err.Error())
@@ -96,12 +99,14 @@ func TestRead(t *testing.T) {
 func TestRead_SOMAXCONN(t *testing.T) {
 
 	var (
-		w, r     *os.File
-		shutdown = make(chan struct{}, 0)
-		testsWg  = make(map[int]*sync.WaitGroup)
-		err      error
+		w, r          *os.File
+		ctx, shutdown = context.WithCancel(context.Background())
+		outputs       = make(map[int]chan []byte)
+		err           error
 	)
 
+	defer shutdown()
+
 	for i := 0; i < syscall.SOMAXCONN; i++ {
 		file := fmt.Sprintf("test_%d.txt", i)
 		w, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY, os.ModePerm)
@@ -133,22 +138,22 @@ func TestRead_SOMAXCONN(t *testing.T) {
 			return
 		}
 
-		var wg = sync.WaitGroup{}
-
 		r, err = os.OpenFile(file, os.O_RDONLY, os.ModePerm)
 		if err != nil {
 			assert.Fail(t, "failed to create reader (OpenFile) ", err.Error())
 			return
 		}
 
-		go Read(r, messages, Separator, shutdown)
-		testsWg[i] = &wg
+		go Read(ctx, r, messages, bufio.ScanLines)
+		outputs[i] = messages
 	}
 
-	close(shutdown)
+	shutdown()
 
 	for i := 0; i < syscall.SOMAXCONN; i++ {
-		testsWg[i].Wait()
+		// wait for output closure
+		for range outputs[i] {
+		}
 
 		file := fmt.Sprintf("test_%d.txt", i)
 		err = os.Remove(file)
@@ -157,3 +162,73 @@ func TestRead_SOMAXCONN(t *testing.T) {
 		}
 	}
 }
+
+func TestRead_Buffer(t *testing.T) {
+	var (
+		buffer   = bytes.NewBufferString("first message\nsecond message\nno separator")
+		messages = make(chan []byte)
+		received []string
+	)
+
+	go Read(context.Background(), buffer, messages, bufio.ScanLines)
+
+	// output is closed once the buffer is exhausted
+	for m := range messages {
+		received = append(received, string(m))
+	}
+
+	assert.Equal(t, []string{"first message", "second message", "no separator"}, received)
+}
+
+func TestRead_Cancel(t *testing.T) {
+	var (
+		maxTestDuration = 1 * time.Second
+		local, remote   = net.Pipe()
+		messages        = make(chan []byte)
+		ctx, shutdown   = context.WithCancel(context.Background())
+	)
+
+	defer remote.Close()
+
+	go Read(ctx, local, messages, bufio.ScanLines)
+
+	_, err := remote.Write([]byte("first message\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first message", string(<-messages))
+
+	// nothing more to read : the pending read is interrupted
+	shutdown()
+
+	select {
+	case <-time.After(maxTestDuration):
+		assert.Fail(t, "test timeout")
+	case _, more := <-messages:
+		assert.False(t, more, "output should be closed")
+	}
+
+	// the reader has been closed
+	_, err = remote.Write([]byte("second message\n"))
+	assert.True(t, errors.Is(err, io.ErrClosedPipe), fmt.Sprintf("unexpected error %v", err))
+}
+
+func TestRead_Deadline(t *testing.T) {
+	var (
+		maxTestDuration = 1 * time.Second
+		local, remote   = net.Pipe()
+		messages        = make(chan []byte)
+	)
+
+	defer remote.Close()
+
+	err := local.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	assert.Nil(t, err)
+
+	go Read(context.Background(), local, messages, bufio.ScanLines)
+
+	select {
+	case <-time.After(maxTestDuration):
+		assert.Fail(t, "test timeout")
+	case _, more := <-messages:
+		assert.False(t, more, "output should be closed")
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github/timtimjnvr/chat/crdt"
+)
+
+type (
+	value interface {
+		GetID() uuid.UUID
+		GetName() string
+
+		*crdt.Chat | *crdt.NodeInfos
+	}
+
+	// List stores values in insertion order and indexes them by id (and by name if names are unique)
+	List[T value] struct {
+		values []T
+		byID   map[uuid.UUID]int // id -> position in values
+		byName map[string]int    // name -> position in values, nil if names are not unique
+	}
+)
+
+var (
+	AlreadyInListWithNameErr = errors.New("already a chat with this name in the list")
+	AlreadyInListWithIDErr   = errors.New("already a chat with this ID in the list")
+	InvalidChatErr           = errors.New("invalid chat")
+	NotFoundErr              = errors.New("not found")
+	InvalidIdentifierErr     = errors.New("invalid identifier")
+)
+
+func NewChatList() *List[*crdt.Chat] {
+	return &List[*crdt.Chat]{
+		byID:   make(map[uuid.UUID]int),
+		byName: make(map[string]int),
+	}
+}
+
+// NewNodeList returns a list of nodes, several users can pick the same name
+func NewNodeList() *List[*crdt.NodeInfos] {
+	return &List[*crdt.NodeInfos]{
+		byID: make(map[uuid.UUID]int),
+	}
+}
+
+func (l *List[T]) Len() int {
+	return len(l.values)
+}
+
+// Add insert the value at the end of the list and return its key
+func (l *List[T]) Add(v T) (uuid.UUID, error) {
+	if v == nil {
+		return uuid.UUID{}, InvalidChatErr
+	}
+
+	id := v.GetID()
+	if _, ok := l.byID[id]; ok {
+		return uuid.UUID{}, AlreadyInListWithIDErr
+	}
+
+	if l.byName != nil {
+		if _, ok := l.byName[v.GetName()]; ok {
+			return uuid.UUID{}, AlreadyInListWithNameErr
+		}
+
+		l.byName[v.GetName()] = len(l.values)
+	}
+
+	l.byID[id] = len(l.values)
+	l.values = append(l.values, v)
+	return id, nil
+}
+
+func (l *List[T]) Contains(id uuid.UUID) bool {
+	_, ok := l.byID[id]
+	return ok
+}
+
+func (l *List[T]) Update(v T) error {
+	if v == nil {
+		return InvalidChatErr
+	}
+
+	index, ok := l.byID[v.GetID()]
+	if !ok {
+		return NotFoundErr
+	}
+
+	if l.byName != nil {
+		oldName, newName := l.values[index].GetName(), v.GetName()
+		if other, ok := l.byName[newName]; ok && other != index {
+			return AlreadyInListWithNameErr
+		}
+
+		delete(l.byName, oldName)
+		l.byName[newName] = index
+	}
+
+	l.values[index] = v
+	return nil
+}
+
+func (l *List[T]) GetByIndex(index int) (T, error) {
+	if index < 0 || index >= len(l.values) {
+		return nil, NotFoundErr
+	}
+
+	return l.values[index], nil
+}
+
+func (l *List[T]) GetById(id uuid.UUID) (T, error) {
+	index, ok := l.byID[id]
+	if !ok {
+		return nil, NotFoundErr
+	}
+
+	return l.values[index], nil
+}
+
+// GetByName returns the value with the given name, only available for lists with unique names
+func (l *List[T]) GetByName(name string) (T, error) {
+	index, ok := l.byName[name]
+	if !ok {
+		return nil, NotFoundErr
+	}
+
+	return l.values[index], nil
+}
+
+// GetAll returns the values in insertion order, the slice can be modified but not the values
+func (l *List[T]) GetAll() []T {
+	values := make([]T, len(l.values))
+	copy(values, l.values)
+	return values
+}
+
+// Delete removes the value keeping the order of the others. It is O(n) : the values after it
+// are shifted and reindexed. Swapping the last value in would be O(1) but break the insertion
+// order GetAll returns, and deletions (closed chats, killed nodes) are rare compared to lookups.
+func (l *List[T]) Delete(id uuid.UUID) {
+	index, ok := l.byID[id]
+	if !ok {
+		return
+	}
+
+	delete(l.byID, id)
+	if l.byName != nil {
+		delete(l.byName, l.values[index].GetName())
+	}
+
+	copy(l.values[index:], l.values[index+1:])
+	l.values[len(l.values)-1] = nil
+	l.values = l.values[:len(l.values)-1]
+
+	for i := index; i < len(l.values); i++ {
+		l.byID[l.values[i].GetID()] = i
+		if l.byName != nil {
+			l.byName[l.values[i].GetName()] = i
+		}
+	}
+}
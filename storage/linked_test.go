@@ -3,237 +3,230 @@ package storage
 import (
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/pkg/errors"
-	"github.com/stretchr/testify/assert"
 	"github/timtimjnvr/chat/crdt"
 	"testing"
 )
 
-func TestList_Len(t *testing.T) {
-	ass := assert.New(t)
-	l := NewChatList()
-	ass.True(l.Len() == 0, "failed on computing listOld length")
-}
-
-func TestList_Add(t *testing.T) {
-	ass := assert.New(t)
-	l := NewChatList()
-
-	id, err := l.Add(crdt.NewChat("1"))
-	assert.Nil(t, err)
-
-	// adding chat with name already in listOld
-	existingChat := crdt.NewChat("1")
-	_, err = l.Add(existingChat)
-	assert.True(t, errors.Is(err, AlreadyInListWithNameErr))
-
-	// adding chat with id already in listOld
-	existingChat = crdt.NewChat("toto")
-	existingChat.Id = id
-	_, err = l.Add(existingChat)
-	assert.True(t, errors.Is(err, AlreadyInListWithIDErr))
-
-	// adding more elements
-	_, err = l.Add(crdt.NewChat("2"))
-	assert.Nil(t, err)
-	_, err = l.Add(crdt.NewChat("3"))
-	assert.Nil(t, err)
+type (
+	// linkedElement and linkedList are the linked list List replaced, kept as a benchmark baseline
+	linkedElement[T value] struct {
+		v    T
+		next *linkedElement[T]
+	}
 
-	// checking listOld length
-	ass.Equal(3, l.Len(), "failed on Adding elements")
-}
+	linkedList[T value] struct {
+		length int
+		head   *linkedElement[T]
+	}
+)
 
-func TestList_Contains(t *testing.T) {
-	l := NewChatList()
-	// test on empty listOld
-	inExistingID, _ := uuid.NewUUID()
-	contains := l.Contains(inExistingID)
-	assert.False(t, contains)
+// add walks the whole list to reject duplicates before appending
+func (l *linkedList[T]) add(v T) error {
+	e := &linkedElement[T]{v: v}
+	if l.head == nil {
+		l.head = e
+		l.length++
+		return nil
+	}
 
-	id1, _ := l.Add(crdt.NewChat("1"))
-	id2, _ := l.Add(crdt.NewChat("2"))
-	id3, _ := l.Add(crdt.NewChat("3"))
+	ptr := l.head
+	for {
+		if ptr.v.GetID() == v.GetID() {
+			return AlreadyInListWithIDErr
+		}
 
-	errMessage := "failed on finding elementOld"
-	assert.True(t, l.Contains(id1), errMessage)
-	assert.True(t, l.Contains(id2), errMessage)
-	assert.True(t, l.Contains(id3), errMessage)
+		if ptr.v.GetName() == v.GetName() {
+			return AlreadyInListWithNameErr
+		}
 
-	id4, _ := uuid.NewUUID()
-	assert.False(t, l.Contains(id4), "found non existing elementOld")
-}
+		if ptr.next == nil {
+			ptr.next = e
+			l.length++
+			return nil
+		}
 
-func TestList_Update(t *testing.T) {
-	l := NewChatList()
-	// Try to update chat in empty listOld
-	err := l.Update(crdt.NewChat("non existing"))
-	assert.True(t, errors.Is(err, NotFoundErr))
-
-	c := crdt.NewChat("1")
-	id1String := c.Id.String()
-	l.Add(c)
-
-	// Try to update with invalid chat
-	err = l.Update(nil)
-	assert.True(t, errors.Is(err, InvalidChatErr))
-
-	err = l.Update(&crdt.Chat{Id: c.Id, Name: "3"})
-	// no error
-	assert.Nil(t, err)
-
-	id1, err := uuid.Parse(id1String)
-	assert.Nil(t, err)
-	c, err = l.GetById(id1)
-	assert.Nil(t, err)
-	assert.Equal(t, &crdt.Chat{Id: id1, Name: "3"}, c, "failed to update chat")
+		ptr = ptr.next
+	}
 }
 
-func TestList_Delete(t *testing.T) {
-	var (
-		ass       = assert.New(t)
-		l         = NewChatList()
-		first, _  = l.Add(crdt.NewChat("1"))
-		second, _ = l.Add(crdt.NewChat("2"))
-		third, _  = l.Add(crdt.NewChat("3"))
-	)
-	// 1 -> 2 -> 3 becomes 2 -> 3
-	l.Delete(first)
-	ass.Equal(l.Len(), 2, "failed on Deleting first elementOld")
-
-	// Verify new first = 2
-	c, err := l.GetByIndex(0)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+func (l *linkedList[T]) getByIndex(index int) (T, error) {
+	if index >= l.length {
+		return nil, NotFoundErr
 	}
-	ass.Equal(c.Id, second)
 
-	// Verify new second = 3
-	c, err = l.GetByIndex(1)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+	tmp := l.head
+	for i := 0; i < index; i++ {
+		tmp = tmp.next
 	}
 
-	ass.Equal(c.Id, third)
-
-	// 2 -> 3 becomes 2
-	l.Delete(third)
-	ass.Equal(l.Len(), 1, "failed on Deleting third elementOld")
+	return tmp.v, nil
+}
 
-	// Verify new first = 2
-	c, err = l.GetByIndex(0)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+func (l *linkedList[T]) getById(id uuid.UUID) (T, error) {
+	for tmp := l.head; tmp != nil; tmp = tmp.next {
+		if tmp.v.GetID() == id {
+			return tmp.v, nil
+		}
 	}
 
-	ass.Equal(c.Id, second)
-
-	l.Delete(second)
-	ass.Equal(l.Len(), 0, "failed on Deleting remaining elementOld")
-	ass.Nil(l.head)
-
-	first, _ = l.Add(crdt.NewChat("1"))
-	second, _ = l.Add(crdt.NewChat("2"))
-	third, _ = l.Add(crdt.NewChat("3"))
-
-	// 1 -> 2 -> 3 becomes 1 -> 3
-	l.Delete(second)
-	ass.Equal(l.Len(), 2, "failed on Deleting first elementOld")
-
-	// Verify new first = 1
-	c, err = l.GetByIndex(0)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
-	}
-	ass.Equal(c.Id, first)
+	return nil, NotFoundErr
+}
 
-	// Verify new second = 3
-	c, err = l.GetByIndex(1)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+// getByName looks the name up like the storage did before List: index by index
+func (l *linkedList[T]) getByName(name string) (T, error) {
+	for index := 0; index < l.length; index++ {
+		v, _ := l.getByIndex(index)
+		if v.GetName() == name {
+			return v, nil
+		}
 	}
 
-	ass.Equal(c.Id, third)
-
-	// Try to delete in existing elementOld (2) and validate that nothing has changed
-	l.Delete(second)
+	return nil, NotFoundErr
+}
 
-	// Verify first has not changed = 1
-	c, err = l.GetByIndex(0)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+func (l *linkedList[T]) delete(id uuid.UUID) {
+	if l.head == nil {
+		return
 	}
-	ass.Equal(c.Id, first)
 
-	// Verify second has not changed = 3
-	c, err = l.GetByIndex(1)
-	if err != nil {
-		ass.Fail("failed to get elementOld after deleting first")
+	if l.head.v.GetID() == id {
+		l.head = l.head.next
+		l.length--
+		return
 	}
 
-	ass.Equal(c.Id, third)
-
-	// try to delete an elementOld in an empty listOld
-	l = NewChatList()
-	l.Delete(second)
+	for previous := l.head; previous.next != nil; previous = previous.next {
+		if previous.next.v.GetID() == id {
+			previous.next = previous.next.next
+			l.length--
+			return
+		}
+	}
 }
 
-func TestList_GetById(t *testing.T) {
+// test helper that returns size chats and the same chats in a List and in the linked baseline
+func helperBenchmarkLists(b *testing.B, size int) ([]*crdt.Chat, *List[*crdt.Chat], *linkedList[*crdt.Chat]) {
 	var (
-		ass       = assert.New(t)
-		l         = NewChatList()
-		values    = []int{1, 2, 3, 4}
-		valuesIds = make(map[int]uuid.UUID)
+		chats   = make([]*crdt.Chat, size)
+		indexed = NewChatList()
+		linked  = &linkedList[*crdt.Chat]{}
 	)
 
-	for _, value := range values {
-		valuesIds[value], _ = l.Add(crdt.NewChat(fmt.Sprintf("%d", value)))
-	}
-
-	for value, id := range valuesIds {
-		res, err := l.GetById(id)
-		if err != nil {
-			assert.Fail(t, "failed on getting elementOld by id")
-			return
+	for i := range chats {
+		chats[i] = crdt.NewChat(fmt.Sprintf("chat-%d", i))
+		if _, err := indexed.Add(chats[i]); err != nil {
+			b.Fatal(err)
 		}
-		var expectedChat = crdt.NewChat(fmt.Sprintf("%d", value))
-		expectedChat.Id = id
 
-		ass.Equal(res, expectedChat, "failed on getting elementOld by id, wrong chat")
+		if err := linked.add(chats[i]); err != nil {
+			b.Fatal(err)
+		}
 	}
 
-	// try to get in existing elementOld in a non empty listOld
-	unExistingID, _ := uuid.NewUUID()
-	res, err := l.GetById(unExistingID)
-	assert.True(t, errors.Is(err, NotFoundErr))
-	assert.Nil(t, res)
-
-	// try to get in existing elementOld in an empty listOld
-	l = NewChatList()
-	res, err = l.GetById(unExistingID)
-	assert.True(t, errors.Is(err, NotFoundErr))
-	assert.Nil(t, res)
+	return chats, indexed, linked
 }
 
-func TestList_GetByIndex(t *testing.T) {
-	l := NewChatList()
-
-	// Try to get more than length
-	e, err := l.GetByIndex(2)
-	assert.True(t, errors.Is(err, NotFoundErr))
-	assert.Nil(t, e)
+func BenchmarkList_Add(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		chats, _, _ := helperBenchmarkLists(b, size)
+
+		b.Run(fmt.Sprintf("linked/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				l := &linkedList[*crdt.Chat]{}
+				for _, c := range chats {
+					if err := l.add(c); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				l := NewChatList()
+				for _, c := range chats {
+					if _, err := l.Add(c); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
 
-	var (
-		values = []int{1, 2, 3, 4}
-	)
+func BenchmarkList_GetById(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		chats, indexed, linked := helperBenchmarkLists(b, size)
+		id := chats[size-1].Id
+
+		b.Run(fmt.Sprintf("linked/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := linked.getById(id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := indexed.GetById(id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
 
-	for _, value := range values {
-		l.Add(crdt.NewChat(fmt.Sprintf("%d", value)))
+func BenchmarkList_GetByName(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		chats, indexed, linked := helperBenchmarkLists(b, size)
+		name := chats[size-1].Name
+
+		b.Run(fmt.Sprintf("linked/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := linked.getByName(name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := indexed.GetByName(name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
+}
 
-	for index, value := range values {
-		var c *crdt.Chat
-		c, err = l.GetByIndex(index)
-		assert.NoError(t, err)
-		assert.Equal(t, c.Name, fmt.Sprintf("%d", value))
+// each value is deleted and added back, so the deleted value is always the first one:
+// the slice shifts all the others while the linked list walks them to append it again
+func BenchmarkList_Delete(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		chats, indexed, linked := helperBenchmarkLists(b, size)
+		linkedNext, indexedNext := 0, 0 // kept across the runs of b.Run
+
+		b.Run(fmt.Sprintf("linked/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := chats[linkedNext%size]
+				linkedNext++
+				linked.delete(c.Id)
+				if err := linked.add(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/values=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := chats[indexedNext%size]
+				indexedNext++
+				indexed.Delete(c.Id)
+				if _, err := indexed.Add(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"github/timtimjnvr/chat/crdt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Persistent is a Storage saving every modification as an operation appended to a log in a data directory,
+	// the log is periodically compacted into a snapshot. Chats and messages survive a restart of the node.
+	Persistent struct {
+		*Storage
+		logLock       *sync.Mutex // keeps the log in the order of the modifications
+		dir           string
+		identity      *crdt.Identity
+		log           *os.File
+		logSize       int64
+		records       int
+		previousChats []PreviousChat
+	}
+
+	// PreviousChat is a chat the node was in before restarting and the nodes it was connected to in it
+	PreviousChat struct {
+		Name  string
+		Nodes []*crdt.NodeInfos
+	}
+)
+
+const (
+	logFileName      = "operations.log"
+	snapshotFileName = "snapshot"
+	identityFileName = "identity"
+
+	// number of operations appended to the log between two snapshots
+	snapshotInterval = 1000
+)
+
+// OpenPersistent restores the storage saved in dir (created if needed).
+// Records partially written during a crash are ignored. The chats the node shared with other nodes
+// are available through GetPreviousChats to connect to them again.
+func OpenPersistent(dir string) (*Persistent, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Persistent{
+		Storage: NewStorage(),
+		logLock: &sync.Mutex{},
+		dir:     dir,
+	}
+
+	p.identity, err = loadIdentity(filepath.Join(dir, identityFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	// operations of the log happened after the snapshot
+	for _, file := range []string{snapshotFileName, logFileName} {
+		err = p.replay(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.previousChats = p.getPreviousChats()
+
+	p.log, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot now holds the whole state : the log (and its possibly truncated last record) can be dropped
+	err = p.snapshot()
+	if err != nil {
+		p.log.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// GetIdentity returns the identity of the node owning the storage, the same across restarts
+func (p *Persistent) GetIdentity() *crdt.Identity {
+	return p.identity
+}
+
+// GetNodeID returns the id of the node owning the storage, derived from its identity
+func (p *Persistent) GetNodeID() uuid.UUID {
+	return p.identity.Id()
+}
+
+// GetPreviousChats returns the chats the node was connected to other nodes in before restarting
+func (p *Persistent) GetPreviousChats() []PreviousChat {
+	return p.previousChats
+}
+
+func (p *Persistent) Close() error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	return p.log.Close()
+}
+
+func (p *Persistent) AddNewChat(chatName string) (uuid.UUID, error) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	id, err := p.Storage.AddNewChat(chatName)
+	if err != nil {
+		return id, err
+	}
+
+	return id, p.append(crdt.NewOperation(crdt.AddChat, chatName, &crdt.Chat{Id: id, Name: chatName}))
+}
+
+func (p *Persistent) AddChat(chat *crdt.Chat) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.AddChat(chat)
+	if err != nil {
+		return err
+	}
+
+	// keys of encrypted chats are not saved, they are received again when joining the chat back
+	return p.append(crdt.NewOperation(crdt.AddChat, chat.Name, &crdt.Chat{Id: chat.Id, Name: chat.Name, Encrypted: chat.Encrypted, Gossip: chat.Gossip, Direct: chat.Direct}))
+}
+
+func (p *Persistent) RemoveChat(chatID uuid.UUID) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	p.Storage.RemoveChat(chatID)
+
+	err := p.append(crdt.NewOperation(crdt.RemoveChat, chatID.String(), nil))
+	if err != nil {
+		log.Println("[ERROR] ", err)
+	}
+}
+
+func (p *Persistent) AddNodeToChat(node *crdt.NodeInfos, chatID uuid.UUID) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.AddNodeToChat(node, chatID)
+	if err != nil {
+		return err
+	}
+
+	return p.append(crdt.NewOperation(crdt.AddNode, chatID.String(), node))
+}
+
+func (p *Persistent) RemoveNodeFromChat(nodeID uuid.UUID, chatID uuid.UUID) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.RemoveNodeFromChat(nodeID, chatID)
+
+	// the node may have been removed even if an error is returned, removing it twice is harmless
+	appendErr := p.append(crdt.NewOperation(crdt.RemoveNode, chatID.String(), &crdt.NodeInfos{Id: nodeID}))
+	if err != nil {
+		return err
+	}
+
+	return appendErr
+}
+
+func (p *Persistent) RemoveNodeFromStorage(nodeID uuid.UUID) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	p.Storage.RemoveNodeFromStorage(nodeID)
+
+	err := p.append(crdt.NewOperation(crdt.KillNode, "", &crdt.NodeInfos{Id: nodeID}))
+	if err != nil {
+		log.Println("[ERROR] ", err)
+	}
+}
+
+func (p *Persistent) AddMessageToChat(message *crdt.Message, chatID uuid.UUID) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.AddMessageToChat(message, chatID)
+	if err != nil {
+		return err
+	}
+
+	return p.append(crdt.NewOperation(crdt.AddMessage, chatID.String(), message))
+}
+
+func (p *Persistent) UpdateMessageInChat(message *crdt.Message, chatID uuid.UUID) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.UpdateMessageInChat(message, chatID)
+	if err != nil {
+		return err
+	}
+
+	return p.append(crdt.NewOperation(crdt.UpdateMessage, chatID.String(), message))
+}
+
+func (p *Persistent) DeleteMessageFromChat(message *crdt.Message, chatID uuid.UUID) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+
+	err := p.Storage.DeleteMessageFromChat(message, chatID)
+	if err != nil {
+		return err
+	}
+
+	return p.append(crdt.NewOperation(crdt.DeleteMessage, chatID.String(), message))
+}
+
+// append writes the operation at the end of the log and waits for it to be on disk, logLock must be held
+func (p *Persistent) append(op *crdt.Operation) error {
+	bytes := op.ToBytes()
+
+	_, err := p.log.Write(bytes)
+	if err == nil {
+		err = p.log.Sync()
+	}
+
+	if err != nil {
+		// don't leave a partial record followed by valid ones
+		_ = p.log.Truncate(p.logSize)
+		return errors.Wrap(err, "failed to save operation")
+	}
+
+	p.logSize += int64(len(bytes))
+	p.records++
+	if p.records >= snapshotInterval {
+		return p.snapshot()
+	}
+
+	return nil
+}
+
+// snapshot writes the whole storage state as a list of operations replacing the previous snapshot and empties the log.
+// If the node crashes before the log is emptied, the log is replayed on top of the new snapshot which is harmless
+// since operations are idempotent.
+func (p *Persistent) snapshot() error {
+	var bytes []byte
+
+	p.Storage.lock.RLock()
+	for _, c := range p.chats.GetAll() {
+		bytes = append(bytes, crdt.NewOperation(crdt.AddChat, c.Name, &crdt.Chat{Id: c.Id, Name: c.Name, Encrypted: c.Encrypted, Gossip: c.Gossip, Direct: c.Direct}).ToBytes()...)
+
+		for _, id := range c.GetNodes() {
+			n, err := p.nodes.GetById(id)
+			if err != nil {
+				continue
+			}
+
+			bytes = append(bytes, crdt.NewOperation(crdt.AddNode, c.Id.String(), n).ToBytes()...)
+		}
+
+		// messages are saved whole : their edits and deletions are only applied to saved messages
+		for _, m := range c.GetMessages() {
+			bytes = append(bytes, crdt.NewOperation(crdt.AddMessage, c.Id.String(), m).ToBytes()...)
+		}
+	}
+	p.Storage.lock.RUnlock()
+
+	err := writeFileAtomically(filepath.Join(p.dir, snapshotFileName), bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+
+	err = p.log.Truncate(0)
+	if err != nil {
+		return errors.Wrap(err, "failed to truncate log")
+	}
+
+	p.logSize = 0
+	p.records = 0
+	return nil
+}
+
+// replay applies all the operations saved in the file until the end of the file
+// or the first record that can't be decoded (partially written or corrupted).
+func (p *Persistent) replay(file string) error {
+	bytes, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(bytes); {
+		size, err := crdt.FrameSize(bytes[offset:])
+		if err != nil || offset+size > len(bytes) {
+			log.Printf("[ERROR] %s : ignoring %d bytes from offset %d\n", file, len(bytes)-offset, offset)
+			return nil
+		}
+
+		op, err := crdt.DecodeOperation(bytes[offset : offset+size])
+		if err != nil {
+			log.Printf("[ERROR] %s : ignoring %d bytes from offset %d\n", file, len(bytes)-offset, offset)
+			return nil
+		}
+
+		p.apply(op)
+		offset += size
+	}
+
+	return nil
+}
+
+// apply executes a saved operation on the in memory storage, errors are ignored since operations are replayed
+// in the order they succeeded and may be replayed twice. Only called while opening the storage.
+func (p *Persistent) apply(op *crdt.Operation) {
+	chatID, _ := uuid.Parse(op.TargetedChat)
+
+	switch op.Typology {
+	case crdt.AddChat:
+		if chat, ok := op.Data.(*crdt.Chat); ok {
+			_ = p.Storage.AddChat(chat)
+		}
+
+	case crdt.RemoveChat:
+		p.Storage.RemoveChat(chatID)
+
+	case crdt.AddNode:
+		if node, ok := op.Data.(*crdt.NodeInfos); ok {
+			_ = p.Storage.AddNodeToChat(node, chatID)
+		}
+
+	case crdt.RemoveNode:
+		c, err := p.getChat(op.TargetedChat, false)
+		if node, ok := op.Data.(*crdt.NodeInfos); ok && err == nil {
+			_ = c.RemoveNode(node.Id)
+		}
+
+	case crdt.KillNode:
+		node, ok := op.Data.(*crdt.NodeInfos)
+		if !ok {
+			break
+		}
+
+		for _, c := range p.chats.GetAll() {
+			_ = c.RemoveNode(node.Id)
+		}
+
+		p.nodes.Delete(node.Id)
+
+	case crdt.AddMessage:
+		if m, ok := op.Data.(*crdt.Message); ok {
+			_ = p.Storage.AddMessageToChat(m, chatID)
+		}
+
+	case crdt.UpdateMessage:
+		if m, ok := op.Data.(*crdt.Message); ok {
+			_ = p.Storage.UpdateMessageInChat(m, chatID)
+		}
+
+	case crdt.DeleteMessage:
+		if m, ok := op.Data.(*crdt.Message); ok {
+			_ = p.Storage.DeleteMessageFromChat(m, chatID)
+		}
+	}
+}
+
+// getPreviousChats returns the chats shared with other nodes
+func (p *Persistent) getPreviousChats() []PreviousChat {
+	var previousChats []PreviousChat
+
+	for _, c := range p.chats.GetAll() {
+		// direct chats can't be joined, they are synchronized with the chats shared with the other node
+		if c.Direct {
+			continue
+		}
+
+		previous := PreviousChat{Name: c.Name}
+
+		for _, id := range c.GetNodes() {
+			if n, err := p.nodes.GetById(id); err == nil {
+				copied := *n
+				previous.Nodes = append(previous.Nodes, &copied)
+			}
+		}
+
+		if len(previous.Nodes) > 0 {
+			previousChats = append(previousChats, previous)
+		}
+	}
+
+	return previousChats
+}
+
+// loadIdentity reads the identity seed saved in file, a new identity is saved if the file does not exist
+func loadIdentity(file string) (*crdt.Identity, error) {
+	bytes, err := os.ReadFile(file)
+	if err == nil {
+		return crdt.NewIdentityFromSeed(bytes)
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	identity, err := crdt.NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, writeFileAtomically(file, identity.Seed())
+}
+
+// writeFileAtomically replaces the content of file : after a crash it holds either the old or the new content
+func writeFileAtomically(file string, bytes []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return err
+	}
+
+	// persist the rename
+	d, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
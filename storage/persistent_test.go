@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"fmt"
+	"github/timtimjnvr/chat/crdt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistent_Restart(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	nodeID := p.GetNodeID()
+
+	roomID, err := p.AddNewChat("room")
+	assert.Nil(t, err)
+
+	goneID, err := p.AddNewChat("gone")
+	assert.Nil(t, err)
+
+	remote := crdt.NewNodeInfos("127.0.0.1", "8081", "bob")
+	assert.Nil(t, p.AddNodeToChat(remote, roomID))
+
+	direct := crdt.NewDirectChat(nodeID, remote)
+	assert.Nil(t, p.AddChat(direct))
+	assert.Nil(t, p.AddNodeToChat(remote, direct.Id))
+
+	// nodes leaving the chat or killed
+	for _, name := range []string{"carol", "dave"} {
+		assert.Nil(t, p.AddNodeToChat(crdt.NewNodeInfos("127.0.0.1", "8082", name), roomID))
+	}
+	members, err := p.GetNodeIDs(roomID)
+	assert.Nil(t, err)
+	assert.Nil(t, p.RemoveNodeFromChat(members[1], roomID))
+	p.RemoveNodeFromStorage(members[2])
+
+	var messages []*crdt.Message
+	for i := 0; i < 3; i++ {
+		m := crdt.NewMessage(nodeID, "alice", fmt.Sprintf("message %d\n", i))
+		assert.Nil(t, p.AddMessageToChat(m, roomID))
+		messages = append(messages, m)
+	}
+
+	received := crdt.NewMessage(remote.Id, remote.Name, "received\n")
+	received.Clock = 10
+	assert.Nil(t, p.AddMessageToChat(received, roomID))
+
+	assert.Nil(t, p.UpdateMessageInChat(&crdt.Message{Id: messages[0].Id, NodeId: nodeID, Content: "edited\n"}, roomID))
+	assert.Nil(t, p.DeleteMessageFromChat(&crdt.Message{Id: messages[1].Id, NodeId: nodeID}, roomID))
+	p.RemoveChat(goneID)
+
+	expected, err := p.GetDigest(roomID)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	restarted, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	defer restarted.Close()
+
+	assert.Equal(t, nodeID, restarted.GetNodeID())
+	assert.Equal(t, 2, restarted.GetNumberOfChats())
+
+	restoredDirect, err := restarted.GetChat(direct.Id)
+	assert.Nil(t, err)
+	assert.True(t, restoredDirect.Direct)
+
+	id, err := restarted.GetChatID("room")
+	assert.Nil(t, err)
+	assert.Equal(t, roomID, id)
+
+	got, err := restarted.GetDigest(roomID)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, got)
+
+	c, err := restarted.GetChat(roomID)
+	assert.Nil(t, err)
+	restoredMessages := c.GetMessages()
+	assert.Equal(t, "edited\n", restoredMessages[0].Content)
+	assert.True(t, restoredMessages[1].Deleted)
+
+	// new messages are ordered after the restored ones
+	m := crdt.NewMessage(nodeID, "alice", "after restart\n")
+	assert.Nil(t, restarted.AddMessageToChat(m, roomID))
+	assert.True(t, m.Clock > received.Clock)
+
+	// memberships are kept to join the chat again
+	members, err = restarted.GetNodeIDs(roomID)
+	assert.Nil(t, err)
+	assert.Equal(t, []uuid.UUID{remote.Id}, members)
+
+	// direct chats are not joined again
+	previous := restarted.GetPreviousChats()
+	assert.Equal(t, 1, len(previous))
+	assert.Equal(t, "room", previous[0].Name)
+	assert.Equal(t, 1, len(previous[0].Nodes))
+	assert.Equal(t, remote.Id, previous[0].Nodes[0].Id)
+	assert.Equal(t, remote.Port, previous[0].Nodes[0].Port)
+}
+
+func TestPersistent_TruncatedLog(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		logFile     = filepath.Join(dir, logFileName)
+		nodeID      uuid.UUID
+		chatID      uuid.UUID
+		recordSizes []int64
+	)
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	nodeID = p.GetNodeID()
+
+	chatID, err = p.AddNewChat("room")
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, p.AddMessageToChat(crdt.NewMessage(nodeID, "alice", fmt.Sprintf("message %d\n", i)), chatID))
+
+		info, err := os.Stat(logFile)
+		assert.Nil(t, err)
+		recordSizes = append(recordSizes, info.Size())
+	}
+
+	assert.Nil(t, p.Close())
+
+	// crash in the middle of any of the two last records
+	for cut := recordSizes[0]; cut < recordSizes[2]; cut++ {
+		crashed := copyDir(t, dir)
+		assert.Nil(t, os.Truncate(filepath.Join(crashed, logFileName), cut))
+
+		expectedMessages := 1
+		if cut >= recordSizes[1] {
+			expectedMessages = 2
+		}
+
+		restarted, err := OpenPersistent(crashed)
+		assert.Nil(t, err)
+
+		digest, err := restarted.GetDigest(chatID)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedMessages, len(digest.Versions), fmt.Sprintf("log cut at %d", cut))
+
+		// the log is usable again after recovery
+		assert.Nil(t, restarted.AddMessageToChat(crdt.NewMessage(nodeID, "alice", "after crash\n"), chatID))
+		assert.Nil(t, restarted.Close())
+
+		restarted, err = OpenPersistent(crashed)
+		assert.Nil(t, err)
+
+		digest, err = restarted.GetDigest(chatID)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedMessages+1, len(digest.Versions), fmt.Sprintf("log cut at %d", cut))
+		assert.Nil(t, restarted.Close())
+	}
+}
+
+func TestPersistent_CorruptedLog(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+
+	chatID, err := p.AddNewChat("room")
+	assert.Nil(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, logFileName))
+	assert.Nil(t, err)
+	firstMessageOffset := info.Size()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, p.AddMessageToChat(crdt.NewMessage(p.GetNodeID(), "alice", fmt.Sprintf("message %d\n", i)), chatID))
+	}
+
+	assert.Nil(t, p.Close())
+
+	// flip a byte in the content of the first message
+	bytes, err := os.ReadFile(filepath.Join(dir, logFileName))
+	assert.Nil(t, err)
+	bytes[firstMessageOffset+crdt.FrameHeaderSize+10] ^= 0xFF
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, logFileName), bytes, 0o600))
+
+	restarted, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	defer restarted.Close()
+
+	// records after the corrupted one can't be trusted
+	digest, err := restarted.GetDigest(chatID)
+	assert.Nil(t, err)
+	assert.Empty(t, digest.Versions)
+}
+
+func TestPersistent_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+
+	chatID, err := p.AddNewChat("room")
+	assert.Nil(t, err)
+
+	numberOfMessages := snapshotInterval + 10
+	var messages []*crdt.Message
+	for i := 0; i < numberOfMessages; i++ {
+		m := crdt.NewMessage(p.GetNodeID(), "alice", fmt.Sprintf("message %d\n", i))
+		assert.Nil(t, p.AddMessageToChat(m, chatID))
+		messages = append(messages, m)
+
+		// modified messages are part of the snapshot
+		if i == 1 {
+			assert.Nil(t, p.UpdateMessageInChat(&crdt.Message{Id: messages[0].Id, NodeId: m.NodeId, Content: "edited\n"}, chatID))
+			assert.Nil(t, p.DeleteMessageFromChat(&crdt.Message{Id: messages[1].Id, NodeId: m.NodeId}, chatID))
+		}
+	}
+
+	expected, err := p.GetDigest(chatID)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	// the log has been compacted into the snapshot
+	assert.Equal(t, 13, p.records)
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.Nil(t, err)
+
+	restarted, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	defer restarted.Close()
+
+	digest, err := restarted.GetDigest(chatID)
+	assert.Nil(t, err)
+	assert.Equal(t, numberOfMessages, len(digest.Versions))
+	assert.Equal(t, expected, digest)
+}
+
+// TestPersistent_ConcurrentAccess is meant to be run with the race detector
+func TestPersistent_ConcurrentAccess(t *testing.T) {
+	const (
+		numberOfWriters    = 4
+		messagesByWriter   = 50
+		expectedOperations = numberOfWriters * messagesByWriter * 2
+	)
+
+	var (
+		dir = t.TempDir()
+		wg  = sync.WaitGroup{}
+	)
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+
+	chatID, err := p.AddNewChat("room")
+	assert.Nil(t, err)
+
+	for i := 0; i < numberOfWriters; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+
+			for j := 0; j < messagesByWriter; j++ {
+				m := crdt.NewMessage(p.GetNodeID(), "alice", fmt.Sprintf("%d-%d\n", writer, j))
+				assert.Nil(t, p.AddMessageToChat(m, chatID))
+				assert.Nil(t, p.UpdateMessageInChat(&crdt.Message{Id: m.Id, NodeId: m.NodeId, Content: "edited\n"}, chatID))
+
+				_, err := p.GetDigest(chatID)
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	assert.Nil(t, p.Close())
+	assert.True(t, expectedOperations < snapshotInterval, "operations must be replayed from the log")
+
+	restarted, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	defer restarted.Close()
+
+	// each edit is saved after its message
+	c, err := restarted.GetChat(chatID)
+	assert.Nil(t, err)
+	messages := c.GetMessages()
+	assert.Equal(t, numberOfWriters*messagesByWriter, len(messages))
+	for _, m := range messages {
+		assert.Equal(t, "edited\n", m.Content)
+	}
+}
+
+func TestPersistent_EncryptedChat(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+
+	chat, err := crdt.NewEncryptedChat("secret")
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddChat(chat))
+
+	epoch, _, err := p.RotateChatKey(chat.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), epoch)
+	assert.Nil(t, p.Close())
+
+	restarted, err := OpenPersistent(dir)
+	assert.Nil(t, err)
+	defer restarted.Close()
+
+	// the chat is still encrypted but its keys are not saved
+	c, err := restarted.GetChat(chat.Id)
+	assert.Nil(t, err)
+	assert.True(t, c.Encrypted)
+
+	_, _, err = c.GetKey()
+	assert.ErrorIs(t, err, crdt.NoChatKeyErr)
+}
+
+// copyDir copies the files of dir into a new temporary directory
+func copyDir(t *testing.T, dir string) string {
+	copied := t.TempDir()
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+
+	for _, e := range entries {
+		bytes, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(copied, e.Name()), bytes, 0o600))
+	}
+
+	return copied
+}
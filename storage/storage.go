@@ -1,15 +1,17 @@
 package storage
 
 import (
-	"fmt"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github/timtimjnvr/chat/crdt"
-	"log"
+	"sync"
 )
 
 type (
+	// Storage holds the chats and nodes infos. It is safe for concurrent use : values passed to the storage are copied
+	// and values returned are snapshots that are not modified afterward.
 	Storage struct {
+		lock  *sync.RWMutex
 		chats *List[*crdt.Chat]
 		nodes *List[*crdt.NodeInfos]
 	}
@@ -17,16 +19,23 @@ type (
 
 func NewStorage() *Storage {
 	return &Storage{
+		lock:  &sync.RWMutex{},
 		chats: NewChatList(),
 		nodes: NewNodeList(),
 	}
 }
 
 func (s *Storage) GetNumberOfChats() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	return s.chats.Len()
 }
 
 func (s *Storage) GetChatID(chatName string) (uuid.UUID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	c, err := s.getChat(chatName, true)
 	if err != nil {
 		return uuid.UUID{}, err
@@ -36,6 +45,9 @@ func (s *Storage) GetChatID(chatName string) (uuid.UUID, error) {
 }
 
 func (s *Storage) GetChatName(id uuid.UUID) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	c, err := s.getChat(id.String(), false)
 	if err != nil {
 		return "", err
@@ -44,7 +56,36 @@ func (s *Storage) GetChatName(id uuid.UUID) (string, error) {
 	return c.Name, nil
 }
 
+// GetChat returns a copy of the chat
+func (s *Storage) GetChat(chatID uuid.UUID) (*crdt.Chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Copy(), nil
+}
+
+// GetChatInfos returns a copy of the chat without its messages, see crdt.Chat.Infos
+func (s *Storage) GetChatInfos(chatID uuid.UUID) (*crdt.Chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Infos(), nil
+}
+
 func (s *Storage) GetNewCurrentChatID() (uuid.UUID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	if s.chats.Len() == 0 {
 		return uuid.UUID{}, errors.New("no chats in storage")
 	}
@@ -58,54 +99,71 @@ func (s *Storage) GetNewCurrentChatID() (uuid.UUID, error) {
 }
 
 func (s *Storage) AddNewChat(chatName string) (uuid.UUID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	newChat := crdt.NewChat(chatName)
 	return s.chats.Add(newChat)
 }
 
+// AddChat saves a copy of the chat
 func (s *Storage) AddChat(chat *crdt.Chat) error {
-	_, err := s.chats.Add(chat)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.chats.Add(chat.Copy())
 	return err
 }
 
 func (s *Storage) RemoveChat(chatID uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	s.chats.Delete(chatID)
 }
 
-// AddNodeToChat add a node to a given chat identified by id. The node slot need to be set
+// AddNodeToChat add a node to a given chat identified by id, the infos of an already known node are updated
 func (s *Storage) AddNodeToChat(node *crdt.NodeInfos, chatID uuid.UUID) error {
-	if !s.nodes.Contains(node.Id) {
-		_, _ = s.nodes.Add(node)
-	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	c, err := s.getChat(chatID.String(), false)
 	if err != nil {
 		return err
 	}
 
-	c.SaveNode(node.Slot)
+	copied := *node
+	if s.nodes.Contains(node.Id) {
+		_ = s.nodes.Update(&copied)
+	} else {
+		_, _ = s.nodes.Add(&copied)
+	}
+
+	c.SaveNode(node.Id)
 	return nil
 }
 
-func (s *Storage) RemoveNodeFromChat(nodeSlot uint8, chatID uuid.UUID) error {
+func (s *Storage) RemoveNodeFromChat(nodeID uuid.UUID, chatID uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	c, err := s.getChat(chatID.String(), false)
 	if err != nil {
 		return err
 	}
 
-	err = c.RemoveNode(nodeSlot)
-	if err != nil {
-		return err
-	}
-	n, err := s.GetNodeBySlot(nodeSlot)
+	err = c.RemoveNode(nodeID)
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("%s leaved chat\n", n.Name)
 	return nil
 }
 
+// AddMessageToChat saves a copy of the message, the message is stamped if it has no Lamport timestamp
 func (s *Storage) AddMessageToChat(message *crdt.Message, chatID uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	c, err := s.getChat(chatID.String(), true)
 	if err != nil {
 		return err
@@ -115,148 +173,272 @@ func (s *Storage) AddMessageToChat(message *crdt.Message, chatID uuid.UUID) erro
 		return errors.New("message already saved")
 	}
 
-	c.SaveMessage(message)
+	// the message is returned as saved : stamped and with the modifications received before it
+	copied := *message
+	c.SaveMessage(&copied)
+	*message = copied
 	return nil
 }
 
-func (s *Storage) GetNodeBySlot(slot uint8) (*crdt.NodeInfos, error) {
-	var (
-		numberOfNodes = s.nodes.Len()
-		n             *crdt.NodeInfos
-		err           error
-	)
-	if s.nodes.length == 0 {
-		return nil, NotFoundErr
+// UpdateMessageInChat applies the edit to the saved message, see crdt.Chat.UpdateMessage
+func (s *Storage) UpdateMessageInChat(message *crdt.Message, chatID uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return err
 	}
 
-	for index := 0; index < numberOfNodes; index++ {
-		n, _ = s.nodes.GetByIndex(index)
-		if n.Slot == slot {
-			return n, nil
-		}
+	copied := *message
+	err = c.UpdateMessage(&copied)
+	if err != nil {
+		return err
+	}
 
-		if err != nil || n == nil {
-			return nil, NotFoundErr
+	*message = copied
+	return nil
+}
+
+// DeleteMessageFromChat replaces the saved message with a tombstone, see crdt.Chat.DeleteMessage
+func (s *Storage) DeleteMessageFromChat(message *crdt.Message, chatID uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return err
+	}
+
+	copied := *message
+	err = c.DeleteMessage(&copied)
+	if err != nil {
+		return err
+	}
+
+	*message = copied
+	return nil
+}
+
+// SetChatKey saves a key of an encrypted chat, see crdt.Chat.SetKey
+func (s *Storage) SetChatKey(chatID uuid.UUID, epoch uint32, key []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return err
+	}
+
+	c.SetKey(epoch, key)
+	return nil
+}
+
+// RotateChatKey generates a new key for the chat and returns it with its epoch
+func (s *Storage) RotateChatKey(chatID uuid.UUID) (uint32, []byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return c.RotateKey()
+}
+
+// SealMessage returns a copy of the message ready to be sent to the other members, see crdt.Chat.SealMessage
+func (s *Storage) SealMessage(message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.SealMessage(message)
+}
+
+// OpenMessage returns a copy of a message received from another member in clear, see crdt.Chat.OpenMessage
+func (s *Storage) OpenMessage(message *crdt.Message, chatID uuid.UUID) (*crdt.Message, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.OpenMessage(message)
+}
+
+// GetDigest returns the summary of the messages saved in the chat
+func (s *Storage) GetDigest(chatID uuid.UUID) (*crdt.Digest, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Digest(), nil
+}
+
+// GetMissingMessages returns the messages of the chat missing from the digest
+func (s *Storage) GetMissingMessages(chatID uuid.UUID, digest *crdt.Digest) ([]*crdt.Message, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, err := s.getChat(chatID.String(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Missing(digest), nil
+}
+
+// GetChatIDsByNode returns the ids of all the chats the node is in
+func (s *Storage) GetChatIDsByNode(nodeID uuid.UUID) []uuid.UUID {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var ids []uuid.UUID
+	for _, c := range s.chats.GetAll() {
+		if c.ContainsNode(nodeID) {
+			ids = append(ids, c.Id)
 		}
 	}
 
-	return n, nil
+	return ids
 }
 
-func (s *Storage) IsSlotUsedByOtherChats(slotToFind uint8, excludeChatForSearch uuid.UUID) bool {
-	var (
-		numberOfChats = s.GetNumberOfChats()
-		err           error
-	)
+// GetNode returns a copy of the node infos
+func (s *Storage) GetNode(nodeID uuid.UUID) (*crdt.NodeInfos, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	for index := 0; index < numberOfChats && err == nil; index++ {
-		tmpChat, _ := s.chats.GetByIndex(index)
+	n, err := s.nodes.GetById(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *n
+	return &copied, nil
+}
+
+func (s *Storage) IsNodeInOtherChats(nodeID uuid.UUID, excludeChatForSearch uuid.UUID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, tmpChat := range s.chats.GetAll() {
 		if tmpChat.Id == excludeChatForSearch {
 			continue
 		}
 
 		// don't kill connections in use in other chats
-		tmpSlots := tmpChat.GetSlots()
-		for _, slot := range tmpSlots {
-			if slot == slotToFind {
-				return true
-			}
+		if tmpChat.ContainsNode(nodeID) {
+			return true
 		}
 	}
 
 	return false
 }
 
-func (s *Storage) RemoveNodeSlotFromStorage(slot uint8) {
-	var (
-		index         = 0
-		numberOfChats = s.GetNumberOfChats()
-		c             *crdt.Chat
-		err           error
-	)
+// RemoveNodeFromStorage removes the node from all the chats and forgets its infos
+func (s *Storage) RemoveNodeFromStorage(nodeID uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	node, err := s.GetNodeBySlot(slot)
-	if err != nil {
-		return
+	for _, c := range s.chats.GetAll() {
+		_ = c.RemoveNode(nodeID)
 	}
 
-	for index < numberOfChats && err == nil {
-		c, _ = s.chats.GetByIndex(index)
+	s.nodes.Delete(nodeID)
+}
 
-		err = c.RemoveNode(slot)
-		if err == nil {
-			fmt.Printf("%s leaved chat %s\n", node.Name, c.Name)
-		}
+// GetChats returns copies of the chats in the order they were added
+func (s *Storage) GetChats() []*crdt.Chat {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-		index++
+	var chats []*crdt.Chat
+	for _, c := range s.chats.GetAll() {
+		chats = append(chats, c.Copy())
 	}
 
-	s.nodes.Delete(node.Id)
+	return chats
 }
 
-func (s *Storage) DisplayChats() {
-	s.chats.Display()
-}
+// GetNodes returns copies of the infos of all the nodes known
+func (s *Storage) GetNodes() []*crdt.NodeInfos {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var nodes []*crdt.NodeInfos
+	for _, n := range s.nodes.GetAll() {
+		copied := *n
+		nodes = append(nodes, &copied)
+	}
 
-func (s *Storage) DisplayNodes() {
-	s.nodes.Display()
+	return nodes
 }
 
-func (s *Storage) DisplayChatUsers(chatID uuid.UUID) error {
+// GetChatNodes returns copies of the infos of the chat members
+func (s *Storage) GetChatNodes(chatID uuid.UUID) ([]*crdt.NodeInfos, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	c, err := s.chats.GetById(chatID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Printf("chat name : %s\n", c.Name)
-	for slot := range c.GetSlots() {
-		n, err := s.nodes.GetByIndex(slot)
+	var nodes []*crdt.NodeInfos
+	for _, id := range c.GetNodes() {
+		n, err := s.nodes.GetById(id)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Printf("- %s (Address: %s, Port: %s, Slot: %d)\n", n.Name, n.Address, n.Port, n.Slot)
+
+		copied := *n
+		nodes = append(nodes, &copied)
 	}
 
-	return nil
+	return nodes, nil
 }
 
-func (s *Storage) GetSlots(chatID uuid.UUID) ([]uint8, error) {
+// GetNodeIDs returns the ids of the chat members
+func (s *Storage) GetNodeIDs(chatID uuid.UUID) ([]uuid.UUID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	c, err := s.getChat(chatID.String(), false)
 	if err != nil {
-		return []uint8{}, err
+		return []uuid.UUID{}, err
 	}
 
-	return c.GetSlots(), nil
+	return c.GetNodes(), nil
 }
 
-func (s *Storage) getChat(identifier string, byName bool) (*crdt.Chat, error) {
-	var (
-		numberOfChats = s.chats.Len()
-		c             *crdt.Chat
-		err           error
-	)
+// getChat expects the caller to hold the lock
 
+func (s *Storage) getChat(identifier string, byName bool) (*crdt.Chat, error) {
 	if byName {
-		for index := 0; index < numberOfChats; index++ {
-			c, _ = s.chats.GetByIndex(index)
-			if c.Name == identifier {
-				return c, nil
-			}
-		}
-
-		if err != nil || c == nil {
-			return nil, NotFoundErr
+		c, err := s.chats.GetByName(identifier)
+		if err == nil {
+			return c, nil
 		}
 	}
 
 	// by uuid
-	var id uuid.UUID
-	id, err = uuid.Parse(identifier)
+	id, err := uuid.Parse(identifier)
 	if err != nil {
 		return nil, InvalidIdentifierErr
 	}
 
-	c, err = s.chats.GetById(id)
+	c, err := s.chats.GetById(id)
 	if err != nil {
 		return nil, NotFoundErr
 	}
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github/timtimjnvr/chat/crdt"
+	"sync"
 	"testing"
 )
 
@@ -104,21 +106,26 @@ func Test_storage_AddNodeToChat(t *testing.T) {
 	c, err := s.getChat(id.String(), false)
 	assert.Nil(t, err)
 
-	slot := uint8(1)
 	node := crdt.NewNodeInfos("127.0.0.1", "8080", "toto")
-	node.Slot = slot
 
-	numberOfSlots := c.GetSlots()
-	assert.Equal(t, 0, len(numberOfSlots))
+	assert.Equal(t, 0, len(c.GetNodes()))
 	err = s.AddNodeToChat(node, id)
 	assert.Nil(t, err)
 
-	assert.Nil(t, err)
-	numberOfSlots = c.GetSlots()
-	assert.Equal(t, 1, len(numberOfSlots))
+	assert.Equal(t, 1, len(c.GetNodes()))
 
 	// Verify node
-	assert.True(t, contains(slot, c.GetSlots()))
+	assert.True(t, c.ContainsNode(node.Id))
+
+	// infos of a node coming back with a new address are updated
+	moved := *node
+	moved.Port = "8081"
+	assert.Nil(t, s.AddNodeToChat(&moved, id))
+	assert.Equal(t, 1, len(c.GetNodes()))
+
+	saved, err := s.GetNode(node.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "8081", saved.Port)
 }
 
 func Test_storage_RemoveNodeFromChat(t *testing.T) {
@@ -130,23 +137,19 @@ func Test_storage_RemoveNodeFromChat(t *testing.T) {
 	c, err := s.getChat(id.String(), false)
 	assert.Nil(t, err)
 
-	// Setting slot to identify active TCP connection
-	nodeSlot := uint8(1)
 	node := crdt.NewNodeInfos("127.0.0.1", "8080", "toto")
-	node.Slot = nodeSlot
 	err = s.AddNodeToChat(node, id)
 	assert.Nil(t, err)
 
-	numberOfSlots := c.GetSlots()
-	assert.Equal(t, 1, len(numberOfSlots))
+	assert.Equal(t, 1, len(c.GetNodes()))
 
 	chatId, err := uuid.Parse(c.Id.String())
 	assert.Nil(t, err)
-	err = s.RemoveNodeFromChat(nodeSlot, chatId)
+	err = s.RemoveNodeFromChat(node.Id, chatId)
 	assert.Nil(t, err)
 
-	// try to remove in existent node slot
-	err = s.RemoveNodeFromChat(nodeSlot, chatId)
+	// try to remove in existent node
+	err = s.RemoveNodeFromChat(node.Id, chatId)
 	assert.NotNil(t, err)
 }
 
@@ -158,7 +161,7 @@ func Test_storage_GetNumberOfChats(t *testing.T) {
 	assert.Equal(t, 1, s.GetNumberOfChats())
 }
 
-func TestStorage_RemoveNodeSlotFromStorage(t *testing.T) {
+func TestStorage_RemoveNodeFromStorage(t *testing.T) {
 	s := NewStorage()
 
 	first, err := s.AddNewChat("first")
@@ -167,26 +170,24 @@ func TestStorage_RemoveNodeSlotFromStorage(t *testing.T) {
 	second, err := s.AddNewChat("second")
 	assert.Nil(t, err)
 
+	// two users can have the same name
 	firstNode := crdt.NewNodeInfos("127.0.0.1", "8080", "toto")
-	firstNodeSlot := uint8(1)
-	firstNode.Slot = firstNodeSlot
-
 	secondNode := crdt.NewNodeInfos("127.0.0.1", "8080", "toto")
-	secondNodeSlot := uint8(2)
-	secondNode.Slot = secondNodeSlot
 
 	err = s.AddNodeToChat(firstNode, first)
 	assert.Nil(t, err)
 
 	err = s.AddNodeToChat(secondNode, first)
+	assert.Nil(t, err)
 
 	c1, err := s.getChat(first.String(), false)
 	assert.Nil(t, err)
 
-	assert.True(t, contains(uint8(1), c1.GetSlots()))
+	assert.True(t, c1.ContainsNode(firstNode.Id))
 
-	s.RemoveNodeSlotFromStorage(2)
-	assert.True(t, !contains(uint8(2), c1.GetSlots()))
+	s.RemoveNodeFromStorage(secondNode.Id)
+	assert.False(t, c1.ContainsNode(secondNode.Id))
+	assert.True(t, c1.ContainsNode(firstNode.Id))
 
 	err = s.AddNodeToChat(secondNode, first)
 	assert.Nil(t, err)
@@ -195,23 +196,266 @@ func TestStorage_RemoveNodeSlotFromStorage(t *testing.T) {
 
 	c2, err := s.getChat(second.String(), false)
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(c1.GetSlots()))
-	assert.Equal(t, 1, len(c2.GetSlots()))
+	assert.Equal(t, 2, len(c1.GetNodes()))
+	assert.Equal(t, 1, len(c2.GetNodes()))
+	assert.Equal(t, []uuid.UUID{first, second}, s.GetChatIDsByNode(secondNode.Id))
+
+	s.RemoveNodeFromStorage(secondNode.Id)
+	assert.Equal(t, 1, len(c1.GetNodes()))
+	assert.Equal(t, 0, len(c2.GetNodes()))
+
+	_, err = s.GetNode(secondNode.Id)
+	assert.True(t, errors.Is(err, NotFoundErr))
+}
+
+func TestStorage_GetChatSnapshot(t *testing.T) {
+	s := NewStorage()
+	chatID, err := s.AddNewChat("room")
+	assert.Nil(t, err)
 
-	s.RemoveNodeSlotFromStorage(2)
-	assert.Equal(t, 1, len(c1.GetSlots()))
-	assert.Equal(t, 0, len(c2.GetSlots()))
+	message := crdt.NewMessage(uuid.New(), "alice", "hello\n")
+	assert.Nil(t, s.AddMessageToChat(message, chatID))
+
+	snapshot, err := s.GetChat(chatID)
+	assert.Nil(t, err)
+
+	// modifications of the storage are not visible in the snapshot and the other way around
+	assert.Nil(t, s.AddMessageToChat(crdt.NewMessage(uuid.New(), "bob", "hi\n"), chatID))
+	assert.Nil(t, s.UpdateMessageInChat(&crdt.Message{Id: message.Id, NodeId: message.NodeId, Content: "edited\n"}, chatID))
+	assert.Equal(t, 1, len(snapshot.GetMessages()))
+	assert.Equal(t, "hello\n", snapshot.GetMessages()[0].Content)
+
+	snapshot.SaveMessage(crdt.NewMessage(uuid.New(), "eve", "not saved\n"))
+	message.Content = "not saved either\n"
+
+	c, err := s.GetChat(chatID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c.GetMessages()))
+	assert.Equal(t, "edited\n", c.GetMessages()[0].Content)
 }
 
-func contains(element uint8, elements []uint8) bool {
-	if len(elements) == 0 {
-		return false
+func TestStorage_GetChatInfos(t *testing.T) {
+	var (
+		s    = NewStorage()
+		chat = crdt.NewChat("room")
+		bob  = crdt.NewNodeInfos("", "8081", "bob")
+	)
+
+	chat.Gossip = true
+	assert.Nil(t, s.AddChat(chat))
+	assert.Nil(t, s.AddNodeToChat(bob, chat.Id))
+	assert.Nil(t, s.AddMessageToChat(crdt.NewMessage(bob.Id, "bob", "hello\n"), chat.Id))
+
+	// the flags and the members of the chat, not its messages
+	infos, err := s.GetChatInfos(chat.Id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "room", infos.Name)
+		assert.True(t, infos.Gossip)
+		assert.Equal(t, []uuid.UUID{bob.Id}, infos.GetNodes())
+		assert.Empty(t, infos.GetMessages())
 	}
 
-	for _, e := range elements {
-		if e == element {
-			return true
+	_, err = s.GetChatInfos(uuid.New())
+	assert.NotNil(t, err)
+}
+
+func TestStorage_GetChatsAndNodes(t *testing.T) {
+	var (
+		s     = NewStorage()
+		alice = crdt.NewNodeInfos("127.0.0.1", "8080", "alice")
+		bob   = crdt.NewNodeInfos("127.0.0.1", "8081", "bob")
+	)
+
+	first, err := s.AddNewChat("first")
+	assert.Nil(t, err)
+	second, err := s.AddNewChat("second")
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.AddNodeToChat(alice, first))
+	assert.Nil(t, s.AddNodeToChat(bob, second))
+	assert.Nil(t, s.AddMessageToChat(crdt.NewMessage(alice.Id, alice.Name, "hello\n"), first))
+
+	// chats are listed in the order they were added
+	chats := s.GetChats()
+	if assert.Equal(t, 2, len(chats)) {
+		assert.Equal(t, "first", chats[0].Name)
+		assert.Equal(t, 1, chats[0].CountMessages())
+		assert.Equal(t, "second", chats[1].Name)
+	}
+
+	assert.Equal(t, 2, len(s.GetNodes()))
+
+	nodes, err := s.GetChatNodes(second)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(nodes)) {
+		assert.Equal(t, "bob", nodes[0].Name)
+	}
+
+	// the infos returned are copies
+	nodes[0].Name = "eve"
+	saved, err := s.GetNode(bob.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", saved.Name)
+
+	_, err = s.GetChatNodes(uuid.New())
+	assert.NotNil(t, err)
+}
+
+// TestStorage_ConcurrentAccess is meant to be run with the race detector
+func TestStorage_ConcurrentAccess(t *testing.T) {
+	const (
+		numberOfWriters    = 8
+		numberOfReaders    = 8
+		operationsByWriter = 200
+	)
+
+	var (
+		s      = NewStorage()
+		wg     = sync.WaitGroup{}
+		nodeID = uuid.New()
+	)
+
+	chatID, err := s.AddNewChat("room")
+	assert.Nil(t, err)
+
+	for i := 0; i < numberOfWriters; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+
+			node := crdt.NewNodeInfos("127.0.0.1", "8080", fmt.Sprintf("node-%d", writer))
+			otherChat := fmt.Sprintf("chat-%d", writer)
+
+			for j := 0; j < operationsByWriter; j++ {
+				m := crdt.NewMessage(nodeID, "alice", fmt.Sprintf("%d-%d\n", writer, j))
+				assert.Nil(t, s.AddMessageToChat(m, chatID))
+				assert.Nil(t, s.UpdateMessageInChat(&crdt.Message{Id: m.Id, NodeId: nodeID, Content: "edited\n"}, chatID))
+
+				assert.Nil(t, s.AddNodeToChat(node, chatID))
+				id, err := s.AddNewChat(otherChat)
+				assert.Nil(t, err)
+				s.RemoveChat(id)
+				s.RemoveNodeFromStorage(node.Id)
+			}
+		}(i)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < numberOfReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for j := 0; j < operationsByWriter; j++ {
+				c, err := s.GetChat(chatID)
+				assert.Nil(t, err)
+				for _, m := range c.GetMessages() {
+					_ = m.Content
+				}
+
+				_, _ = s.GetDigest(chatID)
+				_, _ = s.GetChatID("room")
+				for _, id := range c.GetNodes() {
+					_ = s.GetChatIDsByNode(id)
+					_ = s.IsNodeInOtherChats(id, chatID)
+					if n, err := s.GetNode(id); err == nil {
+						_ = n.Name
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	readers.Wait()
+
+	c, err := s.GetChat(chatID)
+	assert.Nil(t, err)
+	assert.Equal(t, numberOfWriters*operationsByWriter, len(c.GetMessages()))
+	assert.Equal(t, 1, s.GetNumberOfChats())
+}
+
+var benchmarkSizes = []int{10, 1000, 5000}
+
+// newBenchmarkStorage returns a storage with size chats and size nodes each in one of the chats
+func newBenchmarkStorage(b *testing.B, size int) (s *Storage, chatIDs []uuid.UUID, nodeIDs []uuid.UUID) {
+	s = NewStorage()
+
+	for i := 0; i < size; i++ {
+		id, err := s.AddNewChat(fmt.Sprintf("chat-%d", i))
+		if err != nil {
+			b.Fatal(err)
 		}
+
+		n := crdt.NewNodeInfos("127.0.0.1", fmt.Sprintf("%d", i), fmt.Sprintf("node-%d", i))
+		if err = s.AddNodeToChat(n, id); err != nil {
+			b.Fatal(err)
+		}
+
+		chatIDs = append(chatIDs, id)
+		nodeIDs = append(nodeIDs, n.Id)
+	}
+
+	return s, chatIDs, nodeIDs
+}
+
+func BenchmarkStorage_GetChatID(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("chats=%d", size), func(b *testing.B) {
+			s, _, _ := newBenchmarkStorage(b, size)
+			name := fmt.Sprintf("chat-%d", size-1)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetChatID(name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStorage_AddMessageToChat(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("chats=%d", size), func(b *testing.B) {
+			s, chatIDs, _ := newBenchmarkStorage(b, size)
+			nodeID := uuid.New()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// messages spread over the chats to keep them short
+				if err := s.AddMessageToChat(crdt.NewMessage(nodeID, "alice", "hello\n"), chatIDs[i%size]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStorage_GetNode(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("nodes=%d", size), func(b *testing.B) {
+			s, _, nodeIDs := newBenchmarkStorage(b, size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetNode(nodeIDs[size-1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStorage_GetChatIDsByNode(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("chats=%d", size), func(b *testing.B) {
+			s, _, nodeIDs := newBenchmarkStorage(b, size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.GetChatIDsByNode(nodeIDs[0])
+			}
+		})
 	}
-	return false
 }
@@ -0,0 +1,127 @@
+package tui
+
+import "unicode/utf8"
+
+type (
+	KeyCode uint8
+
+	// Key is a key pressed by the user, Rune is only set for KeyRune
+	Key struct {
+		Code KeyCode
+		Rune rune
+	}
+)
+
+const (
+	KeyRune KeyCode = iota
+	KeyEnter
+	KeyBackspace
+	KeyDelete
+	KeyTab
+	KeyLeft
+	KeyRight
+	KeyUp
+	KeyDown
+	KeyHome
+	KeyEnd
+	KeyPageUp
+	KeyPageDown
+	KeyCtrlC
+	KeyCtrlD
+)
+
+const escape = 0x1b
+
+// escape sequences sent by the terminals for the special keys
+var sequences = map[string]KeyCode{
+	"[A": KeyUp, "[B": KeyDown, "[C": KeyRight, "[D": KeyLeft,
+	"[H": KeyHome, "[F": KeyEnd, "OH": KeyHome, "OF": KeyEnd,
+	"[1~": KeyHome, "[7~": KeyHome, "[4~": KeyEnd, "[8~": KeyEnd,
+	"[3~": KeyDelete, "[5~": KeyPageUp, "[6~": KeyPageDown,
+}
+
+// DecodeKeys returns the keys pressed in the bytes read on a terminal in raw mode. The bytes of an incomplete key
+// are returned in rest to be decoded with the next ones (escape alone waits for the next key). Unknown escape
+// sequences are dropped.
+func DecodeKeys(b []byte) (keys []Key, rest []byte) {
+	for len(b) > 0 {
+		switch c := b[0]; {
+		case c == escape:
+			size, code, known := decodeSequence(b)
+			if size == 0 {
+				return keys, b
+			}
+
+			if known {
+				keys = append(keys, Key{Code: code})
+			}
+
+			b = b[size:]
+			continue
+
+		case c == '\r' || c == '\n':
+			keys = append(keys, Key{Code: KeyEnter})
+
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, Key{Code: KeyBackspace})
+
+		case c == '\t':
+			keys = append(keys, Key{Code: KeyTab})
+
+		case c == 0x03:
+			keys = append(keys, Key{Code: KeyCtrlC})
+
+		case c == 0x04:
+			keys = append(keys, Key{Code: KeyCtrlD})
+
+		case c < ' ':
+			// other control keys are ignored
+
+		default:
+			if !utf8.FullRune(b) {
+				return keys, b
+			}
+
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, Key{Code: KeyRune, Rune: r})
+			b = b[size:]
+			continue
+		}
+
+		b = b[1:]
+	}
+
+	return keys, nil
+}
+
+// decodeSequence returns the size of the escape sequence at the start of b, 0 if it is incomplete
+func decodeSequence(b []byte) (int, KeyCode, bool) {
+	if len(b) < 2 {
+		return 0, 0, false
+	}
+
+	switch b[1] {
+	case '[':
+		// control sequence : parameters ended by a byte in 0x40-0x7e
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				code, known := sequences[string(b[1:i+1])]
+				return i + 1, code, known
+			}
+		}
+
+		return 0, 0, false
+
+	case 'O':
+		if len(b) < 3 {
+			return 0, 0, false
+		}
+
+		code, known := sequences[string(b[1:3])]
+		return 3, code, known
+
+	default:
+		// alt + key : the key alone
+		return 1, 0, false
+	}
+}
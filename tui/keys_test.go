@@ -0,0 +1,38 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeKeys(t *testing.T) {
+	keys, rest := DecodeKeys([]byte("hé\r\x7f\t\x03\x04\x1b[A\x1b[3~\x1bOH\x1b[5~\x1b[99X\x01"))
+	assert.Equal(t, []Key{
+		{Code: KeyRune, Rune: 'h'},
+		{Code: KeyRune, Rune: 'é'},
+		{Code: KeyEnter},
+		{Code: KeyBackspace},
+		{Code: KeyTab},
+		{Code: KeyCtrlC},
+		{Code: KeyCtrlD},
+		{Code: KeyUp},
+		{Code: KeyDelete},
+		{Code: KeyHome},
+		{Code: KeyPageUp},
+	}, keys)
+	assert.Empty(t, rest)
+
+	// incomplete keys are kept for the next bytes
+	keys, rest = DecodeKeys([]byte("a\x1b[1"))
+	assert.Equal(t, []Key{{Code: KeyRune, Rune: 'a'}}, keys)
+	assert.Equal(t, []byte("\x1b[1"), rest)
+
+	keys, rest = DecodeKeys(append(rest, '~'))
+	assert.Equal(t, []Key{{Code: KeyHome}}, keys)
+	assert.Empty(t, rest)
+
+	keys, rest = DecodeKeys([]byte("é")[:1])
+	assert.Empty(t, keys)
+	assert.Equal(t, []byte("é")[:1], rest)
+}
@@ -0,0 +1,133 @@
+package tui
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Screen is a virtual terminal buffer : the UI draws in its cells, Render writes them on the terminal.
+// A rune takes one cell.
+type Screen struct {
+	width, height    int
+	cells            [][]rune
+	cursorX, cursorY int
+}
+
+func NewScreen(width, height int) *Screen {
+	s := &Screen{}
+	s.Resize(width, height)
+	return s
+}
+
+// Resize changes the size of the screen, it is cleared
+func (s *Screen) Resize(width, height int) {
+	if width < 0 {
+		width = 0
+	}
+
+	if height < 0 {
+		height = 0
+	}
+
+	s.width, s.height = width, height
+	s.cells = make([][]rune, height)
+	for y := range s.cells {
+		s.cells[y] = make([]rune, width)
+	}
+
+	s.Clear()
+}
+
+func (s *Screen) Size() (int, int) {
+	return s.width, s.height
+}
+
+// Clear fills the screen with spaces and moves the cursor to the top left corner
+func (s *Screen) Clear() {
+	for y := range s.cells {
+		for x := range s.cells[y] {
+			s.cells[y][x] = ' '
+		}
+	}
+
+	s.cursorX, s.cursorY = 0, 0
+}
+
+// Print writes text from x on line y, on width cells at most. It returns the number of cells written.
+func (s *Screen) Print(x, y, width int, text string) int {
+	if y < 0 || y >= s.height {
+		return 0
+	}
+
+	written := 0
+	for _, r := range text {
+		if written >= width || x+written >= s.width {
+			break
+		}
+
+		if x+written >= 0 {
+			if r < ' ' {
+				r = ' '
+			}
+
+			s.cells[y][x+written] = r
+		}
+
+		written++
+	}
+
+	return written
+}
+
+// Fill writes r on width cells from x on line y
+func (s *Screen) Fill(x, y, width int, r rune) {
+	s.Print(x, y, width, strings.Repeat(string(r), width))
+}
+
+// SetCursor moves the cursor of the terminal to the cell x of line y
+func (s *Screen) SetCursor(x, y int) {
+	s.cursorX, s.cursorY = x, y
+}
+
+func (s *Screen) Cursor() (int, int) {
+	return s.cursorX, s.cursorY
+}
+
+// Line returns the content of line y without the trailing spaces
+func (s *Screen) Line(y int) string {
+	if y < 0 || y >= s.height {
+		return ""
+	}
+
+	return strings.TrimRight(string(s.cells[y]), " ")
+}
+
+// String returns the lines of the screen
+func (s *Screen) String() string {
+	lines := make([]string, s.height)
+	for y := range lines {
+		lines[y] = s.Line(y)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Render draws the whole screen on the terminal with ANSI escape sequences
+func (s *Screen) Render(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	// hide the cursor while drawing and go to the top left corner, the last cell must not scroll the terminal
+	_, _ = out.WriteString("\x1b[?25l\x1b[?7l\x1b[H")
+	for y := range s.cells {
+		if y > 0 {
+			_, _ = out.WriteString("\r\n")
+		}
+
+		_, _ = out.WriteString(string(s.cells[y]))
+	}
+
+	_, _ = fmt.Fprintf(out, "\x1b[?7h\x1b[%d;%dH\x1b[?25h", s.cursorY+1, s.cursorX+1)
+	return out.Flush()
+}
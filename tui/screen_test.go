@@ -0,0 +1,31 @@
+package tui
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreen(t *testing.T) {
+	s := NewScreen(10, 3)
+
+	// text is clipped by the width given and the screen
+	assert.Equal(t, 5, s.Print(0, 0, 5, "hello world"))
+	assert.Equal(t, 4, s.Print(6, 1, 20, "world\n"))
+	assert.Equal(t, 0, s.Print(0, 3, 10, "out"))
+	s.Fill(0, 2, 3, '-')
+	s.SetCursor(2, 1)
+
+	assert.Equal(t, "hello\n      worl\n---", s.String())
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, s.Render(output))
+	assert.Equal(t, "\x1b[?25l\x1b[?7l\x1b[Hhello     \r\n      worl\r\n---       \x1b[?7h\x1b[2;3H\x1b[?25h", output.String())
+
+	s.Resize(4, 1)
+	w, h := s.Size()
+	assert.Equal(t, 4, w)
+	assert.Equal(t, 1, h)
+	assert.Equal(t, "", s.String())
+}
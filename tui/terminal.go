@@ -0,0 +1,20 @@
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+// Terminal is a terminal switched to raw mode : the keys are read as they are pressed, without echo
+// and without the signals of the control keys.
+type Terminal struct {
+	file  *os.File
+	state *termios // state of the terminal before raw mode
+}
+
+var NotATerminalErr = errors.New("not a terminal")
+
+// Restore gives the terminal back its state before OpenTerminal
+func (t *Terminal) Restore() error {
+	return setTermios(t.file, t.state)
+}
@@ -0,0 +1,79 @@
+package tui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github/timtimjnvr/chat/chat"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminal_RestoreAfterRun(t *testing.T) {
+	master, tty := helperOpenPty(t)
+	defer master.Close()
+	defer tty.Close()
+
+	terminal, err := OpenTerminal(tty)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = master.Write([]byte("/quit\r"))
+	assert.Nil(t, err)
+
+	New(helperNode(), NewScreen(60, 8)).Run(context.Background(), tty, &bytes.Buffer{}, make(chan chat.Event), make(chan Size))
+
+	// a closed terminal is only released once its pending read returned
+	_, err = master.Write([]byte("x"))
+	assert.Nil(t, err)
+
+	for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if tty.Fd() == ^uintptr(0) {
+			assert.Fail(t, "the terminal has been closed")
+			return
+		}
+	}
+
+	// the terminal is back in its state before raw mode
+	assert.Nil(t, terminal.Restore())
+
+	state := &termios{}
+	assert.Nil(t, ioctl(tty, ioctlGetTermios, unsafe.Pointer(state)))
+	assert.Equal(t, *terminal.state, *state)
+}
+
+// test helper opening a pseudo terminal, the test is skipped if there is none
+func helperOpenPty(t *testing.T) (*os.File, *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no pseudo terminal: ", err)
+	}
+
+	var (
+		unlock int32
+		number uint32
+	)
+
+	err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number))
+	}
+
+	var tty *os.File
+	if err == nil {
+		tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+
+	if err != nil {
+		master.Close()
+		t.Skip("no pseudo terminal: ", err)
+	}
+
+	return master, tty
+}
@@ -0,0 +1,27 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tui
+
+import (
+	"context"
+	"os"
+)
+
+type termios struct{}
+
+// OpenTerminal fails, raw mode is not supported on this system
+func OpenTerminal(_ *os.File) (*Terminal, error) {
+	return nil, NotATerminalErr
+}
+
+func (t *Terminal) Size() (Size, error) {
+	return Size{}, NotATerminalErr
+}
+
+func (t *Terminal) Resized(_ context.Context) <-chan Size {
+	return nil
+}
+
+func setTermios(_ *os.File, _ *termios) error {
+	return NotATerminalErr
+}
@@ -0,0 +1,100 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tui
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+type termios = syscall.Termios
+
+// OpenTerminal switches the terminal f to raw mode, Restore must be called before leaving
+func OpenTerminal(f *os.File) (*Terminal, error) {
+	state := &termios{}
+	if ioctl(f, ioctlGetTermios, unsafe.Pointer(state)) != nil {
+		return nil, NotATerminalErr
+	}
+
+	raw := *state
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	err := setTermios(f, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Terminal{file: f, state: state}, nil
+}
+
+// Size returns the size of the terminal
+func (t *Terminal) Size() (Size, error) {
+	var ws struct {
+		rows, columns, x, y uint16
+	}
+
+	err := ioctl(t.file, syscall.TIOCGWINSZ, unsafe.Pointer(&ws))
+	if err != nil {
+		return Size{}, err
+	}
+
+	return Size{Width: int(ws.columns), Height: int(ws.rows)}, nil
+}
+
+// Resized outputs the size of the terminal every time it changes until ctx is done
+func (t *Terminal) Resized(ctx context.Context) <-chan Size {
+	var (
+		signals = make(chan os.Signal, 1)
+		resized = make(chan Size, 1)
+	)
+
+	signal.Notify(signals, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-signals:
+				size, err := t.Size()
+				if err != nil {
+					continue
+				}
+
+				// only the last size matters
+				select {
+				case <-resized:
+				default:
+				}
+
+				resized <- size
+			}
+		}
+	}()
+
+	return resized
+}
+
+func setTermios(f *os.File, state *termios) error {
+	return ioctl(f, ioctlSetTermios, unsafe.Pointer(state))
+}
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,485 @@
+package tui
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github/timtimjnvr/chat/chat"
+	"github/timtimjnvr/chat/crdt"
+	"github/timtimjnvr/chat/parsestdin"
+	"github/timtimjnvr/chat/reader"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Node is the chat node driven by the UI, *chat.Node implements it
+	Node interface {
+		Rooms() []string
+		CurrentRoom() string
+		Messages(room string) ([]*crdt.Message, error)
+		Members(room string) ([]*crdt.NodeInfos, error)
+		Send(room, text string) error
+		Command(line string, output io.Writer) bool
+	}
+
+	// UI is the full-screen interface of a node : its rooms on the left, the scrollback of the current room in the
+	// middle, the members of the room on the right and the input line at the bottom. A line typed is sent as a
+	// message in the current room unless it starts with a slash, then it is a command.
+	UI struct {
+		node        Node
+		screen      *Screen
+		scrollbacks map[string]*scrollback
+		scroll      int    // lines scrolled up in the scrollback of the current room
+		status      string // last error
+		input       []rune
+		cursor      int // position of the cursor in input
+	}
+
+	// Size of the terminal in cells
+	Size struct {
+		Width, Height int
+	}
+
+	// keyboard hides the Close method of the input from reader.Read
+	keyboard struct {
+		io.Reader
+	}
+
+	scrollback struct {
+		lines []string
+		seen  map[uuid.UUID]bool // messages already in lines
+	}
+)
+
+const (
+	// lines kept in the scrollback of a room, the oldest ones are dropped
+	MaxScrollback = 1000
+
+	minSideWidth = 12
+	maxSideWidth = 24
+	prompt       = "> "
+	separator    = '│'
+)
+
+func New(node Node, screen *Screen) *UI {
+	return &UI{
+		node:        node,
+		screen:      screen,
+		scrollbacks: make(map[string]*scrollback),
+	}
+}
+
+// Run draws the UI on output until ctx is done, the user quits, input is exhausted or events is closed.
+// The keys are read on input (a terminal in raw mode), the terminal size changes are received on resized.
+// Input is not closed : the terminal must still be restored once Run returns.
+func (u *UI) Run(ctx context.Context, input io.Reader, output io.Writer, events <-chan chat.Event, resized <-chan Size) {
+	var (
+		reading, stopReading = context.WithCancel(ctx)
+		chunks               = make(chan []byte)
+		pending              []byte
+		keys                 []Key
+	)
+
+	// the keys are not read anymore once Run returns
+	defer func() {
+		stopReading()
+		for range chunks {
+		}
+	}()
+
+	go reader.Read(reading, keyboard{input}, chunks, bufio.ScanRunes)
+
+	// alternate screen : the terminal gets its content back when leaving
+	_, _ = fmt.Fprint(output, "\x1b[?1049h")
+	defer fmt.Fprint(output, "\x1b[?1049l")
+
+	for {
+		u.Draw()
+		_ = u.screen.Render(output)
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, more := <-events:
+			if !more {
+				return
+			}
+
+			u.HandleEvent(event)
+
+		case size := <-resized:
+			u.screen.Resize(size.Width, size.Height)
+
+		case chunk, more := <-chunks:
+			if !more {
+				return
+			}
+
+			keys, pending = DecodeKeys(append(pending, chunk...))
+			for _, k := range keys {
+				if !u.HandleKey(k) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// HandleEvent updates the scrollbacks with what happened in the chats
+func (u *UI) HandleEvent(e chat.Event) {
+	switch e.Typology {
+	case chat.MessageReceived:
+		u.addMessage(e.Chat, e.Message)
+
+	case chat.MessageEdited:
+		u.notice(e.Chat, fmt.Sprintf("%s edited a message: %s", e.Message.Sender, content(e.Message)))
+
+	case chat.MessageDeleted:
+		u.notice(e.Chat, fmt.Sprintf("%s deleted a message", e.Message.Sender))
+
+	case chat.MemberJoined:
+		u.notice(e.Chat, fmt.Sprintf("%s joined", e.Node.Name))
+
+	case chat.MemberLeft:
+		u.notice(e.Chat, fmt.Sprintf("%s left", e.Node.Name))
+
+	case chat.ChatJoined:
+		u.notice(e.Chat, fmt.Sprintf("you joined %s", e.Chat))
+
+	case chat.ChatLeft:
+		delete(u.scrollbacks, e.Chat)
+
+	case chat.Error:
+		u.status = e.Err.Error()
+
+	case chat.ConnectionChanged:
+		u.status = fmt.Sprintf("%s %s", e.Node.Name, e.Status)
+
+	case chat.RoomsListed:
+		room := u.node.CurrentRoom()
+		u.notice(room, fmt.Sprintf("%d rooms on %s", len(e.Rooms.Rooms), e.Rooms.Host))
+		for _, r := range e.Rooms.Rooms {
+			u.notice(room, fmt.Sprintf("  %s : %d users", r.Name, r.Members))
+		}
+	}
+}
+
+// HandleKey edits the input line or submits it on enter, it returns false once the user quits
+func (u *UI) HandleKey(k Key) bool {
+	switch k.Code {
+	case KeyRune:
+		u.input = append(u.input[:u.cursor], append([]rune{k.Rune}, u.input[u.cursor:]...)...)
+		u.cursor++
+
+	case KeyBackspace:
+		if u.cursor > 0 {
+			u.input = append(u.input[:u.cursor-1], u.input[u.cursor:]...)
+			u.cursor--
+		}
+
+	case KeyDelete:
+		if u.cursor < len(u.input) {
+			u.input = append(u.input[:u.cursor], u.input[u.cursor+1:]...)
+		}
+
+	case KeyLeft:
+		if u.cursor > 0 {
+			u.cursor--
+		}
+
+	case KeyRight:
+		if u.cursor < len(u.input) {
+			u.cursor++
+		}
+
+	case KeyHome:
+		u.cursor = 0
+
+	case KeyEnd:
+		u.cursor = len(u.input)
+
+	case KeyUp:
+		u.scroll++
+
+	case KeyDown:
+		u.scroll--
+
+	case KeyPageUp:
+		u.scroll += u.pageHeight()
+
+	case KeyPageDown:
+		u.scroll -= u.pageHeight()
+
+	case KeyTab:
+		// switch to the next room
+		rooms := u.node.Rooms()
+		current := u.node.CurrentRoom()
+		for i, room := range rooms {
+			if room == current && len(rooms) > 1 {
+				return u.command("/switch " + parsestdin.Quote(rooms[(i+1)%len(rooms)]))
+			}
+		}
+
+	case KeyEnter:
+		line := string(u.input)
+		u.input, u.cursor = nil, 0
+		return u.submit(line)
+
+	case KeyCtrlC:
+		return false
+
+	case KeyCtrlD:
+		return len(u.input) > 0
+	}
+
+	return true
+}
+
+// Draw draws the UI in the screen
+func (u *UI) Draw() {
+	u.screen.Clear()
+
+	width, height := u.screen.Size()
+	if width == 0 || height == 0 {
+		return
+	}
+
+	current := u.node.CurrentRoom()
+	members, _ := u.node.Members(current)
+
+	// header, panes, status and input lines from the top, the smallest screens only keep the last ones
+	if height >= 3 {
+		u.screen.Print(0, 0, width, fmt.Sprintf(" %s (%d members)", current, len(members)+1))
+	}
+
+	if height >= 4 {
+		var (
+			top       = 1
+			paneLines = height - 3
+			side      = clamp(width/5, minSideWidth, maxSideWidth)
+		)
+
+		// narrow screens only show the scrollback
+		if width < 2*side+minSideWidth {
+			side = 0
+		}
+
+		if side > 0 {
+			u.drawRooms(0, top, side-1, paneLines, current)
+			u.drawMembers(width-side+1, top, side-1, paneLines, members)
+			for y := top; y < top+paneLines; y++ {
+				u.screen.Print(side-1, y, 1, string(separator))
+				u.screen.Print(width-side, y, 1, string(separator))
+			}
+		}
+
+		u.drawScrollback(side, top, width-2*side, paneLines, current)
+	}
+
+	if height >= 2 {
+		u.screen.Print(0, height-2, width, u.status)
+	}
+
+	// the input scrolls horizontally to keep the cursor visible
+	var (
+		inputWidth = width - len(prompt)
+		offset     = 0
+	)
+
+	if inputWidth > 0 && u.cursor >= inputWidth {
+		offset = u.cursor - inputWidth + 1
+	}
+
+	u.screen.Print(0, height-1, width, prompt+string(u.input[offset:]))
+	u.screen.SetCursor(len(prompt)+u.cursor-offset, height-1)
+}
+
+func (u *UI) drawRooms(x, y, width, height int, current string) {
+	lines := []string{"Rooms"}
+	for _, room := range u.node.Rooms() {
+		if room == current {
+			lines = append(lines, "> "+room)
+			continue
+		}
+
+		lines = append(lines, "  "+room)
+	}
+
+	u.printLines(x, y, width, height, lines)
+}
+
+func (u *UI) drawMembers(x, y, width, height int, members []*crdt.NodeInfos) {
+	lines := []string{"Members"}
+	for _, m := range members {
+		lines = append(lines, "  "+m.Name)
+	}
+
+	u.printLines(x, y, width, height, lines)
+}
+
+// drawScrollback draws the last lines of the scrollback of room, scrolled up by u.scroll lines
+func (u *UI) drawScrollback(x, y, width, height int, room string) {
+	var lines []string
+	for _, line := range u.room(room).lines {
+		lines = append(lines, wrap(line, width)...)
+	}
+
+	u.scroll = clamp(u.scroll, 0, len(lines)-height)
+	end := len(lines) - u.scroll
+	start := end - height
+	if start < 0 {
+		start = 0
+	}
+
+	u.printLines(x, y, width, height, lines[start:end])
+}
+
+func (u *UI) printLines(x, y, width, height int, lines []string) {
+	for i, line := range lines {
+		if i >= height {
+			return
+		}
+
+		u.screen.Print(x, y+i, width, line)
+	}
+}
+
+// pageHeight returns the number of lines of the scrollback pane
+func (u *UI) pageHeight() int {
+	_, height := u.screen.Size()
+	if height < 4 {
+		return 1
+	}
+
+	return height - 3
+}
+
+// submit sends line as a message in the current room or executes it if it is a command
+func (u *UI) submit(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return true
+	}
+
+	u.scroll = 0
+	if strings.HasPrefix(strings.TrimSpace(line), "/") {
+		return u.command(strings.TrimSpace(line))
+	}
+
+	err := u.node.Send(u.node.CurrentRoom(), line)
+	if err != nil {
+		u.status = err.Error()
+		return true
+	}
+
+	u.status = ""
+	return true
+}
+
+// command executes line, the errors it displays go to the status line and the rest to the current room
+func (u *UI) command(line string) bool {
+	var (
+		output = &bytes.Buffer{}
+		more   = u.node.Command(line, output)
+	)
+
+	u.status = ""
+	for _, l := range strings.Split(output.String(), "\n") {
+		switch {
+		case strings.TrimSpace(l) == "":
+		case strings.HasPrefix(l, "[ERROR] "):
+			u.status = strings.TrimPrefix(l, "[ERROR] ")
+		default:
+			u.notice(u.node.CurrentRoom(), strings.TrimPrefix(l, "[INFO] "))
+		}
+	}
+
+	return more
+}
+
+// room returns the scrollback of room, it starts with the messages already in the room
+func (u *UI) room(room string) *scrollback {
+	s, ok := u.scrollbacks[room]
+	if ok {
+		return s
+	}
+
+	s = &scrollback{seen: make(map[uuid.UUID]bool)}
+	u.scrollbacks[room] = s
+
+	messages, _ := u.node.Messages(room)
+	for _, m := range messages {
+		s.seen[m.Id] = true
+		s.add(formatMessage(m))
+	}
+
+	return s
+}
+
+func (u *UI) addMessage(room string, m *crdt.Message) {
+	s := u.room(room)
+	if s.seen[m.Id] {
+		return
+	}
+
+	s.seen[m.Id] = true
+	s.add(formatMessage(m))
+}
+
+func (u *UI) notice(room, text string) {
+	u.room(room).add("* " + text)
+}
+
+func (s *scrollback) add(line string) {
+	s.lines = append(s.lines, line)
+	if len(s.lines) > MaxScrollback {
+		s.lines = s.lines[len(s.lines)-MaxScrollback:]
+	}
+}
+
+// formatMessage returns the scrollback line of m : "[15:04] sender: content"
+func formatMessage(m *crdt.Message) string {
+	date, err := time.Parse(time.RFC3339, m.Date)
+	if err != nil {
+		return fmt.Sprintf("%s: %s", m.Sender, content(m))
+	}
+
+	return fmt.Sprintf("[%s] %s: %s", date.Local().Format("15:04"), m.Sender, content(m))
+}
+
+func content(m *crdt.Message) string {
+	return strings.ReplaceAll(strings.TrimSuffix(m.Content, "\n"), "\n", " ")
+}
+
+// wrap cuts line in lines of width runes at most
+func wrap(line string, width int) []string {
+	runes := []rune(line)
+	if width <= 0 || len(runes) <= width {
+		return []string{line}
+	}
+
+	var lines []string
+	for len(runes) > width {
+		lines = append(lines, string(runes[:width]))
+		runes = runes[width:]
+	}
+
+	return append(lines, string(runes))
+}
+
+func clamp(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+
+	if value < min {
+		value = min
+	}
+
+	return value
+}
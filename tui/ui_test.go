@@ -0,0 +1,287 @@
+package tui
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github/timtimjnvr/chat/chat"
+	"github/timtimjnvr/chat/crdt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// test helper : a node answering the UI from memory
+type fakeNode struct {
+	rooms    []string
+	current  string
+	messages map[string][]*crdt.Message
+	members  map[string][]*crdt.NodeInfos
+	sent     []string
+	commands []string
+}
+
+func (f *fakeNode) Rooms() []string     { return f.rooms }
+func (f *fakeNode) CurrentRoom() string { return f.current }
+
+func (f *fakeNode) Messages(room string) ([]*crdt.Message, error) {
+	return f.messages[room], nil
+}
+
+func (f *fakeNode) Members(room string) ([]*crdt.NodeInfos, error) {
+	return f.members[room], nil
+}
+
+func (f *fakeNode) Send(room, text string) error {
+	if text == "fail" {
+		return errors.New("can't send")
+	}
+
+	f.sent = append(f.sent, room+": "+text)
+	return nil
+}
+
+func (f *fakeNode) Command(line string, output io.Writer) bool {
+	f.commands = append(f.commands, line)
+	switch {
+	case strings.HasPrefix(line, "/switch "):
+		f.current = strings.TrimPrefix(line, "/switch ")
+		_, _ = fmt.Fprintf(output, "[INFO] Switched to chat %s\n", f.current)
+	case line == "/quit":
+		return false
+	default:
+		_, _ = fmt.Fprintln(output, "[ERROR] unknown command")
+	}
+
+	return true
+}
+
+// test helper : a message sent at 15:04
+func helperMessage(sender, content string) *crdt.Message {
+	m := crdt.NewMessage(uuid.New(), sender, content)
+	m.Date = time.Date(2024, 1, 2, 15, 4, 0, 0, time.Local).Format(time.RFC3339)
+	return m
+}
+
+// test helper : types text followed by enter
+func helperType(u *UI, text string) bool {
+	for _, r := range text {
+		u.HandleKey(Key{Code: KeyRune, Rune: r})
+	}
+
+	return u.HandleKey(Key{Code: KeyEnter})
+}
+
+func helperNode() *fakeNode {
+	return &fakeNode{
+		rooms:   []string{"tim", "room"},
+		current: "room",
+		messages: map[string][]*crdt.Message{
+			"room": {helperMessage("bob", "hello\n")},
+		},
+		members: map[string][]*crdt.NodeInfos{
+			"room": {crdt.NewNodeInfos("", "8081", "bob"), crdt.NewNodeInfos("", "8082", "alice")},
+		},
+	}
+}
+
+func TestUI_Draw(t *testing.T) {
+	var (
+		node   = helperNode()
+		screen = NewScreen(60, 8)
+		u      = New(node, screen)
+	)
+
+	u.HandleEvent(chat.Event{Typology: chat.MessageReceived, Chat: "room", Message: helperMessage("alice", "hi bob\n")})
+	u.HandleEvent(chat.Event{Typology: chat.MemberLeft, Chat: "room", Node: crdt.NewNodeInfos("", "8083", "carol")})
+	u.HandleEvent(chat.Event{Typology: chat.MessageReceived, Chat: "tim", Message: helperMessage("tim", "elsewhere")})
+	u.HandleEvent(chat.Event{Typology: chat.Error, Err: errors.New("connection lost")})
+	for _, r := range "typing" {
+		u.HandleKey(Key{Code: KeyRune, Rune: r})
+	}
+	u.HandleKey(Key{Code: KeyLeft})
+
+	u.Draw()
+	assert.Equal(t, " room (3 members)\n"+
+		"Rooms      │[15:04] bob: hello                  │Members\n"+
+		"  tim      │[15:04] alice: hi bob               │  bob\n"+
+		"> room     │* carol left                        │  alice\n"+
+		"           │                                    │\n"+
+		"           │                                    │\n"+
+		"connection lost\n"+
+		"> typing", screen.String())
+
+	x, y := screen.Cursor()
+	assert.Equal(t, 7, x)
+	assert.Equal(t, 7, y)
+
+	// narrow screens only show the scrollback, the last lines and the end of the input
+	screen.Resize(20, 5)
+	u.HandleKey(Key{Code: KeyEnd})
+	for _, r := range " a long message" {
+		u.HandleKey(Key{Code: KeyRune, Rune: r})
+	}
+
+	u.Draw()
+	assert.Equal(t, " room (3 members)\n"+
+		"b\n"+
+		"* carol left\n"+
+		"connection lost\n"+
+		"> ng a long message", screen.String())
+
+	x, _ = screen.Cursor()
+	assert.Equal(t, 19, x)
+}
+
+func TestUI_Scroll(t *testing.T) {
+	var (
+		node   = helperNode()
+		screen = NewScreen(20, 5)
+		u      = New(node, screen)
+	)
+
+	for i := 0; i < 5; i++ {
+		u.HandleEvent(chat.Event{Typology: chat.MemberJoined, Chat: "room", Node: crdt.NewNodeInfos("", "", fmt.Sprint(i))})
+	}
+
+	u.Draw()
+	assert.Equal(t, "* 4 joined", screen.Line(2))
+
+	u.HandleKey(Key{Code: KeyPageUp})
+	u.Draw()
+	assert.Equal(t, "* 1 joined", screen.Line(1))
+
+	// scrolling stops at the first line
+	u.HandleKey(Key{Code: KeyPageUp})
+	u.HandleKey(Key{Code: KeyPageUp})
+	u.HandleKey(Key{Code: KeyPageUp})
+	u.HandleKey(Key{Code: KeyPageUp})
+	u.Draw()
+	assert.Equal(t, "[15:04] bob: hello", screen.Line(1))
+
+	u.HandleKey(Key{Code: KeyPageDown})
+	u.HandleKey(Key{Code: KeyDown})
+	u.Draw()
+	assert.Equal(t, "* 2 joined", screen.Line(1))
+}
+
+func TestUI_Input(t *testing.T) {
+	var (
+		node = helperNode()
+		u    = New(node, NewScreen(60, 8))
+	)
+
+	// plain text is a message in the current room
+	assert.True(t, helperType(u, "hi all"))
+	assert.True(t, helperType(u, "   "))
+	assert.Equal(t, []string{"room: hi all"}, node.sent)
+
+	assert.True(t, helperType(u, "fail"))
+	assert.Equal(t, "can't send", u.status)
+
+	// line edition
+	for _, r := range "helo" {
+		u.HandleKey(Key{Code: KeyRune, Rune: r})
+	}
+	u.HandleKey(Key{Code: KeyLeft})
+	u.HandleKey(Key{Code: KeyRune, Rune: 'l'})
+	u.HandleKey(Key{Code: KeyHome})
+	u.HandleKey(Key{Code: KeyDelete})
+	u.HandleKey(Key{Code: KeyRune, Rune: 'H'})
+	u.HandleKey(Key{Code: KeyEnd})
+	u.HandleKey(Key{Code: KeyBackspace})
+	u.HandleKey(Key{Code: KeyRight})
+	assert.True(t, helperType(u, "o!"))
+	assert.Equal(t, "room: Hello!", node.sent[1])
+
+	// commands, their errors go to the status line and the rest to the scrollback
+	assert.True(t, helperType(u, "/unknown"))
+	assert.Equal(t, "unknown command", u.status)
+
+	assert.True(t, u.HandleKey(Key{Code: KeyTab}))
+	assert.Equal(t, "tim", node.current)
+	assert.Equal(t, "", u.status)
+	assert.Equal(t, []string{"* Switched to chat tim"}, u.room("tim").lines)
+
+	// the rooms of a remote node are listed in the current room
+	u.HandleEvent(chat.Event{Typology: chat.RoomsListed, Rooms: &crdt.RoomList{Host: "bob", Rooms: []crdt.Room{{Name: "bob", Members: 2}}}})
+	assert.Equal(t, []string{"* Switched to chat tim", "* 1 rooms on bob", "*   bob : 2 users"}, u.room("tim").lines)
+
+	// the connections with the other nodes are reported on the status line
+	u.HandleEvent(chat.Event{Typology: chat.ConnectionChanged, Node: crdt.NewNodeInfos("", "8081", "bob"), Status: "unreachable"})
+	assert.Equal(t, "bob unreachable", u.status)
+
+	u.HandleEvent(chat.Event{Typology: chat.ChatLeft, Chat: "room"})
+	assert.Empty(t, u.scrollbacks["room"])
+
+	assert.False(t, helperType(u, "/quit"))
+	assert.Equal(t, []string{"/unknown", "/switch tim", "/quit"}, node.commands)
+
+	// ctrl-d only quits on an empty line
+	u.HandleKey(Key{Code: KeyRune, Rune: 'a'})
+	assert.True(t, u.HandleKey(Key{Code: KeyCtrlD}))
+	u.HandleKey(Key{Code: KeyBackspace})
+	assert.False(t, u.HandleKey(Key{Code: KeyCtrlD}))
+	assert.False(t, u.HandleKey(Key{Code: KeyCtrlC}))
+}
+
+func TestUI_Run(t *testing.T) {
+	var (
+		node          = helperNode()
+		screen        = NewScreen(60, 8)
+		u             = New(node, screen)
+		input, typing = io.Pipe()
+		output        = &bytes.Buffer{}
+		events        = make(chan chat.Event)
+		resized       = make(chan Size)
+		done          = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+		u.Run(context.Background(), input, output, events, resized)
+	}()
+
+	events <- chat.Event{Typology: chat.MessageReceived, Chat: "room", Message: helperMessage("alice", "hi")}
+	resized <- Size{Width: 40, Height: 6}
+	_, _ = typing.Write([]byte("yo\r\x1b[5"))
+	_, _ = typing.Write([]byte("~/quit\r"))
+	<-done
+
+	assert.Equal(t, []string{"room: yo"}, node.sent)
+	assert.Equal(t, []string{"/quit"}, node.commands)
+	assert.True(t, strings.HasPrefix(output.String(), "\x1b[?1049h"))
+	assert.True(t, strings.HasSuffix(output.String(), "\x1b[?1049l"))
+
+	w, h := screen.Size()
+	assert.Equal(t, 40, w)
+	assert.Equal(t, 6, h)
+	assert.Equal(t, "> room     │[15:04] alice: h│  alice", screen.Line(3))
+}
+
+func TestUI_Run_KeepsInputOpen(t *testing.T) {
+	var (
+		u     = New(helperNode(), NewScreen(60, 8))
+		input = &closableInput{Reader: strings.NewReader("/quit\r")}
+	)
+
+	// the terminal is restored on the input once Run returns
+	u.Run(context.Background(), input, &bytes.Buffer{}, make(chan chat.Event), make(chan Size))
+	assert.False(t, input.closed)
+}
+
+// test helper : an input recording whether it has been closed
+type closableInput struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closableInput) Close() error {
+	c.closed = true
+	return nil
+}